@@ -16,9 +16,18 @@ configuration parameters for that instance as key:value pairs.
 	local = "127.0.0.1:5000"
 
 	# peer specifies the address of the peer that the tunnel should
-	# connect its socket to
+	# connect its socket to.
+	# Addresses may use a host name in place of an IP address, for
+	# example "lns.example.com:1701".
 	peer = "127.0.0.1:5001"
 
+	# alternate_peers lists the addresses of further peers a dynamic
+	# tunnel tries in turn if it can't open a control connection to peer,
+	# either because the peer doesn't answer or because it asks the tunnel
+	# to try another LNS.
+	# By default the tunnel only tries to connect to peer.
+	alternate_peers = [ "127.0.0.1:5002", "127.0.0.1:5003" ]
+
 	# version specifies the version of the L2TP specification the
 	# tunnel should use.
 	# Currently supported values are "l2tpv2" and "l2tpv3"
@@ -82,6 +91,22 @@ configuration parameters for that instance as key:value pairs.
 	# The default is to advertise both sync and async framing.
 	framing_caps = ["sync","async"]
 
+	# secret, if set, enables tunnel authentication using the shared
+	# secret per RFC2661.  This applies to dynamic L2TPv2 tunnels only.
+	# By default tunnel authentication is not used.
+	secret = "opensesame"
+
+	# digest_type, if set, enables control message authentication for
+	# dynamic L2TPv3 tunnels using the secret per RFC3931.  Messages are
+	# authenticated using the specified algorithm: "hmac_md5" or "hmac_sha1".
+	# By default control messages are not authenticated.
+	digest_type = "hmac_sha1"
+
+	# hide_avps, if set, hides sensitive AVPs in the control messages the
+	# tunnel sends using the secret per RFC2661.
+	# By default AVPs are sent in the clear.
+	hide_avps = true
+
 	# This is a session instance called "s1" within parent tunnel "t1".
 	# Session instances are always created inside a parent tunnel.
 	[tunnel.t1.session.s1]
@@ -139,6 +164,12 @@ configuration parameters for that instance as key:value pairs.
 	# By default no Layer 2 specific sublayer is used.
 	l2spec_type = "default"
 
+	# remote_end_id specifies the Remote End ID a session in a dynamic
+	# L2TPv3 tunnel sends the peer, identifying the circuit the peer
+	# should attach to the session as per RFC3931 section 5.4.4.
+	# By default an empty Remote End ID is sent.
+	remote_end_id = "eth-circuit-7"
+
 	# pppoe_session_id specifies the assigned PPPoE session ID for the session.
 	# Per RFC2516, the PPPoE session ID is in the range 1 - 65535
 	# This parameter only applies to pppac pseudowires.
@@ -147,6 +178,62 @@ configuration parameters for that instance as key:value pairs.
 	# pppoe_peer_mac specifies the MAC address of the PPPoE peer for the session.
 	# This parameter only applies to pppac pseudowires.
 	pppoe_peer_mac = [ 0x02, 0x42, 0x94, 0xd1, 0x4e, 0x9a ]
+
+	# peer_id and password specify the credentials the PPP client uses to
+	# authenticate with the peer.  PAP, CHAP-MD5 and MS-CHAPv2 are supported,
+	# and the peer selects which is used during LCP negotiation.
+	# These parameters only apply to ppp pseudowires in dynamic tunnels.
+	peer_id = "alice"
+	password = "s3cr3t"
+
+	# lcp_echo_interval, if set, enables transmission of PPP LCP echo
+	# requests at the specified interval.  Echo requests keep NAT mappings
+	# alive, and allow for detection of a dead peer.
+	# By default no echo requests are sent.
+	lcp_echo_interval = 30000 # milliseconds
+
+	# lcp_echo_failure sets how many consecutive echo requests may go
+	# unanswered before the peer is considered dead and the session is
+	# closed.
+	# By default the session is not closed for lack of echo replies.
+	lcp_echo_failure = 4
+
+	# request_nbns, if set, requests the addresses of the peer's NetBIOS
+	# name servers during IPCP negotiation.  DNS server addresses are
+	# always requested.
+	request_nbns = false
+
+	# ipv6, if set, negotiates IPv6 with the peer in addition to IPv4.
+	# By default only IPv4 is negotiated.
+	ipv6 = true
+
+	# mru sets the Maximum-Receive-Unit requested during PPP LCP negotiation.
+	# The MTU of the session is limited by both our MRU and the peer's MRU.
+	# The default MRU is 1500.
+	mru = 1400
+
+	# mppe sets whether MPPE encryption is negotiated with the peer.
+	# MPPE is only available with MS-CHAPv2 authentication.
+	# Valid values are "require", "allow", and "refuse".
+	# The default is "allow".
+	mppe = "require"
+
+	# vj_compression, if set, negotiates Van Jacobson TCP/IP header
+	# compression during IPCP negotiation.
+	# By default header compression is not used.
+	vj_compression = true
+
+	# deflate, if set, negotiates Deflate compression of the data plane
+	# during CCP negotiation.  Deflate is not used when MPPE encryption is
+	# available.
+	# By default compression is not used.
+	deflate = true
+
+	# outgoing_call, if set, has the session ask the peer to place an
+	# outgoing call to called_number, rather than report an incoming call.
+	# This applies to sessions in dynamic L2TPv2 tunnels only.
+	outgoing_call = true
+	called_number = "555-0100"
 */
 package config
 
@@ -303,6 +390,22 @@ func toVersion(v interface{}) (l2tp.ProtocolVersion, error) {
 	return 0, err
 }
 
+func toStringSlice(v interface{}) ([]string, error) {
+	vals, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected array value")
+	}
+	var out []string
+	for _, val := range vals {
+		s, err := toString(val)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
 func toFramingCaps(v interface{}) (l2tp.FramingCapability, error) {
 	var fc l2tp.FramingCapability
 
@@ -361,6 +464,22 @@ func toPseudowireType(v interface{}) (l2tp.PseudowireType, error) {
 	return 0, err
 }
 
+func toMPPEPolicy(v interface{}) (l2tp.MPPEPolicy, error) {
+	s, err := toString(v)
+	if err == nil {
+		switch s {
+		case "require":
+			return l2tp.MPPEPolicyRequire, nil
+		case "allow":
+			return l2tp.MPPEPolicyAllow, nil
+		case "refuse":
+			return l2tp.MPPEPolicyRefuse, nil
+		}
+		return 0, fmt.Errorf("expect 'require', 'allow', or 'refuse'")
+	}
+	return 0, err
+}
+
 func toL2SpecType(v interface{}) (l2tp.L2SpecType, error) {
 	s, err := toString(v)
 	if err == nil {
@@ -375,6 +494,20 @@ func toL2SpecType(v interface{}) (l2tp.L2SpecType, error) {
 	return l2tp.L2SpecTypeNone, err
 }
 
+func toDigestType(v interface{}) (l2tp.DigestType, error) {
+	s, err := toString(v)
+	if err == nil {
+		switch s {
+		case "hmac_md5":
+			return l2tp.DigestTypeHMACMD5, nil
+		case "hmac_sha1":
+			return l2tp.DigestTypeHMACSHA1, nil
+		}
+		return l2tp.DigestTypeNone, fmt.Errorf("expect 'hmac_md5' or 'hmac_sha1'")
+	}
+	return l2tp.DigestTypeNone, err
+}
+
 func toCCID(v interface{}) (l2tp.ControlConnID, error) {
 	u, err := toUint32(v)
 	return l2tp.ControlConnID(u), err
@@ -427,12 +560,36 @@ func (cfg *Config) newSessionConfig(tunnel *NamedTunnel, name string, scfg map[s
 			ns.Config.InterfaceName, err = toString(v)
 		case "l2spec_type":
 			ns.Config.L2SpecType, err = toL2SpecType(v)
+		case "remote_end_id":
+			ns.Config.RemoteEndID, err = toString(v)
 		case "pppoe_session_id":
 			ns.Config.PPPoESessionId, err = toUint16(v)
 		case "peer_id":
 			ns.Config.PeerId, err = toString(v)
 		case "password":
 			ns.Config.Password, err = toString(v)
+		case "lcp_echo_interval":
+			ns.Config.LcpEchoInterval, err = toDurationMs(v)
+		case "lcp_echo_failure":
+			var u uint16
+			u, err = toUint16(v)
+			ns.Config.LcpEchoFailure = uint(u)
+		case "request_nbns":
+			ns.Config.RequestNBNS, err = toBool(v)
+		case "ipv6":
+			ns.Config.EnableIPv6, err = toBool(v)
+		case "mru":
+			ns.Config.MRU, err = toUint16(v)
+		case "mppe":
+			ns.Config.MPPE, err = toMPPEPolicy(v)
+		case "vj_compression":
+			ns.Config.VJCompression, err = toBool(v)
+		case "deflate":
+			ns.Config.Deflate, err = toBool(v)
+		case "outgoing_call":
+			ns.Config.OutgoingCall, err = toBool(v)
+		case "called_number":
+			ns.Config.CalledNumber, err = toString(v)
 		case "pppoe_peer_mac":
 			mac, err := toBytes(v)
 			if err == nil {
@@ -486,6 +643,8 @@ func (cfg *Config) newTunnelConfig(name string, tcfg map[string]interface{}) (*N
 			nt.Config.Local, err = toString(v)
 		case "peer":
 			nt.Config.Peer, err = toString(v)
+		case "alternate_peers":
+			nt.Config.AlternatePeers, err = toStringSlice(v)
 		case "encap":
 			nt.Config.Encap, err = toEncapType(v)
 		case "version":
@@ -508,6 +667,12 @@ func (cfg *Config) newTunnelConfig(name string, tcfg map[string]interface{}) (*N
 			nt.Config.HostName, err = toString(v)
 		case "framing_caps":
 			nt.Config.FramingCaps, err = toFramingCaps(v)
+		case "secret":
+			nt.Config.Secret, err = toString(v)
+		case "hide_avps":
+			nt.Config.HideAVPs, err = toBool(v)
+		case "digest_type":
+			nt.Config.DigestType, err = toDigestType(v)
 		case "session":
 			nt.Sessions, err = cfg.loadSessions(nt, v)
 		default:
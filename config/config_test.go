@@ -24,16 +24,21 @@ func TestGetTunnels(t *testing.T) {
 				 ptid = 8192
 				 framing_caps = ["sync"]
 				 host_name = "blackhole.local"
+				 secret = "opensesame"
+				 digest_type = "hmac_md5"
 
 				 [tunnel.t2]
 				 encap = "udp"
 				 version = "l2tpv2"
 				 peer = "[2001:0000:1234:0000:0000:C1C0:ABCD:0876]:6543"
+				 alternate_peers = ["[2001:db8::1]:6543", "192.0.2.1:1701"]
 				 hello_timeout = 250
 				 window_size = 10
 				 retry_timeout = 250
 				 max_retries = 2
 				 framing_caps = ["sync","async"]
+				 secret = "opensesame"
+				 hide_avps = true
 				 `,
 			want: []NamedTunnel{
 				{
@@ -46,19 +51,27 @@ func TestGetTunnels(t *testing.T) {
 						PeerTunnelID: 8192,
 						FramingCaps:  l2tp.FramingCapSync,
 						HostName:     "blackhole.local",
+						Secret:       "opensesame",
+						DigestType:   l2tp.DigestTypeHMACMD5,
 					},
 				},
 				{
 					Name: "t2",
 					Config: &l2tp.TunnelConfig{
-						Encap:        l2tp.EncapTypeUDP,
-						Version:      l2tp.ProtocolVersion2,
-						Peer:         "[2001:0000:1234:0000:0000:C1C0:ABCD:0876]:6543",
+						Encap:   l2tp.EncapTypeUDP,
+						Version: l2tp.ProtocolVersion2,
+						Peer:    "[2001:0000:1234:0000:0000:C1C0:ABCD:0876]:6543",
+						AlternatePeers: []string{
+							"[2001:db8::1]:6543",
+							"192.0.2.1:1701",
+						},
 						HelloTimeout: 250 * time.Millisecond,
 						WindowSize:   10,
 						RetryTimeout: 250 * time.Millisecond,
 						MaxRetries:   2,
 						FramingCaps:  l2tp.FramingCapSync | l2tp.FramingCapAsync,
+						Secret:       "opensesame",
+						HideAVPs:     true,
 					},
 				},
 			},
@@ -76,6 +89,7 @@ func TestGetTunnels(t *testing.T) {
 				 seqnum = true
 				 reorder_timeout = 1500
 				 l2spec_type = "none"
+				 remote_end_id = "vlan100"
 
 				 [tunnel.t1.session.s2]
 				 pseudowire = "ppp"
@@ -83,6 +97,16 @@ func TestGetTunnels(t *testing.T) {
 				 psid = 1237812
 				 interface_name = "becky"
 				 l2spec_type = "default"
+				 lcp_echo_interval = 30000
+				 lcp_echo_failure = 4
+				 request_nbns = true
+				 ipv6 = true
+				 mru = 1400
+				 mppe = "require"
+				 vj_compression = true
+				 deflate = true
+				 outgoing_call = true
+				 called_number = "555-0100"
 
 				 [tunnel.t1.session.s3]
 				 pseudowire = "pppac"
@@ -108,16 +132,27 @@ func TestGetTunnels(t *testing.T) {
 								SeqNum:         true,
 								ReorderTimeout: time.Millisecond * 1500,
 								L2SpecType:     l2tp.L2SpecTypeNone,
+								RemoteEndID:    "vlan100",
 							},
 						},
 						{
 							Name: "s2",
 							Config: &l2tp.SessionConfig{
-								Pseudowire:    l2tp.PseudowireTypePPP,
-								SessionID:     90210,
-								PeerSessionID: 1237812,
-								InterfaceName: "becky",
-								L2SpecType:    l2tp.L2SpecTypeDefault,
+								Pseudowire:      l2tp.PseudowireTypePPP,
+								SessionID:       90210,
+								PeerSessionID:   1237812,
+								InterfaceName:   "becky",
+								L2SpecType:      l2tp.L2SpecTypeDefault,
+								LcpEchoInterval: 30 * time.Second,
+								LcpEchoFailure:  4,
+								RequestNBNS:     true,
+								EnableIPv6:      true,
+								MRU:             1400,
+								MPPE:            l2tp.MPPEPolicyRequire,
+								VJCompression:   true,
+								Deflate:         true,
+								OutgoingCall:    true,
+								CalledNumber:    "555-0100",
 							},
 						},
 						{
@@ -230,6 +265,19 @@ func TestBadConfig(t *testing.T) {
 				 l2spec_type = "whizzoo"`,
 			estr: "expect 'none' or 'default'",
 		},
+		{
+			name: "Bad value (unrecognised digest type)",
+			in: `[tunnel.t1]
+				 digest_type = "crc32"`,
+			estr: "expect 'hmac_md5' or 'hmac_sha1'",
+		},
+		{
+			name: "Bad value (unrecognised MPPE policy)",
+			in: `[tunnel.t1]
+				 [tunnel.t1.session.s1]
+				 mppe = "sometimes"`,
+			estr: "expect 'require', 'allow', or 'refuse'",
+		},
 		{
 			name: "Bad value (unrecognised FramingCap)",
 			in: `[tunnel.t1]
@@ -2,6 +2,8 @@ package l2tp
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -87,6 +89,8 @@ const (
 	avpDataTypeResultCode avpDataType = iota
 	// avpDataTypeMsgID represents an AVP carrying the message type identifier
 	avpDataTypeMsgID avpDataType = iota
+	// avpDataTypeUint16Array represents an AVP carrying a list of uint16 values
+	avpDataTypeUint16Array avpDataType = iota
 	// avpDataTypeUnimplemented represents an AVP carrying a currently unimplemented data type
 	avpDataTypeUnimplemented avpDataType = iota
 	// avpDataTypeIllegal represents an AVP carrying an illegal data type.
@@ -132,8 +136,8 @@ var avpInfoTable = [...]avpInfo{
 	{avpType: avpTypeProxyAuthChallenge, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
 	{avpType: avpTypeProxyAuthID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
 	{avpType: avpTypeProxyAuthResponse, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
-	{avpType: avpTypeCallErrors, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeBytes}, // TODO: handle fully
-	{avpType: avpTypeAccm, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeBytes},       // TODO: handle fully
+	{avpType: avpTypeCallErrors, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeBytes},
+	{avpType: avpTypeAccm, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeBytes},
 	{avpType: avpTypeRandomVector, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeBytes},
 	{avpType: avpTypePrivGroupID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeString},
 	{avpType: avpTypeRxConnectSpeed, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
@@ -160,7 +164,7 @@ var avpInfoTable = [...]avpInfo{
 	{avpType: avpTypeMessageDigest, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
 	{avpType: avpTypeRouterID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
 	{avpType: avpTypeAssignedConnID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
-	{avpType: avpTypePseudowireCaps, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUnimplemented}, // TODO: L2TPv3
+	{avpType: avpTypePseudowireCaps, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint16Array},
 	{avpType: avpTypeLocalSessionID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
 	{avpType: avpTypeRemoteSessionID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
 	{avpType: avpTypeAssignedCookie, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
@@ -605,6 +609,8 @@ func (t avpDataType) String() string {
 		return "result code"
 	case avpDataTypeMsgID:
 		return "message ID"
+	case avpDataTypeUint16Array:
+		return "uint16 array"
 	case avpDataTypeUnimplemented:
 		return "unimplemented AVP data type"
 	case avpDataTypeIllegal:
@@ -655,6 +661,9 @@ func (p avpPayload) String() string {
 		str.WriteString(s)
 	case avpDataTypeBytes:
 		str.WriteString(fmt.Sprintf("%s", p.data))
+	case avpDataTypeUint16Array:
+		v, _ := p.toUint16Array()
+		str.WriteString(fmt.Sprintf("%v", v))
 	case avpDataTypeEmpty, avpDataTypeUnimplemented, avpDataTypeIllegal:
 		str.WriteString("")
 	}
@@ -729,6 +738,86 @@ func (avp *avp) totalLen() int {
 	return avp.header.totalLen()
 }
 
+// avpSensitiveTypes lists the AVPs hidden in outgoing messages if a
+// tunnel is configured to hide AVPs.
+var avpSensitiveTypes = map[avpType]bool{
+	avpTypeSessionID:          true,
+	avpTypeCallingNumber:      true,
+	avpTypeCalledNumber:       true,
+	avpTypeSubAddress:         true,
+	avpTypeProxyAuthName:      true,
+	avpTypeProxyAuthChallenge: true,
+	avpTypeProxyAuthID:        true,
+	avpTypeProxyAuthResponse:  true,
+}
+
+// avpHiddenBlockLen is the size of the blocks in which a hidden AVP value
+// is obscured, and to which it is padded.
+const avpHiddenBlockLen = md5.Size
+
+// avpHideValue applies the AVP hiding algorithm to an AVP value: each
+// block of the value is XORed with an MD5 hash chained from the previous
+// block of the hidden value.  The same operation reveals a hidden value.
+// Ref: RFC2661 section 4.3
+func avpHideValue(typ avpType, secret string, rv, in []byte, hiding bool) []byte {
+	out := make([]byte, len(in))
+	h := md5.New()
+	h.Write([]byte{byte(typ >> 8), byte(typ)})
+	h.Write([]byte(secret))
+	h.Write(rv)
+	for i := 0; i < len(in); i += avpHiddenBlockLen {
+		b := h.Sum(nil)
+		end := min(i+avpHiddenBlockLen, len(in))
+		for j := i; j < end; j++ {
+			out[j] = in[j] ^ b[j-i]
+		}
+		h.Reset()
+		h.Write([]byte(secret))
+		if hiding {
+			h.Write(out[i:end])
+		} else {
+			h.Write(in[i:end])
+		}
+	}
+	return out
+}
+
+// hide obscures the AVP's value using the tunnel secret and the value of
+// the Random Vector AVP preceding it in the message.  The value is padded
+// with random data to conceal its length.  Ref: RFC2661 section 4.3
+func (avp *avp) hide(secret string, rv []byte) error {
+	n := len(avp.payload.data)
+	plain := make([]byte, 2+n, (2+n+avpHiddenBlockLen-1)/avpHiddenBlockLen*avpHiddenBlockLen)
+	binary.BigEndian.PutUint16(plain, uint16(n))
+	copy(plain[2:], avp.payload.data)
+	pad := make([]byte, cap(plain)-len(plain))
+	if _, err := rand.Read(pad); err != nil {
+		return err
+	}
+	plain = append(plain, pad...)
+	if len(plain)+avpHeaderLen > 0x3ff {
+		return fmt.Errorf("AVP %v too long to hide", avp.getType())
+	}
+	avp.payload.data = avpHideValue(avp.getType(), secret, rv, plain, true)
+	avp.header = *newAvpHeader(avp.isMandatory(), true, uint(len(plain)), avp.vendorID(), avp.getType())
+	return nil
+}
+
+// unhide reveals the value of a hidden AVP.  Ref: RFC2661 section 4.3
+func (avp *avp) unhide(secret string, rv []byte) error {
+	plain := avpHideValue(avp.getType(), secret, rv, avp.payload.data, false)
+	if len(plain) < 2 {
+		return fmt.Errorf("hidden AVP %v too short", avp.getType())
+	}
+	n := int(binary.BigEndian.Uint16(plain))
+	if n > len(plain)-2 {
+		return fmt.Errorf("hidden AVP %v has bad original length %d", avp.getType(), n)
+	}
+	avp.payload.data = plain[2 : 2+n]
+	avp.header = *newAvpHeader(avp.isMandatory(), false, uint(n), avp.vendorID(), avp.getType())
+	return nil
+}
+
 func getAVPInfo(avpType avpType, VendorID avpVendorID) (*avpInfo, error) {
 	for _, info := range avpInfoTable {
 		if info.avpType == avpType && info.VendorID == VendorID {
@@ -832,6 +921,8 @@ func encodePayload(info *avpInfo, value interface{}) ([]byte, error) {
 		_, ok = value.([]byte)
 	case avpDataTypeMsgID:
 		_, ok = value.(avpMsgType)
+	case avpDataTypeUint16Array:
+		_, ok = value.([]uint16)
 	case avpDataTypeResultCode:
 		var rc resultCode
 		rc, ok = value.(resultCode)
@@ -926,6 +1017,18 @@ func (p *avpPayload) toUint64() (out uint64, err error) {
 	return out, err
 }
 
+func (p *avpPayload) toUint16Array() (out []uint16, err error) {
+	if len(p.data)%2 != 0 {
+		return nil, fmt.Errorf("AVP payload length %v is not a multiple of 2", len(p.data))
+	}
+	out = make([]uint16, len(p.data)/2)
+	r := bytes.NewReader(p.data)
+	if err = binary.Read(r, binary.BigEndian, out); err != nil {
+		return nil, err
+	}
+	return out, err
+}
+
 func (p *avpPayload) toString() (out string, err error) {
 	return string(p.data), nil
 }
@@ -972,6 +1075,8 @@ func (avp *avp) decode() (interface{}, error) {
 		return avp.payload.data, nil
 	case avpDataTypeResultCode:
 		return avp.payload.toResultCode()
+	case avpDataTypeUint16Array:
+		return avp.payload.toUint16Array()
 	case avpDataTypeMsgID:
 		v, err := avp.payload.toUint16()
 		if err != nil {
@@ -1012,6 +1117,16 @@ func (avp *avp) decodeUint64Data() (value uint64, err error) {
 	return avp.payload.toUint64()
 }
 
+// decodeUint16ArrayData decodes an AVP holding a list of uint16 values.
+// It is an error to call this function on an AVP which doesn't
+// contain a uint16 array payload.
+func (avp *avp) decodeUint16ArrayData() (value []uint16, err error) {
+	if !avp.isDataType(avpDataTypeUint16Array) {
+		return nil, errors.New("AVP data is not of type uint16 array, cannot decode")
+	}
+	return avp.payload.toUint16Array()
+}
+
 // decodeStringData decodes an AVP holding a string value.
 // It is an error to call this function on an AVP which doesn't
 // contain a string payload.
@@ -1105,6 +1220,20 @@ func findUint64Avp(avps []avp, vendorID avpVendorID, typ avpType) (uint64, error
 	return val, nil
 }
 
+// findUint16ArrayAvp looks up a specific AVP in a slice of AVPs and decodes as a uint16 slice.
+// An error will be returned if the AVP isn't present or is of the wrong type.
+func findUint16ArrayAvp(avps []avp, vendorID avpVendorID, typ avpType) ([]uint16, error) {
+	avp, err := findAvp(avps, vendorID, typ)
+	if err != nil {
+		return nil, err
+	}
+	val, err := avp.decodeUint16ArrayData()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %v: %v", typ, err)
+	}
+	return val, nil
+}
+
 // findBytesAvp looks up a specific AVP in a slice of AVPs and decodes as a byte slice.
 // An error will be returned if the AVP isn't present or is of the wrong type.
 func findBytesAvp(avps []avp, vendorID avpVendorID, typ avpType) ([]byte, error) {
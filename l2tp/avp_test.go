@@ -205,6 +205,45 @@ func TestAVPDecodeUint16(t *testing.T) {
 	}
 }
 
+func TestAVPDecodeUint16Array(t *testing.T) {
+	cases := []struct {
+		in      []byte
+		wantVal []uint16
+		wantErr bool
+	}{
+		{
+			in:      []byte{0x80, 0x0a, 0x00, 0x00, 0x00, 0x3e, 0x00, 0x05, 0x00, 0x07},
+			wantVal: []uint16{5, 7},
+		},
+		{
+			in:      []byte{0x80, 0x07, 0x00, 0x00, 0x00, 0x3e, 0x05},
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		got, err := parseAVPBuffer(c.in)
+		if err != nil {
+			t.Fatalf("parseAVPBuffer(%q) failed: %q", c.in, err)
+		}
+		if got[0].getType() != avpTypePseudowireCaps {
+			t.Errorf("Wanted type %q, got %q", avpTypePseudowireCaps, got[0].getType())
+		}
+		val, err := got[0].decodeUint16ArrayData()
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("decodeUint16ArrayData(%v) succeeded, wanted error", c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("decodeUint16ArrayData(%v) failed: %v", c.in, err)
+		}
+		if len(val) != len(c.wantVal) || val[0] != c.wantVal[0] || val[1] != c.wantVal[1] {
+			t.Errorf("Wanted value %v, got %v", c.wantVal, val)
+		}
+	}
+}
+
 func TestAVPDecodeUint32(t *testing.T) {
 	cases := []struct {
 		in       []byte
@@ -683,3 +722,60 @@ func TestAvpDataTypeStringer(t *testing.T) {
 		}
 	}
 }
+
+func TestAVPUnhide(t *testing.T) {
+	rv := make([]byte, 16)
+	for i := range rv {
+		rv[i] = byte(i)
+	}
+	// Assigned Session ID 42, hidden with secret "opensesame" and zero padding
+	in := []byte{
+		0xc0, 0x16, 0x00, 0x00, 0x00, 0x0e,
+		0xe7, 0x47, 0x8e, 0xe3, 0x2d, 0x4f, 0x0e, 0x26,
+		0xe5, 0xb1, 0x25, 0x50, 0x6f, 0xe1, 0x4e, 0x01,
+	}
+	avps, err := parseAVPBuffer(in)
+	if err != nil {
+		t.Fatalf("parseAVPBuffer(): %v", err)
+	}
+	if !avps[0].isHidden() {
+		t.Fatalf("AVP not hidden")
+	}
+	err = avps[0].unhide("opensesame", rv)
+	if err != nil {
+		t.Fatalf("unhide(): %v", err)
+	}
+	if avps[0].isHidden() || !avps[0].isMandatory() {
+		t.Errorf("unexpected AVP flags after unhide: %v", avps[0].header)
+	}
+	sid, err := avps[0].decodeUint16Data()
+	if err != nil || sid != 42 {
+		t.Errorf("unhidden session ID = %v, %v, want 42", sid, err)
+	}
+}
+
+func TestAVPHideRoundTrip(t *testing.T) {
+	rv := []byte("0123456789abcdef")
+	values := []string{"", "5", "555-0100", "a called number long enough to span several blocks"}
+	for _, v := range values {
+		a, err := newAvp(vendorIDIetf, avpTypeCalledNumber, v)
+		if err != nil {
+			t.Fatalf("newAvp(): %v", err)
+		}
+		err = a.hide("opensesame", rv)
+		if err != nil {
+			t.Fatalf("hide(%q): %v", v, err)
+		}
+		if !a.isHidden() || len(a.payload.data)%16 != 0 || a.totalLen() != avpHeaderLen+len(a.payload.data) {
+			t.Fatalf("hide(%q): unexpected hidden AVP %v, %d bytes", v, a.header, len(a.payload.data))
+		}
+		err = a.unhide("opensesame", rv)
+		if err != nil {
+			t.Fatalf("unhide(%q): %v", v, err)
+		}
+		got, err := a.decodeStringData()
+		if err != nil || got != v {
+			t.Errorf("round trip of %q gave %q, %v", v, got, err)
+		}
+	}
+}
@@ -69,6 +69,19 @@ const (
 	PseudowireTypePPPAC = nll2tp.PwtypePppAc
 )
 
+// DigestType is the hash algorithm used for L2TPv3 control message
+// authentication as per RFC3931 section 4.3.
+type DigestType int
+
+const (
+	// DigestTypeNone disables control message authentication
+	DigestTypeNone DigestType = iota
+	// DigestTypeHMACMD5 specifies authentication using HMAC-MD5
+	DigestTypeHMACMD5
+	// DigestTypeHMACSHA1 specifies authentication using HMAC-SHA-1
+	DigestTypeHMACSHA1
+)
+
 // DebugFlags is used for kernel-space tunnel and session logging control.
 // Logging is emitted using the kernel's printk facility, and may be viewed
 // using dmesg, syslog, or the systemd journal depending on distro configuration.
@@ -94,6 +107,20 @@ const (
 	L2SpecTypeDefault = nll2tp.L2spectypeDefault
 )
 
+// MPPEPolicy defines whether a session negotiates MPPE encryption.
+type MPPEPolicy int
+
+const (
+	// MPPEPolicyAllow enables MPPE encryption if the peer agrees to it,
+	// without holding the data plane until it is negotiated.
+	MPPEPolicyAllow MPPEPolicy = iota
+	// MPPEPolicyRequire closes the session unless MPPE encryption is
+	// negotiated in both directions, holding the data plane until it is.
+	MPPEPolicyRequire
+	// MPPEPolicyRefuse disables MPPE encryption.
+	MPPEPolicyRefuse
+)
+
 // TunnelType define the runtime behaviour of a tunnel instance.
 type TunnelType int
 
@@ -109,6 +136,55 @@ const (
 	TunnelTypeStatic
 )
 
+// TunnelDownCause describes why a tunnel went down.
+type TunnelDownCause int
+
+const (
+	// TunnelDownCauseClosed indicates the tunnel was closed locally using
+	// Tunnel.Close or Context.Close.
+	TunnelDownCauseClosed TunnelDownCause = iota
+	// TunnelDownCauseStopCCNSent indicates the tunnel closed the control
+	// connection because of an error, such as a failure to authenticate
+	// the peer or a bad control message from the peer.
+	TunnelDownCauseStopCCNSent
+	// TunnelDownCauseStopCCNReceived indicates the peer closed the control
+	// connection.
+	TunnelDownCauseStopCCNReceived
+	// TunnelDownCauseHelloTimeout indicates the peer stopped acknowledging
+	// the HELLO messages sent to check that it is alive.
+	TunnelDownCauseHelloTimeout
+	// TunnelDownCauseRetriesExhausted indicates the peer failed to
+	// acknowledge a control message within TunnelConfig.MaxRetries
+	// retransmissions.
+	TunnelDownCauseRetriesExhausted
+	// TunnelDownCauseTransportError indicates control messages could not
+	// be sent or received, for example because of a socket error.
+	TunnelDownCauseTransportError
+	// TunnelDownCauseProtocolError indicates the tunnel closed without a
+	// StopCCN because of an event the control protocol doesn't allow for.
+	TunnelDownCauseProtocolError
+)
+
+func (c TunnelDownCause) String() string {
+	switch c {
+	case TunnelDownCauseClosed:
+		return "closed"
+	case TunnelDownCauseStopCCNSent:
+		return "StopCCN sent"
+	case TunnelDownCauseStopCCNReceived:
+		return "StopCCN received"
+	case TunnelDownCauseHelloTimeout:
+		return "HELLO timeout"
+	case TunnelDownCauseRetriesExhausted:
+		return "retries exhausted"
+	case TunnelDownCauseTransportError:
+		return "transport error"
+	case TunnelDownCauseProtocolError:
+		return "protocol error"
+	}
+	return "unknown"
+}
+
 // TunnelConfig encapsulates tunnel configuration for a single
 // connection between two L2TP hosts.  Each tunnel may contain
 // multiple sessions.
@@ -121,11 +197,34 @@ type TunnelConfig struct {
 	// This must be specified for static and quiescent tunnels.
 	// For dynamic tunnels this can be left blank and the kernel
 	// will autobind the socket when connecting to the peer.
+	//
+	// Addresses take the form host:port, where host is an IP address
+	// or a host name.  Host names are looked up using the Context's
+	// Resolver each time the tunnel connects to a peer.
 	Local string
 
-	// The address of the L2TP peer to connect to.
+	// The address of the L2TP peer to connect to.  If the peer's host
+	// name has several IPv4 and IPv6 addresses, a dynamic tunnel tries
+	// them in turn, alternating between address families, moving on
+	// once an address has failed to acknowledge the tunnel's SCCRQ
+	// after MaxRetries retransmissions.  Addresses are not tried
+	// concurrently.  Other tunnel types use the first address.  Only
+	// addresses of the same family as the local address are used.
 	Peer string
 
+	// AlternatePeers optionally lists the addresses of further L2TP peers
+	// for a dynamic tunnel to connect to, which are tried in order if the
+	// tunnel fails to open a control connection to Peer.  A peer is
+	// abandoned if it doesn't acknowledge the tunnel's SCCRQ, or if it
+	// closes the control connection with a StopCCN asking the tunnel to
+	// try another LNS.  If that StopCCN's error message is an IP address,
+	// optionally with a port, the tunnel tries the address it names
+	// before any remaining alternate peers, provided the address is one
+	// of the alternate peers or the StopCCN was authenticated by an
+	// L2TPv3 Message Digest.  An alternate peer's host name is looked up
+	// when the tunnel fails over to it.
+	AlternatePeers []string
+
 	// The encapsulation type to be used by the tunnel instance.
 	// L2TPv2 tunnels support UDP encapsulation only.
 	Encap EncapType
@@ -190,6 +289,30 @@ type TunnelConfig struct {
 	// in the Framing Capabilities AVP per RFC2661.
 	// The default is to advertise both sync and async framing.
 	FramingCaps FramingCapability
+
+	// Secret, if set, enables tunnel authentication per RFC2661 section
+	// 5.1.1 using the shared secret: the tunnel challenges the peer to
+	// prove it knows the secret, and answers the peer's challenge.
+	// A tunnel without a secret cannot answer a challenge, so is closed
+	// if the peer sends one.
+	// By default tunnel authentication is not used.
+	Secret string
+
+	// HideAVPs, if set, hides sensitive AVPs such as session IDs, call
+	// numbers and proxy authentication details in the control messages
+	// sent by a dynamic L2TPv2 tunnel, using the algorithm of RFC2661
+	// section 4.3.  Hiding requires a Secret.  Hidden AVPs received from
+	// the peer are always revealed using the Secret.
+	// By default AVPs are sent in the clear.
+	HideAVPs bool
+
+	// DigestType, if set, enables control message authentication for
+	// dynamic L2TPv3 tunnels per RFC3931 section 4.3 using the Secret:
+	// every control message carries a Message Digest AVP computed using
+	// the specified algorithm, and messages received without a valid
+	// digest are discarded.  Requires a Secret.
+	// By default control messages are not authenticated.
+	DigestType DigestType
 }
 
 // SessionConfig encapsulates session configuration for a pseudowire
@@ -250,6 +373,12 @@ type SessionConfig struct {
 	// By default no Layer 2 specific sublayer is used.
 	L2SpecType L2SpecType
 
+	// RemoteEndID specifies the Remote End ID a session in a dynamic
+	// L2TPv3 tunnel sends the peer per RFC3931, identifying the circuit
+	// the peer should attach to the session.
+	// By default an empty Remote End ID is sent.
+	RemoteEndID string
+
 	// PPPoESessionId specifies the assigned PPPoE ID of the session.
 	// This parameter applies to PseudowireTypePPPAC only.
 	PPPoESessionId uint16
@@ -258,7 +387,74 @@ type SessionConfig struct {
 	// This parameter applies to PseudowireTypePPPAC only.
 	PPPoEPeerMac [6]byte
 
+	// PeerId specifies the name used to authenticate with the peer
+	// using PAP, CHAP-MD5 or MS-CHAPv2.
 	PeerId string
 
+	// Password specifies the secret used to authenticate with the peer
+	// using PAP, CHAP-MD5 or MS-CHAPv2.
 	Password string
+
+	// LcpEchoInterval, if set, enables transmission of PPP LCP
+	// Echo-Request messages at the specified interval once LCP is open.
+	// Echo requests keep NAT mappings alive, and allow for detection of
+	// a dead peer.
+	// By default no echo requests are sent.
+	LcpEchoInterval time.Duration
+
+	// LcpEchoFailure sets how many consecutive echo requests may go
+	// unanswered before the peer is considered dead and the session is
+	// closed.
+	// By default the session is not closed for lack of echo replies.
+	LcpEchoFailure uint
+
+	// RequestNBNS, if set, requests the addresses of the peer's NetBIOS
+	// name servers during IPCP negotiation per RFC1877.
+	// DNS server addresses are always requested.
+	RequestNBNS bool
+
+	// EnableIPv6, if set, negotiates IPv6 with the peer using IPV6CP per
+	// RFC5072 in addition to IPv4.  The data plane is started once IPv4
+	// is up, and restarted to add IPv6 when IPV6CP completes.  Failure of
+	// IPV6CP negotiation does not close the session.
+	// By default only IPv4 is negotiated.
+	EnableIPv6 bool
+
+	// MRU sets the Maximum-Receive-Unit requested during PPP LCP
+	// negotiation.  The MTU of the session is limited by both our MRU
+	// and the MRU requested by the peer.
+	// The default MRU is 1500.
+	MRU uint16
+
+	// MPPE sets whether the session negotiates 128-bit MPPE encryption
+	// of the data plane per RFC3078.  MPPE is keyed by MS-CHAPv2
+	// authentication, and is not available with other authentication
+	// protocols.
+	// By default MPPE is used if MS-CHAPv2 authentication is used and
+	// the peer agrees to encryption.
+	MPPE MPPEPolicy
+
+	// VJCompression, if set, negotiates Van Jacobson TCP/IP header
+	// compression per RFC1144 during IPCP negotiation.  Compression
+	// reduces the overhead of interactive TCP traffic on slow links.
+	// By default header compression is not used.
+	VJCompression bool
+
+	// Deflate, if set, negotiates Deflate compression of the data plane
+	// per RFC1979 during CCP negotiation.  Deflate is not used when MPPE
+	// encryption is available, since encrypted data doesn't compress.
+	// By default compression is not used.
+	Deflate bool
+
+	// OutgoingCall, if set, has a session in a dynamic L2TPv2 tunnel
+	// request an outgoing call per RFC2661: the session sends an OCRQ
+	// message asking the peer (acting as LAC) to dial CalledNumber,
+	// rather than an ICRQ message reporting an incoming call.
+	// By default sessions in dynamic tunnels report incoming calls.
+	OutgoingCall bool
+
+	// CalledNumber specifies the number the peer dials for an outgoing
+	// call.
+	// This parameter applies to sessions with OutgoingCall set only.
+	CalledNumber string
 }
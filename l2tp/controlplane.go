@@ -76,6 +76,12 @@ func (cp *controlPlane) bind() error {
 	return unix.Bind(cp.fd, cp.local)
 }
 
+// reuseAddr allows the socket to share its local address with other
+// sockets.  It must be called before bind.
+func (cp *controlPlane) reuseAddr() error {
+	return unix.SetsockoptInt(cp.fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+}
+
 func tunnelSocket(family, protocol int) (fd int, err error) {
 
 	fd, err = unix.Socket(family, unix.SOCK_DGRAM, protocol)
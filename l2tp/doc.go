@@ -22,10 +22,11 @@ Currently package l2tp implements:
 
  * support for controlling the Linux L2TP data plane for L2TPv2 and
    L2TPv3 tunnels and sessions,
- * the L2TPv2 control plane for client/LAC mode.
-
-In the future we plan to add support for the L2TPv3 control plane, and
-server/LNS mode.
+ * the L2TPv2 control plane for client/LAC mode,
+ * the L2TPv2 control plane for server/LNS mode, using a listener which
+   accepts tunnels initiated by peers,
+ * the L2TPv3 control plane for Ethernet pseudowires, in both client/LAC
+   and server/LNS modes.
 
 Usage
 
@@ -71,6 +72,13 @@ acknowledged using the L2TP reliable transport algorithm.  This slight extension
 allows for detection of tunnel failure in an otherwise static setup.
 
 The final tunnel type is the dynamic tunnel.  This runs the full L2TP control protocol.
+Dynamic tunnels are usually created by the client/LAC, while a server/LNS
+creates a dynamic listener which instantiates a dynamic tunnel for each
+control connection initiated by a peer.  Incoming calls on those tunnels
+are passed to the listener's IncomingCallHandler, which decides whether
+to accept each call and supplies its session configuration.  Outgoing
+calls requested by a peer acting as LNS are placed by the context's
+OutgoingCallHandler.
 
 Configuration
 
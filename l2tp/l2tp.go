@@ -1,10 +1,12 @@
 package l2tp
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,12 +20,18 @@ type Context struct {
 	logger        log.Logger
 	tunnelsByName map[string]tunnel
 	tunnelsByID   map[ControlConnID]tunnel
+	listeners     map[string]*dynamicListener
 	tlock         sync.RWMutex
 	dp            DataPlane
 	callSerial    uint32
 	serialLock    sync.Mutex
+	routerID      uint32
 	eventHandlers []EventHandler
 	evtLock       sync.RWMutex
+	callHandler   OutgoingCallHandler
+	callLock      sync.RWMutex
+	resolver      Resolver
+	resolverLock  sync.RWMutex
 }
 
 // Tunnel is an interface representing an L2TP tunnel.
@@ -40,10 +48,156 @@ type Tunnel interface {
 
 	// Return the file descriptor for the tunnel control plane.
 	//
+	// A dynamic tunnel replaces its control plane socket when it fails
+	// over to another peer address, so the descriptor may change until
+	// the TunnelUpEvent is generated.  The descriptor in use once the
+	// tunnel is up is passed to DataPlane.NewTunnel.
+	//
 	// default is -1
 	ControlPlaneFd() int
 }
 
+// Listener is an interface representing an L2TP listener, which accepts
+// tunnels initiated by peers.
+type Listener interface {
+	// SetIncomingCallHandler sets the handler deciding whether to accept
+	// incoming calls in tunnels accepted by the listener.
+	//
+	// If no handler is set, all incoming calls are accepted using a
+	// PPP pseudowire.
+	SetIncomingCallHandler(handler IncomingCallHandler)
+
+	// Close closes the listener, releasing allocated resources.
+	//
+	// Tunnels previously accepted by the listener are not affected.
+	Close()
+}
+
+// IncomingCallHandler is an interface for deciding whether to accept
+// incoming calls requested by peers in tunnels accepted by a listener.
+type IncomingCallHandler interface {
+	// HandleIncomingCall is called on receipt of an ICRQ message
+	// requesting an incoming call.
+	//
+	// It returns the configuration for the session to be created for
+	// the call, or an error to reject the call.  The session IDs in the
+	// configuration are ignored: they are assigned by the control protocol.
+	// For L2TPv3 calls the pseudowire type, and the peer's cookie, Layer 2
+	// specific sublayer and sequencing options are those the peer requested.
+	//
+	// HandleIncomingCall is called from the goroutine of the session
+	// created for the call.
+	HandleIncomingCall(call *IncomingCall) (*SessionConfig, error)
+
+	// HandleIncomingCallConnected is called on receipt of the ICCN message
+	// completing the setup of an accepted call, with the ProxyAuth field of
+	// the call set if the peer performed proxy authentication.
+	//
+	// It returns an error to disconnect the call.
+	HandleIncomingCallConnected(call *IncomingCall) error
+}
+
+// IncomingCall describes an incoming call requested by a peer.
+// Fields for optional AVPs the peer did not send are zero.
+type IncomingCall struct {
+	TunnelName   string
+	Tunnel       Tunnel
+	TunnelConfig *TunnelConfig
+	SessionName  string
+	Session      Session
+	// CallSerialNumber is the identifier assigned to the call by the peer.
+	CallSerialNumber uint32
+	// BearerType is the bearer capability of the call, if any.
+	BearerType uint32
+	// PhysicalChannelID is the peer's physical channel identifier for
+	// the call.
+	PhysicalChannelID uint32
+	// CallingNumber, CalledNumber, and SubAddress describe the call.
+	CallingNumber, CalledNumber, SubAddress string
+	// Pseudowire is the type of pseudowire requested by the peer: PPP
+	// for L2TPv2, or the Pseudowire Type of an L2TPv3 call.
+	Pseudowire PseudowireType
+	// RemoteEndID identifies the circuit the peer requests an L2TPv3
+	// call be attached to.
+	RemoteEndID string
+	// ProxyAuth holds the result of authentication performed by the peer
+	// on behalf of the LNS, once the call is connected.
+	ProxyAuth *ProxyAuth
+}
+
+// ProxyAuth holds the authentication information passed by a LAC which
+// authenticated the PPP peer of a call on behalf of the LNS.
+// Ref: RFC2661 section 4.4.5
+type ProxyAuth struct {
+	// Type is the authentication type: 1 for textual username and
+	// password, 2 for PPP CHAP, 3 for PPP PAP, 4 for no authentication,
+	// and 5 for Microsoft CHAP version 1.
+	Type uint16
+	// Name is the name provided by the PPP peer.
+	Name string
+	// Challenge is the CHAP challenge sent to the PPP peer.
+	Challenge []byte
+	// ID is the identifier of the CHAP exchange.
+	ID byte
+	// Response is the PPP peer's response to the challenge, or its
+	// password for PAP and textual authentication.
+	Response []byte
+}
+
+// defaultIncomingCallHandler accepts all incoming calls
+type defaultIncomingCallHandler struct{}
+
+func (h *defaultIncomingCallHandler) HandleIncomingCall(call *IncomingCall) (*SessionConfig, error) {
+	return &SessionConfig{Pseudowire: call.Pseudowire}, nil
+}
+
+func (h *defaultIncomingCallHandler) HandleIncomingCallConnected(call *IncomingCall) error {
+	return nil
+}
+
+// OutgoingCallHandler is an interface for placing outgoing calls requested
+// by peers acting as LNS.
+type OutgoingCallHandler interface {
+	// PlaceOutgoingCall is called once the OCRP message acknowledging
+	// the peer's OCRQ has been sent.  It dials the call, and returns
+	// the configuration for the session once the call is connected,
+	// or an error if the call fails.
+	//
+	// The session ID fields of the returned configuration are ignored:
+	// they are assigned by the control protocol.
+	//
+	// PlaceOutgoingCall is called from a goroutine of its own.  The
+	// session may be closed while the call is being placed, in which
+	// case the result is discarded.
+	PlaceOutgoingCall(call *OutgoingCall) (*SessionConfig, error)
+}
+
+// Resolver is an interface for looking up the IP addresses of the host
+// names in tunnel addresses.  *net.Resolver implements Resolver.
+type Resolver interface {
+	// LookupIPAddr returns the IPv4 and IPv6 addresses of a host.
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// OutgoingCall describes an outgoing call requested by a peer.
+// Fields for optional AVPs the peer did not send are zero.
+type OutgoingCall struct {
+	TunnelName   string
+	Tunnel       Tunnel
+	TunnelConfig *TunnelConfig
+	SessionName  string
+	Session      Session
+	// CallSerialNumber is the identifier assigned to the call by the peer.
+	CallSerialNumber uint32
+	// MinimumBPS and MaximumBPS give the range of acceptable line speeds.
+	MinimumBPS, MaximumBPS uint32
+	// BearerType and FramingType give the bearer and framing types
+	// acceptable for the call.
+	BearerType, FramingType uint32
+	// CalledNumber and SubAddress give the number to dial.
+	CalledNumber, SubAddress string
+}
+
 type tunnel interface {
 	Tunnel
 	getName() string
@@ -60,6 +214,52 @@ type Session interface {
 	Close()
 }
 
+// LinkInfoSession is implemented by the sessions of dynamic L2TPv2 tunnels,
+// which may pass information about the PPP link with the remote system to
+// the peer.  Use a type assertion on a Session to obtain it.
+//
+// The methods may only be called once the session is established.  They
+// block until the peer acknowledges the message or the session closes,
+// and may be called from an EventHandler, for example to send the ACCM
+// on receipt of a SessionUpEvent.
+type LinkInfoSession interface {
+	Session
+
+	// SendWanErrorNotify sends the peer a WAN-Error-Notify message
+	// reporting the error counters of the link with the remote system.
+	// It is sent by a LAC to inform the LNS of errors on the link.
+	// Ref: RFC2661 section 6.13
+	SendWanErrorNotify(errors *CallErrors) error
+
+	// SendSetLinkInfo sends the peer a Set-Link-Info message carrying the
+	// ACCM values negotiated by PPP.  Ref: RFC2661 section 6.14
+	SendSetLinkInfo(accm *ACCM) error
+}
+
+// CallErrors holds the error counters of the link between a LAC and the
+// remote system, which are reported by a WAN-Error-Notify message.  The
+// counters are cumulative since the call was established.
+type CallErrors struct {
+	CRCErrors        uint32
+	FramingErrors    uint32
+	HardwareOverruns uint32
+	BufferOverruns   uint32
+	TimeoutErrors    uint32
+	AlignmentErrors  uint32
+}
+
+// ACCM holds the Async-Control-Character-Map values negotiated by PPP,
+// which are passed to a LAC using asynchronous framing by a Set-Link-Info
+// message.
+type ACCM struct {
+	// SendACCM is the ACCM the LAC applies to the packets it sends to the
+	// remote system.
+	SendACCM uint32
+	// ReceiveACCM is the ACCM the LAC applies to the packets it receives
+	// from the remote system.
+	ReceiveACCM uint32
+}
+
 type session interface {
 	Session
 	getName() string
@@ -125,8 +325,42 @@ type SessionDataPlane interface {
 	// HandleDataPacket is called to pass a data packet to the session data plane.
 	HandleDataPacket([]byte) error
 
-	// Start session
-	Start([]byte) error
+	// Start is called to start the data plane once the network layer
+	// configuration of the session has been negotiated.
+	Start(*SessionNetworkConfig) error
+
+	// Stop is called to stop the data plane when the network layer of
+	// the session goes down, for example because the peer renegotiated
+	// PPP.  Start is called again once the network layer comes back up.
+	Stop() error
+}
+
+// SessionNetworkConfig holds the network layer configuration negotiated
+// with the peer by the PPP network control protocols of a session.
+// Addresses the peer did not provide are nil.
+type SessionNetworkConfig struct {
+	// Address is the local IPv4 address assigned by the peer.
+	Address net.IP
+	// PrimaryDNS and SecondaryDNS are the DNS servers provided by the peer.
+	PrimaryDNS, SecondaryDNS net.IP
+	// PrimaryNBNS and SecondaryNBNS are the NetBIOS name servers provided
+	// by the peer, if requested using SessionConfig.RequestNBNS.
+	PrimaryNBNS, SecondaryNBNS net.IP
+	// IPv6InterfaceID is the local IPv6 interface identifier negotiated by
+	// IPV6CP, from which the link-local address is formed.  It is nil unless
+	// IPv6 is enabled using SessionConfig.EnableIPv6 and IPV6CP succeeded.
+	IPv6InterfaceID []byte
+	// MTU is the largest network layer packet which may be sent over the
+	// session, derived from the MRUs negotiated by LCP and the overhead of
+	// the L2TP tunnel, and reduced by the overhead of MPPE encryption
+	// if in use.
+	MTU int
+	// Encapsulate returns the L2TP data message carrying an IPv4 or IPv6
+	// packet to be sent to the peer, applying the PPP framing and any
+	// encryption negotiated for the session.  It returns an error if the
+	// packet may not be sent.
+	// Encapsulate is safe to call from any goroutine.
+	Encapsulate func(packet []byte) ([]byte, error)
 }
 
 // EventHandler is an interface for receiving L2TP-specific events.
@@ -152,6 +386,11 @@ type TunnelUpEvent struct {
 	Tunnel                    Tunnel
 	Config                    *TunnelConfig
 	LocalAddress, PeerAddress unix.Sockaddr
+	// Peer is the address of the peer the tunnel connected to: for a
+	// dynamic tunnel this is TunnelConfig.Peer, one of
+	// TunnelConfig.AlternatePeers, or an address the tunnel was redirected
+	// to by a peer.
+	Peer string
 }
 
 // TunnelDownEvent is passed to registered EventHandler instances when a
@@ -164,6 +403,28 @@ type TunnelDownEvent struct {
 	Tunnel                    Tunnel
 	Config                    *TunnelConfig
 	LocalAddress, PeerAddress unix.Sockaddr
+	// Cause describes why the tunnel went down.
+	Cause TunnelDownCause
+	// StopCCN holds the result carried by the StopCCN message sent or
+	// received as the control connection closed.  It is nil if no StopCCN
+	// was exchanged.
+	StopCCN *StopCCNResult
+	// Result describes why the tunnel went down in human-readable form.
+	Result string
+}
+
+// StopCCNResult holds the result carried by a StopCCN message.
+// Ref: RFC2661 section 4.4.2, RFC3931 section 5.4.2
+type StopCCNResult struct {
+	// Sent is true if the StopCCN was sent to the peer, or false if it
+	// was received from the peer.
+	Sent bool
+	// ResultCode gives the reason the control connection was closed.
+	ResultCode uint16
+	// ErrorCode gives further information on a general error.
+	ErrorCode uint16
+	// ErrorMessage is the optional error message.
+	ErrorMessage string
 }
 
 // SessionEchoEvent is passed to registered EventHandler instances when a session
@@ -177,6 +438,59 @@ type SessionEchoEvent struct {
 	SessionConfig *SessionConfig
 }
 
+// SessionEchoReplyEvent is passed to registered EventHandler instances when a
+// session receives a reply to an LCP echo request it sent.
+type SessionEchoReplyEvent struct {
+	TunnelName    string
+	Tunnel        Tunnel
+	TunnelConfig  *TunnelConfig
+	SessionName   string
+	Session       Session
+	SessionConfig *SessionConfig
+	// RTT is the round trip time of the echo request.
+	RTT time.Duration
+}
+
+// SessionEchoTimeoutEvent is passed to registered EventHandler instances when
+// the peer fails to reply to SessionConfig.LcpEchoFailure consecutive LCP echo
+// requests.  The session is closed following this event.
+type SessionEchoTimeoutEvent struct {
+	TunnelName    string
+	Tunnel        Tunnel
+	TunnelConfig  *TunnelConfig
+	SessionName   string
+	Session       Session
+	SessionConfig *SessionConfig
+	// Failures is the number of unanswered echo requests.
+	Failures uint
+}
+
+// SessionWanErrorNotifyEvent is passed to registered EventHandler instances
+// when a session receives a WAN-Error-Notify message from the peer.
+type SessionWanErrorNotifyEvent struct {
+	TunnelName    string
+	Tunnel        Tunnel
+	TunnelConfig  *TunnelConfig
+	SessionName   string
+	Session       Session
+	SessionConfig *SessionConfig
+	// Errors holds the error counters reported by the peer.
+	Errors CallErrors
+}
+
+// SessionSetLinkInfoEvent is passed to registered EventHandler instances
+// when a session receives a Set-Link-Info message from the peer.
+type SessionSetLinkInfoEvent struct {
+	TunnelName    string
+	Tunnel        Tunnel
+	TunnelConfig  *TunnelConfig
+	SessionName   string
+	Session       Session
+	SessionConfig *SessionConfig
+	// ACCM holds the ACCM values passed by the peer.
+	ACCM ACCM
+}
+
 // SessionUpEvent is passed to registered EventHandler instances when a session
 // comes up.  In the case of static or quiescent sessions, this occurs immediately
 // on instantiation of the session.  For dynamic sessions, this occurs on the
@@ -248,8 +562,10 @@ func NewContext(dataPlane DataPlane, logger log.Logger) (*Context, error) {
 		logger:        logger,
 		tunnelsByName: make(map[string]tunnel),
 		tunnelsByID:   make(map[ControlConnID]tunnel),
+		listeners:     make(map[string]*dynamicListener),
 		dp:            dp,
 		callSerial:    rand.Uint32(),
+		routerID:      rand.Uint32(),
 	}, nil
 }
 
@@ -262,8 +578,6 @@ func NewContext(dataPlane DataPlane, logger log.Logger) (*Context, error) {
 // The name provided must be unique in the Context.
 func (ctx *Context) NewDynamicTunnel(name string, cfg *TunnelConfig) (tunl Tunnel, err error) {
 
-	var sal, sap unix.Sockaddr
-
 	// Must have configuration
 	if cfg == nil {
 		return nil, fmt.Errorf("invalid nil config")
@@ -277,6 +591,10 @@ func (ctx *Context) NewDynamicTunnel(name string, cfg *TunnelConfig) (tunl Tunne
 		return nil, fmt.Errorf("already have tunnel %q", name)
 	}
 
+	// Duplicate the alternate peers too so that the tunnel's list can't be
+	// modified by the caller
+	myCfg.AlternatePeers = append([]string(nil), cfg.AlternatePeers...)
+
 	// Generate host name if unset
 	if myCfg.HostName == "" {
 		name, err := os.Hostname()
@@ -307,6 +625,10 @@ func (ctx *Context) NewDynamicTunnel(name string, cfg *TunnelConfig) (tunl Tunne
 	if myCfg.Peer == "" {
 		return nil, fmt.Errorf("must specify peer address for dynamic tunnel")
 	}
+	err = checkDigestConfig(&myCfg)
+	if err != nil {
+		return nil, err
+	}
 
 	// If the tunnel ID in the config is unset we must generate one.
 	// If the tunnel ID is set, we must check for collisions.
@@ -325,21 +647,20 @@ func (ctx *Context) NewDynamicTunnel(name string, cfg *TunnelConfig) (tunl Tunne
 		}
 	}
 
-	// Initialise tunnel address structures
-	switch myCfg.Encap {
-	case EncapTypeUDP:
-		sal, sap, err = newUDPAddressPair(myCfg.Local, myCfg.Peer)
-	case EncapTypeIP:
-		sal, sap, err = newIPAddressPair(myCfg.Local, myCfg.TunnelID,
-			myCfg.Peer, myCfg.PeerTunnelID)
-	default:
-		err = fmt.Errorf("unrecognised encapsulation type %v", myCfg.Encap)
-	}
+	// Initialise tunnel address structures.  The alternate peers'
+	// addresses are resolved if and when the tunnel fails over to them.
+	addrs, err := ctx.resolveTunnelAddresses(&myCfg, myCfg.Peer)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialise tunnel addresses: %v", err)
 	}
+	for _, peer := range myCfg.AlternatePeers {
+		_, _, err = net.SplitHostPort(peer)
+		if err != nil {
+			return nil, fmt.Errorf("alternate peer address %q: %v", peer, err)
+		}
+	}
 
-	t, err := newDynamicTunnel(name, ctx, sal, sap, &myCfg)
+	t, err := newDynamicTunnel(name, ctx, addrs, &myCfg)
 	if err != nil {
 		return nil, err
 	}
@@ -350,6 +671,104 @@ func (ctx *Context) NewDynamicTunnel(name string, cfg *TunnelConfig) (tunl Tunne
 	return
 }
 
+// NewDynamicListener creates a new dynamic L2TP listener.
+//
+// A dynamic L2TP listener runs the server/LNS side of the RFC2661
+// (L2TPv2) or RFC3931 (L2TPv3) control protocol.  It accepts control connections initiated
+// by peers on its local address, creating a dynamic tunnel instance for
+// each peer.  A TunnelUpEvent is generated when each tunnel is established.
+//
+// The name provided must be unique in the Context.  Tunnels created by the
+// listener are named using the listener name and the tunnel ID.
+//
+// The tunnel configuration is used for each tunnel created by the listener.
+// It must include the local address, and must not include tunnel IDs or the
+// peer address, which are determined for each tunnel as it is created.
+func (ctx *Context) NewDynamicListener(name string, cfg *TunnelConfig) (lstnr Listener, err error) {
+
+	// Must have configuration
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid nil config")
+	}
+
+	// Duplicate the configuration so we don't modify the user's copy
+	myCfg := *cfg
+
+	// Must not have name clashes
+	if _, ok := ctx.findListenerByName(name); ok {
+		return nil, fmt.Errorf("already have listener %q", name)
+	}
+
+	// Generate host name if unset
+	if myCfg.HostName == "" {
+		name, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up host name: %v", err)
+		}
+		myCfg.HostName = name
+	}
+
+	// Default StopCCN retransmit timeout if unset.
+	// RFC2661 section 5.7 recommends a default of 31s.
+	if myCfg.StopCCNTimeout == 0 {
+		myCfg.StopCCNTimeout = 31 * time.Second
+	}
+
+	// Sanity check the configuration
+	if myCfg.Encap != EncapTypeUDP {
+		return nil, fmt.Errorf("only UDP encapsulation is supported for dynamic listeners")
+	}
+	if myCfg.TunnelID != 0 || myCfg.PeerTunnelID != 0 {
+		return nil, fmt.Errorf("connection IDs cannot be specified for dynamic listeners")
+	}
+	if myCfg.Local == "" {
+		return nil, fmt.Errorf("must specify local address for dynamic listener")
+	}
+	if myCfg.Peer != "" {
+		return nil, fmt.Errorf("peer address cannot be specified for dynamic listener")
+	}
+	err = checkDigestConfig(&myCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Initialise listener address structure: the listener binds to the
+	// first address of a host name
+	var sal unix.Sockaddr
+	laddrs, err := ctx.resolveUDPAddrs(myCfg.Local)
+	if err == nil {
+		sal, err = udpSockaddr(laddrs[0].IP, laddrs[0].Port)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise listener address: local address %q: %v", myCfg.Local, err)
+	}
+
+	l, err := newDynamicListener(name, ctx, sal, &myCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.linkListener(l)
+	lstnr = l
+
+	return
+}
+
+// checkDigestConfig sanity checks the control message authentication
+// configuration of a dynamic tunnel or listener
+func checkDigestConfig(cfg *TunnelConfig) error {
+	if cfg.DigestType == DigestTypeNone {
+		return nil
+	}
+	if cfg.Version != ProtocolVersion3 {
+		return fmt.Errorf("control message authentication only supported for L2TPv3 tunnels")
+	}
+	if cfg.Secret == "" {
+		return fmt.Errorf("control message authentication requires a secret")
+	}
+	return nil
+}
+
 // NewQuiescentTunnel creates a new "quiescent" L2TP tunnel.
 //
 // A quiescent tunnel creates a user space socket for the
@@ -409,18 +828,11 @@ func (ctx *Context) NewQuiescentTunnel(name string, cfg *TunnelConfig) (tunl Tun
 	}
 
 	// Initialise tunnel address structures
-	switch myCfg.Encap {
-	case EncapTypeUDP:
-		sal, sap, err = newUDPAddressPair(myCfg.Local, myCfg.Peer)
-	case EncapTypeIP:
-		sal, sap, err = newIPAddressPair(myCfg.Local, myCfg.TunnelID,
-			myCfg.Peer, myCfg.PeerTunnelID)
-	default:
-		err = fmt.Errorf("unrecognised encapsulation type %v", myCfg.Encap)
-	}
+	addrs, err := ctx.resolveTunnelAddresses(&myCfg, myCfg.Peer)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialise tunnel addresses: %v", err)
 	}
+	sal, sap = addrs[0].sal, addrs[0].sap
 
 	t, err := newQuiescentTunnel(name, ctx, sal, sap, &myCfg)
 	if err != nil {
@@ -486,18 +898,11 @@ func (ctx *Context) NewStaticTunnel(name string, cfg *TunnelConfig) (tunl Tunnel
 	}
 
 	// Initialise tunnel address structures
-	switch myCfg.Encap {
-	case EncapTypeUDP:
-		sal, sap, err = newUDPAddressPair(myCfg.Local, myCfg.Peer)
-	case EncapTypeIP:
-		sal, sap, err = newIPAddressPair(myCfg.Local, myCfg.TunnelID,
-			myCfg.Peer, myCfg.PeerTunnelID)
-	default:
-		err = fmt.Errorf("unrecognised encapsulation type %v", myCfg.Encap)
-	}
+	addrs, err := ctx.resolveTunnelAddresses(&myCfg, myCfg.Peer)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialise tunnel addresses: %v", err)
 	}
+	sal, sap = addrs[0].sal, addrs[0].sap
 
 	t, err := newStaticTunnel(name, ctx, sal, sap, &myCfg)
 	if err != nil {
@@ -538,6 +943,43 @@ func (ctx *Context) UnregisterEventHandler(handler EventHandler) {
 	}
 }
 
+// SetOutgoingCallHandler sets the handler placing outgoing calls requested
+// by peers in the L2TP context's dynamic tunnels.
+//
+// If no handler is set, all outgoing call requests are rejected.
+func (ctx *Context) SetOutgoingCallHandler(handler OutgoingCallHandler) {
+	ctx.callLock.Lock()
+	defer ctx.callLock.Unlock()
+	ctx.callHandler = handler
+}
+
+func (ctx *Context) getOutgoingCallHandler() OutgoingCallHandler {
+	ctx.callLock.RLock()
+	defer ctx.callLock.RUnlock()
+	return ctx.callHandler
+}
+
+// SetResolver sets the resolver used to look up host names in the local
+// and peer addresses of the L2TP context's tunnels and listeners.  For
+// example, an application running inside a VPN may provide a resolver
+// which queries DNS servers outside the VPN.
+//
+// If no resolver is set, net.DefaultResolver is used.
+func (ctx *Context) SetResolver(resolver Resolver) {
+	ctx.resolverLock.Lock()
+	defer ctx.resolverLock.Unlock()
+	ctx.resolver = resolver
+}
+
+func (ctx *Context) getResolver() Resolver {
+	ctx.resolverLock.RLock()
+	defer ctx.resolverLock.RUnlock()
+	if ctx.resolver == nil {
+		return net.DefaultResolver
+	}
+	return ctx.resolver
+}
+
 func (ctx *Context) handleUserEvent(event interface{}) {
 	ctx.evtLock.RLock()
 	defer ctx.evtLock.RUnlock()
@@ -549,8 +991,21 @@ func (ctx *Context) handleUserEvent(event interface{}) {
 // Close tears down the context, including all the L2TP tunnels and sessions
 // running inside it.
 func (ctx *Context) Close() {
+	listeners := []Listener{}
 	tunnels := []Tunnel{}
 
+	// Close listeners first so that no further tunnels are created
+	ctx.tlock.Lock()
+	for name, lstnr := range ctx.listeners {
+		listeners = append(listeners, lstnr)
+		delete(ctx.listeners, name)
+	}
+	ctx.tlock.Unlock()
+
+	for _, lstnr := range listeners {
+		lstnr.Close()
+	}
+
 	ctx.tlock.Lock()
 	for name, tunl := range ctx.tunnelsByName {
 		tunnels = append(tunnels, tunl)
@@ -594,6 +1049,25 @@ func (ctx *Context) unlinkTunnel(tunl tunnel) {
 	delete(ctx.tunnelsByID, tunl.getCfg().TunnelID)
 }
 
+func (ctx *Context) linkListener(lstnr *dynamicListener) {
+	ctx.tlock.Lock()
+	defer ctx.tlock.Unlock()
+	ctx.listeners[lstnr.name] = lstnr
+}
+
+func (ctx *Context) unlinkListener(lstnr *dynamicListener) {
+	ctx.tlock.Lock()
+	defer ctx.tlock.Unlock()
+	delete(ctx.listeners, lstnr.name)
+}
+
+func (ctx *Context) findListenerByName(name string) (lstnr *dynamicListener, ok bool) {
+	ctx.tlock.RLock()
+	defer ctx.tlock.RUnlock()
+	lstnr, ok = ctx.listeners[name]
+	return
+}
+
 func (ctx *Context) findTunnelByName(name string) (tunl tunnel, ok bool) {
 	ctx.tlock.RLock()
 	defer ctx.tlock.RUnlock()
@@ -615,23 +1089,17 @@ func (ctx *Context) allocCallSerial() uint32 {
 	return ctx.callSerial
 }
 
-func newUDPTunnelAddress(address string) (unix.Sockaddr, error) {
-
-	u, err := net.ResolveUDPAddr("udp", address)
-	if err != nil {
-		return nil, fmt.Errorf("resolve %v: %v", address, err)
-	}
-
-	if b := u.IP.To4(); b != nil {
+func udpSockaddr(ip net.IP, port int) (unix.Sockaddr, error) {
+	if b := ip.To4(); b != nil {
 		return &unix.SockaddrInet4{
-			Port: u.Port,
+			Port: port,
 			Addr: [4]byte{b[0], b[1], b[2], b[3]},
 		}, nil
-	} else if b := u.IP.To16(); b != nil {
+	} else if b := ip.To16(); b != nil {
 		// TODO: SockaddrInet6 has a uint32 ZoneId, while UDPAddr
 		// has a Zone string.  How to convert between the two?
 		return &unix.SockaddrInet6{
-			Port: u.Port,
+			Port: port,
 			Addr: [16]byte{
 				b[0], b[1], b[2], b[3],
 				b[4], b[5], b[6], b[7],
@@ -645,48 +1113,25 @@ func newUDPTunnelAddress(address string) (unix.Sockaddr, error) {
 	return nil, fmt.Errorf("unhandled address family")
 }
 
-func newUDPAddressPair(local, remote string) (sal, sap unix.Sockaddr, err error) {
-
-	// We expect the peer address to always be set
-	sap, err = newUDPTunnelAddress(remote)
-	if err != nil {
-		return nil, nil, fmt.Errorf("remote address %q: %v", remote, err)
-	}
-
-	// The local address may not be set: in this case return
-	// a zero-value sockaddr appropriate to the peer address type
-	if local != "" {
-		sal, err = newUDPTunnelAddress(local)
-		if err != nil {
-			return nil, nil, fmt.Errorf("local address %q: %v", local, err)
-		}
-	} else {
-		switch sap.(type) {
-		case *unix.SockaddrInet4:
-			sal = &unix.SockaddrInet4{}
-		case *unix.SockaddrInet6:
-			sal = &unix.SockaddrInet6{}
-		default:
-			// should not occur, c.f. newUDPTunnelAddress
-			return nil, nil, fmt.Errorf("unhanded address family")
-		}
+// sockaddrString returns the string representation of a UDP address, in
+// host:port form.
+func sockaddrString(sa unix.Sockaddr) string {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return (&net.UDPAddr{IP: sa.Addr[:], Port: sa.Port}).String()
+	case *unix.SockaddrInet6:
+		return (&net.UDPAddr{IP: sa.Addr[:], Port: sa.Port}).String()
 	}
-	return
+	return fmt.Sprintf("%v", sa)
 }
 
-func newIPTunnelAddress(address string, ccid ControlConnID) (unix.Sockaddr, error) {
-
-	u, err := net.ResolveUDPAddr("udp", address)
-	if err != nil {
-		return nil, fmt.Errorf("resolve %v: %v", address, err)
-	}
-
-	if b := u.IP.To4(); b != nil {
+func ipSockaddr(ip net.IP, ccid ControlConnID) (unix.Sockaddr, error) {
+	if b := ip.To4(); b != nil {
 		return &unix.SockaddrL2TPIP{
 			Addr:   [4]byte{b[0], b[1], b[2], b[3]},
 			ConnId: uint32(ccid),
 		}, nil
-	} else if b := u.IP.To16(); b != nil {
+	} else if b := ip.To16(); b != nil {
 		// TODO: SockaddrInet6 has a uint32 ZoneId, while UDPAddr
 		// has a Zone string.  How to convert between the two?
 		return &unix.SockaddrL2TPIP6{
@@ -704,32 +1149,170 @@ func newIPTunnelAddress(address string, ccid ControlConnID) (unix.Sockaddr, erro
 	return nil, fmt.Errorf("unhandled address family")
 }
 
-func newIPAddressPair(local string, ccid ControlConnID, remote string, pccid ControlConnID) (sal, sap unix.Sockaddr, err error) {
+// tunnelAddress is a pair of local and peer socket addresses a tunnel
+// may use to connect to its peer.
+type tunnelAddress struct {
+	sal, sap unix.Sockaddr
+}
+
+// resolveTimeout limits the time spent looking up a host name
+const resolveTimeout = 10 * time.Second
+
+// resolveTunnelAddresses resolves the tunnel's local address and the
+// address of a peer to the socket addresses the tunnel may use to connect
+// to the peer, in the order they should be tried.  Peer addresses of an
+// address family the local address doesn't resolve to are skipped.
+//
+// Host names are looked up afresh on every call so that a tunnel
+// reconnecting to a peer finds the peer's current addresses.
+func (ctx *Context) resolveTunnelAddresses(cfg *TunnelConfig, peer string) ([]tunnelAddress, error) {
+	if cfg.Encap != EncapTypeUDP && cfg.Encap != EncapTypeIP {
+		return nil, fmt.Errorf("unrecognised encapsulation type %v", cfg.Encap)
+	}
+
 	// We expect the peer address to always be set
-	sap, err = newIPTunnelAddress(remote, pccid)
+	paddrs, err := ctx.resolveUDPAddrs(peer)
 	if err != nil {
-		return nil, nil, fmt.Errorf("remote address %q: %v", remote, err)
+		return nil, fmt.Errorf("remote address %q: %v", peer, err)
 	}
 
-	// The local address may not be set: in this case return
-	// a zero-value sockaddr appropriate to the peer address type
-	if local != "" {
-		sal, err = newIPTunnelAddress(local, ccid)
+	var laddrs []*net.UDPAddr
+	if cfg.Local != "" {
+		laddrs, err = ctx.resolveUDPAddrs(cfg.Local)
 		if err != nil {
-			return nil, nil, fmt.Errorf("local address %q: %v", local, err)
+			return nil, fmt.Errorf("local address %q: %v", cfg.Local, err)
 		}
-	} else {
-		switch sap.(type) {
-		case *unix.SockaddrL2TPIP:
-			sal = &unix.SockaddrL2TPIP{}
-		case *unix.SockaddrL2TPIP6:
-			sal = &unix.SockaddrL2TPIP6{}
-		default:
-			// should not occur, c.f. newIPTunnelAddress
-			return nil, nil, fmt.Errorf("unhanded address family")
+	}
+
+	var addrs []tunnelAddress
+	for _, pa := range paddrs {
+		sap, err := tunnelSockaddr(cfg.Encap, pa, cfg.PeerTunnelID)
+		if err != nil {
+			return nil, fmt.Errorf("remote address %q: %v", peer, err)
+		}
+
+		// The local address may not be set: in this case use
+		// a zero-value sockaddr appropriate to the peer address type
+		var sal unix.Sockaddr
+		if laddrs == nil {
+			sal = unspecifiedSockaddr(sap)
+		} else {
+			la := findAddressOfFamily(laddrs, pa.IP)
+			if la == nil {
+				continue
+			}
+			sal, err = tunnelSockaddr(cfg.Encap, la, cfg.TunnelID)
+			if err != nil {
+				return nil, fmt.Errorf("local address %q: %v", cfg.Local, err)
+			}
 		}
+
+		addrs = append(addrs, tunnelAddress{sal: sal, sap: sap})
 	}
-	return
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("local address %q: no address of the same family as remote address %q",
+			cfg.Local, peer)
+	}
+	return addrs, nil
+}
+
+// resolveUDPAddrs resolves an address of the form host:port to the UDP
+// addresses it names.  The host may be an IP address or a host name.
+//
+// The addresses of a host name alternate between IPv6 and IPv4, starting
+// with the family of the first address returned by the resolver.  They
+// are tried one at a time rather than raced: a dynamic tunnel only moves
+// on to the next address once its SCCRQ to the current one has run out of
+// retries.
+func (ctx *Context) resolveUDPAddrs(address string) ([]*net.UDPAddr, error) {
+	host, service, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %v: %v", address, err)
+	}
+
+	// IP addresses, which may have an IPv6 zone, need no lookup
+	ip, _, _ := strings.Cut(host, "%")
+	if host == "" || net.ParseIP(ip) != nil {
+		u, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %v: %v", address, err)
+		}
+		return []*net.UDPAddr{u}, nil
+	}
+
+	port, err := net.LookupPort("udp", service)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %v: %v", address, err)
+	}
+
+	lookupCtx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := ctx.getResolver().LookupIPAddr(lookupCtx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %v: %v", address, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("resolve %v: no addresses found", address)
+	}
+
+	var first, second []*net.UDPAddr
+	isV4 := ips[0].IP.To4() != nil
+	for _, ip := range ips {
+		u := &net.UDPAddr{IP: ip.IP, Port: port, Zone: ip.Zone}
+		if (ip.IP.To4() != nil) == isV4 {
+			first = append(first, u)
+		} else {
+			second = append(second, u)
+		}
+	}
+
+	var addrs []*net.UDPAddr
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			addrs = append(addrs, first[0])
+			first = first[1:]
+		}
+		if len(second) > 0 {
+			addrs = append(addrs, second[0])
+			second = second[1:]
+		}
+	}
+	return addrs, nil
+}
+
+// findAddressOfFamily returns the first of addrs in the same address
+// family as ip, or nil if there is none.
+func findAddressOfFamily(addrs []*net.UDPAddr, ip net.IP) *net.UDPAddr {
+	for _, a := range addrs {
+		if (a.IP.To4() != nil) == (ip.To4() != nil) {
+			return a
+		}
+	}
+	return nil
+}
+
+func tunnelSockaddr(encap EncapType, u *net.UDPAddr, ccid ControlConnID) (unix.Sockaddr, error) {
+	if encap == EncapTypeIP {
+		return ipSockaddr(u.IP, ccid)
+	}
+	return udpSockaddr(u.IP, u.Port)
+}
+
+// unspecifiedSockaddr returns a zero-value sockaddr of the same type as sa
+func unspecifiedSockaddr(sa unix.Sockaddr) unix.Sockaddr {
+	switch sa.(type) {
+	case *unix.SockaddrInet4:
+		return &unix.SockaddrInet4{}
+	case *unix.SockaddrInet6:
+		return &unix.SockaddrInet6{}
+	case *unix.SockaddrL2TPIP:
+		return &unix.SockaddrL2TPIP{}
+	case *unix.SockaddrL2TPIP6:
+		return &unix.SockaddrL2TPIP6{}
+	}
+	// should not occur, c.f. tunnelSockaddr
+	return nil
 }
 
 func initDataPlane(dp DataPlane) (DataPlane, error) {
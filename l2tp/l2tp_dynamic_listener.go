@@ -0,0 +1,244 @@
+package l2tp
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+// dynamicListener accepts control connections initiated by peers,
+// creating a server/LNS mode dynamic tunnel for each peer.
+type dynamicListener struct {
+	logger log.Logger
+	name   string
+	parent *Context
+	cfg    *TunnelConfig
+	sal    unix.Sockaddr
+	cp     *controlPlane
+	wg     sync.WaitGroup
+	// digest verifies SCCRQ messages if control message authentication
+	// is enabled
+	digest *v3Digest
+
+	handlerLock sync.RWMutex
+	callHandler IncomingCallHandler
+}
+
+func (dl *dynamicListener) SetIncomingCallHandler(handler IncomingCallHandler) {
+	dl.handlerLock.Lock()
+	defer dl.handlerLock.Unlock()
+	dl.callHandler = handler
+}
+
+func (dl *dynamicListener) getIncomingCallHandler() IncomingCallHandler {
+	dl.handlerLock.RLock()
+	defer dl.handlerLock.RUnlock()
+	if dl.callHandler == nil {
+		return &defaultIncomingCallHandler{}
+	}
+	return dl.callHandler
+}
+
+func (dl *dynamicListener) Close() {
+	if dl != nil {
+		dl.parent.unlinkListener(dl)
+		dl.cp.close()
+		dl.wg.Wait()
+	}
+}
+
+func (dl *dynamicListener) runListener() {
+	defer dl.wg.Done()
+
+	level.Info(dl.logger).Log(
+		"message", "new dynamic listener",
+		"version", dl.cfg.Version,
+		"encap", dl.cfg.Encap,
+		"local", dl.cfg.Local)
+
+	for {
+		buffer := make([]byte, 4096)
+		n, from, err := dl.cp.recvFrom(buffer)
+		if err != nil {
+			level.Info(dl.logger).Log(
+				"message", "close",
+				"error", err)
+			return
+		}
+		dl.handleFrame(buffer[:n], from)
+	}
+}
+
+// handleFrame handles a frame received on the listener socket.  Peers
+// only send SCCRQ messages to the listener: once a tunnel has been created
+// its socket receives the peer's subsequent messages.
+func (dl *dynamicListener) handleFrame(b []byte, from unix.Sockaddr) {
+	messages, err := parseMessageBuffer(b)
+	if err != nil {
+		level.Debug(dl.logger).Log(
+			"message", "discarding frame",
+			"error", err)
+		return
+	}
+
+	for _, msg := range messages {
+		if msg.protocolVersion() != dl.cfg.Version {
+			level.Debug(dl.logger).Log(
+				"message", "discarding control message with wrong protocol version",
+				"got", msg.protocolVersion())
+			continue
+		}
+		// The SCCRQ is the first message the peer sends: it is
+		// addressed to tunnel ID 0, and its Ns is 0.
+		if msg.getType() != avpMsgTypeSccrq || msgControlConnID(msg) != 0 || msg.ns() != 0 {
+			level.Debug(dl.logger).Log(
+				"message", "discarding unexpected control message",
+				"message_type", msg.getType(),
+				"tunnel ID", msgControlConnID(msg))
+			continue
+		}
+		// Unauthenticated messages are silently discarded
+		if v3msg, ok := msg.(*v3ControlMessage); ok && dl.digest != nil {
+			if err := dl.digest.verify(v3msg); err != nil {
+				level.Debug(dl.logger).Log(
+					"message", "discarding unauthenticated control message",
+					"message_type", msg.getType(),
+					"error", err)
+				continue
+			}
+		}
+		// Hidden AVPs are an L2TPv2 feature
+		var err error
+		if v2msg, ok := msg.(*v2ControlMessage); ok {
+			err = v2msg.unhideAvps(dl.cfg.Secret)
+		}
+		if err == nil {
+			err = msg.validate()
+		}
+		if err != nil {
+			level.Error(dl.logger).Log(
+				"message", "bad control message",
+				"message_type", msg.getType(),
+				"error", err)
+			continue
+		}
+		dl.handleSccrq(msg, from)
+	}
+}
+
+func (dl *dynamicListener) handleSccrq(msg controlMessage, from unix.Sockaddr) {
+
+	ptid, err := findPeerControlConnID(msg)
+	if err != nil {
+		// Shouldn't occur since tunnel ID is mandatory
+		level.Error(dl.logger).Log(
+			"message", "failed to parse peer tunnel ID from SCCRQ",
+			"error", err)
+		return
+	}
+
+	peer := sockaddrString(from)
+
+	// The peer retransmits its SCCRQ until our SCCRP is acknowledged,
+	// and a retransmission may arrive before the tunnel socket is
+	// connected.
+	if dl.findTunnel(peer, ptid) {
+		level.Debug(dl.logger).Log(
+			"message", "ignoring SCCRQ for existing tunnel",
+			"peer", peer,
+			"peer_tunnel_id", ptid)
+		return
+	}
+
+	// Duplicate the configuration for the new tunnel
+	cfg := *dl.cfg
+	cfg.Peer = peer
+	cfg.PeerTunnelID = ptid
+	cfg.TunnelID, err = dl.parent.allocTid(cfg.Version)
+	if err != nil {
+		level.Error(dl.logger).Log(
+			"message", "failed to allocate a TID",
+			"error", err)
+		return
+	}
+
+	name := fmt.Sprintf("%s-%d", dl.name, cfg.TunnelID)
+	if _, ok := dl.parent.findTunnelByName(name); ok {
+		level.Error(dl.logger).Log(
+			"message", "failed to create tunnel",
+			"error", fmt.Sprintf("already have tunnel %q", name))
+		return
+	}
+
+	level.Info(dl.logger).Log(
+		"message", "accepting tunnel",
+		"tunnel_name", name,
+		"peer", peer,
+		"peer_tunnel_id", ptid)
+
+	_, err = newDynamicLNSTunnel(name, dl.parent, dl, from, &cfg, msg)
+	if err != nil {
+		level.Error(dl.logger).Log(
+			"message", "failed to create tunnel",
+			"error", err)
+	}
+}
+
+// findTunnel returns true if the listener has already created a tunnel
+// for the peer's control connection.
+func (dl *dynamicListener) findTunnel(peer string, ptid ControlConnID) bool {
+	dl.parent.tlock.RLock()
+	defer dl.parent.tlock.RUnlock()
+	for _, t := range dl.parent.tunnelsByID {
+		if dt, ok := t.(*dynamicTunnel); ok && dt.listener == dl {
+			if dt.cfg.Peer == peer && dt.cfg.PeerTunnelID == ptid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func newDynamicListener(name string, parent *Context, sal unix.Sockaddr, cfg *TunnelConfig) (dl *dynamicListener, err error) {
+
+	dl = &dynamicListener{
+		logger: log.With(parent.logger, "listener_name", name),
+		name:   name,
+		parent: parent,
+		cfg:    cfg,
+		sal:    sal,
+	}
+
+	if cfg.DigestType != DigestTypeNone {
+		dl.digest, err = newV3Digest(cfg.DigestType, cfg.Secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dl.cp, err = newL2tpControlPlane(sal, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tunnel sockets share the listener's local address
+	err = dl.cp.reuseAddr()
+	if err != nil {
+		dl.cp.close()
+		return nil, err
+	}
+
+	err = dl.cp.bind()
+	if err != nil {
+		dl.cp.close()
+		return nil, err
+	}
+
+	dl.wg.Add(1)
+	go dl.runListener()
+
+	return
+}
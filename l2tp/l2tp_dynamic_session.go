@@ -1,29 +1,94 @@
 package l2tp
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
 )
 
 type dynamicSession struct {
 	*baseSession
-	isClosed    bool
-	established bool
-	callSerial  uint32
-	ifname      string
-	result      string
-	dt          *dynamicTunnel
-	dp          SessionDataPlane
-	wg          sync.WaitGroup
-	pppRxChan   chan *pppDataMessage
-	msgRxChan   chan controlMessage
-	eventChan   chan string
-	closeChan   chan interface{}
-	killChan    chan interface{}
-	fsm         fsm
+	isClosed      bool
+	established   bool
+	authenticated bool
+	authProtocol  pppProtocolType
+	authID        byte
+	authPending   bool
+	chapAlgorithm byte
+	mschapv2      *mschapv2Response
+	mppeMasterKey []byte
+	callSerial    uint32
+	ifname        string
+	result        string
+	dt            *dynamicTunnel
+	icrq          controlMessage
+	call          *IncomingCall
+	ocrq          controlMessage
+	outgoingCall  *OutgoingCall
+	callChan      chan outgoingCallResult
+	dp            SessionDataPlane
+	lcp           *pppFSM
+	lcpNeg        *pppLCP
+	ipcp          *pppFSM
+	ipcpNeg       *pppIPCP
+	ipv6cp        *pppFSM
+	ccp           *pppFSM
+	ccpNeg        *pppCCP
+	netCfg        SessionNetworkConfig
+	ipcpUp        bool
+	ccpActive     bool
+	ccpDone       bool
+	dpStarted     bool
+	ccpRx         pppDecompressor
+	vjRx          *vjDecompressor
+	echoTicker    *time.Ticker
+	echoTickChan  <-chan time.Time
+	authTimer     *time.Timer
+	authTimerChan <-chan time.Time
+	mppeTimer     *time.Timer
+	mppeTimerChan <-chan time.Time
+	wg            sync.WaitGroup
+	pppRxChan     chan *pppDataMessage
+	pppTimerChan  chan pppTimerExpiry
+	msgRxChan     chan controlMessage
+	eventChan     chan string
+	closeChan     chan interface{}
+	killChan      chan interface{}
+	doneChan      chan interface{}
+	fsm           fsm
+
+	// establishedLock protects established, which is read by callers
+	// sending WEN and SLI messages from outside the session goroutine.
+	establishedLock sync.Mutex
+
+	// txLock protects state used by encapsulate, which is called from
+	// the data plane.
+	txLock sync.Mutex
+	ccpTx  pppCompressor
+	txIPv6 bool
+	txACFC bool
+	txPFC  bool
+	vjTx   *vjCompressor
+}
+
+// pppTimerExpiry carries a PPP restart timer expiry to the session goroutine
+type pppTimerExpiry struct {
+	f   *pppFSM
+	seq uint
+}
+
+// outgoingCallResult carries the result of placing an outgoing call to the
+// session goroutine
+type outgoingCallResult struct {
+	cfg *SessionConfig
+	err error
 }
 
 func (ds *dynamicSession) Close() {
@@ -48,6 +113,7 @@ func (ds *dynamicSession) handleCtlMsg(msg controlMessage) {
 
 func (ds *dynamicSession) runSession() {
 	defer ds.wg.Done()
+	defer close(ds.doneChan)
 
 	level.Info(ds.logger).Log(
 		"message", "new dynamic session",
@@ -59,6 +125,22 @@ func (ds *dynamicSession) runSession() {
 		select {
 		case msg, _ := <-ds.pppRxChan:
 			ds.handlePPPMsg(msg)
+		case exp := <-ds.pppTimerChan:
+			exp.f.timeout(exp.seq)
+		case <-ds.echoTickChan:
+			ds.lcpNeg.keepalive()
+		case <-ds.authTimerChan:
+			ds.onAuthTimeout()
+		case <-ds.mppeTimerChan:
+			ds.onMPPETimeout()
+		case res := <-ds.callChan:
+			if res.err != nil {
+				ds.handleEvent("callfailed",
+					avpCDNResultCodeAdminDisconnect,
+					fmt.Sprintf("call failed: %v", res.err))
+			} else {
+				ds.handleEvent("callconnected", res.cfg)
+			}
 		case msg, ok := <-ds.msgRxChan:
 			if !ok {
 				ds.fsmActClose(nil)
@@ -97,13 +179,25 @@ func (ds *dynamicSession) handleEvent(ev string, args ...interface{}) {
 }
 
 // panics if expected arguments are not passed
-func fsmArgsToV2Msg(args []interface{}) (msg *v2ControlMessage) {
+func fsmArgsToMsg(args []interface{}) (msg controlMessage) {
+	if len(args) != 1 {
+		panic(fmt.Sprintf("unexpected argument count (wanted 1, got %v)", len(args)))
+	}
+	msg, ok := args[0].(controlMessage)
+	if !ok {
+		panic(fmt.Sprintf("first argument %T not controlMessage", args[0]))
+	}
+	return
+}
+
+// panics if expected arguments are not passed
+func fsmArgsToSessionConfig(args []interface{}) (cfg *SessionConfig) {
 	if len(args) != 1 {
 		panic(fmt.Sprintf("unexpected argument count (wanted 1, got %v)", len(args)))
 	}
-	msg, ok := args[0].(*v2ControlMessage)
+	cfg, ok := args[0].(*SessionConfig)
 	if !ok {
-		panic(fmt.Sprintf("first argument %T not *v2ControlMessage", args[0]))
+		panic(fmt.Sprintf("first argument %T not *SessionConfig", args[0]))
 	}
 	return
 }
@@ -130,7 +224,7 @@ func fsmArgsToCdnResult(args []interface{}) *resultCode {
 }
 
 func cdnResultCodeToString(rc *resultCode) string {
-	var resStr, errStr, errMsg string
+	var resStr string
 
 	switch rc.result {
 	case avpCDNResultCodeReserved:
@@ -159,6 +253,14 @@ func cdnResultCodeToString(rc *resultCode) string {
 		resStr = "no appropriate framing detected"
 	}
 
+	return resultCodeToString(rc, resStr)
+}
+
+// resultCodeToString formats a CDN or StopCCN result code given the
+// description of its result value.
+func resultCodeToString(rc *resultCode, resStr string) string {
+	var errStr, errMsg string
+
 	switch rc.errCode {
 	case avpErrorCodeNoError:
 		errStr = "no general error"
@@ -208,6 +310,16 @@ func (ds *dynamicSession) handleMsg(msg controlMessage) {
 		}
 		ds.handleV2Msg(msg)
 		return
+	case ProtocolVersion3:
+		msg, ok := msg.(*v3ControlMessage)
+		if !ok {
+			level.Error(ds.logger).Log(
+				"message", "couldn't cast L2TPv3 message as v3ControlMessage")
+			ds.fsmActClose(nil)
+			return
+		}
+		ds.handleV3Msg(msg)
+		return
 	}
 
 	level.Error(ds.logger).Log(
@@ -227,321 +339,1094 @@ func (ds *dynamicSession) handlePPPMsg(msg *pppDataMessage) {
 			"got", msg.Sid())
 		return
 	}
+	// The PPP peer of a call requested by the peer is terminated by the
+	// data plane
+	if ds.call != nil || ds.outgoingCall != nil {
+		level.Debug(ds.logger).Log(
+			"message", "discarding ppp packet for call requested by peer",
+			"protocol", msg.Protocol())
+		return
+	}
 	switch msg.Protocol() {
-	case pppProtocolIPV4:
-		ds.handleIPv4Msg(msg)
+	case pppProtocolIPV4, pppProtocolIPV6, pppProtocolVJCompressed, pppProtocolVJUncompressed:
+		// Unencrypted packets are discarded once MPPE is expected
+		if _, mppe := ds.ccpRx.(*mppeState); mppe || ds.cfg.MPPE == MPPEPolicyRequire {
+			level.Debug(ds.logger).Log(
+				"message", "discarding unencrypted packet",
+				"protocol", msg.Protocol())
+			break
+		}
+		if ds.ccpRx != nil {
+			ds.ccpRx.incompressible(msg.Protocol(), msg.payload.data)
+		}
+		ds.handleIPMsg(msg)
+		break
+	case pppProtocolCompressed:
+		ds.handleCompressedMsg(msg)
 		break
 	case pppProtocolLCP:
-		ds.handleLcpMsg(msg)
+		ds.lcp.input(msg)
 		break
 	case pppProtocolIPCP:
-		ds.handleIpcpMsg(msg)
+		ds.ipcp.input(msg)
+		break
+	case pppProtocolIPV6CP:
+		if !ds.cfg.EnableIPv6 {
+			ds.protocolReject(msg)
+			break
+		}
+		ds.ipv6cp.input(msg)
+		break
+	case pppProtocolCCP:
+		if !ds.ccpActive {
+			ds.protocolReject(msg)
+			break
+		}
+		ds.ccp.input(msg)
 		break
 	case pppProtocolPAP:
 		ds.handlePapMsg(msg)
 		break
+	case pppProtocolCHAP:
+		ds.handleChapMsg(msg)
+		break
+	default:
+		ds.protocolReject(msg)
+	}
+}
+
+// protocolReject rejects a packet of a protocol we don't support.
+// Ref: RFC1661 section 5.7
+func (ds *dynamicSession) protocolReject(msg *pppDataMessage) {
+	// Protocol-Reject may only be sent in the LCP Opened state
+	if !ds.lcp.isOpened() {
+		level.Debug(ds.logger).Log(
+			"message", "discarding packet of unsupported protocol",
+			"protocol", fmt.Sprintf("0x%04x", uint16(msg.Protocol())))
+		return
+	}
+	level.Debug(ds.logger).Log(
+		"message", "rejecting packet of unsupported protocol",
+		"protocol", fmt.Sprintf("0x%04x", uint16(msg.Protocol())))
+
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, uint16(msg.Protocol()))
+	data = append(data, msg.information()...)
+	// The rejected information is truncated to fit the peer's MRU
+	if limit := int(ds.pppPeerMRU()) - pppPayloadHeaderLen; len(data) > limit {
+		data = data[:limit]
+	}
+	ds.sendPPP(pppProtocolLCP, pppCodeProtocolReject, ds.lcp.nextIdentifier(), data)
+}
+
+// handleCompressedMsg decompresses or decrypts a CCP datagram and processes
+// the packet it carries.  Ref: RFC1962 section 2.2
+func (ds *dynamicSession) handleCompressedMsg(msg *pppDataMessage) {
+	if ds.ccpRx == nil {
+		level.Debug(ds.logger).Log(
+			"message", "discarding compressed packet, ccp not negotiated")
+		return
+	}
+	protocol, data, err := ds.ccpRx.decompress(msg.payload.data)
+	if err != nil {
+		level.Debug(ds.logger).Log(
+			"message", "failed to decompress packet",
+			"error", err)
+		if err == errCCPResync {
+			ds.sendPPP(pppProtocolCCP, pppCCPCodeResetRequest, ds.ccp.nextIdentifier(), nil)
+		}
+		// A discarded packet invalidates the VJ decompressor state
+		if ds.vjRx != nil {
+			ds.vjRx.tossPacket()
+		}
+		return
+	}
+	switch protocol {
+	case pppProtocolIPV4, pppProtocolIPV6, pppProtocolVJCompressed, pppProtocolVJUncompressed:
+		inner := &pppDataMessage{header: msg.header, payload: pppPayload{data: data}}
+		inner.header.Protocol = uint16(protocol)
+		ds.handleIPMsg(inner)
+	default:
+		level.Debug(ds.logger).Log(
+			"message", "discarding compressed packet carrying unsupported protocol",
+			"protocol", fmt.Sprintf("0x%04x", uint16(protocol)))
 	}
 }
 
-func (ds *dynamicSession) handleIPv4Msg(msg *pppDataMessage) {
+func (ds *dynamicSession) handleIPMsg(msg *pppDataMessage) {
+	packet := msg.payload.data
+	switch msg.Protocol() {
+	case pppProtocolIPV6:
+		if !ds.ipv6cp.isOpened() {
+			return
+		}
+	case pppProtocolVJCompressed, pppProtocolVJUncompressed:
+		if ds.vjRx == nil {
+			level.Debug(ds.logger).Log(
+				"message", "discarding vj packet, vj compression not negotiated",
+				"protocol", msg.Protocol())
+			return
+		}
+		var err error
+		packet, err = ds.vjRx.decompress(msg.Protocol(), packet)
+		if err != nil {
+			level.Debug(ds.logger).Log(
+				"message", "failed to decompress vj packet",
+				"protocol", msg.Protocol(),
+				"error", err)
+			return
+		}
+	}
 	if ds.dp == nil {
 		level.Debug(ds.logger).Log(
-			"message", "got ipv4 packet, session dataplane is nil")
+			"message", "got ip packet, session dataplane is nil",
+			"protocol", msg.Protocol())
 		return
 	}
-	err := ds.dp.HandleDataPacket(msg.payload.data)
+	err := ds.dp.HandleDataPacket(packet)
 	if err != nil {
 		level.Debug(ds.logger).Log(
-			"message", "failed to handle IPv4 packet",
+			"message", "failed to handle IP packet",
+			"protocol", msg.Protocol(),
 			"error", err)
 	}
 }
 
-func (ds *dynamicSession) handleLcpMsg(msg *pppDataMessage) {
-	tid := ds.parent.getCfg().PeerTunnelID
-	sid := ds.cfg.PeerSessionID
-	supportedOpts := make([]pppOption, 0)
-	rejectOpts := make([]pppOption, 0)
+// encapsulate returns the L2TP data message carrying an IP packet sent by
+// the data plane, compressing the packet's headers if VJ compression is
+// active, and compressing or encrypting the packet if CCP is active.
+// It is safe to call from any goroutine.
+func (ds *dynamicSession) encapsulate(packet []byte) ([]byte, error) {
+	if len(packet) == 0 {
+		return nil, errors.New("empty packet")
+	}
 
-	level.Debug(ds.logger).Log(
-		"message", "received lcp message",
-		"code", msg.payload.code,
-	)
+	ds.txLock.Lock()
+	defer ds.txLock.Unlock()
 
-	if msg.payload.code == pppCodeConfigureRequest {
-		supportMagicNumber := false
-		supportMRU := false
-		opts := msg.payload.getOptions()
-		for _, opt := range opts {
-			if opt.supportPap() {
-				supportedOpts = append(supportedOpts, opt)
-				continue
-			}
-			if opt.supportMagicNumber() {
-				supportedOpts = append(supportedOpts, opt)
-				supportMagicNumber = true
-				continue
-			}
-			if opt.supportMRU() {
-				supportedOpts = append(supportedOpts, opt)
-				supportMRU = true
-				continue
-			}
-			rejectOpts = append(rejectOpts, opt)
+	var protocol pppProtocolType
+	switch packet[0] >> 4 {
+	case 4:
+		protocol = pppProtocolIPV4
+	case 6:
+		if !ds.txIPv6 {
+			return nil, errors.New("IPv6 not negotiated")
 		}
+		protocol = pppProtocolIPV6
+	default:
+		return nil, fmt.Errorf("unrecognised IP version %d", packet[0]>>4)
+	}
 
-		res := newPPPResponse(tid, sid, msg)
-		if len(rejectOpts) > 0 {
-			res.payload.code = pppCodeConfigureReject
-			res.payload.setData(encodePPPOptions(rejectOpts))
-			ds.dt.xport.sendMessage1(res, false)
-		} else if len(supportedOpts) > 0 {
-			res.payload.code = pppCodeConfigureAck
-			res.payload.setData(encodePPPOptions(supportedOpts))
-			ds.dt.xport.sendMessage1(res, false)
-
-			// start lcp request
-			// TODO support retry
-			lcpReq := newLcpRequest(tid, sid, supportMRU, supportMagicNumber)
-			ds.dt.xport.sendMessage1(lcpReq, false)
-		}
-	} else if msg.payload.code == pppCodeConfigureAck {
-		req := newPapRequest(tid, sid, ds.cfg.PeerId, ds.cfg.Password)
-		ds.dt.xport.sendMessage1(req, false)
-	} else if msg.payload.code == pppCodeEchoRequest {
-		res := newEchoReply(tid, sid, msg)
-		ds.dt.xport.sendMessage1(res, false)
-		ds.parent.handleUserEvent(&SessionEchoEvent{
-			TunnelName:    ds.parent.getName(),
-			Tunnel:        ds.parent,
-			TunnelConfig:  ds.parent.getCfg(),
-			SessionName:   ds.getName(),
-			Session:       ds,
-			SessionConfig: ds.cfg,
-		})
-	} else if msg.payload.code == pppCodeTerminateRequest {
-		res := newTerminateReply(tid, sid, msg)
-		ds.dt.xport.sendMessage1(res, false)
-		// session closed, notify
-		ds.handleEvent("close", avpCDNResultCodeAdminDisconnect)
+	if protocol == pppProtocolIPV4 && ds.vjTx != nil {
+		protocol, packet = ds.vjTx.compress(packet)
 	}
+	if ds.ccpTx != nil {
+		protocol, packet = ds.ccpTx.compress(protocol, packet)
+	} else if ds.cfg.MPPE == MPPEPolicyRequire {
+		return nil, errors.New("MPPE required but not active")
+	}
+
+	header := NewPPPDataHeader(ds.parent.getCfg().PeerTunnelID, ds.cfg.PeerSessionID, uint16(protocol))
+	header.ACFC = ds.txACFC
+	header.PFC = ds.txPFC
+	return append(header.ToBytes(), packet...), nil
 }
 
-func (ds *dynamicSession) handleIpcpMsg(msg *pppDataMessage) {
-	tid := ds.parent.getCfg().PeerTunnelID
-	sid := ds.cfg.PeerSessionID
+// setVJCompression sets the VJ header compression state negotiated by IPCP
+// for each direction, which is nil if compression isn't in use.
+func (ds *dynamicSession) setVJCompression(tx *vjCompressor, rx *vjDecompressor) {
+	ds.txLock.Lock()
+	ds.vjTx = tx
+	ds.txLock.Unlock()
+	ds.vjRx = rx
+}
 
-	level.Debug(ds.logger).Log(
-		"message", "received ipcp message",
-		"code", msg.payload.code,
-	)
+// setHeaderCompression sets whether the header compression options
+// negotiated by LCP are applied to data messages sent to the peer.
+func (ds *dynamicSession) setHeaderCompression(acfc, pfc bool) {
+	ds.txLock.Lock()
+	defer ds.txLock.Unlock()
+	ds.txACFC = acfc
+	ds.txPFC = pfc
+}
 
-	if msg.payload.code == pppCodeConfigureRequest {
-		opts := msg.payload.getOptions()
-		// accept all options
-		res := newPPPResponse(tid, sid, msg)
-		res.payload.code = pppCodeConfigureAck
-		res.payload.setData(encodePPPOptions(opts))
-		ds.dt.xport.sendMessage1(res, false)
-	} else if msg.payload.code == pppCodeConfigureNak {
-		opts := msg.payload.getOptions()
-		ip := []byte{0, 0, 0, 0}
-		foundIp := false
-		for _, opt := range opts {
-			if opt.type_ == pppIPCPOptionIPAddress {
-				ip = opt.value
-				foundIp = true
-				break
-			}
-		}
-		req := newIpcpRequest(tid, sid, ip)
-		ds.dt.xport.sendMessage1(req, false)
-		if foundIp {
-			ds.dp.Start(ip)
-		}
+// sendPPP implements pppLink, transmitting a PPP control packet to the peer
+func (ds *dynamicSession) sendPPP(protocol pppProtocolType, code, identifier byte, data []byte) {
+	msg := newPPPPacket(ds.parent.getCfg().PeerTunnelID, ds.cfg.PeerSessionID,
+		protocol, code, identifier, data)
+	ds.dt.xport.sendMessage1(msg, false)
+}
+
+// pppPeerMRU implements pppLink, returning the MRU negotiated by LCP
+func (ds *dynamicSession) pppPeerMRU() uint16 {
+	return ds.lcpNeg.peerMRU
+}
+
+// pppTimeout implements pppLink.  It is called from the timer goroutine,
+// and hands the expiry over to the session goroutine for processing.
+func (ds *dynamicSession) pppTimeout(f *pppFSM, seq uint) {
+	select {
+	case ds.pppTimerChan <- pppTimerExpiry{f: f, seq: seq}:
+	case <-ds.doneChan:
 	}
 }
 
-func (ds *dynamicSession) handlePapMsg(msg *pppDataMessage) {
-	tid := ds.parent.getCfg().PeerTunnelID
-	sid := ds.cfg.PeerSessionID
+// startEcho starts transmission of LCP echo requests, if configured
+func (ds *dynamicSession) startEcho() {
+	ds.stopEcho()
+	if ds.cfg.LcpEchoInterval > 0 {
+		ds.echoTicker = time.NewTicker(ds.cfg.LcpEchoInterval)
+		ds.echoTickChan = ds.echoTicker.C
+	}
+}
 
-	level.Debug(ds.logger).Log(
-		"message", "received pap message",
-		"code", msg.payload.code,
-	)
-	if msg.payload.code == pppCodeConfigureAck {
-		// auth success
-		req := newIpcpRequest(tid, sid, nil)
-		ds.dt.xport.sendMessage1(req, false)
-	} else if msg.payload.code == pppCodeConfigureAck {
-		// close session
-		ds.handleEvent("close", avpStopCCNResultCodeChannelNotAuthorized)
+func (ds *dynamicSession) stopEcho() {
+	if ds.echoTicker != nil {
+		ds.echoTicker.Stop()
+		ds.echoTicker = nil
+		ds.echoTickChan = nil
 	}
 }
 
-func (ds *dynamicSession) closeLcp() {
-	tid := ds.parent.getCfg().PeerTunnelID
-	sid := ds.cfg.PeerSessionID
-	req := newTerminateRequest(tid, sid)
-	ds.dt.xport.sendMessage1(req, false)
+// onIPCPUp records the configuration negotiated by IPCP
+func (ds *dynamicSession) onIPCPUp(nc *SessionNetworkConfig) {
+	level.Info(ds.logger).Log(
+		"message", "ipcp negotiation complete",
+		"address", nc.Address,
+		"primary_dns", nc.PrimaryDNS,
+		"secondary_dns", nc.SecondaryDNS)
+	ds.netCfg.Address = nc.Address
+	ds.netCfg.PrimaryDNS = nc.PrimaryDNS
+	ds.netCfg.SecondaryDNS = nc.SecondaryDNS
+	ds.netCfg.PrimaryNBNS = nc.PrimaryNBNS
+	ds.netCfg.SecondaryNBNS = nc.SecondaryNBNS
+	ds.ipcpUp = true
+	ds.startDataPlane()
 }
 
-func (ds *dynamicSession) handleV2Msg(msg *v2ControlMessage) {
+// onIPCPDown stops the data plane until IPCP is renegotiated
+func (ds *dynamicSession) onIPCPDown() {
+	ds.ipcpUp = false
+	ds.stopDataPlane()
+}
 
-	// It's possible to have a message mis-delivered on our control
-	// socket.  Ignore these messages: ideally we'd redirect them
-	// but dropping them is a good compromise for now.
-	if msg.Sid() != uint16(ds.cfg.SessionID) {
-		level.Error(ds.logger).Log(
-			"message", "received control message with the wrong SID",
-			"expected", ds.cfg.SessionID,
-			"got", msg.Sid())
+// onLCPDown resets the state of the network and compression control
+// protocols so that the data plane starts again once they are
+// renegotiated.
+func (ds *dynamicSession) onLCPDown() {
+	ds.ipcpUp = false
+	ds.ccpDone = false
+	ds.netCfg.IPv6InterfaceID = nil
+	ds.stopMPPETimer()
+	ds.stopDataPlane()
+}
+
+// onIPV6CPUp records the interface identifier negotiated by IPV6CP.  The
+// data plane doesn't wait for IPV6CP, so if IPv4 is already running the
+// data plane is restarted to add IPv6.
+func (ds *dynamicSession) onIPV6CPUp(id []byte) {
+	level.Info(ds.logger).Log(
+		"message", "ipv6cp negotiation complete",
+		"link_local", interfaceIDToLinkLocal(id))
+	ds.netCfg.IPv6InterfaceID = id
+	ds.startDataPlane()
+}
+
+// onIPV6CPDown removes IPv6 from the data plane until IPV6CP is
+// renegotiated.
+func (ds *dynamicSession) onIPV6CPDown() {
+	if ds.netCfg.IPv6InterfaceID == nil {
 		return
 	}
+	ds.netCfg.IPv6InterfaceID = nil
+	ds.startDataPlane()
+}
 
-	// Validate the message.  If validation fails drive shutdown via.
-	// the FSM to allow the error to be communicated to the peer.
-	err := msg.validate()
-	if err != nil {
-		level.Error(ds.logger).Log(
-			"message", "bad control message",
-			"message_type", msg.getType(),
-			"error", err)
-		ds.handleEvent("close",
-			avpCDNResultCodeGeneralError,
-			avpErrorCodeBadValue,
-			fmt.Sprintf("bad %v message: %v", msg.getType(), err))
-	}
+// onIPV6CPFinished leaves the data plane running IPv4 only if IPV6CP
+// negotiation fails.
+func (ds *dynamicSession) onIPV6CPFinished(reason string) {
+	level.Info(ds.logger).Log(
+		"message", "ipv6cp negotiation finished",
+		"reason", reason)
+}
 
-	// Map the message to the appropriate event type.  If we haven't got
-	// an event appropriate to the incoming message close the tunnel.
-	eventMap := []struct {
-		m avpMsgType
-		e string
-	}{
-		{avpMsgTypeIcrq, "icrq"},
-		{avpMsgTypeIcrp, "icrp"},
-		{avpMsgTypeIccn, "iccn"},
-		{avpMsgTypeCdn, "cdn"},
+// onCCPUp enables the compression or encryption negotiated by CCP in each
+// direction, which is nil if CCP negotiated nothing for that direction.
+func (ds *dynamicSession) onCCPUp(tx pppCompressor, rx pppDecompressor) {
+	_, mppeTx := tx.(*mppeState)
+	_, mppeRx := rx.(*mppeState)
+	if ds.cfg.MPPE == MPPEPolicyRequire && (!mppeTx || !mppeRx) {
+		ds.onPPPFinished("CCP", "MPPE not negotiated in both directions")
+		return
 	}
+	level.Info(ds.logger).Log(
+		"message", "ccp negotiation complete",
+		"tx", ccpAlgorithmName(tx),
+		"rx", ccpAlgorithmName(rx))
+	ds.txLock.Lock()
+	ds.ccpTx = tx
+	ds.txLock.Unlock()
+	ds.ccpRx = rx
+	ds.ccpDone = true
+	ds.stopMPPETimer()
+	ds.startDataPlane()
+}
 
-	for _, em := range eventMap {
-		if msg.getType() == em.m {
-			ds.handleEvent(em.e, msg)
-			return
-		}
+// onCCPDown removes compression and encryption from the data plane until
+// CCP is renegotiated.  If MPPE is required the data plane is stopped
+// rather than passing unencrypted traffic.
+func (ds *dynamicSession) onCCPDown() {
+	ds.txLock.Lock()
+	ds.ccpTx = nil
+	ds.txLock.Unlock()
+	ds.ccpRx = nil
+	ds.ccpDone = false
+	if ds.cfg.MPPE == MPPEPolicyRequire {
+		ds.stopDataPlane()
+		return
 	}
+	ds.startDataPlane()
+}
 
-	level.Error(ds.logger).Log(
-		"message", "unhandled v2 control message",
-		"message_type", msg.getType())
+// onCCPFinished leaves the data plane running without compression or
+// encryption if CCP negotiation fails, unless MPPE is required.
+func (ds *dynamicSession) onCCPFinished(reason string) {
+	if ds.cfg.MPPE == MPPEPolicyRequire {
+		ds.onPPPFinished("CCP", reason)
+		return
+	}
+	level.Info(ds.logger).Log(
+		"message", "ccp negotiation finished",
+		"reason", reason)
+}
 
-	ds.handleEvent("close",
-		avpCDNResultCodeGeneralError,
-		avpErrorCodeBadValue,
-		fmt.Sprintf("unhandled v2 control message %v", msg.getType()))
+// startMPPETimer limits the time the peer may take to negotiate MPPE when
+// it is required
+func (ds *dynamicSession) startMPPETimer() {
+	ds.stopMPPETimer()
+	ds.mppeTimer = time.NewTimer(pppMPPETimeout)
+	ds.mppeTimerChan = ds.mppeTimer.C
 }
 
-func (ds *dynamicSession) sendMessage(msg controlMessage) {
-	err := ds.dt.sendMessage(msg)
-	if err != nil {
-		level.Error(ds.logger).Log(
-			"message", "failed to send control message",
-			"message_type", msg.getType(),
-			"error", err)
-		ds.fsmActClose(nil)
+func (ds *dynamicSession) stopMPPETimer() {
+	if ds.mppeTimer != nil {
+		ds.mppeTimer.Stop()
+		ds.mppeTimer = nil
+		ds.mppeTimerChan = nil
 	}
 }
 
-func (ds *dynamicSession) fsmActSendIcrq(args []interface{}) {
-	err := ds.sendIcrq()
-	if err != nil {
-		level.Error(ds.logger).Log(
-			"message", "failed to send ICRQ message",
-			"error", err)
-		ds.fsmActClose(nil)
+// onMPPETimeout closes the session if the peer doesn't negotiate the MPPE
+// encryption we require in time
+func (ds *dynamicSession) onMPPETimeout() {
+	ds.stopMPPETimer()
+	if ds.ccpDone {
+		return
 	}
+	ds.onPPPFinished("CCP", "peer did not negotiate required MPPE encryption")
 }
 
-func (ds *dynamicSession) sendIcrq() (err error) {
-	msg, err := newV2Icrq(ds.callSerial, ds.parent.getCfg().PeerTunnelID, ds.cfg)
-	if err != nil {
-		return err
+// resetCompressor resets the compressor in response to the peer's
+// Reset-Request.
+func (ds *dynamicSession) resetCompressor() {
+	ds.txLock.Lock()
+	defer ds.txLock.Unlock()
+	if ds.ccpTx != nil {
+		ds.ccpTx.reset()
 	}
-	ds.sendMessage(msg)
-	return
 }
 
-func (ds *dynamicSession) fsmActOnIcrp(args []interface{}) {
-	msg := fsmArgsToV2Msg(args)
+// resetDecompressor resets the decompressor once the peer acknowledges
+// our Reset-Request.
+func (ds *dynamicSession) resetDecompressor() {
+	if ds.ccpRx != nil {
+		ds.ccpRx.reset()
+	}
+}
 
-	psid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeSessionID)
-	if err != nil {
-		// Shouldn't occur since session ID is mandatory
-		level.Error(ds.logger).Log(
-			"message", "failed to parse peer session ID from ICRP",
-			"error", err)
-		ds.handleEvent("close",
-			avpCDNResultCodeGeneralError,
-			avpErrorCodeBadValue,
-			"no Assigned Session ID AVP in ICRP message")
+// startDataPlane starts the data plane once IPCP is up, and once MPPE is
+// negotiated if it is required.  IPv6, compression and optional encryption
+// are added as IPV6CP and CCP come up, so a data plane which is already
+// running is restarted with the current configuration.
+func (ds *dynamicSession) startDataPlane() {
+	if !ds.ipcpUp {
 		return
 	}
-
-	ds.cfg.PeerSessionID = ControlConnID(psid)
-
-	err = ds.sendIccn()
-	if err != nil {
-		level.Error(ds.logger).Log(
-			"message", "failed to send ICCN",
-			"error", err)
-		// TODO: CDN args
-		ds.fsmActClose(nil)
+	if ds.cfg.MPPE == MPPEPolicyRequire && !ds.ccpDone {
 		return
 	}
-
-	level.Info(ds.logger).Log("message", "control plane established")
-
-	// establish the data plane
-	ds.dp, err = ds.parent.getDP().NewSession(
-		ds.parent.getCfg().TunnelID,
-		ds.parent.getCfg().PeerTunnelID,
-		ds.cfg)
+	ds.stopDataPlane()
+	ds.dpStarted = true
+	if ds.dp == nil {
+		return
+	}
+	_, ipv6Tunnel := ds.dt.sap.(*unix.SockaddrInet6)
+	nc := ds.netCfg
+	nc.MTU = pppMTU(ds.lcpNeg.mru, ds.lcpNeg.peerMRU, ipv6Tunnel)
+	ds.txLock.Lock()
+	if ds.ccpTx != nil {
+		nc.MTU -= ds.ccpTx.overhead()
+	}
+	ds.txIPv6 = nc.IPv6InterfaceID != nil
+	ds.txLock.Unlock()
+	nc.Encapsulate = ds.encapsulate
+	err := ds.dp.Start(&nc)
 	if err != nil {
 		level.Error(ds.logger).Log(
-			"message", "failed to establish data plane",
+			"message", "failed to start data plane",
 			"error", err)
-		// TODO: CDN args
-		ds.fsmActClose(nil)
-		return
 	}
+}
 
-	ds.ifname, err = ds.dp.GetInterfaceName()
+// stopDataPlane stops the data plane if it was started
+func (ds *dynamicSession) stopDataPlane() {
+	if !ds.dpStarted {
+		return
+	}
+	ds.dpStarted = false
+	if ds.dp == nil {
+		return
+	}
+	err := ds.dp.Stop()
 	if err != nil {
 		level.Error(ds.logger).Log(
-			"message", "failed to retrieve session interface name",
+			"message", "failed to stop data plane",
 			"error", err)
-		// TODO: CDN args
-		ds.fsmActClose(nil)
 	}
+}
 
-	level.Info(ds.logger).Log("message", "data plane established")
-
-	ds.established = true
-	ds.parent.handleUserEvent(&SessionUpEvent{
-		TunnelName:    ds.parent.getName(),
-		Tunnel:        ds.parent,
-		TunnelConfig:  ds.parent.getCfg(),
+// onPPPFinished closes the session when negotiation of a PPP protocol
+// terminates while the session is established.
+func (ds *dynamicSession) onPPPFinished(protocol, reason string) {
+	if !ds.established {
+		return
+	}
+	level.Error(ds.logger).Log(
+		"message", "ppp negotiation finished",
+		"protocol", protocol,
+		"reason", reason)
+	ds.handleEvent("close",
+		avpCDNResultCodeGeneralError,
+		avpErrorCodeNoError,
+		fmt.Sprintf("%s negotiation failed: %s", protocol, reason))
+}
+
+// startAuth authenticates with the peer using the protocol it requested
+// during LCP negotiation.  IPCP is started once authentication succeeds.
+func (ds *dynamicSession) startAuth() {
+	tid := ds.parent.getCfg().PeerTunnelID
+	sid := ds.cfg.PeerSessionID
+
+	ds.authenticated = false
+	ds.authPending = false
+	ds.stopAuthTimer()
+
+	switch ds.authProtocol {
+	case pppProtocolPAP:
+		ds.authID++
+		ds.authPending = true
+		req := newPapRequest(tid, sid, ds.authID, ds.cfg.PeerId, ds.cfg.Password)
+		ds.dt.xport.sendMessage1(req, false)
+		ds.startAuthTimer()
+	case pppProtocolCHAP:
+		// The authenticator drives CHAP: wait for its challenge
+		ds.startAuthTimer()
+	default:
+		ds.onAuthSuccess()
+	}
+}
+
+// startAuthTimer limits the time the peer may take to authenticate us
+func (ds *dynamicSession) startAuthTimer() {
+	ds.stopAuthTimer()
+	ds.authTimer = time.NewTimer(pppAuthTimeout)
+	ds.authTimerChan = ds.authTimer.C
+}
+
+func (ds *dynamicSession) stopAuthTimer() {
+	if ds.authTimer != nil {
+		ds.authTimer.Stop()
+		ds.authTimer = nil
+		ds.authTimerChan = nil
+	}
+}
+
+// onAuthTimeout closes the session if the peer doesn't authenticate us in
+// time
+func (ds *dynamicSession) onAuthTimeout() {
+	ds.onAuthFailure(ds.authProtocolName(), "timed out waiting for the peer")
+}
+
+// authProtocolName returns the name of the authentication protocol
+// negotiated by LCP, for logging
+func (ds *dynamicSession) authProtocolName() string {
+	switch {
+	case ds.authProtocol == pppProtocolPAP:
+		return "PAP"
+	case ds.chapAlgorithm == pppCHAPAlgorithmMSCHAPv2:
+		return "MS-CHAPv2"
+	}
+	return "CHAP"
+}
+
+func (ds *dynamicSession) onAuthSuccess() {
+	if ds.authenticated {
+		return
+	}
+	ds.authenticated = true
+	ds.authPending = false
+	ds.stopAuthTimer()
+	mppe := ds.cfg.MPPE != MPPEPolicyRefuse && ds.mppeMasterKey != nil
+	if !mppe && ds.cfg.MPPE == MPPEPolicyRequire {
+		level.Error(ds.logger).Log(
+			"message", "mppe required but not available",
+			"reason", "MPPE requires MS-CHAPv2 authentication")
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeNoError,
+			"MPPE required but not available")
+		return
+	}
+	if mppe || ds.cfg.Deflate {
+		// CCP runs alongside the network control protocols.  The data
+		// plane only waits for it if MPPE is required, and then for a
+		// limited time.  Ref: RFC3078 section 1
+		ds.ccpNeg.configure(mppe, ds.cfg.Deflate)
+		ds.ccpActive = true
+		ds.ccpDone = false
+		if ds.cfg.MPPE == MPPEPolicyRequire {
+			ds.startMPPETimer()
+		}
+		ds.ccp.open()
+		ds.ccp.up()
+	}
+	ds.ipcp.open()
+	ds.ipcp.up()
+	if ds.cfg.EnableIPv6 {
+		ds.ipv6cp.open()
+		ds.ipv6cp.up()
+	}
+}
+
+func (ds *dynamicSession) onAuthFailure(protocol, reason string) {
+	ds.authPending = false
+	ds.stopAuthTimer()
+	level.Error(ds.logger).Log(
+		"message", "authentication failed",
+		"protocol", protocol,
+		"reason", reason)
+	ds.handleEvent("close",
+		avpCDNResultCodeGeneralError,
+		avpErrorCodeNoError,
+		fmt.Sprintf("%s authentication failed: %s", protocol, reason))
+}
+
+func (ds *dynamicSession) handlePapMsg(msg *pppDataMessage) {
+	level.Debug(ds.logger).Log(
+		"message", "received pap message",
+		"code", msg.payload.code,
+	)
+	if !ds.authPending || msg.payload.identifier != ds.authID {
+		level.Debug(ds.logger).Log(
+			"message", "discarding pap response with mismatched identifier",
+			"identifier", msg.payload.identifier,
+			"expected", ds.authID)
+		return
+	}
+	if msg.payload.code == pppCodeConfigureAck {
+		ds.onAuthSuccess()
+	} else if msg.payload.code == pppCodeConfigureNak {
+		// Authenticate-Nak carries a length-prefixed message
+		reason := "authentication rejected by peer"
+		if b := msg.payload.data; len(b) > 1 && int(b[0]) <= len(b)-1 && b[0] > 0 {
+			reason = string(b[1 : 1+int(b[0])])
+		}
+		ds.onAuthFailure("PAP", reason)
+	}
+}
+
+func (ds *dynamicSession) handleChapMsg(msg *pppDataMessage) {
+	tid := ds.parent.getCfg().PeerTunnelID
+	sid := ds.cfg.PeerSessionID
+
+	level.Debug(ds.logger).Log(
+		"message", "received chap message",
+		"code", msg.payload.code,
+	)
+
+	if ds.authProtocol != pppProtocolCHAP {
+		level.Debug(ds.logger).Log(
+			"message", "ignoring chap message: chap was not negotiated")
+		return
+	}
+
+	switch msg.payload.code {
+	case pppCHAPCodeChallenge:
+		challenge, name, err := parseChapChallenge(msg.payload.data)
+		if err != nil {
+			level.Error(ds.logger).Log(
+				"message", "bad chap challenge",
+				"error", err)
+			return
+		}
+		level.Debug(ds.logger).Log(
+			"message", "answering chap challenge",
+			"authenticator", name,
+			"algorithm", ds.chapAlgorithm)
+
+		var value []byte
+		if ds.chapAlgorithm == pppCHAPAlgorithmMSCHAPv2 {
+			peerChallenge := make([]byte, mschapv2ChallengeLen)
+			_, err = rand.Read(peerChallenge)
+			if err == nil {
+				ds.mschapv2, err = newMschapv2Response(challenge, peerChallenge, ds.cfg.PeerId, ds.cfg.Password)
+			}
+			if err != nil {
+				level.Error(ds.logger).Log(
+					"message", "failed to compute ms-chapv2 response",
+					"error", err)
+				return
+			}
+			value = ds.mschapv2.value
+		} else {
+			value = chapMD5Response(msg.payload.identifier, ds.cfg.Password, challenge)
+		}
+		res := newChapResponse(tid, sid, msg.payload.identifier, value, ds.cfg.PeerId)
+		ds.dt.xport.sendMessage1(res, false)
+		ds.authID = msg.payload.identifier
+		ds.authPending = true
+	case pppCHAPCodeSuccess, pppCHAPCodeFailure:
+		// The result must answer our outstanding response.
+		// Ref: RFC1994 section 4.2
+		if !ds.authPending || msg.payload.identifier != ds.authID {
+			level.Debug(ds.logger).Log(
+				"message", "discarding chap result with no matching response",
+				"code", msg.payload.code,
+				"identifier", msg.payload.identifier,
+				"expected", ds.authID)
+			return
+		}
+		ds.authPending = false
+		if msg.payload.code == pppCHAPCodeFailure {
+			ds.onChapFailure(msg)
+			return
+		}
+		if ds.chapAlgorithm == pppCHAPAlgorithmMSCHAPv2 {
+			if ds.mschapv2 == nil {
+				ds.onAuthFailure("MS-CHAPv2", "success received before any challenge")
+				return
+			}
+			err := ds.mschapv2.verifySuccess(string(msg.payload.data))
+			if err != nil {
+				ds.onAuthFailure("MS-CHAPv2", err.Error())
+				return
+			}
+			ds.mppeMasterKey = ds.mschapv2.masterKey
+		}
+		ds.onAuthSuccess()
+	}
+}
+
+func (ds *dynamicSession) onChapFailure(msg *pppDataMessage) {
+	if ds.chapAlgorithm == pppCHAPAlgorithmMSCHAPv2 {
+		ds.onAuthFailure("MS-CHAPv2", parseMschapv2Failure(string(msg.payload.data)))
+		return
+	}
+	reason := string(msg.payload.data)
+	if reason == "" {
+		reason = "authentication rejected by peer"
+	}
+	ds.onAuthFailure("CHAP", reason)
+}
+
+func (ds *dynamicSession) handleV2Msg(msg *v2ControlMessage) {
+
+	// It's possible to have a message mis-delivered on our control
+	// socket.  Ignore these messages: ideally we'd redirect them
+	// but dropping them is a good compromise for now.
+	if msg.Sid() != uint16(ds.cfg.SessionID) {
+		level.Error(ds.logger).Log(
+			"message", "received control message with the wrong SID",
+			"expected", ds.cfg.SessionID,
+			"got", msg.Sid())
+		return
+	}
+
+	ds.dispatchMsg(msg)
+}
+
+func (ds *dynamicSession) handleV3Msg(msg *v3ControlMessage) {
+
+	// Session messages are routed by the Remote Session ID AVP, which
+	// carries our session ID, c.f. handleV2Msg
+	if sid := msgSessionID(msg); sid != ds.cfg.SessionID {
+		level.Error(ds.logger).Log(
+			"message", "received control message with the wrong SID",
+			"expected", ds.cfg.SessionID,
+			"got", sid)
+		return
+	}
+
+	ds.dispatchMsg(msg)
+}
+
+// dispatchMsg validates a control message and passes it to the FSM
+func (ds *dynamicSession) dispatchMsg(msg controlMessage) {
+
+	// Validate the message.  If validation fails drive shutdown via.
+	// the FSM to allow the error to be communicated to the peer.
+	err := msg.validate()
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "bad control message",
+			"message_type", msg.getType(),
+			"error", err)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeBadValue,
+			fmt.Sprintf("bad %v message: %v", msg.getType(), err))
+		return
+	}
+
+	// Map the message to the appropriate event type.  If we haven't got
+	// an event appropriate to the incoming message close the tunnel.
+	eventMap := []struct {
+		m avpMsgType
+		e string
+	}{
+		{avpMsgTypeIcrq, "icrq"},
+		{avpMsgTypeIcrp, "icrp"},
+		{avpMsgTypeIccn, "iccn"},
+		{avpMsgTypeOcrq, "ocrq"},
+		{avpMsgTypeOcrp, "ocrp"},
+		{avpMsgTypeOccn, "occn"},
+		{avpMsgTypeCdn, "cdn"},
+		{avpMsgTypeWen, "wen"},
+		{avpMsgTypeSli, "sli"},
+	}
+
+	for _, em := range eventMap {
+		if msg.getType() == em.m {
+			ds.handleEvent(em.e, msg)
+			return
+		}
+	}
+
+	level.Error(ds.logger).Log(
+		"message", "unhandled control message",
+		"message_type", msg.getType())
+
+	ds.handleEvent("close",
+		avpCDNResultCodeGeneralError,
+		avpErrorCodeBadValue,
+		fmt.Sprintf("unhandled control message %v", msg.getType()))
+}
+
+func (ds *dynamicSession) sendMessage(msg controlMessage) {
+	err := ds.dt.sendMessage(msg)
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to send control message",
+			"message_type", msg.getType(),
+			"error", err)
+		ds.fsmActClose(nil)
+	}
+}
+
+func (ds *dynamicSession) fsmActSendIcrq(args []interface{}) {
+	err := ds.sendIcrq()
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to send ICRQ message",
+			"error", err)
+		ds.fsmActClose(nil)
+	}
+}
+
+func (ds *dynamicSession) sendIcrq() (err error) {
+	var msg controlMessage
+	if ds.parent.getCfg().Version == ProtocolVersion3 {
+		msg, err = newV3Icrq(ds.callSerial, ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	} else {
+		msg, err = newV2Icrq(ds.callSerial, ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	}
+	if err != nil {
+		return err
+	}
+	ds.sendMessage(msg)
+	return
+}
+
+func (ds *dynamicSession) fsmActOnIcrp(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	psid, err := findPeerSessionID(msg)
+	if err != nil {
+		// Shouldn't occur since session ID is mandatory
+		level.Error(ds.logger).Log(
+			"message", "failed to parse peer session ID from ICRP",
+			"error", err)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeBadValue,
+			"no Assigned Session ID AVP in ICRP message")
+		return
+	}
+
+	ds.cfg.PeerSessionID = psid
+	applyV3SessionAvps(ds.cfg, msg)
+
+	err = ds.sendIccn()
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to send ICCN",
+			"error", err)
+		// TODO: CDN args
+		ds.fsmActClose(nil)
+		return
+	}
+
+	if ds.establish() {
+		ds.startPPP()
+	}
+}
+
+// startPPP starts userspace PPP negotiation for a call placed by the session.
+func (ds *dynamicSession) startPPP() {
+	// Userspace PPP negotiation is not required for PPPoE access
+	// concentrator sessions, where the PPP peer is the PPPoE client,
+	// nor for L2TPv3 pseudowires which don't carry PPP.
+	if ds.parent.getCfg().Version == ProtocolVersion2 && ds.cfg.Pseudowire != PseudowireTypePPPAC {
+		ds.lcp.open()
+		ds.lcp.up()
+	}
+}
+
+// applyV3SessionAvps adopts the data plane parameters the peer advertises
+// in an L2TPv3 ICRQ or ICRP.  It has no effect for L2TPv2 messages.
+// Ref: RFC3931 sections 5.4.4, 5.4.5
+func applyV3SessionAvps(scfg *SessionConfig, msg controlMessage) {
+	if msg.protocolVersion() != ProtocolVersion3 {
+		return
+	}
+	avps := msg.getAvps()
+	if cookie, err := findBytesAvp(avps, vendorIDIetf, avpTypeAssignedCookie); err == nil {
+		scfg.PeerCookie = cookie
+	}
+	if l2spec, err := findUint16Avp(avps, vendorIDIetf, avpTypeL2specificSublayer); err == nil {
+		scfg.L2SpecType = L2SpecType(l2spec)
+	}
+	if seq, err := findUint16Avp(avps, vendorIDIetf, avpTypeDataSequencing); err == nil && seq != v3DataSequencingNone {
+		scfg.SeqNum = true
+	}
+}
+
+// establish brings up the data plane once the session three-way handshake
+// is complete, and informs the user that the session is up.  It returns
+// false if the session is closed.
+func (ds *dynamicSession) establish() bool {
+	level.Info(ds.logger).Log("message", "control plane established")
+
+	// establish the data plane
+	var err error
+	ds.dp, err = ds.parent.getDP().NewSession(
+		ds.parent.getCfg().TunnelID,
+		ds.parent.getCfg().PeerTunnelID,
+		ds.cfg)
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to establish data plane",
+			"error", err)
+		// TODO: CDN args
+		ds.fsmActClose(nil)
+		return false
+	}
+
+	ds.ifname, err = ds.dp.GetInterfaceName()
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to retrieve session interface name",
+			"error", err)
+		// TODO: CDN args
+		ds.fsmActClose(nil)
+		return false
+	}
+
+	level.Info(ds.logger).Log("message", "data plane established")
+
+	ds.setEstablished(true)
+	ds.parent.handleUserEvent(&SessionUpEvent{
+		TunnelName:    ds.parent.getName(),
+		Tunnel:        ds.parent,
+		TunnelConfig:  ds.parent.getCfg(),
 		SessionName:   ds.getName(),
 		Session:       ds,
 		SessionConfig: ds.cfg,
 		InterfaceName: ds.ifname,
 	})
+	return true
+}
+
+// fsmActOnIcrq answers the ICRQ for an incoming call if the user's
+// IncomingCallHandler accepts the call.
+func (ds *dynamicSession) fsmActOnIcrq(args []interface{}) {
+	ds.call = newIncomingCall(ds, ds.icrq)
+
+	if ds.parent.getCfg().Version == ProtocolVersion3 && ds.call.Pseudowire != PseudowireTypeEth {
+		level.Info(ds.logger).Log(
+			"message", "rejecting incoming call",
+			"pseudowire", ds.call.Pseudowire,
+			"error", "unsupported pseudowire type")
+		ds.fsmActSendCdn([]interface{}{
+			avpCDNResultCodeNotAvailable,
+			"unsupported pseudowire type"})
+		return
+	}
+
+	cfg, err := ds.dt.listener.getIncomingCallHandler().HandleIncomingCall(ds.call)
+	if err == nil && cfg == nil {
+		err = fmt.Errorf("no session configuration")
+	}
+	if err != nil {
+		level.Info(ds.logger).Log(
+			"message", "rejecting incoming call",
+			"calling_number", ds.call.CallingNumber,
+			"called_number", ds.call.CalledNumber,
+			"error", err)
+		ds.fsmActSendCdn([]interface{}{
+			avpCDNResultCodeAdminDisconnect,
+			fmt.Sprintf("call rejected: %v", err)})
+		return
+	}
+
+	// The session IDs are assigned by the control protocol
+	myCfg := *cfg
+	myCfg.SessionID = ds.cfg.SessionID
+	myCfg.PeerSessionID = ds.cfg.PeerSessionID
+	if ds.parent.getCfg().Version == ProtocolVersion3 {
+		myCfg.Pseudowire = ds.call.Pseudowire
+		applyV3SessionAvps(&myCfg, ds.icrq)
+	}
+	*ds.cfg = myCfg
+
+	err = ds.sendIcrp()
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to send ICRP message",
+			"error", err)
+		ds.fsmActClose(nil)
+	}
+}
+
+func (ds *dynamicSession) sendIcrp() (err error) {
+	var msg controlMessage
+	if ds.parent.getCfg().Version == ProtocolVersion3 {
+		msg, err = newV3Icrp(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	} else {
+		msg, err = newV2Icrp(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	}
+	if err != nil {
+		return err
+	}
+	ds.sendMessage(msg)
+	return
+}
+
+// fsmActOnIccn establishes an incoming call once the user's
+// IncomingCallHandler accepts the proxy authentication the peer performed,
+// if any.  The PPP peer of the call is terminated by the data plane.
+func (ds *dynamicSession) fsmActOnIccn(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	ds.call.ProxyAuth = newProxyAuth(msg)
+
+	err := ds.dt.listener.getIncomingCallHandler().HandleIncomingCallConnected(ds.call)
+	if err != nil {
+		level.Info(ds.logger).Log(
+			"message", "disconnecting incoming call",
+			"error", err)
+		ds.fsmActSendCdn([]interface{}{
+			avpCDNResultCodeAdminDisconnect,
+			fmt.Sprintf("call rejected: %v", err)})
+		return
+	}
+
+	ds.establish()
+}
+
+// newIncomingCall describes the call requested by an ICRQ
+func newIncomingCall(ds *dynamicSession, msg controlMessage) *IncomingCall {
+	avps := msg.getAvps()
+	call := &IncomingCall{
+		TunnelName:   ds.parent.getName(),
+		Tunnel:       ds.parent,
+		TunnelConfig: ds.parent.getCfg(),
+		SessionName:  ds.getName(),
+		Session:      ds,
+		Pseudowire:   PseudowireTypePPP,
+	}
+	if msg.protocolVersion() == ProtocolVersion3 {
+		pw, _ := findUint16Avp(avps, vendorIDIetf, avpTypePseudowireType)
+		call.Pseudowire = PseudowireType(pw)
+		reid, _ := findBytesAvp(avps, vendorIDIetf, avpTypeRemoteEndID)
+		call.RemoteEndID = string(reid)
+	}
+	// Optional AVPs are left zero if absent
+	call.CallSerialNumber, _ = findUint32Avp(avps, vendorIDIetf, avpTypeCallSerialNumber)
+	call.BearerType, _ = findUint32Avp(avps, vendorIDIetf, avpTypeBearerType)
+	call.PhysicalChannelID, _ = findUint32Avp(avps, vendorIDIetf, avpTypePhysicalChannelID)
+	call.CallingNumber, _ = findStringAvp(avps, vendorIDIetf, avpTypeCallingNumber)
+	call.CalledNumber, _ = findStringAvp(avps, vendorIDIetf, avpTypeCalledNumber)
+	call.SubAddress, _ = findStringAvp(avps, vendorIDIetf, avpTypeSubAddress)
+	return call
+}
+
+// newProxyAuth returns the proxy authentication AVPs of an ICCN, or nil
+// if the peer didn't perform proxy authentication.
+// Ref: RFC2661 section 4.4.5
+func newProxyAuth(msg controlMessage) *ProxyAuth {
+	avps := msg.getAvps()
+	typ, err := findUint16Avp(avps, vendorIDIetf, avpTypeProxyAuthType)
+	if err != nil {
+		return nil
+	}
+	pa := &ProxyAuth{Type: typ}
+	pa.Name, _ = findStringAvp(avps, vendorIDIetf, avpTypeProxyAuthName)
+	pa.Challenge, _ = findBytesAvp(avps, vendorIDIetf, avpTypeProxyAuthChallenge)
+	pa.Response, _ = findBytesAvp(avps, vendorIDIetf, avpTypeProxyAuthResponse)
+	// The ID is carried in the low octet of a two octet field
+	if id, err := findBytesAvp(avps, vendorIDIetf, avpTypeProxyAuthID); err == nil && len(id) == 2 {
+		pa.ID = id[1]
+	}
+	return pa
 }
 
 func (ds *dynamicSession) sendIccn() (err error) {
-	msg, err := newV2Iccn(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	var msg controlMessage
+	if ds.parent.getCfg().Version == ProtocolVersion3 {
+		msg, err = newV3Iccn(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	} else {
+		msg, err = newV2Iccn(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	}
+	if err != nil {
+		return err
+	}
+	ds.sendMessage(msg)
+	return
+}
+
+func (ds *dynamicSession) fsmActSendOcrq(args []interface{}) {
+	err := ds.sendOcrq()
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to send OCRQ message",
+			"error", err)
+		ds.fsmActClose(nil)
+	}
+}
+
+func (ds *dynamicSession) sendOcrq() (err error) {
+	msg, err := newV2Ocrq(ds.callSerial, ds.parent.getCfg().PeerTunnelID, ds.cfg)
 	if err != nil {
 		return err
 	}
@@ -549,6 +1434,133 @@ func (ds *dynamicSession) sendIccn() (err error) {
 	return
 }
 
+func (ds *dynamicSession) fsmActOnOcrp(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	psid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeSessionID)
+	if err != nil {
+		// Shouldn't occur since session ID is mandatory
+		level.Error(ds.logger).Log(
+			"message", "failed to parse peer session ID from OCRP",
+			"error", err)
+		ds.handleEvent("close",
+			avpCDNResultCodeGeneralError,
+			avpErrorCodeBadValue,
+			"no Assigned Session ID AVP in OCRP message")
+		return
+	}
+
+	ds.cfg.PeerSessionID = ControlConnID(psid)
+}
+
+// fsmActOnOccn establishes an outgoing call once the peer reports that the
+// call is connected.
+func (ds *dynamicSession) fsmActOnOccn(args []interface{}) {
+	if ds.establish() {
+		ds.startPPP()
+	}
+}
+
+// fsmActOnOcrq answers the OCRQ for an outgoing call, and has the user's
+// OutgoingCallHandler place the call.
+func (ds *dynamicSession) fsmActOnOcrq(args []interface{}) {
+	ds.outgoingCall = newOutgoingCall(ds, ds.ocrq)
+
+	handler := ds.dt.parent.getOutgoingCallHandler()
+	if handler == nil {
+		level.Info(ds.logger).Log(
+			"message", "rejecting outgoing call",
+			"called_number", ds.outgoingCall.CalledNumber,
+			"error", "no outgoing call handler")
+		ds.fsmActSendCdn([]interface{}{
+			avpCDNResultCodeNotAvailable,
+			"outgoing calls are not supported"})
+		return
+	}
+
+	err := ds.sendOcrp()
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to send OCRP message",
+			"error", err)
+		ds.fsmActClose(nil)
+		return
+	}
+
+	call := ds.outgoingCall
+	go func() {
+		cfg, err := handler.PlaceOutgoingCall(call)
+		if err == nil && cfg == nil {
+			err = fmt.Errorf("no session configuration")
+		}
+		select {
+		case ds.callChan <- outgoingCallResult{cfg: cfg, err: err}:
+		case <-ds.doneChan:
+		}
+	}()
+}
+
+func (ds *dynamicSession) sendOcrp() (err error) {
+	msg, err := newV2Ocrp(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	if err != nil {
+		return err
+	}
+	return ds.dt.sendMessage(msg)
+}
+
+// fsmActOnCallConnected reports a connected outgoing call to the peer with
+// an OCCN, and establishes the session.  The PPP peer of the call is the
+// called party.
+func (ds *dynamicSession) fsmActOnCallConnected(args []interface{}) {
+	cfg := fsmArgsToSessionConfig(args)
+
+	// The session IDs are assigned by the control protocol
+	myCfg := *cfg
+	myCfg.SessionID = ds.cfg.SessionID
+	myCfg.PeerSessionID = ds.cfg.PeerSessionID
+	*ds.cfg = myCfg
+
+	err := ds.sendOccn()
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to send OCCN message",
+			"error", err)
+		ds.fsmActClose(nil)
+		return
+	}
+
+	ds.establish()
+}
+
+func (ds *dynamicSession) sendOccn() (err error) {
+	msg, err := newV2Occn(ds.parent.getCfg().PeerTunnelID, ds.cfg)
+	if err != nil {
+		return err
+	}
+	return ds.dt.sendMessage(msg)
+}
+
+// newOutgoingCall describes the call requested by an OCRQ
+func newOutgoingCall(ds *dynamicSession, msg controlMessage) *OutgoingCall {
+	avps := msg.getAvps()
+	call := &OutgoingCall{
+		TunnelName:       ds.parent.getName(),
+		Tunnel:           ds.parent,
+		TunnelConfig:     ds.parent.getCfg(),
+		SessionName:      ds.getName(),
+		Session:          ds,
+		CallSerialNumber: ds.callSerial,
+	}
+	// Optional AVPs are left zero if absent
+	call.MinimumBPS, _ = findUint32Avp(avps, vendorIDIetf, avpTypeMinimumBps)
+	call.MaximumBPS, _ = findUint32Avp(avps, vendorIDIetf, avpTypeMaximumBps)
+	call.BearerType, _ = findUint32Avp(avps, vendorIDIetf, avpTypeBearerType)
+	call.FramingType, _ = findUint32Avp(avps, vendorIDIetf, avpTypeFramingType)
+	call.CalledNumber, _ = findStringAvp(avps, vendorIDIetf, avpTypeCalledNumber)
+	call.SubAddress, _ = findStringAvp(avps, vendorIDIetf, avpTypeSubAddress)
+	return call
+}
+
 func (ds *dynamicSession) fsmActSendCdn(args []interface{}) {
 	rc := fsmArgsToCdnResult(args)
 	if ds.result == "" {
@@ -559,7 +1571,12 @@ func (ds *dynamicSession) fsmActSendCdn(args []interface{}) {
 }
 
 func (ds *dynamicSession) sendCdn(rc *resultCode) (err error) {
-	msg, err := newV2Cdn(ds.parent.getCfg().PeerTunnelID, rc, ds.cfg)
+	var msg controlMessage
+	if ds.parent.getCfg().Version == ProtocolVersion3 {
+		msg, err = newV3Cdn(ds.parent.getCfg().PeerTunnelID, rc, ds.cfg)
+	} else {
+		msg, err = newV2Cdn(ds.parent.getCfg().PeerTunnelID, rc, ds.cfg)
+	}
 	if err != nil {
 		return err
 	}
@@ -568,7 +1585,7 @@ func (ds *dynamicSession) sendCdn(rc *resultCode) (err error) {
 }
 
 func (ds *dynamicSession) fsmActOnCdn(args []interface{}) {
-	msg := fsmArgsToV2Msg(args)
+	msg := fsmArgsToMsg(args)
 
 	rc, err := findResultCodeAvp(msg.getAvps(), vendorIDIetf, avpTypeResultCode)
 	if err == nil && ds.result == "" {
@@ -578,6 +1595,106 @@ func (ds *dynamicSession) fsmActOnCdn(args []interface{}) {
 	ds.fsmActClose(args)
 }
 
+func (ds *dynamicSession) fsmActOnWen(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	ce, err := findCallErrorsAvp(msg.getAvps())
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to parse WEN message",
+			"error", err)
+		return
+	}
+
+	ds.parent.handleUserEvent(&SessionWanErrorNotifyEvent{
+		TunnelName:    ds.parent.getName(),
+		Tunnel:        ds.parent,
+		TunnelConfig:  ds.parent.getCfg(),
+		SessionName:   ds.getName(),
+		Session:       ds,
+		SessionConfig: ds.cfg,
+		Errors:        *ce,
+	})
+}
+
+func (ds *dynamicSession) fsmActOnSli(args []interface{}) {
+	msg := fsmArgsToMsg(args)
+
+	accm, err := findACCMAvp(msg.getAvps())
+	if err != nil {
+		level.Error(ds.logger).Log(
+			"message", "failed to parse SLI message",
+			"error", err)
+		return
+	}
+
+	ds.parent.handleUserEvent(&SessionSetLinkInfoEvent{
+		TunnelName:    ds.parent.getName(),
+		Tunnel:        ds.parent,
+		TunnelConfig:  ds.parent.getCfg(),
+		SessionName:   ds.getName(),
+		Session:       ds,
+		SessionConfig: ds.cfg,
+		ACCM:          *accm,
+	})
+}
+
+func (ds *dynamicSession) SendWanErrorNotify(ce *CallErrors) error {
+	return ds.sendLinkInfo(func() (controlMessage, error) {
+		return newV2Wen(ds.parent.getCfg().PeerTunnelID, ds.cfg, ce)
+	})
+}
+
+func (ds *dynamicSession) SendSetLinkInfo(accm *ACCM) error {
+	return ds.sendLinkInfo(func() (controlMessage, error) {
+		return newV2Sli(ds.parent.getCfg().PeerTunnelID, ds.cfg, accm)
+	})
+}
+
+// sendLinkInfo sends a WEN or SLI message and waits for the peer to
+// acknowledge it.  It doesn't depend on the session goroutine, so it may
+// be called from an event handler running on that goroutine.
+func (ds *dynamicSession) sendLinkInfo(build func() (controlMessage, error)) error {
+	if ds.parent.getCfg().Version != ProtocolVersion2 {
+		return fmt.Errorf("link information messages are not supported by L2TPv3")
+	}
+
+	// WEN and SLI messages are only sent for an established call
+	if !ds.isEstablished() {
+		return fmt.Errorf("session is not established")
+	}
+
+	msg, err := build()
+	if err != nil {
+		return err
+	}
+
+	// The tunnel drains its send channel while closing its sessions,
+	// but stops once they're closed: don't block on a closed session.
+	sm := &sendMsg{
+		msg:          msg,
+		completeChan: make(chan error),
+	}
+	select {
+	case ds.dt.sendChan <- sm:
+	case <-ds.doneChan:
+		return fmt.Errorf("session is closed")
+	}
+	return <-sm.completeChan
+}
+
+func (ds *dynamicSession) setEstablished(established bool) {
+	ds.establishedLock.Lock()
+	defer ds.establishedLock.Unlock()
+	ds.established = established
+}
+
+func (ds *dynamicSession) isEstablished() bool {
+	ds.establishedLock.Lock()
+	defer ds.establishedLock.Unlock()
+	return ds.established
+}
+
 func (ds *dynamicSession) fsmActClose(args []interface{}) {
 	if ds.dp != nil {
 		err := ds.dp.Down()
@@ -587,8 +1704,15 @@ func (ds *dynamicSession) fsmActClose(args []interface{}) {
 	}
 
 	if ds.established {
-		ds.closeLcp()
-		ds.established = false
+		ds.setEstablished(false)
+		ds.stopEcho()
+		ds.stopAuthTimer()
+		ds.stopMPPETimer()
+		ds.lcp.close()
+		ds.lcp.stopTimer()
+		ds.ipcp.stopTimer()
+		ds.ipv6cp.stopTimer()
+		ds.ccp.stopTimer()
 		ds.parent.handleUserEvent(&SessionDownEvent{
 			TunnelName:    ds.parent.getName(),
 			Tunnel:        ds.parent,
@@ -609,20 +1733,7 @@ func (ds *dynamicSession) fsmActClose(args []interface{}) {
 // Create a new client/LAC mode session instance
 func newDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *SessionConfig) (ds *dynamicSession, err error) {
 
-	ds = &dynamicSession{
-		baseSession: newBaseSession(
-			log.With(parent.getLogger(), "session_name", name),
-			name,
-			parent,
-			cfg),
-		callSerial: serial,
-		dt:         parent,
-		pppRxChan:  make(chan *pppDataMessage),
-		msgRxChan:  make(chan controlMessage),
-		eventChan:  make(chan string),
-		closeChan:  make(chan interface{}),
-		killChan:   make(chan interface{}),
-	}
+	ds = newDynamicSessionInstance(serial, name, parent, cfg)
 
 	// Ref: RFC2661 section 7.4.1
 	ds.fsm = fsm{
@@ -634,15 +1745,161 @@ func newDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *S
 			{from: "waitreply", events: []string{"icrp"}, cb: ds.fsmActOnIcrp, to: "established"},
 			{from: "waitreply", events: []string{"iccn"}, cb: ds.fsmActClose, to: "dead"},
 			{from: "waitreply", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
-			{from: "waitreply", events: []string{"icrq", "close"}, cb: ds.fsmActSendCdn, to: "dead"},
+			{from: "waitreply", events: []string{"icrq", "ocrq", "ocrp", "occn", "close"}, cb: ds.fsmActSendCdn, to: "dead"},
+
+			{from: "established", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+			{from: "established", events: []string{"wen"}, cb: ds.fsmActOnWen, to: "established"},
+			{from: "established", events: []string{"sli"}, cb: ds.fsmActOnSli, to: "established"},
+			{
+				from: "established",
+				events: []string{
+					"icrq",
+					"icrp",
+					"iccn",
+					"ocrq",
+					"ocrp",
+					"occn",
+					"close",
+				},
+				cb: ds.fsmActSendCdn,
+				to: "dead",
+			},
+		},
+	}
+
+	ds.wg.Add(1)
+	go ds.runSession()
+
+	return
+}
+
+// Create a new server/LNS mode session instance for an incoming call
+// requested by the peer's ICRQ
+func newDynamicLNSSession(name string, parent *dynamicTunnel, cfg *SessionConfig, icrq controlMessage) (ds *dynamicSession, err error) {
+
+	serial, _ := findUint32Avp(icrq.getAvps(), vendorIDIetf, avpTypeCallSerialNumber)
+
+	ds = newDynamicSessionInstance(serial, name, parent, cfg)
+	ds.icrq = icrq
+
+	// Ref: RFC2661 section 7.4.2
+	ds.fsm = fsm{
+		current: "idle",
+		table: []eventDesc{
+			// The session is created on receipt of the ICRQ
+			{from: "idle", events: []string{"tunnelopen"}, cb: ds.fsmActOnIcrq, to: "waitconnect"},
+			{from: "idle", events: []string{"close"}, cb: ds.fsmActClose, to: "dead"},
+
+			{from: "waitconnect", events: []string{"iccn"}, cb: ds.fsmActOnIccn, to: "established"},
+			{from: "waitconnect", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+			{from: "waitconnect", events: []string{"icrq", "icrp", "ocrq", "ocrp", "occn", "close"}, cb: ds.fsmActSendCdn, to: "dead"},
+
+			{from: "established", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+			{from: "established", events: []string{"wen"}, cb: ds.fsmActOnWen, to: "established"},
+			{from: "established", events: []string{"sli"}, cb: ds.fsmActOnSli, to: "established"},
+			{
+				from: "established",
+				events: []string{
+					"icrq",
+					"icrp",
+					"iccn",
+					"ocrq",
+					"ocrp",
+					"occn",
+					"close",
+				},
+				cb: ds.fsmActSendCdn,
+				to: "dead",
+			},
+		},
+	}
+
+	ds.wg.Add(1)
+	go ds.runSession()
+
+	return
+}
+
+// Create a new server/LNS mode session instance for an outgoing call
+func newDynamicLNSOutgoingSession(serial uint32, name string, parent *dynamicTunnel, cfg *SessionConfig) (ds *dynamicSession, err error) {
+
+	ds = newDynamicSessionInstance(serial, name, parent, cfg)
+
+	// Ref: RFC2661 section 7.4.3
+	ds.fsm = fsm{
+		current: "waittunnel",
+		table: []eventDesc{
+			{from: "waittunnel", events: []string{"tunnelopen"}, cb: ds.fsmActSendOcrq, to: "waitreply"},
+			{from: "waittunnel", events: []string{"close"}, cb: ds.fsmActClose, to: "dead"},
+
+			{from: "waitreply", events: []string{"ocrp"}, cb: ds.fsmActOnOcrp, to: "waitconnect"},
+			{from: "waitreply", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+			{from: "waitreply", events: []string{"icrq", "icrp", "iccn", "ocrq", "occn", "close"}, cb: ds.fsmActSendCdn, to: "dead"},
+
+			{from: "waitconnect", events: []string{"occn"}, cb: ds.fsmActOnOccn, to: "established"},
+			{from: "waitconnect", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+			{from: "waitconnect", events: []string{"icrq", "icrp", "iccn", "ocrq", "ocrp", "close"}, cb: ds.fsmActSendCdn, to: "dead"},
+
+			{from: "established", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+			{from: "established", events: []string{"wen"}, cb: ds.fsmActOnWen, to: "established"},
+			{from: "established", events: []string{"sli"}, cb: ds.fsmActOnSli, to: "established"},
+			{
+				from: "established",
+				events: []string{
+					"icrq",
+					"icrp",
+					"iccn",
+					"ocrq",
+					"ocrp",
+					"occn",
+					"close",
+				},
+				cb: ds.fsmActSendCdn,
+				to: "dead",
+			},
+		},
+	}
+
+	ds.wg.Add(1)
+	go ds.runSession()
+
+	return
+}
+
+// Create a new client/LAC mode session instance for an outgoing call
+// requested by the peer's OCRQ
+func newDynamicLACOutgoingSession(name string, parent *dynamicTunnel, cfg *SessionConfig, ocrq controlMessage) (ds *dynamicSession, err error) {
+
+	serial, _ := findUint32Avp(ocrq.getAvps(), vendorIDIetf, avpTypeCallSerialNumber)
+
+	ds = newDynamicSessionInstance(serial, name, parent, cfg)
+	ds.ocrq = ocrq
+
+	// Ref: RFC2661 section 7.4.4
+	ds.fsm = fsm{
+		current: "idle",
+		table: []eventDesc{
+			// The session is created on receipt of the OCRQ
+			{from: "idle", events: []string{"tunnelopen"}, cb: ds.fsmActOnOcrq, to: "waitcsanswer"},
+			{from: "idle", events: []string{"close"}, cb: ds.fsmActClose, to: "dead"},
+
+			{from: "waitcsanswer", events: []string{"callconnected"}, cb: ds.fsmActOnCallConnected, to: "established"},
+			{from: "waitcsanswer", events: []string{"callfailed"}, cb: ds.fsmActSendCdn, to: "dead"},
+			{from: "waitcsanswer", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+			{from: "waitcsanswer", events: []string{"icrq", "icrp", "iccn", "ocrq", "ocrp", "occn", "close"}, cb: ds.fsmActSendCdn, to: "dead"},
 
 			{from: "established", events: []string{"cdn"}, cb: ds.fsmActOnCdn, to: "dead"},
+			{from: "established", events: []string{"wen"}, cb: ds.fsmActOnWen, to: "established"},
+			{from: "established", events: []string{"sli"}, cb: ds.fsmActOnSli, to: "established"},
 			{
 				from: "established",
 				events: []string{
 					"icrq",
 					"icrp",
 					"iccn",
+					"ocrq",
+					"ocrp",
+					"occn",
 					"close",
 				},
 				cb: ds.fsmActSendCdn,
@@ -656,3 +1913,34 @@ func newDynamicSession(serial uint32, name string, parent *dynamicTunnel, cfg *S
 
 	return
 }
+
+func newDynamicSessionInstance(serial uint32, name string, parent *dynamicTunnel, cfg *SessionConfig) *dynamicSession {
+	ds := &dynamicSession{
+		baseSession: newBaseSession(
+			log.With(parent.getLogger(), "session_name", name),
+			name,
+			parent,
+			cfg),
+		callSerial: serial,
+		dt:         parent,
+		pppRxChan:  make(chan *pppDataMessage),
+		msgRxChan:  make(chan controlMessage),
+		eventChan:  make(chan string),
+		closeChan:  make(chan interface{}),
+		killChan:   make(chan interface{}),
+		doneChan:   make(chan interface{}),
+
+		pppTimerChan: make(chan pppTimerExpiry),
+		callChan:     make(chan outgoingCallResult),
+	}
+
+	ds.lcpNeg = newPPPLCP(ds)
+	ds.lcp = newPPPFSM(ds.logger, "LCP", pppProtocolLCP, ds, ds.lcpNeg)
+	ds.ipcpNeg = newPPPIPCP(ds)
+	ds.ipcp = newPPPFSM(ds.logger, "IPCP", pppProtocolIPCP, ds, ds.ipcpNeg)
+	ds.ipv6cp = newPPPFSM(ds.logger, "IPV6CP", pppProtocolIPV6CP, ds, newPPPIPV6CP(ds))
+	ds.ccpNeg = newPPPCCP(ds)
+	ds.ccp = newPPPFSM(ds.logger, "CCP", pppProtocolCCP, ds, ds.ccpNeg)
+
+	return ds
+}
@@ -6,7 +6,9 @@ package l2tp
 // These tests are using the null dataplane and hence don't require root.
 
 import (
+	"bytes"
 	"fmt"
+	"net"
 	"os"
 	"sync"
 	"testing"
@@ -93,10 +95,21 @@ func (secc *testSessionEventCounterCloser) wait() {
 }
 
 type testLNS struct {
-	logger             log.Logger
-	tcfg               *TunnelConfig
-	scfg               *SessionConfig
-	xport              *transport
+	logger log.Logger
+	tcfg   *TunnelConfig
+	scfg   *SessionConfig
+	xport  *transport
+	// tiebreaker is set to answer the LAC's SCCRQ with an SCCRQ of our
+	// own, as though both ends opened a control connection at once.
+	tiebreaker []byte
+	// stopccn is sent to the LAC once the tunnel is established, and
+	// mute stops the LNS responding to the LAC once the tunnel is
+	// established.
+	stopccn *resultCode
+	mute    bool
+	// tryAnother is sent to the LAC in answer to its SCCRQ, after which
+	// the LNS shuts down.
+	tryAnother         *resultCode
 	tunnelEstablished  bool
 	sessionEstablished bool
 	isShutdown         bool
@@ -105,10 +118,11 @@ type testLNS struct {
 func newTestLNS(logger log.Logger, tcfg *TunnelConfig, scfg *SessionConfig) (*testLNS, error) {
 	myLogger := log.With(logger, "tunnel_name", "testLNS")
 
-	sal, sap, err := newUDPAddressPair(tcfg.Local, tcfg.Peer)
+	addrs, err := (&Context{}).resolveTunnelAddresses(tcfg, tcfg.Peer)
 	if err != nil {
-		return nil, fmt.Errorf("newUDPAddressPair(%v, %v): %v", tcfg.Local, tcfg.Peer, err)
+		return nil, fmt.Errorf("resolveTunnelAddresses(%v): %v", tcfg.Peer, err)
 	}
+	sal, sap := addrs[0].sal, addrs[0].sap
 
 	cp, err := newL2tpControlPlane(sal, sap)
 	if err != nil {
@@ -156,13 +170,73 @@ func (lns *testLNS) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr) error
 		lns.xport.config.PeerControlConnID = ControlConnID(ptid)
 		lns.tcfg.PeerTunnelID = ControlConnID(ptid)
 		lns.xport.cp.connectTo(from)
-		rsp, err := newV2Sccrp(lns.tcfg)
+		if lns.tryAnother != nil {
+			rsp, err := newV2Stopccn(lns.tryAnother, lns.tcfg)
+			if err != nil {
+				return fmt.Errorf("failed to build StopCCN: %v", err)
+			}
+			err = lns.xport.send(rsp)
+			if err != nil {
+				return err
+			}
+			lns.shutdown()
+			return nil
+		}
+		if lns.tiebreaker != nil {
+			req, err := newV2Sccrq(lns.tcfg, nil, lns.tiebreaker)
+			if err != nil {
+				return fmt.Errorf("failed to build SCCRQ: %v", err)
+			}
+			err = lns.xport.send(req)
+			if err != nil {
+				return err
+			}
+			// The winner's SCCRQ is answered by the LAC
+			tiebreaker, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeTiebreaker)
+			if err != nil {
+				return fmt.Errorf("no Tie Breaker AVP in SCCRQ")
+			}
+			if bytes.Compare(lns.tiebreaker, tiebreaker) < 0 {
+				return nil
+			}
+		}
+		rsp, err := newV2Sccrp(lns.tcfg, nil, nil)
 		if err != nil {
 			return fmt.Errorf("failed to build SCCRP: %v", err)
 		}
 		return lns.xport.send(rsp)
+	case avpMsgTypeSccrp:
+		if msg.Tid() != uint16(lns.tcfg.TunnelID) {
+			return fmt.Errorf("SCCRP addressed to TID %v", msg.Tid())
+		}
+		rsp, err := newV2Scccn(lns.tcfg, nil)
+		if err != nil {
+			return fmt.Errorf("failed to build SCCCN: %v", err)
+		}
+		err = lns.xport.send(rsp)
+		if err != nil {
+			return err
+		}
+		lns.tunnelEstablished = true
+		return nil
 	case avpMsgTypeScccn:
 		lns.tunnelEstablished = true
+		if lns.stopccn != nil {
+			rsp, err := newV2Stopccn(lns.stopccn, lns.tcfg)
+			if err != nil {
+				return fmt.Errorf("failed to build StopCCN: %v", err)
+			}
+			err = lns.xport.send(rsp)
+			if err != nil {
+				return err
+			}
+			lns.shutdown()
+		}
+		if lns.mute {
+			// Allow the transport to ack the SCCCN before shutting down
+			time.Sleep(250 * time.Millisecond)
+			lns.shutdown()
+		}
 		return nil
 	case avpMsgTypeStopccn:
 		// HACK: allow the transport to ack the stopccn.
@@ -206,6 +280,10 @@ func (lns *testLNS) run(timeout time.Duration) {
 			if !ok {
 				return
 			}
+			if _, ok := m.msg.(*pppDataMessage); ok {
+				// The test LNS doesn't run PPP
+				continue
+			}
 			msg, ok := m.msg.(*v2ControlMessage)
 			if !ok {
 				panic("failed to cast received message as v2ControlMessage")
@@ -360,3 +438,1328 @@ func TestDynamicClient(t *testing.T) {
 		})
 	}
 }
+
+func TestDynamicTiebreaker(t *testing.T) {
+	cases := []struct {
+		name       string
+		tiebreaker []byte
+	}{
+		{"peer wins", []byte{0, 0, 0, 0, 0, 0, 0, 0}},
+		{"peer loses", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+			lacAddr := fmt.Sprintf("127.0.0.1:%d", 6170+2*i)
+			peerAddr := fmt.Sprintf("127.0.0.1:%d", 6171+2*i)
+
+			// The test LNS stands in for a peer which opens a control
+			// connection to the LAC as the LAC opens one to it.
+			peer, err := newTestLNS(logger, &TunnelConfig{
+				Local:       peerAddr,
+				Peer:        lacAddr,
+				Version:     ProtocolVersion2,
+				TunnelID:    4242,
+				Encap:       EncapTypeUDP,
+				HostName:    "peer",
+				FramingCaps: FramingCapSync | FramingCapAsync,
+			}, nil)
+			if err != nil {
+				t.Fatalf("newTestLNS: %v", err)
+			}
+			peer.tiebreaker = c.tiebreaker
+
+			var peerWg sync.WaitGroup
+			peerWg.Add(1)
+			go func() {
+				peer.run(3 * time.Second)
+				peerWg.Done()
+			}()
+
+			ctx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			eventCounter := &testTunnelEventCounterCloser{}
+			ctx.RegisterEventHandler(eventCounter)
+
+			_, err = ctx.NewDynamicTunnel("t1", &TunnelConfig{
+				Local:          lacAddr,
+				Peer:           peerAddr,
+				Version:        ProtocolVersion2,
+				TunnelID:       4567,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(): %v", err)
+			}
+
+			peerWg.Wait()
+			ctx.Close()
+			eventCounter.wait()
+
+			expectEvents := eventCounters{tunnelUp: 1, tunnelDown: 1}
+			if gotEvents := eventCounter.getEventCounts(); expectEvents != gotEvents {
+				t.Errorf("event listener: expected %v event, got %v", expectEvents, gotEvents)
+			}
+			if !peer.tunnelEstablished {
+				t.Errorf("peer didn't establish")
+			}
+		})
+	}
+}
+
+func TestDynamicTunnelDownCause(t *testing.T) {
+	cases := []struct {
+		name        string
+		stopccn     *resultCode
+		mute        bool
+		wantCause   TunnelDownCause
+		wantStopccn *StopCCNResult
+	}{
+		{
+			name:      "closed",
+			wantCause: TunnelDownCauseClosed,
+			wantStopccn: &StopCCNResult{
+				Sent:       true,
+				ResultCode: uint16(avpStopCCNResultCodeClearConnection),
+			},
+		},
+		{
+			name: "StopCCN received",
+			stopccn: &resultCode{
+				result:  avpStopCCNResultCodeChannelNotAuthorized,
+				errCode: avpErrorCodeNoError,
+				errMsg:  "go away",
+			},
+			wantCause: TunnelDownCauseStopCCNReceived,
+			wantStopccn: &StopCCNResult{
+				ResultCode:   uint16(avpStopCCNResultCodeChannelNotAuthorized),
+				ErrorMessage: "go away",
+			},
+		},
+		{
+			name:      "HELLO timeout",
+			mute:      true,
+			wantCause: TunnelDownCauseHelloTimeout,
+		},
+	}
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+			lacAddr := fmt.Sprintf("127.0.0.1:%d", 6190+2*i)
+			lnsAddr := fmt.Sprintf("127.0.0.1:%d", 6191+2*i)
+
+			lns, err := newTestLNS(logger, &TunnelConfig{
+				Local:       lnsAddr,
+				Peer:        lacAddr,
+				Version:     ProtocolVersion2,
+				TunnelID:    4242,
+				Encap:       EncapTypeUDP,
+				HostName:    "lns",
+				FramingCaps: FramingCapSync | FramingCapAsync,
+			}, nil)
+			if err != nil {
+				t.Fatalf("newTestLNS: %v", err)
+			}
+			lns.stopccn = c.stopccn
+			lns.mute = c.mute
+
+			lnsDone := make(chan bool)
+			go func() {
+				lns.run(3 * time.Second)
+				close(lnsDone)
+			}()
+
+			ctx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+			events := newTestListenerEventCounter()
+			ctx.RegisterEventHandler(events)
+
+			tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+				Local:          lacAddr,
+				Peer:           lnsAddr,
+				Version:        ProtocolVersion2,
+				TunnelID:       4567,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				HelloTimeout:   250 * time.Millisecond,
+				RetryTimeout:   200 * time.Millisecond,
+				MaxRetries:     2,
+			})
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(): %v", err)
+			}
+
+			select {
+			case <-events.upChan:
+			case <-time.After(3 * time.Second):
+				t.Fatalf("timed out waiting for tunnel up")
+			}
+
+			if c.mute {
+				// Swallow the LAC's messages once the LNS has shut down
+				<-lnsDone
+				conn, err := net.ListenPacket("udp", lnsAddr)
+				if err != nil {
+					t.Fatalf("ListenPacket(%v): %v", lnsAddr, err)
+				}
+				defer conn.Close()
+			} else if c.stopccn == nil {
+				tunl.Close()
+			}
+
+			var ev *TunnelDownEvent
+			select {
+			case ev = <-events.dnChan:
+			case <-time.After(3 * time.Second):
+				t.Fatalf("timed out waiting for tunnel down")
+			}
+			if ev.Cause != c.wantCause {
+				t.Errorf("expected cause %v, got %v (%v)", c.wantCause, ev.Cause, ev.Result)
+			}
+			if c.wantStopccn == nil && ev.StopCCN != nil {
+				t.Errorf("expected no StopCCN, got %+v", *ev.StopCCN)
+			} else if c.wantStopccn != nil && (ev.StopCCN == nil || *ev.StopCCN != *c.wantStopccn) {
+				t.Errorf("expected StopCCN %+v, got %+v", *c.wantStopccn, ev.StopCCN)
+			}
+			if ev.Result == "" {
+				t.Errorf("no result in tunnel down event")
+			}
+			<-lnsDone
+		})
+	}
+}
+
+func TestDynamicFailover(t *testing.T) {
+	cases := []struct {
+		name       string
+		tryAnother bool
+		redirect   bool
+		untrusted  bool
+	}{
+		{name: "unresponsive peer"},
+		{name: "try another", tryAnother: true},
+		{name: "redirect", tryAnother: true, redirect: true},
+		{name: "untrusted redirect", tryAnother: true, redirect: true, untrusted: true},
+	}
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+			lacAddr := fmt.Sprintf("127.0.0.1:%d", 6200+4*i)
+			lnsAddr := fmt.Sprintf("127.0.0.1:%d", 6201+4*i)
+			peerAddr := fmt.Sprintf("127.0.0.1:%d", 6202+4*i)
+			deadAddr := fmt.Sprintf("127.0.0.1:%d", 6203+4*i)
+
+			lns, err := newTestLNS(logger, &TunnelConfig{
+				Local:       lnsAddr,
+				Peer:        lacAddr,
+				Version:     ProtocolVersion2,
+				TunnelID:    4242,
+				Encap:       EncapTypeUDP,
+				HostName:    "lns",
+				FramingCaps: FramingCapSync | FramingCapAsync,
+			}, nil)
+			if err != nil {
+				t.Fatalf("newTestLNS: %v", err)
+			}
+
+			lnsDone := make(chan bool)
+			go func() {
+				lns.run(5 * time.Second)
+				close(lnsDone)
+			}()
+
+			// The LAC's first peer either doesn't answer, or asks the
+			// LAC to try another LNS, optionally redirecting it to the
+			// test LNS in preference to its other alternate peers.  A
+			// redirect to an address which isn't an alternate peer is
+			// ignored, since the StopCCN isn't authenticated.
+			alternatePeers := []string{lnsAddr}
+			var dead *net.UDPConn
+			if c.tryAnother {
+				rc := &resultCode{
+					result:  avpStopCCNResultCodeGeneralError,
+					errCode: avpErrorCodeTryAnother,
+				}
+				if c.redirect {
+					rc.errMsg = lnsAddr
+					alternatePeers = []string{deadAddr, lnsAddr}
+					if c.untrusted {
+						rc.errMsg = deadAddr
+						alternatePeers = []string{lnsAddr}
+					}
+					addr, err := net.ResolveUDPAddr("udp", deadAddr)
+					if err != nil {
+						t.Fatalf("ResolveUDPAddr(%v): %v", deadAddr, err)
+					}
+					dead, err = net.ListenUDP("udp", addr)
+					if err != nil {
+						t.Fatalf("ListenUDP(%v): %v", deadAddr, err)
+					}
+					defer dead.Close()
+				}
+				peer, err := newTestLNS(logger, &TunnelConfig{
+					Local:       peerAddr,
+					Peer:        lacAddr,
+					Version:     ProtocolVersion2,
+					TunnelID:    4343,
+					Encap:       EncapTypeUDP,
+					HostName:    "peer",
+					FramingCaps: FramingCapSync | FramingCapAsync,
+				}, nil)
+				if err != nil {
+					t.Fatalf("newTestLNS: %v", err)
+				}
+				peer.tryAnother = rc
+				go peer.run(5 * time.Second)
+			}
+
+			ctx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+			events := newTestListenerEventCounter()
+			ctx.RegisterEventHandler(events)
+
+			tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+				Local:          lacAddr,
+				Peer:           peerAddr,
+				AlternatePeers: alternatePeers,
+				Version:        ProtocolVersion2,
+				TunnelID:       4567,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				RetryTimeout:   200 * time.Millisecond,
+				MaxRetries:     2,
+			})
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(): %v", err)
+			}
+
+			select {
+			case ev := <-events.upChan:
+				if ev.Peer != lnsAddr {
+					t.Errorf("expected tunnel up with peer %v, got %v", lnsAddr, ev.Peer)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for tunnel up")
+			}
+
+			tunl.Close()
+			<-lnsDone
+
+			if !lns.tunnelEstablished {
+				t.Errorf("LNS didn't establish")
+			}
+			if dead != nil {
+				dead.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+				if _, _, err := dead.ReadFromUDP(make([]byte, 1500)); err == nil {
+					t.Errorf("LAC tried %v", deadAddr)
+				}
+			}
+		})
+	}
+}
+
+func TestDynamicResolvePeer(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+	lacAddr := "127.0.0.1:6220"
+	lnsAddr := "127.0.0.1:6221"
+
+	lns, err := newTestLNS(logger, &TunnelConfig{
+		Local:       lnsAddr,
+		Peer:        lacAddr,
+		Version:     ProtocolVersion2,
+		TunnelID:    4242,
+		Encap:       EncapTypeUDP,
+		HostName:    "lns",
+		FramingCaps: FramingCapSync | FramingCapAsync,
+	}, nil)
+	if err != nil {
+		t.Fatalf("newTestLNS: %v", err)
+	}
+
+	lnsDone := make(chan bool)
+	go func() {
+		lns.run(5 * time.Second)
+		close(lnsDone)
+	}()
+
+	// Only the last address tried reaches the test LNS
+	resolver := newTestResolver(map[string][]string{
+		"dead.example.com": {"127.0.0.2"},
+		"lns.example.com":  {"127.0.0.3", "127.0.0.1"},
+	})
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer ctx.Close()
+	ctx.SetResolver(resolver)
+	events := newTestListenerEventCounter()
+	ctx.RegisterEventHandler(events)
+
+	tunl, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          lacAddr,
+		Peer:           "dead.example.com:6221",
+		AlternatePeers: []string{"lns.example.com:6221"},
+		Version:        ProtocolVersion2,
+		TunnelID:       4567,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+		RetryTimeout:   200 * time.Millisecond,
+		MaxRetries:     2,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	if n := resolver.getLookups("lns.example.com"); n != 0 {
+		t.Errorf("alternate peer resolved %v times before failing over to it", n)
+	}
+
+	select {
+	case ev := <-events.upChan:
+		if ev.Peer != "lns.example.com:6221" {
+			t.Errorf("expected tunnel up with peer lns.example.com:6221, got %v", ev.Peer)
+		}
+		if got := sockaddrString(ev.PeerAddress); got != lnsAddr {
+			t.Errorf("expected tunnel up with peer address %v, got %v", lnsAddr, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for tunnel up")
+	}
+
+	if n := resolver.getLookups("lns.example.com"); n != 1 {
+		t.Errorf("expected alternate peer to be resolved once, got %v", n)
+	}
+
+	tunl.Close()
+	<-lnsDone
+}
+
+func TestRedirectPeer(t *testing.T) {
+	cases := []struct {
+		errMsg, peer, want string
+	}{
+		{"192.0.2.1:1702", "127.0.0.1:1701", "192.0.2.1:1702"},
+		{"192.0.2.1", "127.0.0.1:1701", "192.0.2.1:1701"},
+		{" 2001:db8::1 ", "[::1]:1701", "[2001:db8::1]:1701"},
+		{"[2001:db8::1]:1702", "[::1]:1701", "[2001:db8::1]:1702"},
+		{"", "127.0.0.1:1701", ""},
+		{"try again later", "127.0.0.1:1701", ""},
+		{"lns.example.com:1701", "127.0.0.1:1701", ""},
+	}
+	for _, c := range cases {
+		got := redirectPeer(c.errMsg, c.peer)
+		if got != c.want {
+			t.Errorf("redirectPeer(%q, %q): expected %q, got %q", c.errMsg, c.peer, c.want, got)
+		}
+	}
+}
+
+type testListenerEventCounter struct {
+	testEventCounter
+	lock   sync.Mutex
+	upChan chan *TunnelUpEvent
+	dnChan chan *TunnelDownEvent
+}
+
+func (tlec *testListenerEventCounter) HandleEvent(event interface{}) {
+	tlec.lock.Lock()
+	tlec.testEventCounter.HandleEvent(event)
+	tlec.lock.Unlock()
+	switch ev := event.(type) {
+	case *TunnelUpEvent:
+		tlec.upChan <- ev
+	case *TunnelDownEvent:
+		tlec.dnChan <- ev
+	}
+}
+
+func (tlec *testListenerEventCounter) getEventCounts() eventCounters {
+	tlec.lock.Lock()
+	defer tlec.lock.Unlock()
+	return tlec.eventCounters
+}
+
+func newTestListenerEventCounter() *testListenerEventCounter {
+	return &testListenerEventCounter{
+		upChan: make(chan *TunnelUpEvent, 4),
+		dnChan: make(chan *TunnelDownEvent, 4),
+	}
+}
+
+func TestDynamicListener(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+	lnsEvents := newTestListenerEventCounter()
+	lnsCtx.RegisterEventHandler(lnsEvents)
+
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+	lacEvents := newTestListenerEventCounter()
+	lacCtx.RegisterEventHandler(lacEvents)
+
+	lcfg := &TunnelConfig{
+		Local:          "127.0.0.1:6100",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	}
+	_, err = lnsCtx.NewDynamicListener("l1", lcfg)
+	if err != nil {
+		t.Fatalf("NewDynamicListener(%q, %v): %v", "l1", lcfg, err)
+	}
+	if _, err = lnsCtx.NewDynamicListener("l1", lcfg); err == nil {
+		t.Fatalf("NewDynamicListener succeeded with duplicate name")
+	}
+
+	waitUp := func(events *testListenerEventCounter) *TunnelUpEvent {
+		select {
+		case ev := <-events.upChan:
+			return ev
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for tunnel up")
+		}
+		return nil
+	}
+	waitDown := func(events *testListenerEventCounter) {
+		select {
+		case <-events.dnChan:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for tunnel down")
+		}
+	}
+
+	// Bring up two tunnels from different peer ports
+	for i, local := range []string{"127.0.0.1:6101", "127.0.0.1:6102"} {
+		tcfg := &TunnelConfig{
+			Local:          local,
+			Peer:           "127.0.0.1:6100",
+			Version:        ProtocolVersion2,
+			Encap:          EncapTypeUDP,
+			StopCCNTimeout: 250 * time.Millisecond,
+		}
+		name := fmt.Sprintf("t%d", i)
+		tunl, err := lacCtx.NewDynamicTunnel(name, tcfg)
+		if err != nil {
+			t.Fatalf("NewDynamicTunnel(%q, %v): %v", name, tcfg, err)
+		}
+
+		lacUp := waitUp(lacEvents)
+		lnsUp := waitUp(lnsEvents)
+		if lnsUp.Config.PeerTunnelID != lacUp.Config.TunnelID ||
+			lnsUp.Config.TunnelID != lacUp.Config.PeerTunnelID {
+			t.Errorf("tunnel IDs don't match: LNS %v/%v, LAC %v/%v",
+				lnsUp.Config.TunnelID, lnsUp.Config.PeerTunnelID,
+				lacUp.Config.TunnelID, lacUp.Config.PeerTunnelID)
+		}
+		if lnsUp.Config.Peer != local {
+			t.Errorf("LNS tunnel peer %q, expected %q", lnsUp.Config.Peer, local)
+		}
+
+		// Closing the LAC tunnel sends StopCCN to the LNS
+		tunl.Close()
+		waitDown(lacEvents)
+		waitDown(lnsEvents)
+	}
+
+	expect := eventCounters{tunnelUp: 2, tunnelDown: 2}
+	if got := lnsEvents.getEventCounts(); got != expect {
+		t.Errorf("LNS: expected %v events, got %v", expect, got)
+	}
+	if got := lacEvents.getEventCounts(); got != expect {
+		t.Errorf("LAC: expected %v events, got %v", expect, got)
+	}
+}
+
+type testIncomingCallHandler struct {
+	lock      sync.Mutex
+	reject    bool
+	cfg       *SessionConfig
+	calls     []*IncomingCall
+	connected int
+}
+
+func (h *testIncomingCallHandler) HandleIncomingCall(call *IncomingCall) (*SessionConfig, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.calls = append(h.calls, call)
+	if h.reject {
+		return nil, fmt.Errorf("not today")
+	}
+	if h.cfg != nil {
+		return h.cfg, nil
+	}
+	return &SessionConfig{Pseudowire: PseudowireTypePPP}, nil
+}
+
+func (h *testIncomingCallHandler) HandleIncomingCallConnected(call *IncomingCall) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.connected++
+	return nil
+}
+
+type testSessionUpCounter struct {
+	upChan chan *SessionUpEvent
+}
+
+func (tsuc *testSessionUpCounter) HandleEvent(event interface{}) {
+	if ev, ok := event.(*SessionUpEvent); ok {
+		tsuc.upChan <- ev
+	}
+}
+
+func TestDynamicListenerIncomingCall(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+	lnsEvents := &testSessionUpCounter{upChan: make(chan *SessionUpEvent, 4)}
+	lnsCtx.RegisterEventHandler(lnsEvents)
+
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+	lacEvents := &testSessionUpCounter{upChan: make(chan *SessionUpEvent, 4)}
+	lacCtx.RegisterEventHandler(lacEvents)
+
+	lstnr, err := lnsCtx.NewDynamicListener("l1", &TunnelConfig{
+		Local:          "127.0.0.1:6110",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicListener(): %v", err)
+	}
+	handler := &testIncomingCallHandler{}
+	lstnr.SetIncomingCallHandler(handler)
+
+	tunl, err := lacCtx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6111",
+		Peer:           "127.0.0.1:6110",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	waitUp := func(events *testSessionUpCounter) *SessionUpEvent {
+		select {
+		case ev := <-events.upChan:
+			return ev
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for session up")
+		}
+		return nil
+	}
+
+	// An accepted call comes up at both ends
+	_, err = tunl.NewSession("s1", &SessionConfig{Pseudowire: PseudowireTypePPP})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	lacUp := waitUp(lacEvents)
+	lnsUp := waitUp(lnsEvents)
+	if lnsUp.SessionConfig.PeerSessionID != lacUp.SessionConfig.SessionID ||
+		lnsUp.SessionConfig.SessionID != lacUp.SessionConfig.PeerSessionID {
+		t.Errorf("session IDs don't match: LNS %v/%v, LAC %v/%v",
+			lnsUp.SessionConfig.SessionID, lnsUp.SessionConfig.PeerSessionID,
+			lacUp.SessionConfig.SessionID, lacUp.SessionConfig.PeerSessionID)
+	}
+
+	handler.lock.Lock()
+	if len(handler.calls) != 1 || handler.connected != 1 {
+		t.Errorf("expected one call connected, got %d calls, %d connected", len(handler.calls), handler.connected)
+	} else if call := handler.calls[0]; call.Session != lnsUp.Session || call.ProxyAuth != nil {
+		t.Errorf("unexpected call %+v", call)
+	}
+	handler.reject = true
+	handler.lock.Unlock()
+
+	// A rejected call is disconnected by the LNS
+	_, err = tunl.NewSession("s2", &SessionConfig{Pseudowire: PseudowireTypePPP})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		handler.lock.Lock()
+		ncalls := len(handler.calls)
+		handler.lock.Unlock()
+		if _, ok := tunl.(*dynamicTunnel).findSessionByName("s2"); !ok && ncalls == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for rejected session to close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	handler.lock.Lock()
+	if len(handler.calls) != 2 || handler.connected != 1 {
+		t.Errorf("expected second call rejected, got %d calls, %d connected", len(handler.calls), handler.connected)
+	}
+	handler.lock.Unlock()
+}
+
+type testOutgoingCallHandler struct {
+	lock  sync.Mutex
+	calls []*OutgoingCall
+}
+
+func (h *testOutgoingCallHandler) PlaceOutgoingCall(call *OutgoingCall) (*SessionConfig, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.calls = append(h.calls, call)
+	if call.CalledNumber != "555-0100" {
+		return nil, fmt.Errorf("no answer")
+	}
+	return &SessionConfig{Pseudowire: PseudowireTypePPP}, nil
+}
+
+type testLinkInfoEvents struct {
+	upChan  chan *SessionUpEvent
+	wenChan chan *SessionWanErrorNotifyEvent
+	sliChan chan *SessionSetLinkInfoEvent
+	// upAccm is sent to the peer by the SessionUpEvent handler if set,
+	// and the result passed on upErrChan.
+	upAccm    *ACCM
+	upErrChan chan error
+}
+
+func newTestLinkInfoEvents() *testLinkInfoEvents {
+	return &testLinkInfoEvents{
+		upChan:    make(chan *SessionUpEvent, 4),
+		wenChan:   make(chan *SessionWanErrorNotifyEvent, 4),
+		sliChan:   make(chan *SessionSetLinkInfoEvent, 4),
+		upErrChan: make(chan error, 4),
+	}
+}
+
+func (tlie *testLinkInfoEvents) HandleEvent(event interface{}) {
+	switch ev := event.(type) {
+	case *SessionUpEvent:
+		if tlie.upAccm != nil {
+			tlie.upErrChan <- ev.Session.(LinkInfoSession).SendSetLinkInfo(tlie.upAccm)
+		}
+		tlie.upChan <- ev
+	case *SessionWanErrorNotifyEvent:
+		tlie.wenChan <- ev
+	case *SessionSetLinkInfoEvent:
+		tlie.sliChan <- ev
+	}
+}
+
+func TestDynamicLinkInfo(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+	lnsEvents := newTestLinkInfoEvents()
+	lnsCtx.RegisterEventHandler(lnsEvents)
+
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+	lacEvents := newTestLinkInfoEvents()
+	lacCtx.RegisterEventHandler(lacEvents)
+
+	_, err = lnsCtx.NewDynamicListener("l1", &TunnelConfig{
+		Local:          "127.0.0.1:6180",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicListener(): %v", err)
+	}
+
+	tunl, err := lacCtx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6181",
+		Peer:           "127.0.0.1:6180",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	sess, err := tunl.NewSession("s1", &SessionConfig{Pseudowire: PseudowireTypePPP})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	var lacUp, lnsUp *SessionUpEvent
+	for _, c := range []struct {
+		upChan chan *SessionUpEvent
+		ev     **SessionUpEvent
+	}{
+		{lacEvents.upChan, &lacUp},
+		{lnsEvents.upChan, &lnsUp},
+	} {
+		select {
+		case *c.ev = <-c.upChan:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for session up")
+		}
+	}
+
+	// The LAC reports link errors to the LNS
+	lacSess, ok := sess.(LinkInfoSession)
+	if !ok {
+		t.Fatalf("dynamic session isn't a LinkInfoSession")
+	}
+	ce := CallErrors{CRCErrors: 3, FramingErrors: 1, TimeoutErrors: 7}
+	err = lacSess.SendWanErrorNotify(&ce)
+	if err != nil {
+		t.Fatalf("SendWanErrorNotify(): %v", err)
+	}
+	select {
+	case ev := <-lnsEvents.wenChan:
+		if ev.Errors != ce || ev.Session != lnsUp.Session {
+			t.Errorf("unexpected WEN event %+v", ev)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for WEN event")
+	}
+
+	// The LNS passes the ACCM to the LAC
+	lnsSess, ok := lnsUp.Session.(LinkInfoSession)
+	if !ok {
+		t.Fatalf("dynamic session isn't a LinkInfoSession")
+	}
+	accm := ACCM{SendACCM: 0xffffffff, ReceiveACCM: 0}
+	err = lnsSess.SendSetLinkInfo(&accm)
+	if err != nil {
+		t.Fatalf("SendSetLinkInfo(): %v", err)
+	}
+	select {
+	case ev := <-lacEvents.sliChan:
+		if ev.ACCM != accm || ev.Session != sess {
+			t.Errorf("unexpected SLI event %+v", ev)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for SLI event")
+	}
+
+	// Link information can't be sent once the session has closed
+	sess.Close()
+	if err = lacSess.SendWanErrorNotify(&ce); err == nil {
+		t.Errorf("SendWanErrorNotify() succeeded on a closed session")
+	}
+}
+
+func TestDynamicLinkInfoOnSessionUp(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	// The LNS sends the ACCM from its SessionUpEvent handler, which runs
+	// on the session goroutine.
+	accm := ACCM{SendACCM: 0xffffffff, ReceiveACCM: 0x000a0000}
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+	lnsEvents := newTestLinkInfoEvents()
+	lnsEvents.upAccm = &accm
+	lnsCtx.RegisterEventHandler(lnsEvents)
+
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+	lacEvents := newTestLinkInfoEvents()
+	lacCtx.RegisterEventHandler(lacEvents)
+
+	_, err = lnsCtx.NewDynamicListener("l1", &TunnelConfig{
+		Local:          "127.0.0.1:6230",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicListener(): %v", err)
+	}
+
+	tunl, err := lacCtx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6231",
+		Peer:           "127.0.0.1:6230",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	sess, err := tunl.NewSession("s1", &SessionConfig{Pseudowire: PseudowireTypePPP})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	select {
+	case err := <-lnsEvents.upErrChan:
+		if err != nil {
+			t.Fatalf("SendSetLinkInfo() from SessionUpEvent handler: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for SendSetLinkInfo() from SessionUpEvent handler")
+	}
+
+	select {
+	case ev := <-lacEvents.sliChan:
+		if ev.ACCM != accm || ev.Session != sess {
+			t.Errorf("unexpected SLI event %+v", ev)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for SLI event")
+	}
+}
+
+func TestDynamicOutgoingCall(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+	lnsTunnelEvents := newTestListenerEventCounter()
+	lnsCtx.RegisterEventHandler(lnsTunnelEvents)
+	lnsEvents := &testSessionUpCounter{upChan: make(chan *SessionUpEvent, 4)}
+	lnsCtx.RegisterEventHandler(lnsEvents)
+
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+	lacEvents := &testSessionUpCounter{upChan: make(chan *SessionUpEvent, 4)}
+	lacCtx.RegisterEventHandler(lacEvents)
+	handler := &testOutgoingCallHandler{}
+	lacCtx.SetOutgoingCallHandler(handler)
+
+	_, err = lnsCtx.NewDynamicListener("l1", &TunnelConfig{
+		Local:          "127.0.0.1:6120",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicListener(): %v", err)
+	}
+
+	_, err = lacCtx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6121",
+		Peer:           "127.0.0.1:6120",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	var lnsTunl Tunnel
+	select {
+	case ev := <-lnsTunnelEvents.upChan:
+		lnsTunl = ev.Tunnel
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timed out waiting for tunnel up")
+	}
+
+	waitUp := func(events *testSessionUpCounter) *SessionUpEvent {
+		select {
+		case ev := <-events.upChan:
+			return ev
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for session up")
+		}
+		return nil
+	}
+
+	// A call the LAC connects comes up at both ends
+	_, err = lnsTunl.NewSession("s1", &SessionConfig{
+		Pseudowire:   PseudowireTypePPP,
+		OutgoingCall: true,
+		CalledNumber: "555-0100",
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	lnsUp := waitUp(lnsEvents)
+	lacUp := waitUp(lacEvents)
+	if lnsUp.SessionConfig.PeerSessionID != lacUp.SessionConfig.SessionID ||
+		lnsUp.SessionConfig.SessionID != lacUp.SessionConfig.PeerSessionID {
+		t.Errorf("session IDs don't match: LNS %v/%v, LAC %v/%v",
+			lnsUp.SessionConfig.SessionID, lnsUp.SessionConfig.PeerSessionID,
+			lacUp.SessionConfig.SessionID, lacUp.SessionConfig.PeerSessionID)
+	}
+
+	handler.lock.Lock()
+	if len(handler.calls) != 1 {
+		t.Errorf("expected one call, got %d", len(handler.calls))
+	} else if call := handler.calls[0]; call.Session != lacUp.Session || call.CalledNumber != "555-0100" {
+		t.Errorf("unexpected call %+v", call)
+	}
+	handler.lock.Unlock()
+
+	// A call the LAC fails to connect is disconnected
+	_, err = lnsTunl.NewSession("s2", &SessionConfig{
+		Pseudowire:   PseudowireTypePPP,
+		OutgoingCall: true,
+		CalledNumber: "555-0199",
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		handler.lock.Lock()
+		ncalls := len(handler.calls)
+		handler.lock.Unlock()
+		if _, ok := lnsTunl.(*dynamicTunnel).findSessionByName("s2"); !ok && ncalls == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for failed call to close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDynamicTunnelAuthentication(t *testing.T) {
+	cases := []struct {
+		name                 string
+		lacSecret, lnsSecret string
+		wantUp               bool
+	}{
+		{"matching secrets", "opensesame", "opensesame", true},
+		{"mismatched secrets", "opensesame", "letmein", false},
+		{"LAC has no secret", "", "opensesame", false},
+		{"LNS has no secret", "opensesame", "", false},
+	}
+	for i, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+			lnsAddr := fmt.Sprintf("127.0.0.1:%d", 6130+2*i)
+			lacAddr := fmt.Sprintf("127.0.0.1:%d", 6131+2*i)
+
+			lnsCtx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lnsCtx.Close()
+
+			lacCtx, err := NewContext(nil, logger)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer lacCtx.Close()
+			lacEvents := newTestListenerEventCounter()
+			lacCtx.RegisterEventHandler(lacEvents)
+
+			_, err = lnsCtx.NewDynamicListener("l1", &TunnelConfig{
+				Local:          lnsAddr,
+				Version:        ProtocolVersion2,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				Secret:         c.lnsSecret,
+			})
+			if err != nil {
+				t.Fatalf("NewDynamicListener(): %v", err)
+			}
+
+			_, err = lacCtx.NewDynamicTunnel("t1", &TunnelConfig{
+				Local:          lacAddr,
+				Peer:           lnsAddr,
+				Version:        ProtocolVersion2,
+				Encap:          EncapTypeUDP,
+				StopCCNTimeout: 250 * time.Millisecond,
+				Secret:         c.lacSecret,
+			})
+			if err != nil {
+				t.Fatalf("NewDynamicTunnel(): %v", err)
+			}
+
+			if c.wantUp {
+				select {
+				case <-lacEvents.upChan:
+				case <-time.After(3 * time.Second):
+					t.Fatalf("timed out waiting for tunnel up")
+				}
+				return
+			}
+
+			deadline := time.Now().Add(3 * time.Second)
+			for {
+				if _, ok := lacCtx.findTunnelByName("t1"); !ok {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("timed out waiting for tunnel to close")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if ec := lacEvents.getEventCounts(); ec.tunnelUp != 0 {
+				t.Errorf("tunnel came up without authenticating")
+			}
+		})
+	}
+}
+
+func TestDynamicHiddenAvps(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+	lnsEvents := &testSessionUpCounter{upChan: make(chan *SessionUpEvent, 4)}
+	lnsCtx.RegisterEventHandler(lnsEvents)
+
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+	lacEvents := &testSessionUpCounter{upChan: make(chan *SessionUpEvent, 4)}
+	lacCtx.RegisterEventHandler(lacEvents)
+
+	_, err = lnsCtx.NewDynamicListener("l1", &TunnelConfig{
+		Local:          "127.0.0.1:6140",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+		Secret:         "opensesame",
+		HideAVPs:       true,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicListener(): %v", err)
+	}
+
+	tunl, err := lacCtx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6141",
+		Peer:           "127.0.0.1:6140",
+		Version:        ProtocolVersion2,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+		Secret:         "opensesame",
+		HideAVPs:       true,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	// Both ends hide the Assigned Session ID AVP in the session messages
+	_, err = tunl.NewSession("s1", &SessionConfig{Pseudowire: PseudowireTypePPP})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	for _, events := range []*testSessionUpCounter{lacEvents, lnsEvents} {
+		select {
+		case <-events.upChan:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for session up")
+		}
+	}
+}
+
+func TestDynamicL2TPv3(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+	lnsEvents := &testSessionUpCounter{upChan: make(chan *SessionUpEvent, 4)}
+	lnsCtx.RegisterEventHandler(lnsEvents)
+
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+	lacEvents := &testSessionUpCounter{upChan: make(chan *SessionUpEvent, 4)}
+	lacCtx.RegisterEventHandler(lacEvents)
+
+	lstnr, err := lnsCtx.NewDynamicListener("l1", &TunnelConfig{
+		Local:          "127.0.0.1:6150",
+		Version:        ProtocolVersion3,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicListener(): %v", err)
+	}
+	handler := &testIncomingCallHandler{
+		cfg: &SessionConfig{Cookie: []byte{0xca, 0xfe, 0xf0, 0x0d}},
+	}
+	lstnr.SetIncomingCallHandler(handler)
+
+	tunl, err := lacCtx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6151",
+		Peer:           "127.0.0.1:6150",
+		Version:        ProtocolVersion3,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	// Only Ethernet pseudowires are supported
+	_, err = tunl.NewSession("s0", &SessionConfig{Pseudowire: PseudowireTypePPP})
+	if err == nil {
+		t.Fatalf("NewSession() succeeded for a PPP pseudowire")
+	}
+
+	_, err = tunl.NewSession("s1", &SessionConfig{
+		Pseudowire:  PseudowireTypeEth,
+		Cookie:      []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		SeqNum:      true,
+		RemoteEndID: "vlan100",
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	var up [2]*SessionUpEvent
+	for i, events := range []*testSessionUpCounter{lacEvents, lnsEvents} {
+		select {
+		case up[i] = <-events.upChan:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for session up")
+		}
+	}
+	lac, lns := up[0].SessionConfig, up[1].SessionConfig
+
+	if lns.PeerSessionID != lac.SessionID || lns.SessionID != lac.PeerSessionID {
+		t.Errorf("session IDs don't match: LNS %v/%v, LAC %v/%v",
+			lns.SessionID, lns.PeerSessionID, lac.SessionID, lac.PeerSessionID)
+	}
+	if !bytes.Equal(lns.PeerCookie, lac.Cookie) || !bytes.Equal(lac.PeerCookie, lns.Cookie) {
+		t.Errorf("cookies don't match: LNS %x/%x, LAC %x/%x",
+			lns.Cookie, lns.PeerCookie, lac.Cookie, lac.PeerCookie)
+	}
+	if lns.Pseudowire != PseudowireTypeEth || !lns.SeqNum {
+		t.Errorf("LNS session didn't adopt the LAC's parameters: %+v", lns)
+	}
+
+	handler.lock.Lock()
+	if len(handler.calls) != 1 || handler.calls[0].RemoteEndID != "vlan100" {
+		t.Errorf("unexpected calls %+v", handler.calls)
+	}
+	handler.lock.Unlock()
+}
+
+func TestDynamicL2TPv3Authentication(t *testing.T) {
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowDebug())
+
+	lnsCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lnsCtx.Close()
+	lnsEvents := &testSessionUpCounter{upChan: make(chan *SessionUpEvent, 4)}
+	lnsCtx.RegisterEventHandler(lnsEvents)
+
+	lacCtx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	defer lacCtx.Close()
+	lacEvents := &testSessionUpCounter{upChan: make(chan *SessionUpEvent, 4)}
+	lacCtx.RegisterEventHandler(lacEvents)
+
+	_, err = lnsCtx.NewDynamicListener("l1", &TunnelConfig{
+		Local:          "127.0.0.1:6160",
+		Version:        ProtocolVersion3,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+		Secret:         "opensesame",
+		DigestType:     DigestTypeHMACSHA1,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicListener(): %v", err)
+	}
+
+	// Authentication requires a secret
+	_, err = lacCtx.NewDynamicTunnel("t0", &TunnelConfig{
+		Peer:       "127.0.0.1:6160",
+		Version:    ProtocolVersion3,
+		Encap:      EncapTypeUDP,
+		DigestType: DigestTypeHMACSHA1,
+	})
+	if err == nil {
+		t.Fatalf("NewDynamicTunnel() succeeded without a secret")
+	}
+
+	tunl, err := lacCtx.NewDynamicTunnel("t1", &TunnelConfig{
+		Local:          "127.0.0.1:6161",
+		Peer:           "127.0.0.1:6160",
+		Version:        ProtocolVersion3,
+		Encap:          EncapTypeUDP,
+		StopCCNTimeout: 250 * time.Millisecond,
+		Secret:         "opensesame",
+		DigestType:     DigestTypeHMACSHA1,
+		HelloTimeout:   50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewDynamicTunnel(): %v", err)
+	}
+
+	_, err = tunl.NewSession("s1", &SessionConfig{Pseudowire: PseudowireTypeEth})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	for _, events := range []*testSessionUpCounter{lacEvents, lnsEvents} {
+		select {
+		case <-events.upChan:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for session up")
+		}
+	}
+
+	// Authenticated HELLO messages keep the tunnel up
+	time.Sleep(200 * time.Millisecond)
+	if _, ok := tunl.(*dynamicTunnel).findSessionByName("s1"); !ok {
+		t.Fatalf("session closed")
+	}
+}
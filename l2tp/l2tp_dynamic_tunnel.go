@@ -1,7 +1,11 @@
 package l2tp
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"fmt"
+	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -26,15 +30,46 @@ type dynamicTunnel struct {
 	isClosing   bool
 	established bool
 	sal, sap    unix.Sockaddr
-	cp          *controlPlane
-	xport       *transport
-	dp          TunnelDataPlane
-	closeChan   chan bool
-	sendChan    chan *sendMsg
-	eventChan   chan *eventArgs
-	wg          sync.WaitGroup
-	sessionTxWg sync.WaitGroup
-	fsm         fsm
+	// peer is the address of the peer the tunnel is connected to.  A LAC
+	// mode tunnel which fails to open a control connection to it fails
+	// over to the next of the peer's resolved addresses in peerAddrs,
+	// then to the next of alternatePeers, skipping those in triedPeers.
+	peer           string
+	peerAddrs      []tunnelAddress
+	alternatePeers []string
+	triedPeers     map[string]bool
+	cp             *controlPlane
+	xport          *transport
+	dp             TunnelDataPlane
+	closeChan      chan bool
+	sendChan       chan *sendMsg
+	eventChan      chan *eventArgs
+	wg             sync.WaitGroup
+	sessionTxWg    sync.WaitGroup
+	fsm            fsm
+	// cpLock protects cp, which failover replaces on the tunnel
+	// goroutine while ControlPlaneFd may be called from any goroutine.
+	cpLock sync.Mutex
+	// listener and sccrq are set for LNS mode tunnels, which are opened
+	// by the peer's SCCRQ received by a listener.
+	listener *dynamicListener
+	sccrq    controlMessage
+	// challenge is the challenge we sent the peer, if the tunnel is
+	// authenticated.
+	challenge []byte
+	// tiebreaker is the Tie Breaker we sent in our SCCRQ, which settles
+	// which control connection survives if the peer opens one to us at
+	// the same time.
+	tiebreaker []byte
+	// digest authenticates control messages for L2TPv3 tunnels if
+	// control message authentication is enabled.
+	digest *v3Digest
+	// downCause, stopccn and downResult record why the tunnel went down
+	// for the TunnelDownEvent.  The first cause recorded is kept.
+	downRecorded bool
+	downCause    TunnelDownCause
+	stopccn      *StopCCNResult
+	downResult   string
 }
 
 func (dt *dynamicTunnel) NewSession(name string, cfg *SessionConfig) (sess Session, err error) {
@@ -59,6 +94,19 @@ func (dt *dynamicTunnel) NewSession(name string, cfg *SessionConfig) (sess Sessi
 	// Duplicate the configuration so we don't modify the user's copy
 	myCfg := *cfg
 
+	if dt.cfg.Version == ProtocolVersion3 {
+		if myCfg.Pseudowire != PseudowireTypeEth {
+			return nil, fmt.Errorf("dynamic L2TPv3 tunnels support Ethernet pseudowires only")
+		}
+		if myCfg.OutgoingCall {
+			return nil, fmt.Errorf("outgoing calls are not supported by dynamic L2TPv3 tunnels")
+		}
+		// Ref: RFC3931 section 5.4.4
+		if n := len(myCfg.Cookie); n != 0 && n != 4 && n != 8 {
+			return nil, fmt.Errorf("cookie must be 4 or 8 bytes long")
+		}
+	}
+
 	// If the session ID in the config is unset, we must generate one.
 	// If the session ID is set, we must check for collisions.
 	// TODO: there is a potential race here if sessions are concurrently
@@ -76,7 +124,12 @@ func (dt *dynamicTunnel) NewSession(name string, cfg *SessionConfig) (sess Sessi
 		}
 	}
 
-	s, err := newDynamicSession(dt.parent.allocCallSerial(), name, dt, &myCfg)
+	var s *dynamicSession
+	if myCfg.OutgoingCall {
+		s, err = newDynamicLNSOutgoingSession(dt.parent.allocCallSerial(), name, dt, &myCfg)
+	} else {
+		s, err = newDynamicSession(dt.parent.allocCallSerial(), name, dt, &myCfg)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -96,6 +149,8 @@ func (dt *dynamicTunnel) Close() {
 }
 
 func (dt *dynamicTunnel) ControlPlaneFd() int {
+	dt.cpLock.Lock()
+	defer dt.cpLock.Unlock()
 	return dt.cp.fd
 }
 
@@ -137,6 +192,18 @@ func (dt *dynamicTunnel) sendMessage(msg controlMessage) error {
 	return <-sm.completeChan
 }
 
+// send transmits a control message reliably, hiding sensitive AVPs if the
+// tunnel is configured to do so.
+func (dt *dynamicTunnel) send(msg controlMessage) error {
+	if m, ok := msg.(*v2ControlMessage); ok && dt.cfg.HideAVPs && dt.cfg.Secret != "" {
+		err := m.hideAvps(dt.cfg.Secret, avpSensitiveTypes)
+		if err != nil {
+			return err
+		}
+	}
+	return dt.xport.send(msg)
+}
+
 func (dt *dynamicTunnel) runTunnel() {
 	defer dt.wg.Done()
 
@@ -153,6 +220,7 @@ func (dt *dynamicTunnel) runTunnel() {
 	for {
 		select {
 		case <-dt.closeChan:
+			dt.recordDown(TunnelDownCauseClosed, "closed")
 			dt.handleEvent("close", avpStopCCNResultCodeClearConnection)
 			return
 		case m, ok := <-dt.xport.recvChan:
@@ -175,7 +243,7 @@ func (dt *dynamicTunnel) runTunnel() {
 			dt.sessionTxWg.Add(1)
 			go func() {
 				defer dt.sessionTxWg.Done()
-				err := dt.xport.send(sm.msg)
+				err := dt.send(sm.msg)
 				sm.completeChan <- err
 			}()
 		}
@@ -192,6 +260,7 @@ func (dt *dynamicTunnel) handleEvent(ev string, args ...interface{}) {
 			level.Error(dt.logger).Log(
 				"message", "failed to handle fsm event",
 				"error", err)
+			dt.recordDown(TunnelDownCauseProtocolError, err.Error())
 			// TODO: this may be extreme
 			dt.fsmActClose(nil)
 		}
@@ -207,13 +276,13 @@ func (dt *dynamicTunnel) injectEvent(ev string, args ...interface{}) {
 }
 
 // panics if expected arguments are not passed
-func fsmArgsToV2MsgFrom(args []interface{}) (msg *v2ControlMessage, from unix.Sockaddr) {
+func fsmArgsToMsgFrom(args []interface{}) (msg controlMessage, from unix.Sockaddr) {
 	if len(args) != 2 {
 		panic(fmt.Sprintf("unexpected argument count (wanted 2, got %v)", len(args)))
 	}
-	msg, ok := args[0].(*v2ControlMessage)
+	msg, ok := args[0].(controlMessage)
 	if !ok {
-		panic(fmt.Sprintf("first argument %T not *v2ControlMessage", args[0]))
+		panic(fmt.Sprintf("first argument %T not controlMessage", args[0]))
 	}
 	from, ok = args[1].(unix.Sockaddr)
 	if !ok {
@@ -300,6 +369,16 @@ func (dt *dynamicTunnel) handleMsg(m *recvMsg) {
 		}
 		dt.handleV2Msg(msg, m.from)
 		return
+	case ProtocolVersion3:
+		msg, ok := m.msg.(*v3ControlMessage)
+		if !ok {
+			level.Error(dt.logger).Log(
+				"message", "couldn't cast L2TPv3 message as v3ControlMessage")
+			dt.fsmActClose(nil)
+			return
+		}
+		dt.handleV3Msg(msg, m.from)
+		return
 	}
 
 	level.Error(dt.logger).Log(
@@ -338,8 +417,10 @@ func (dt *dynamicTunnel) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr)
 
 	// It's possible to have a message mis-delivered on our control
 	// socket.  Ignore these messages: ideally we'd redirect them
-	// but dropping them is a good compromise for now.
-	if msg.Tid() != uint16(dt.cfg.TunnelID) {
+	// but dropping them is a good compromise for now.  The exception
+	// is the SCCRQ of a peer opening a control connection to us at the
+	// same time as we open one to it, which is addressed to TID 0.
+	if msg.Tid() != uint16(dt.cfg.TunnelID) && !isPeerSccrq(msg) {
 		level.Error(dt.logger).Log(
 			"message", "received control message with the wrong TID",
 			"expected", dt.cfg.TunnelID,
@@ -347,9 +428,13 @@ func (dt *dynamicTunnel) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr)
 		return
 	}
 
-	// Validate the message.  If validation fails drive shutdown via.
-	// the FSM to allow the error to be communicated to the peer.
-	err := msg.validate()
+	// Reveal hidden AVPs and validate the message.  If validation fails
+	// drive shutdown via. the FSM to allow the error to be communicated
+	// to the peer.
+	err := msg.unhideAvps(dt.cfg.Secret)
+	if err == nil {
+		err = msg.validate()
+	}
 	if err != nil {
 		level.Error(dt.logger).Log(
 			"message", "bad control message",
@@ -359,6 +444,7 @@ func (dt *dynamicTunnel) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr)
 			avpStopCCNResultCodeGeneralError,
 			avpErrorCodeBadValue,
 			fmt.Sprintf("bad %v message: %v", msg.getType(), err))
+		return
 	}
 
 	// Map the message to the appropriate event type.  If we haven't got
@@ -375,6 +461,9 @@ func (dt *dynamicTunnel) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr)
 		{avpMsgTypeIcrq, "sessionmsg"},
 		{avpMsgTypeIcrp, "sessionmsg"},
 		{avpMsgTypeIccn, "sessionmsg"},
+		{avpMsgTypeOcrq, "sessionmsg"},
+		{avpMsgTypeOcrp, "sessionmsg"},
+		{avpMsgTypeOccn, "sessionmsg"},
 		{avpMsgTypeCdn, "sessionmsg"},
 		{avpMsgTypeSli, "sli"},
 		{avpMsgTypeWen, "wen"},
@@ -397,29 +486,334 @@ func (dt *dynamicTunnel) handleV2Msg(msg *v2ControlMessage, from unix.Sockaddr)
 		fmt.Sprintf("unhandled v2 control message %v", msg.getType()))
 }
 
+func (dt *dynamicTunnel) handleV3Msg(msg *v3ControlMessage, from unix.Sockaddr) {
+
+	// Ignore messages mis-delivered on our control socket, c.f. handleV2Msg
+	if ControlConnID(msg.ControlConnectionID()) != dt.cfg.TunnelID && !isPeerSccrq(msg) {
+		level.Error(dt.logger).Log(
+			"message", "received control message with the wrong CCID",
+			"expected", dt.cfg.TunnelID,
+			"got", msg.ControlConnectionID())
+		return
+	}
+
+	err := msg.validate()
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "bad control message",
+			"message_type", msg.getType(),
+			"error", err)
+		dt.handleEvent("close",
+			avpStopCCNResultCodeGeneralError,
+			avpErrorCodeBadValue,
+			fmt.Sprintf("bad %v message: %v", msg.getType(), err))
+		return
+	}
+
+	eventMap := []struct {
+		m avpMsgType
+		e string
+	}{
+		{avpMsgTypeSccrq, "sccrq"},
+		{avpMsgTypeSccrp, "sccrp"},
+		{avpMsgTypeScccn, "scccn"},
+		{avpMsgTypeStopccn, "stopccn"},
+		{avpMsgTypeHello, ""}, // fsm ignores empty events
+		{avpMsgTypeIcrq, "sessionmsg"},
+		{avpMsgTypeIcrp, "sessionmsg"},
+		{avpMsgTypeIccn, "sessionmsg"},
+		{avpMsgTypeCdn, "sessionmsg"},
+	}
+
+	for _, em := range eventMap {
+		if msg.getType() == em.m {
+			dt.handleEvent(em.e, msg, from)
+			return
+		}
+	}
+
+	level.Error(dt.logger).Log(
+		"message", "unhandled v3 control message",
+		"message_type", msg.getType())
+
+	dt.handleEvent("close",
+		avpStopCCNResultCodeGeneralError,
+		avpErrorCodeBadValue,
+		fmt.Sprintf("unhandled v3 control message %v", msg.getType()))
+}
+
 func (dt *dynamicTunnel) fsmActSendSccrq(args []interface{}) {
 	err := dt.sendSccrq()
 	if err != nil {
 		level.Error(dt.logger).Log(
 			"message", "failed to send SCCRQ message",
+			"peer", dt.peer,
 			"error", err)
-		dt.fsmActClose(nil)
+		if !dt.failover("") {
+			dt.fsmActClose(nil)
+		}
+	}
+}
+
+// fsmActOnSccrqStopccn handles a StopCCN sent by the peer in answer to
+// our SCCRQ.  If the peer asks us to try another LNS we fail over to
+// the next peer, which may be one the StopCCN redirects us to.
+// Ref: RFC2661 section 4.4.2
+func (dt *dynamicTunnel) fsmActOnSccrqStopccn(args []interface{}) {
+	msg, _ := fsmArgsToMsgFrom(args)
+	rc, err := findResultCodeAvp(msg.getAvps(), vendorIDIetf, avpTypeResultCode)
+	if err != nil || rc.errCode != avpErrorCodeTryAnother {
+		dt.handleEvent("rejected", args...)
+		return
+	}
+
+	level.Info(dt.logger).Log(
+		"message", "peer asked us to try another LNS",
+		"peer", dt.peer,
+		"error_message", rc.errMsg)
+
+	redirect := redirectPeer(rc.errMsg, dt.peer)
+	if redirect != "" && !dt.trustRedirect(redirect) {
+		level.Info(dt.logger).Log(
+			"message", "ignoring redirect from unauthenticated peer",
+			"peer", dt.peer,
+			"redirect", redirect)
+		redirect = ""
 	}
+
+	// Allow the transport to ack the StopCCN before closing it
+	dt.drainTransport(2 * dt.xport.getConfig().AckTimeout)
+
+	if !dt.failover(redirect) {
+		dt.handleEvent("rejected", args...)
+	}
+}
+
+// trustRedirect reports whether the tunnel may follow a StopCCN answering
+// its SCCRQ which redirects it to addr.  Such a StopCCN is only
+// authenticated by the Message Digest of an L2TPv3 tunnel using control
+// message authentication: L2TPv2 tunnel authentication isn't complete
+// until the SCCRP.  Otherwise the redirect is only followed to one of the
+// tunnel's alternate peers, so that a spoofed StopCCN can't send the
+// tunnel to an address of the attacker's choosing.
+func (dt *dynamicTunnel) trustRedirect(addr string) bool {
+	if dt.digest != nil {
+		return true
+	}
+	for _, peer := range dt.cfg.AlternatePeers {
+		if samePeerAddress(peer, addr) {
+			return true
+		}
+	}
+	return false
 }
 
-func (dt *dynamicTunnel) sendSccrq() error {
-	msg, err := newV2Sccrq(dt.cfg)
+// samePeerAddress reports whether two host:port peer addresses are the
+// same, comparing IP addresses by value.
+func samePeerAddress(a, b string) bool {
+	ahost, aport, err := net.SplitHostPort(a)
+	if err != nil {
+		return false
+	}
+	bhost, bport, err := net.SplitHostPort(b)
+	if err != nil || aport != bport {
+		return false
+	}
+	aip, bip := net.ParseIP(ahost), net.ParseIP(bhost)
+	if aip != nil && bip != nil {
+		return aip.Equal(bip)
+	}
+	return ahost == bhost
+}
+
+// failover abandons the control connection we're opening to the current
+// peer address, and sends an SCCRQ to the next: the redirect address if
+// one is given, otherwise the next address of the current peer or of the
+// alternate peers.  It returns false if there are no more addresses to try.
+func (dt *dynamicTunnel) failover(redirect string) bool {
+	if redirect != "" && !dt.triedPeers[redirect] {
+		dt.peerAddrs = nil
+		dt.alternatePeers = append([]string{redirect}, dt.alternatePeers...)
+	}
+
+	for {
+		for len(dt.peerAddrs) > 0 {
+			addr := dt.peerAddrs[0]
+			dt.peerAddrs = dt.peerAddrs[1:]
+
+			err := dt.connectAddress(addr)
+			if err != nil {
+				level.Error(dt.logger).Log(
+					"message", "failed to connect to peer",
+					"peer", dt.peer,
+					"address", sockaddrString(addr.sap),
+					"error", err)
+				continue
+			}
+
+			level.Info(dt.logger).Log(
+				"message", "failing over to peer",
+				"peer", dt.peer,
+				"address", sockaddrString(addr.sap))
+			dt.handleEvent("failover")
+			return true
+		}
+
+		if len(dt.alternatePeers) == 0 {
+			return false
+		}
+		peer := dt.alternatePeers[0]
+		dt.alternatePeers = dt.alternatePeers[1:]
+
+		if dt.triedPeers[peer] {
+			continue
+		}
+		dt.triedPeers[peer] = true
+
+		// Resolve the peer now rather than when the tunnel was created
+		// in case its addresses have changed in the meantime
+		addrs, err := dt.parent.resolveTunnelAddresses(dt.cfg, peer)
+		if err != nil {
+			level.Error(dt.logger).Log(
+				"message", "failed to resolve peer",
+				"peer", peer,
+				"error", err)
+			continue
+		}
+		dt.peer = peer
+		dt.peerAddrs = addrs
+	}
+}
+
+// connectAddress replaces the tunnel's control plane and transport with
+// ones for a control connection to a new peer address.
+func (dt *dynamicTunnel) connectAddress(addr tunnelAddress) error {
+	// The peer tunnel ID is learnt afresh from the new peer's SCCRP
+	dt.cfg.PeerTunnelID = 0
+	sal, sap := addr.sal, addr.sap
+
+	// The transport owns the control plane and closes it too
+	dt.xport.close()
+
+	cp, err := newL2tpControlPlane(sal, sap)
 	if err != nil {
 		return err
 	}
-	return dt.xport.send(msg)
+
+	err = cp.bind()
+	if err != nil {
+		cp.close()
+		return err
+	}
+
+	dt.cpLock.Lock()
+	dt.cp = cp
+	dt.cpLock.Unlock()
+	dt.sal, dt.sap = sal, sap
+
+	return dt.openTransport()
+}
+
+// redirectPeer returns the address of the LNS named by the error message
+// of a StopCCN asking us to try another LNS, or an empty string if the
+// message doesn't name one.  The message may be an IP address, in which
+// case the port of the current peer is used, or an IP address and port.
+func redirectPeer(errMsg, peer string) string {
+	errMsg = strings.TrimSpace(errMsg)
+	if host, _, err := net.SplitHostPort(errMsg); err == nil {
+		if net.ParseIP(host) != nil {
+			return errMsg
+		}
+		return ""
+	}
+	ip := net.ParseIP(errMsg)
+	if ip == nil {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(peer)
+	if err != nil {
+		return ""
+	}
+	return net.JoinHostPort(ip.String(), port)
+}
+
+func (dt *dynamicTunnel) sendSccrq() (err error) {
+	dt.tiebreaker, err = newTiebreaker()
+	if err != nil {
+		return err
+	}
+	var msg controlMessage
+	if dt.cfg.Version == ProtocolVersion3 {
+		msg, err = newV3Sccrq(dt.cfg, dt.parent.routerID, dt.authNonce(), dt.tiebreaker)
+	} else {
+		if dt.cfg.Secret != "" {
+			dt.challenge, err = newV2Challenge()
+			if err != nil {
+				return err
+			}
+		}
+		msg, err = newV2Sccrq(dt.cfg, dt.challenge, dt.tiebreaker)
+	}
+	if err != nil {
+		return err
+	}
+	return dt.send(msg)
+}
+
+// authNonce returns the Control Message Authentication Nonce to send in
+// an L2TPv3 SCCRQ or SCCRP, or nil if control messages aren't authenticated.
+func (dt *dynamicTunnel) authNonce() []byte {
+	if dt.digest == nil {
+		return nil
+	}
+	return dt.digest.nonce
+}
+
+// checkChallengeResponse verifies the peer's response to our challenge,
+// if we sent one.  Ref: RFC2661 section 5.1.1
+func (dt *dynamicTunnel) checkChallengeResponse(msg controlMessage) error {
+	if dt.challenge == nil {
+		return nil
+	}
+	response, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeChallengeResponse)
+	if err != nil {
+		return fmt.Errorf("no challenge response in %v", msg.getType())
+	}
+	if !hmac.Equal(response, v2ChallengeResponse(msg.getType(), dt.cfg.Secret, dt.challenge)) {
+		return fmt.Errorf("bad challenge response in %v", msg.getType())
+	}
+	return nil
+}
+
+// answerChallenge returns the response to the peer's challenge, if msg
+// carries one, to be sent in a message of type msgType.
+func (dt *dynamicTunnel) answerChallenge(msg controlMessage, msgType avpMsgType) ([]byte, error) {
+	challenge, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeChallenge)
+	if err != nil {
+		return nil, nil
+	}
+	if dt.cfg.Secret == "" {
+		return nil, fmt.Errorf("challenge in %v but no secret is configured", msg.getType())
+	}
+	return v2ChallengeResponse(msgType, dt.cfg.Secret, challenge), nil
+}
+
+// authFailed closes the tunnel on failure of tunnel authentication
+func (dt *dynamicTunnel) authFailed(err error) {
+	level.Error(dt.logger).Log(
+		"message", "tunnel authentication failed",
+		"error", err)
+	dt.handleEvent("close",
+		avpStopCCNResultCodeChannelNotAuthorized,
+		avpErrorCodeNoError,
+		fmt.Sprintf("not authorized: %v", err))
 }
 
 func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 
-	msg, from := fsmArgsToV2MsgFrom(args)
+	msg, from := fsmArgsToMsgFrom(args)
 
-	ptid, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeTunnelID)
+	ptid, err := findPeerControlConnID(msg)
 	if err != nil {
 		// Shouldn't occur since tunnel ID is mandatory
 		level.Error(dt.logger).Log(
@@ -431,11 +825,23 @@ func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 
 	// Reconfigure transport and socket now we know the peer TID
 	// and the address being used for this tunnel
-	dt.xport.config.PeerControlConnID = ControlConnID(ptid)
-	dt.cfg.PeerTunnelID = ControlConnID(ptid)
+	dt.xport.config.PeerControlConnID = ptid
+	dt.cfg.PeerTunnelID = ptid
 	dt.cp.connectTo(from)
 
-	err = dt.sendScccn()
+	err = dt.checkChallengeResponse(msg)
+	if err != nil {
+		dt.authFailed(err)
+		return
+	}
+
+	response, err := dt.answerChallenge(msg, avpMsgTypeScccn)
+	if err != nil {
+		dt.authFailed(err)
+		return
+	}
+
+	err = dt.sendScccn(response)
 	if err != nil {
 		level.Error(dt.logger).Log(
 			"message", "failed to send SCCCN",
@@ -444,9 +850,138 @@ func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 		return
 	}
 
+	dt.establish()
+}
+
+// fsmActOnSimultaneousSccrq handles an SCCRQ from the peer received while
+// our own SCCRQ is outstanding.  The Tie Breaker values in the two SCCRQs
+// decide which control connection survives: the lower value wins, and the
+// loser abandons its own attempt in favour of the peer's.
+// Ref: RFC2661 section 4.4.3, RFC3931 section 5.4.3
+func (dt *dynamicTunnel) fsmActOnSimultaneousSccrq(args []interface{}) {
+
+	msg, from := fsmArgsToMsgFrom(args)
+
+	// A peer which doesn't send a Tie Breaker doesn't expect its SCCRQ
+	// to take precedence over ours.
+	tiebreaker, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeTiebreaker)
+	if err != nil || bytes.Compare(dt.tiebreaker, tiebreaker) < 0 {
+		level.Info(dt.logger).Log(
+			"message", "ignoring SCCRQ from peer: our control connection wins the tie break")
+		return
+	}
+
+	// With equal values neither control connection wins, so tear ours
+	// down: the peer does the same.
+	if bytes.Equal(dt.tiebreaker, tiebreaker) {
+		dt.handleEvent("close",
+			avpStopCCNResultCodeChannelExists,
+			avpErrorCodeNoError,
+			"tie breaker values are equal")
+		return
+	}
+
+	ptid, err := findPeerControlConnID(msg)
+	if err != nil {
+		// Shouldn't occur since tunnel ID is mandatory
+		level.Error(dt.logger).Log(
+			"message", "failed to parse peer tunnel ID from SCCRQ",
+			"error", err)
+		dt.handleEvent("close")
+		return
+	}
+
+	level.Info(dt.logger).Log(
+		"message", "peer's control connection wins the tie break",
+		"peer_tunnel_id", ptid)
+
+	// Adopt the peer's control connection, which continues as though the
+	// peer's SCCRQ had opened an LNS mode tunnel.
+	dt.sccrq = msg
+	dt.xport.config.PeerControlConnID = ptid
+	dt.cfg.PeerTunnelID = ptid
+	dt.cp.connectTo(from)
+	if dt.digest != nil {
+		nonce, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeControlAuthNonce)
+		if err == nil {
+			dt.digest.setPeerNonce(nonce)
+		}
+	}
+
+	dt.handleEvent("tiebreaklost")
+}
+
+func (dt *dynamicTunnel) sendScccn(response []byte) (err error) {
+	var msg controlMessage
+	if dt.cfg.Version == ProtocolVersion3 {
+		msg, err = newV3Scccn(dt.cfg)
+	} else {
+		msg, err = newV2Scccn(dt.cfg, response)
+	}
+	if err != nil {
+		return err
+	}
+	return dt.send(msg)
+}
+
+// fsmActOnSccrq answers the SCCRQ which opened an LNS mode tunnel.
+// The peer tunnel ID and address are known from the SCCRQ, so the
+// transport and socket are already configured for the peer.
+func (dt *dynamicTunnel) fsmActOnSccrq(args []interface{}) {
+	response, err := dt.answerChallenge(dt.sccrq, avpMsgTypeSccrp)
+	if err != nil {
+		dt.authFailed(err)
+		return
+	}
+
+	err = dt.sendSccrp(response)
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "failed to send SCCRP message",
+			"error", err)
+		dt.fsmActClose(nil)
+	}
+}
+
+func (dt *dynamicTunnel) sendSccrp(response []byte) (err error) {
+	var msg controlMessage
+	if dt.cfg.Version == ProtocolVersion3 {
+		msg, err = newV3Sccrp(dt.cfg, dt.parent.routerID, dt.authNonce())
+	} else {
+		if dt.cfg.Secret != "" {
+			dt.challenge, err = newV2Challenge()
+			if err != nil {
+				return err
+			}
+		}
+		msg, err = newV2Sccrp(dt.cfg, dt.challenge, response)
+	}
+	if err != nil {
+		return err
+	}
+	return dt.send(msg)
+}
+
+func (dt *dynamicTunnel) fsmActOnScccn(args []interface{}) {
+	msg, _ := fsmArgsToMsgFrom(args)
+
+	err := dt.checkChallengeResponse(msg)
+	if err != nil {
+		dt.authFailed(err)
+		return
+	}
+
+	dt.establish()
+}
+
+// establish brings up the data plane once the control connection
+// three-way handshake is complete, and informs sessions and the user
+// that the tunnel is up.
+func (dt *dynamicTunnel) establish() {
 	level.Info(dt.logger).Log("message", "control plane established")
 
 	// establish the data plane
+	var err error
 	dt.dp, err = dt.parent.dp.NewTunnel(dt.cfg, dt.sal, dt.sap, dt.cp.fd)
 	if err != nil {
 		level.Error(dt.logger).Log(
@@ -475,31 +1010,30 @@ func (dt *dynamicTunnel) fsmActOnSccrp(args []interface{}) {
 		Config:       dt.cfg,
 		LocalAddress: dt.sal,
 		PeerAddress:  dt.sap,
+		Peer:         dt.peer,
 	})
 }
 
-func (dt *dynamicTunnel) sendScccn() error {
-	msg, err := newV2Scccn(dt.cfg)
-	if err != nil {
-		return err
-	}
-	return dt.xport.send(msg)
-}
-
 func (dt *dynamicTunnel) fsmActSendStopccn(args []interface{}) {
 
 	rc := fsmArgsToStopccnResult(args)
+	dt.recordStopccn(rc, true)
 	// Ignore tx error since we're going to close in any case
 	_ = dt.sendStopccn(rc)
 	dt.fsmActClose(args)
 }
 
-func (dt *dynamicTunnel) sendStopccn(rc *resultCode) error {
-	msg, err := newV2Stopccn(rc, dt.cfg)
+func (dt *dynamicTunnel) sendStopccn(rc *resultCode) (err error) {
+	var msg controlMessage
+	if dt.cfg.Version == ProtocolVersion3 {
+		msg, err = newV3Stopccn(rc, dt.cfg)
+	} else {
+		msg, err = newV2Stopccn(rc, dt.cfg)
+	}
 	if err != nil {
 		return err
 	}
-	return dt.xport.send(msg)
+	return dt.send(msg)
 }
 
 // Implementes stopccn pend timeout as per RFC2661 section 5.7.
@@ -508,20 +1042,107 @@ func (dt *dynamicTunnel) sendStopccn(rc *resultCode) error {
 // continue to drain the transport in order to allow messages to
 // be ACKed.
 func (dt *dynamicTunnel) fsmActOnStopccn(args []interface{}) {
+	msg, _ := fsmArgsToMsgFrom(args)
+	rc, err := findResultCodeAvp(msg.getAvps(), vendorIDIetf, avpTypeResultCode)
+	if err != nil {
+		// Shouldn't occur since the result code is mandatory
+		rc = &resultCode{}
+	}
+	dt.recordStopccn(rc, false)
+
 	level.Debug(dt.logger).Log(
 		"message", "pending for stopccn retransmit period",
 		"timeout", dt.cfg.StopCCNTimeout)
-	timeout := time.NewTimer(dt.cfg.StopCCNTimeout)
+	dt.drainTransport(dt.cfg.StopCCNTimeout)
+	dt.fsmActClose(args)
+}
+
+// drainTransport ignores messages received for the timeout period,
+// continuing to drain the transport in order to allow messages to be ACKed.
+func (dt *dynamicTunnel) drainTransport(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	for {
 		select {
-		case <-timeout.C:
-			dt.fsmActClose(args)
+		case <-timer.C:
 			return
-		case <-dt.xport.recvChan:
+		case _, ok := <-dt.xport.recvChan:
+			if !ok {
+				return
+			}
 		}
 	}
 }
 
+// recordDown records why the tunnel is going down, unless a cause has
+// already been recorded.
+func (dt *dynamicTunnel) recordDown(cause TunnelDownCause, result string) {
+	if !dt.downRecorded {
+		dt.downRecorded = true
+		dt.downCause = cause
+		dt.downResult = result
+	}
+}
+
+// recordStopccn records the result of a StopCCN sent to or received from
+// the peer.
+func (dt *dynamicTunnel) recordStopccn(rc *resultCode, sent bool) {
+	dt.stopccn = &StopCCNResult{
+		Sent:         sent,
+		ResultCode:   uint16(rc.result),
+		ErrorCode:    uint16(rc.errCode),
+		ErrorMessage: rc.errMsg,
+	}
+	cause := TunnelDownCauseStopCCNReceived
+	if sent {
+		cause = TunnelDownCauseStopCCNSent
+	}
+	dt.recordDown(cause, stopccnResultCodeToString(rc))
+}
+
+// recordTransportDown records the failure of the transport as the reason
+// the tunnel is going down.
+func (dt *dynamicTunnel) recordTransportDown() {
+	err := dt.xport.getDownErr()
+	if err == nil || err == errTransportClosed {
+		dt.recordDown(TunnelDownCauseClosed, "closed")
+		return
+	}
+	cause := TunnelDownCauseTransportError
+	if rerr, ok := err.(*retriesExhaustedError); ok {
+		cause = TunnelDownCauseRetriesExhausted
+		if rerr.msgType == avpMsgTypeHello {
+			cause = TunnelDownCauseHelloTimeout
+		}
+	}
+	dt.recordDown(cause, err.Error())
+}
+
+func stopccnResultCodeToString(rc *resultCode) string {
+	var resStr string
+
+	switch rc.result {
+	case avpStopCCNResultCodeReserved:
+		resStr = "reserved"
+	case avpStopCCNResultCodeClearConnection:
+		resStr = "general request to clear control connection"
+	case avpStopCCNResultCodeGeneralError:
+		resStr = "general error"
+	case avpStopCCNResultCodeChannelExists:
+		resStr = "control channel already exists"
+	case avpStopCCNResultCodeChannelNotAuthorized:
+		resStr = "requester is not authorized to establish a control channel"
+	case avpStopCCNResultCodeChannelProtocolVersionUnsupported:
+		resStr = "protocol version not supported"
+	case avpStopCCNResultCodeChannelShuttingDown:
+		resStr = "requester is being shut down"
+	case avpStopCCNResultCodeChannelFSMError:
+		resStr = "finite state machine error"
+	}
+
+	return resultCodeToString(rc, resStr)
+}
+
 func (dt *dynamicTunnel) fsmActLinkSession(args []interface{}) {
 	ds := fsmArgsToSession(args)
 	dt.linkSession(ds)
@@ -535,22 +1156,71 @@ func (dt *dynamicTunnel) fsmActStartSession(args []interface{}) {
 
 func (dt *dynamicTunnel) fsmActForwardSessionMsg(args []interface{}) {
 
-	msg, _ := fsmArgsToV2MsgFrom(args)
+	msg, _ := fsmArgsToMsgFrom(args)
 
-	if s, ok := dt.findSessionByID(ControlConnID(msg.Sid())); ok {
+	if s, ok := dt.findSessionByID(msgSessionID(msg)); ok {
 		if ds, ok := s.(*dynamicSession); ok {
 			ds.handleCtlMsg(msg)
 		}
+	} else if msg.getType() == avpMsgTypeIcrq && dt.listener != nil {
+		dt.acceptCall(msg)
+	} else if msg.getType() == avpMsgTypeOcrq && dt.listener == nil {
+		dt.acceptCall(msg)
 	} else {
-		// TODO: on receipt of ICRQ we'll end up here; to handle this
-		// we'd need to be able to create an LNS-mode session instance
 		level.Error(dt.logger).Log(
 			"message", "received session message for unknown session",
 			"message_type", msg.getType(),
-			"session ID", msg.Sid())
+			"session ID", msgSessionID(msg))
 	}
 }
 
+// acceptCall creates a session for a call requested by the peer: an LNS
+// mode session for an incoming call requested by an ICRQ, or a LAC mode
+// session for an outgoing call requested by an OCRQ.  The session decides
+// whether to accept the call.
+func (dt *dynamicTunnel) acceptCall(msg controlMessage) {
+
+	psid, err := findPeerSessionID(msg)
+	if err != nil {
+		// Shouldn't occur since session ID is mandatory
+		level.Error(dt.logger).Log(
+			"message", "failed to parse peer session ID",
+			"message_type", msg.getType(),
+			"error", err)
+		return
+	}
+
+	sid, err := dt.allocSid()
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "failed to allocate a SID",
+			"error", err)
+		return
+	}
+
+	cfg := &SessionConfig{
+		SessionID:     sid,
+		PeerSessionID: psid,
+	}
+	name := fmt.Sprintf("%s-%d", dt.getName(), sid)
+
+	var ds *dynamicSession
+	if msg.getType() == avpMsgTypeOcrq {
+		ds, err = newDynamicLACOutgoingSession(name, dt, cfg, msg)
+	} else {
+		ds, err = newDynamicLNSSession(name, dt, cfg, msg)
+	}
+	if err != nil {
+		level.Error(dt.logger).Log(
+			"message", "failed to create session",
+			"error", err)
+		return
+	}
+
+	dt.linkSession(ds)
+	ds.onTunnelUp()
+}
+
 func (dt *dynamicTunnel) fsmActForwardSessionPPP(args []interface{}) {
 
 	msg, _ := fsmArgsToPPPMsgFrom(args)
@@ -569,15 +1239,6 @@ func (dt *dynamicTunnel) fsmActForwardSessionPPP(args []interface{}) {
 	}
 }
 
-func (dt *dynamicTunnel) fsmActIgnoreMsg(args []interface{}) {
-
-	msg, _ := fsmArgsToV2MsgFrom(args)
-
-	level.Warn(dt.logger).Log(
-		"message", "ignoring unimplemented v2 control message",
-		"message_type", msg.getType())
-}
-
 // Closes all tunnel resources and unlinks child sessions.
 // The tunnel goroutine will terminate after this call completes
 // because the transport recv channel will have been closed.
@@ -603,6 +1264,7 @@ func (dt *dynamicTunnel) fsmActClose(args []interface{}) {
 		}
 		if dt.xport != nil {
 			dt.xport.close()
+			dt.recordTransportDown()
 		}
 		if dt.cp != nil {
 			dt.cp.close()
@@ -616,6 +1278,9 @@ func (dt *dynamicTunnel) fsmActClose(args []interface{}) {
 				Config:       dt.cfg,
 				LocalAddress: dt.sal,
 				PeerAddress:  dt.sap,
+				Cause:        dt.downCause,
+				StopCCN:      dt.stopccn,
+				Result:       dt.downResult,
 			})
 		}
 
@@ -625,27 +1290,14 @@ func (dt *dynamicTunnel) fsmActClose(args []interface{}) {
 }
 
 // Create a new client/LAC mode tunnel instance running the full control protocol
-func newDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig) (dt *dynamicTunnel, err error) {
+func newDynamicTunnel(name string, parent *Context, addrs []tunnelAddress, cfg *TunnelConfig) (dt *dynamicTunnel, err error) {
 
-	// Currently only handle L2TPv2
-	if cfg.Version != ProtocolVersion2 {
-		return nil, fmt.Errorf("L2TPv3 dynamic tunnels are not (yet) supported")
-	}
+	dt = newDynamicTunnelInstance(name, parent, addrs[0].sal, addrs[0].sap, cfg)
+	dt.peerAddrs = addrs[1:]
+	dt.alternatePeers = cfg.AlternatePeers
+	dt.triedPeers = map[string]bool{cfg.Peer: true}
 
-	dt = &dynamicTunnel{
-		baseTunnel: newBaseTunnel(
-			log.With(parent.logger, "tunnel_name", name),
-			name,
-			parent,
-			cfg),
-		sal:       sal,
-		sap:       sap,
-		closeChan: make(chan bool),
-		sendChan:  make(chan *sendMsg),
-		eventChan: make(chan *eventArgs),
-	}
-
-	// Ref: RFC2661 section 7.2.1
+	// Ref: RFC2661 section 7.2.1, RFC3931 section 7.2
 	dt.fsm = fsm{
 		current: "idle",
 		table: []eventDesc{
@@ -655,27 +1307,126 @@ func newDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg
 
 			// waitctlreply is for when we've sent an sccrq to the peer and are waiting on the reply
 			{from: "waitctlreply", events: []string{"sccrp"}, cb: dt.fsmActOnSccrp, to: "established"},
-			{from: "waitctlreply", events: []string{"stopccn"}, cb: dt.fsmActOnStopccn, to: "dead"},
+			{from: "waitctlreply", events: []string{"stopccn"}, cb: dt.fsmActOnSccrqStopccn, to: "waitctlreply"},
+			{from: "waitctlreply", events: []string{"rejected"}, cb: dt.fsmActOnStopccn, to: "dead"},
+			{from: "waitctlreply", events: []string{"failover"}, cb: dt.fsmActSendSccrq, to: "waitctlreply"},
 			{from: "waitctlreply", events: []string{"newsession"}, cb: dt.fsmActLinkSession, to: "waitctlreply"},
 			// TODO: don't really expect session messages: OK to ignore?
 			{from: "waitctlreply", events: []string{"sessionmsg"}, cb: nil, to: "waitctlreply"},
+			{from: "waitctlreply", events: []string{"sccrq"}, cb: dt.fsmActOnSimultaneousSccrq, to: "waitctlreply"},
+			{from: "waitctlreply", events: []string{"tiebreaklost"}, cb: dt.fsmActOnSccrq, to: "waitctlconn"},
 			{
 				from: "waitctlreply",
+				events: []string{
+					"scccn",
+					"close",
+				},
+				cb: dt.fsmActSendStopccn,
+				to: "dead",
+			},
+
+			// waitctlconn is for when we've lost a tie break with the peer, and
+			// have answered its SCCRQ with an SCCRP
+			{from: "waitctlconn", events: []string{"scccn"}, cb: dt.fsmActOnScccn, to: "established"},
+			{from: "waitctlconn", events: []string{"stopccn"}, cb: dt.fsmActOnStopccn, to: "dead"},
+			{from: "waitctlconn", events: []string{"newsession"}, cb: dt.fsmActLinkSession, to: "waitctlconn"},
+			{from: "waitctlconn", events: []string{"sessionmsg"}, cb: nil, to: "waitctlconn"},
+			{
+				from: "waitctlconn",
 				events: []string{
 					"sccrq",
+					"sccrp",
+					"close",
+				},
+				cb: dt.fsmActSendStopccn,
+				to: "dead",
+			},
+
+			// established is for once the tunnel three-way handshake is complete
+			{from: "established", events: []string{"stopccn"}, cb: dt.fsmActOnStopccn, to: "dead"},
+			{from: "established", events: []string{"newsession"}, cb: dt.fsmActStartSession, to: "established"},
+			{from: "established", events: []string{"sessionmsg", "sli", "wen"}, cb: dt.fsmActForwardSessionMsg, to: "established"},
+			{from: "established", events: []string{"pppmsg"}, cb: dt.fsmActForwardSessionPPP, to: "established"},
+			{
+				from: "established",
+				events: []string{
+					"sccrq",
+					"sccrp",
 					"scccn",
 					"close",
 				},
 				cb: dt.fsmActSendStopccn,
 				to: "dead",
 			},
+		},
+	}
+
+	dt.cp, err = newL2tpControlPlane(dt.sal, dt.sap)
+	if err != nil {
+		dt.Close()
+		return nil, err
+	}
+
+	err = dt.cp.bind()
+	if err != nil {
+		dt.Close()
+		return nil, err
+	}
+
+	err = dt.start()
+	if err != nil {
+		dt.Close()
+		return nil, err
+	}
+
+	return
+}
+
+// Create a new server/LNS mode tunnel instance running the full control
+// protocol, for a control connection opened by the peer's SCCRQ.
+//
+// The tunnel socket shares the listener's local address, and is connected
+// to the peer so that the peer's subsequent messages are delivered to the
+// tunnel rather than to the listener.
+//
+// The tunnel is linked into the parent context before it is started,
+// reserving its tunnel ID, since it may unlink itself as soon as it runs.
+func newDynamicLNSTunnel(name string, parent *Context, listener *dynamicListener, sap unix.Sockaddr, cfg *TunnelConfig, sccrq controlMessage) (dt *dynamicTunnel, err error) {
+
+	dt = newDynamicTunnelInstance(name, parent, listener.sal, sap, cfg)
+	dt.listener = listener
+	dt.sccrq = sccrq
+
+	parent.linkTunnel(dt)
+
+	// Ref: RFC2661 section 7.2.1, RFC3931 section 7.2
+	dt.fsm = fsm{
+		current: "idle",
+		table: []eventDesc{
+			// The tunnel is opened on receipt of the peer's SCCRQ
+			{from: "idle", events: []string{"open"}, cb: dt.fsmActOnSccrq, to: "waitctlconn"},
+
+			// waitctlconn is for when we've sent an sccrp to the peer and are waiting on the connect
+			{from: "waitctlconn", events: []string{"scccn"}, cb: dt.fsmActOnScccn, to: "established"},
+			{from: "waitctlconn", events: []string{"stopccn"}, cb: dt.fsmActOnStopccn, to: "dead"},
+			{from: "waitctlconn", events: []string{"newsession"}, cb: dt.fsmActLinkSession, to: "waitctlconn"},
+			{from: "waitctlconn", events: []string{"sessionmsg"}, cb: nil, to: "waitctlconn"},
+			{
+				from: "waitctlconn",
+				events: []string{
+					"sccrq",
+					"sccrp",
+					"close",
+				},
+				cb: dt.fsmActSendStopccn,
+				to: "dead",
+			},
 
 			// established is for once the tunnel three-way handshake is complete
 			{from: "established", events: []string{"stopccn"}, cb: dt.fsmActOnStopccn, to: "dead"},
 			{from: "established", events: []string{"newsession"}, cb: dt.fsmActStartSession, to: "established"},
-			{from: "established", events: []string{"sessionmsg"}, cb: dt.fsmActForwardSessionMsg, to: "established"},
+			{from: "established", events: []string{"sessionmsg", "sli", "wen"}, cb: dt.fsmActForwardSessionMsg, to: "established"},
 			{from: "established", events: []string{"pppmsg"}, cb: dt.fsmActForwardSessionPPP, to: "established"},
-			{from: "established", events: []string{"sli", "wen"}, cb: dt.fsmActIgnoreMsg, to: "established"},
 			{
 				from: "established",
 				events: []string{
@@ -690,7 +1441,13 @@ func newDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg
 		},
 	}
 
-	dt.cp, err = newL2tpControlPlane(sal, sap)
+	dt.cp, err = newL2tpControlPlane(listener.sal, sap)
+	if err != nil {
+		dt.Close()
+		return nil, err
+	}
+
+	err = dt.cp.reuseAddr()
 	if err != nil {
 		dt.Close()
 		return nil, err
@@ -702,7 +1459,73 @@ func newDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg
 		return nil, err
 	}
 
-	dt.xport, err = newTransport(dt.logger, dt.cp, transportConfig{
+	err = dt.cp.connect()
+	if err != nil {
+		dt.Close()
+		return nil, err
+	}
+
+	err = dt.start()
+	if err != nil {
+		dt.Close()
+		return nil, err
+	}
+
+	return
+}
+
+func newDynamicTunnelInstance(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig) *dynamicTunnel {
+	return &dynamicTunnel{
+		baseTunnel: newBaseTunnel(
+			log.With(parent.logger, "tunnel_name", name),
+			name,
+			parent,
+			cfg),
+		sal:       sal,
+		sap:       sap,
+		peer:      cfg.Peer,
+		closeChan: make(chan bool),
+		sendChan:  make(chan *sendMsg),
+		eventChan: make(chan *eventArgs),
+	}
+}
+
+// start creates the transport and runs the tunnel goroutine
+func (dt *dynamicTunnel) start() (err error) {
+	err = dt.openTransport()
+	if err != nil {
+		return err
+	}
+
+	// The listener received the SCCRQ which opened an LNS mode tunnel:
+	// account for it in the transport so that our SCCRP acknowledges it.
+	if dt.sccrq != nil {
+		dt.xport.slowStart.incrementNr()
+	}
+
+	dt.wg.Add(1)
+	go dt.runTunnel()
+
+	return nil
+}
+
+// openTransport creates the transport for the tunnel's control plane
+func (dt *dynamicTunnel) openTransport() (err error) {
+	if dt.cfg.DigestType != DigestTypeNone {
+		dt.digest, err = newV3Digest(dt.cfg.DigestType, dt.cfg.Secret)
+		if err != nil {
+			return err
+		}
+		// An LNS mode tunnel learns the peer's nonce from the SCCRQ
+		if dt.sccrq != nil {
+			nonce, err := findBytesAvp(dt.sccrq.getAvps(), vendorIDIetf, avpTypeControlAuthNonce)
+			if err == nil {
+				dt.digest.setPeerNonce(nonce)
+			}
+		}
+	}
+
+	xport, err := newTransport(dt.logger, dt.cp, transportConfig{
 		HelloTimeout:      dt.cfg.HelloTimeout,
 		TxWindowSize:      dt.cfg.WindowSize,
 		MaxRetries:        dt.cfg.MaxRetries,
@@ -710,14 +1533,12 @@ func newDynamicTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg
 		AckTimeout:        time.Millisecond * 100,
 		Version:           dt.cfg.Version,
 		PeerControlConnID: dt.cfg.PeerTunnelID,
+		Digest:            dt.digest,
 	})
 	if err != nil {
-		dt.Close()
-		return nil, err
+		return err
 	}
 
-	dt.wg.Add(1)
-	go dt.runTunnel()
-
-	return
+	dt.xport = xport
+	return nil
 }
@@ -2,15 +2,20 @@ package l2tp
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
 )
 
 // Must be called with root permissions
@@ -504,3 +509,175 @@ func checkTunnel(cfg *TunnelConfig) error {
 	}
 	return validateIPL2tpTunnelOut(out, tid, ptid, cfg.Encap)
 }
+
+// testResolver resolves host names from a fixed table, counting lookups
+type testResolver struct {
+	lock    sync.Mutex
+	hosts   map[string][]string
+	lookups map[string]int
+}
+
+func newTestResolver(hosts map[string][]string) *testResolver {
+	return &testResolver{
+		hosts:   hosts,
+		lookups: make(map[string]int),
+	}
+}
+
+func (r *testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lookups[host]++
+	ips, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func (r *testResolver) getLookups(host string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.lookups[host]
+}
+
+func TestResolveTunnelAddresses(t *testing.T) {
+	resolver := newTestResolver(map[string][]string{
+		"lns.example.com": {"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2", "192.0.2.3"},
+		"lac.example.com": {"192.0.2.100"},
+		"v4.example.com":  {"192.0.2.1", "192.0.2.2", "2001:db8::1"},
+		"empty.example":   {},
+	})
+	cases := []struct {
+		name      string
+		cfg       TunnelConfig
+		peer      string
+		want      []tunnelAddress
+		expectErr bool
+	}{
+		{
+			name: "IP addresses",
+			cfg:  TunnelConfig{Local: "127.0.0.1:1701", Encap: EncapTypeUDP},
+			peer: "127.0.0.2:1702",
+			want: []tunnelAddress{
+				{
+					sal: &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 1701},
+					sap: &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 2}, Port: 1702},
+				},
+			},
+		},
+		{
+			name: "families interleaved starting with IPv6",
+			cfg:  TunnelConfig{Encap: EncapTypeUDP},
+			peer: "lns.example.com:1701",
+			want: []tunnelAddress{
+				{
+					sal: &unix.SockaddrInet6{},
+					sap: &unix.SockaddrInet6{Addr: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}, Port: 1701},
+				},
+				{
+					sal: &unix.SockaddrInet4{},
+					sap: &unix.SockaddrInet4{Addr: [4]byte{192, 0, 2, 1}, Port: 1701},
+				},
+				{
+					sal: &unix.SockaddrInet6{},
+					sap: &unix.SockaddrInet6{Addr: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 2}, Port: 1701},
+				},
+				{
+					sal: &unix.SockaddrInet4{},
+					sap: &unix.SockaddrInet4{Addr: [4]byte{192, 0, 2, 2}, Port: 1701},
+				},
+				{
+					sal: &unix.SockaddrInet4{},
+					sap: &unix.SockaddrInet4{Addr: [4]byte{192, 0, 2, 3}, Port: 1701},
+				},
+			},
+		},
+		{
+			name: "families interleaved starting with IPv4",
+			cfg:  TunnelConfig{Encap: EncapTypeUDP},
+			peer: "v4.example.com:1701",
+			want: []tunnelAddress{
+				{
+					sal: &unix.SockaddrInet4{},
+					sap: &unix.SockaddrInet4{Addr: [4]byte{192, 0, 2, 1}, Port: 1701},
+				},
+				{
+					sal: &unix.SockaddrInet6{},
+					sap: &unix.SockaddrInet6{Addr: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}, Port: 1701},
+				},
+				{
+					sal: &unix.SockaddrInet4{},
+					sap: &unix.SockaddrInet4{Addr: [4]byte{192, 0, 2, 2}, Port: 1701},
+				},
+			},
+		},
+		{
+			name: "peer addresses limited to local address family",
+			cfg:  TunnelConfig{Local: "lac.example.com:1701", Encap: EncapTypeIP, TunnelID: 42, PeerTunnelID: 43},
+			peer: "v4.example.com:0",
+			want: []tunnelAddress{
+				{
+					sal: &unix.SockaddrL2TPIP{Addr: [4]byte{192, 0, 2, 100}, ConnId: 42},
+					sap: &unix.SockaddrL2TPIP{Addr: [4]byte{192, 0, 2, 1}, ConnId: 43},
+				},
+				{
+					sal: &unix.SockaddrL2TPIP{Addr: [4]byte{192, 0, 2, 100}, ConnId: 42},
+					sap: &unix.SockaddrL2TPIP{Addr: [4]byte{192, 0, 2, 2}, ConnId: 43},
+				},
+			},
+		},
+		{
+			name:      "no address of local address family",
+			cfg:       TunnelConfig{Local: "[::1]:1701", Encap: EncapTypeUDP},
+			peer:      "lac.example.com:1701",
+			expectErr: true,
+		},
+		{
+			name:      "unknown host",
+			cfg:       TunnelConfig{Encap: EncapTypeUDP},
+			peer:      "unknown.example.com:1701",
+			expectErr: true,
+		},
+		{
+			name:      "no addresses",
+			cfg:       TunnelConfig{Encap: EncapTypeUDP},
+			peer:      "empty.example:1701",
+			expectErr: true,
+		},
+		{
+			name:      "missing port",
+			cfg:       TunnelConfig{Encap: EncapTypeUDP},
+			peer:      "lns.example.com",
+			expectErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, err := NewContext(nil, nil)
+			if err != nil {
+				t.Fatalf("NewContext(): %v", err)
+			}
+			defer ctx.Close()
+			ctx.SetResolver(resolver)
+
+			got, err := ctx.resolveTunnelAddresses(&c.cfg, c.peer)
+			if c.expectErr {
+				if err == nil {
+					t.Fatalf("resolveTunnelAddresses(%v): expected error, got %v", c.peer, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveTunnelAddresses(%v): %v", c.peer, err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("resolveTunnelAddresses(%v): expected %v, got %v", c.peer, c.want, got)
+			}
+		})
+	}
+}
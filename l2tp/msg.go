@@ -2,10 +2,16 @@ package l2tp
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"sync"
 )
 
 // L2TPv2 and L2TPv3 headers have these fields in common
@@ -160,6 +166,42 @@ func v2IccnMsgSpec() *msgSpec {
 	return &spec
 }
 
+func v2OcrqMsgSpec() *msgSpec {
+	/* Ref: RFC2661 section 6.9 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeSessionID] = mustExist
+	spec.m[avpTypeCallSerialNumber] = mustExist
+	spec.m[avpTypeMinimumBps] = mustExist
+	spec.m[avpTypeMaximumBps] = mustExist
+	spec.m[avpTypeBearerType] = mustExist
+	spec.m[avpTypeFramingType] = mustExist
+	spec.m[avpTypeCalledNumber] = mustExist
+	spec.m[avpTypeSubAddress] = mayExist
+	spec.m[avpTypeRxWindowSize] = mayExist
+	return &spec
+}
+
+func v2OcrpMsgSpec() *msgSpec {
+	/* Ref: RFC2661 section 6.10 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeSessionID] = mustExist
+	spec.m[avpTypePhysicalChannelID] = mayExist
+	return &spec
+}
+
+func v2OccnMsgSpec() *msgSpec {
+	/* Ref: RFC2661 section 6.11 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeConnectSpeed] = mustExist
+	spec.m[avpTypeFramingType] = mustExist
+	spec.m[avpTypeRxConnectSpeed] = mayExist
+	spec.m[avpTypeSequencingRequired] = mayExist
+	return &spec
+}
+
 func v2CdnMsgSpec() *msgSpec {
 	/* Ref: RFC2661 section 6.12 */
 	spec := msgSpec{make(map[avpType]avpSpec)}
@@ -204,6 +246,12 @@ func getV2MsgSpec(t avpMsgType) (*msgSpec, error) {
 		return v2IcrpMsgSpec(), nil
 	case avpMsgTypeIccn:
 		return v2IccnMsgSpec(), nil
+	case avpMsgTypeOcrq:
+		return v2OcrqMsgSpec(), nil
+	case avpMsgTypeOcrp:
+		return v2OcrpMsgSpec(), nil
+	case avpMsgTypeOccn:
+		return v2OccnMsgSpec(), nil
 	case avpMsgTypeCdn:
 		return v2CdnMsgSpec(), nil
 	case avpMsgTypeWen:
@@ -214,6 +262,63 @@ func getV2MsgSpec(t avpMsgType) (*msgSpec, error) {
 	return nil, fmt.Errorf("no specification for v2 message %v", t)
 }
 
+func v3SccrqMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.1 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeHostName] = mustExist
+	spec.m[avpTypeRouterID] = mustExist
+	spec.m[avpTypeAssignedConnID] = mustExist
+	spec.m[avpTypePseudowireCaps] = mustExist
+
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeControlAuthNonce] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeTiebreaker] = mayExist
+	spec.m[avpTypeVendorName] = mayExist
+	spec.m[avpTypeRxWindowSize] = mayExist
+	spec.m[avpTypePreferredLanguage] = mayExist
+	return &spec
+}
+
+func v3SccrpMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.2 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeHostName] = mustExist
+	spec.m[avpTypeRouterID] = mustExist
+	spec.m[avpTypeAssignedConnID] = mustExist
+	spec.m[avpTypePseudowireCaps] = mustExist
+
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeControlAuthNonce] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeVendorName] = mayExist
+	spec.m[avpTypeRxWindowSize] = mayExist
+	spec.m[avpTypePreferredLanguage] = mayExist
+	return &spec
+}
+
+func v3ScccnMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.3 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	return &spec
+}
+
+func v3StopccnMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.4 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeResultCode] = mustExist
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeAssignedConnID] = mayExist
+	return &spec
+}
+
 func v3HelloMsgSpec() *msgSpec {
 	/* Ref: RFC3931 section 6.5 */
 	spec := msgSpec{make(map[avpType]avpSpec)}
@@ -223,10 +328,108 @@ func v3HelloMsgSpec() *msgSpec {
 	return &spec
 }
 
+func v3IcrqMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.6 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+	spec.m[avpTypeCallSerialNumber] = mustExist
+	spec.m[avpTypePseudowireType] = mustExist
+	spec.m[avpTypeRemoteEndID] = mustExist
+	spec.m[avpTypeCircuitStatus] = mustExist
+
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeAssignedCookie] = mayExist
+	spec.m[avpTypeL2specificSublayer] = mayExist
+	spec.m[avpTypeDataSequencing] = mayExist
+	spec.m[avpTypeTxConnectSpeedBps] = mayExist
+	spec.m[avpTypeRxConnectSpeedBps] = mayExist
+	spec.m[avpTypePhysicalChannelID] = mayExist
+	return &spec
+}
+
+func v3IcrpMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.7 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+	spec.m[avpTypeCircuitStatus] = mustExist
+
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeAssignedCookie] = mayExist
+	spec.m[avpTypeL2specificSublayer] = mayExist
+	spec.m[avpTypeDataSequencing] = mayExist
+	spec.m[avpTypeTxConnectSpeedBps] = mayExist
+	spec.m[avpTypeRxConnectSpeedBps] = mayExist
+	spec.m[avpTypePhysicalChannelID] = mayExist
+	return &spec
+}
+
+func v3IccnMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.8 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeL2specificSublayer] = mayExist
+	spec.m[avpTypeDataSequencing] = mayExist
+	spec.m[avpTypeTxConnectSpeedBps] = mayExist
+	spec.m[avpTypeRxConnectSpeedBps] = mayExist
+	spec.m[avpTypeCircuitStatus] = mayExist
+	return &spec
+}
+
+func v3CdnMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.12 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeResultCode] = mustExist
+	spec.m[avpTypeLocalSessionID] = mustExist
+	spec.m[avpTypeRemoteSessionID] = mustExist
+
+	spec.m[avpTypeRandomVector] = mayExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	spec.m[avpTypeQ931CauseCode] = mayExist
+	return &spec
+}
+
+func v3AckMsgSpec() *msgSpec {
+	/* Ref: RFC3931 section 6.15 */
+	spec := msgSpec{make(map[avpType]avpSpec)}
+	spec.m[avpTypeMessage] = mustExist
+	spec.m[avpTypeMessageDigest] = mayExist
+	return &spec
+}
+
 func getV3MsgSpec(t avpMsgType) (*msgSpec, error) {
 	switch t {
+	case avpMsgTypeSccrq:
+		return v3SccrqMsgSpec(), nil
+	case avpMsgTypeSccrp:
+		return v3SccrpMsgSpec(), nil
+	case avpMsgTypeScccn:
+		return v3ScccnMsgSpec(), nil
+	case avpMsgTypeStopccn:
+		return v3StopccnMsgSpec(), nil
 	case avpMsgTypeHello:
 		return v3HelloMsgSpec(), nil
+	case avpMsgTypeIcrq:
+		return v3IcrqMsgSpec(), nil
+	case avpMsgTypeIcrp:
+		return v3IcrpMsgSpec(), nil
+	case avpMsgTypeIccn:
+		return v3IccnMsgSpec(), nil
+	case avpMsgTypeCdn:
+		return v3CdnMsgSpec(), nil
+	case avpMsgTypeAck:
+		return v3AckMsgSpec(), nil
 	}
 	return nil, fmt.Errorf("no specification for v3 message %v", t)
 }
@@ -264,6 +467,11 @@ func validateAvps(avps []avp, spec *msgSpec) error {
 		if as == mustExist {
 			seen[avp.getType()] = true
 		}
+		// The value of a hidden AVP can't be decoded.  Hidden AVPs in
+		// received messages are revealed before validation.
+		if avp.isHidden() {
+			continue
+		}
 		_, err := avp.decode()
 		if err != nil {
 			return fmt.Errorf("failed to decode AVP %v: %v", avp.getType(), err)
@@ -342,14 +550,18 @@ func bytesToV3CtlMsg(b []byte) (msg *v3ControlMessage, err error) {
 		return nil, err
 	}
 
-	if avps, err = parseAVPBuffer(b[v3HeaderLen:hdr.Common.Len]); err != nil {
-		return nil, err
-	}
+	// RFC3931 acknowledges messages using an explicit ACK message, but
+	// peers may also send ZLB (zero-length-body) acks as per RFC2661.
+	if hdr.Common.Len > v3HeaderLen {
+		if avps, err = parseAVPBuffer(b[v3HeaderLen:hdr.Common.Len]); err != nil {
+			return nil, err
+		}
 
-	// RFC3931 says the first AVP in the message MUST be the Message Type AVP,
-	// so let's validate that now
-	if avps[0].getType() != avpTypeMessage {
-		return nil, errors.New("invalid L2TPv3 message: first AVP is not Message Type AVP")
+		// RFC3931 says the first AVP in the message MUST be the Message Type AVP,
+		// so let's validate that now
+		if avps[0].getType() != avpTypeMessage {
+			return nil, errors.New("invalid L2TPv3 message: first AVP is not Message Type AVP")
+		}
 	}
 
 	return &v3ControlMessage{
@@ -483,9 +695,66 @@ func (m *v2ControlMessage) validate() error {
 	if err != nil {
 		return err
 	}
+	// Any message may carry Random Vector AVPs for hidden AVPs
+	spec.m[avpTypeRandomVector] = mayExist
 	return validateAvps(m.avps, spec)
 }
 
+// hideAvps hides the message's AVPs of the given types, inserting a
+// Random Vector AVP ahead of the first hidden AVP.  Ref: RFC2661 section 4.3
+func (m *v2ControlMessage) hideAvps(secret string, types map[avpType]bool) error {
+	var rv []byte
+	avps := []avp{}
+	for _, a := range m.avps {
+		if a.vendorID() == vendorIDIetf && types[a.getType()] && !a.isHidden() {
+			if rv == nil {
+				rv = make([]byte, avpHiddenBlockLen)
+				if _, err := rand.Read(rv); err != nil {
+					return err
+				}
+				rva, err := newAvp(vendorIDIetf, avpTypeRandomVector, rv)
+				if err != nil {
+					return err
+				}
+				avps = append(avps, *rva)
+			}
+			if err := a.hide(secret, rv); err != nil {
+				return err
+			}
+		}
+		avps = append(avps, a)
+	}
+	m.avps = avps
+	m.header.Common.Len = uint16(v2HeaderLen + avpsLengthBytes(avps))
+	return nil
+}
+
+// unhideAvps reveals the message's hidden AVPs using the value of the
+// most recent Random Vector AVP preceding each.  Ref: RFC2661 section 4.3
+func (m *v2ControlMessage) unhideAvps(secret string) error {
+	var rv []byte
+	for i := range m.avps {
+		a := &m.avps[i]
+		if a.vendorID() == vendorIDIetf && a.getType() == avpTypeRandomVector {
+			rv = a.payload.data
+			continue
+		}
+		if !a.isHidden() {
+			continue
+		}
+		if secret == "" {
+			return fmt.Errorf("hidden AVP %v but no secret is configured", a.getType())
+		}
+		if rv == nil {
+			return fmt.Errorf("hidden AVP %v without a preceding Random Vector", a.getType())
+		}
+		if err := a.unhide(secret, rv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *v3ControlMessage) protocolVersion() ProtocolVersion {
 	return ProtocolVersion3
 }
@@ -507,6 +776,11 @@ func (m *v3ControlMessage) getAvps() []avp {
 }
 
 func (m v3ControlMessage) getType() avpMsgType {
+	// ZLB messages are treated as ACK messages, c.f. v2ControlMessage
+	if len(m.getAvps()) == 0 {
+		return avpMsgTypeAck
+	}
+
 	avp := m.getAvps()[0]
 
 	// c.f. bytesToV2CtlMsg: we've validated this condition at message
@@ -663,8 +937,47 @@ func buildV2Msg(ptid ControlConnID, psid ControlConnID, in []avpIn) (msg *v2Cont
 	return
 }
 
+// v2ChallengeLen is the length of the challenges we send for tunnel
+// authentication
+const v2ChallengeLen = 16
+
+// newV2Challenge generates a random challenge for tunnel authentication
+func newV2Challenge() ([]byte, error) {
+	challenge := make([]byte, v2ChallengeLen)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// v2ChallengeResponse computes the response to a tunnel authentication
+// challenge, which is carried in a message of type msgType.
+// Ref: RFC2661 section 5.1.1, RFC1994 section 4.1
+func v2ChallengeResponse(msgType avpMsgType, secret string, challenge []byte) []byte {
+	h := md5.New()
+	h.Write([]byte{byte(msgType)})
+	h.Write([]byte(secret))
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+// tiebreakerLen is the length of the Tie Breaker AVP value.
+// Ref: RFC2661 section 4.4.3, RFC3931 section 5.4.3
+const tiebreakerLen = 8
+
+// newTiebreaker generates a random Tie Breaker AVP value
+func newTiebreaker() ([]byte, error) {
+	tiebreaker := make([]byte, tiebreakerLen)
+	_, err := rand.Read(tiebreaker)
+	if err != nil {
+		return nil, err
+	}
+	return tiebreaker, nil
+}
+
 // newV2Sccrq builds a new SCCRQ message
-func newV2Sccrq(cfg *TunnelConfig) (msg *v2ControlMessage, err error) {
+func newV2Sccrq(cfg *TunnelConfig, challenge, tiebreaker []byte) (msg *v2ControlMessage, err error) {
 	/* RFC2661 says we MUST include:
 
 	- Message Type
@@ -689,11 +1002,17 @@ func newV2Sccrq(cfg *TunnelConfig) (msg *v2ControlMessage, err error) {
 		{avpTypeFramingCap, uint32(cfg.FramingCaps)},
 		{avpTypeTunnelID, uint16(cfg.TunnelID)},
 	}
+	if challenge != nil {
+		in = append(in, avpIn{avpTypeChallenge, challenge})
+	}
+	if tiebreaker != nil {
+		in = append(in, avpIn{avpTypeTiebreaker, tiebreaker})
+	}
 	return buildV2Msg(0, 0, in)
 }
 
 // newV2Sccrp builds a new SCCRP message
-func newV2Sccrp(cfg *TunnelConfig) (msg *v2ControlMessage, err error) {
+func newV2Sccrp(cfg *TunnelConfig, challenge, response []byte) (msg *v2ControlMessage, err error) {
 	/* RFC2661 says we MUST include:
 
 	- Message Type
@@ -718,11 +1037,17 @@ func newV2Sccrp(cfg *TunnelConfig) (msg *v2ControlMessage, err error) {
 		{avpTypeHostName, cfg.HostName},
 		{avpTypeTunnelID, uint16(cfg.TunnelID)},
 	}
+	if challenge != nil {
+		in = append(in, avpIn{avpTypeChallenge, challenge})
+	}
+	if response != nil {
+		in = append(in, avpIn{avpTypeChallengeResponse, response})
+	}
 	return buildV2Msg(cfg.PeerTunnelID, 0, in)
 }
 
 // newV2Scccn builds a new SCCCN message
-func newV2Scccn(cfg *TunnelConfig) (msg *v2ControlMessage, err error) {
+func newV2Scccn(cfg *TunnelConfig, response []byte) (msg *v2ControlMessage, err error) {
 	/* RFC2661 says we MUST include:
 
 	- Message Type
@@ -735,6 +1060,9 @@ func newV2Scccn(cfg *TunnelConfig) (msg *v2ControlMessage, err error) {
 	in := []avpIn{
 		{avpTypeMessage, avpMsgTypeScccn},
 	}
+	if response != nil {
+		in = append(in, avpIn{avpTypeChallengeResponse, response})
+	}
 	return buildV2Msg(cfg.PeerTunnelID, 0, in)
 }
 
@@ -837,6 +1165,77 @@ func newV2Iccn(ptid ControlConnID, scfg *SessionConfig) (msg *v2ControlMessage,
 	return buildV2Msg(ptid, scfg.PeerSessionID, in)
 }
 
+// newV2Ocrq builds a new OCRQ message
+func newV2Ocrq(callSerial uint32, ptid ControlConnID, scfg *SessionConfig) (msg *v2ControlMessage, err error) {
+	/* RFC2661 says we MUST include:
+
+	- Message Type
+	- Assigned Session ID
+	- Call Serial Number
+	- Minimum BPS
+	- Maximum BPS
+	- Bearer Type
+	- Framing Type
+	- Called Number
+
+	and we MAY include:
+
+	- Sub-Address
+	- Receive Window Size
+
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeOcrq},
+		{avpTypeSessionID, uint16(scfg.SessionID)},
+		{avpTypeCallSerialNumber, callSerial},
+		{avpTypeMinimumBps, uint32(0)},                                 // TODO: config field?
+		{avpTypeMaximumBps, ^uint32(0)},                                // TODO: config field?
+		{avpTypeBearerType, uint32(0x3)},                               // analog or digital
+		{avpTypeFramingType, uint32(FramingCapSync | FramingCapAsync)}, // TODO: config field?
+		{avpTypeCalledNumber, scfg.CalledNumber},
+	}
+	return buildV2Msg(ptid, 0, in)
+}
+
+// newV2Ocrp builds a new OCRP message
+func newV2Ocrp(ptid ControlConnID, scfg *SessionConfig) (msg *v2ControlMessage, err error) {
+	/* RFC2661 says we MUST include
+
+	- Message Type
+	- Assigned Session ID
+
+	and we MAY include:
+
+	- Physical Channel ID
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeOcrp},
+		{avpTypeSessionID, uint16(scfg.SessionID)},
+	}
+	return buildV2Msg(ptid, scfg.PeerSessionID, in)
+}
+
+// newV2Occn builds a new OCCN message
+func newV2Occn(ptid ControlConnID, scfg *SessionConfig) (msg *v2ControlMessage, err error) {
+	/* RFC2661 says we MUST include:
+
+	- Message Type
+	- (Tx) Connect Speed
+	- Framing Type
+
+	and we MAY include:
+
+	- Rx Connect Speed
+	- Sequencing Required
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeOccn},
+		{avpTypeConnectSpeed, uint32(0)},                               // TODO: config field?
+		{avpTypeFramingType, uint32(FramingCapSync | FramingCapAsync)}, // TODO: config field?
+	}
+	return buildV2Msg(ptid, scfg.PeerSessionID, in)
+}
+
 // newV2Cdn builds a new CDN message
 func newV2Cdn(ptid ControlConnID, rc *resultCode, scfg *SessionConfig) (msg *v2ControlMessage, err error) {
 	/* RFC2661 says we MUST include:
@@ -857,6 +1256,97 @@ func newV2Cdn(ptid ControlConnID, rc *resultCode, scfg *SessionConfig) (msg *v2C
 	return buildV2Msg(ptid, scfg.PeerSessionID, in)
 }
 
+// newV2Wen builds a new WEN message
+func newV2Wen(ptid ControlConnID, scfg *SessionConfig, ce *CallErrors) (msg *v2ControlMessage, err error) {
+	/* RFC2661 says we MUST include:
+
+	- Message Type
+	- Call Errors
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeWen},
+		{avpTypeCallErrors, encodeCallErrors(ce)},
+	}
+	return buildV2Msg(ptid, scfg.PeerSessionID, in)
+}
+
+// newV2Sli builds a new SLI message
+func newV2Sli(ptid ControlConnID, scfg *SessionConfig, accm *ACCM) (msg *v2ControlMessage, err error) {
+	/* RFC2661 says we MUST include:
+
+	- Message Type
+	- ACCM
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeSli},
+		{avpTypeAccm, encodeACCM(accm)},
+	}
+	return buildV2Msg(ptid, scfg.PeerSessionID, in)
+}
+
+// The Call Errors and ACCM AVP values start with two reserved bytes.
+// Ref: RFC2661 section 4.4.6
+const (
+	callErrorsLen = 2 + 6*4
+	accmLen       = 2 + 2*4
+)
+
+func encodeCallErrors(ce *CallErrors) []byte {
+	b := make([]byte, callErrorsLen)
+	for i, v := range []uint32{
+		ce.CRCErrors,
+		ce.FramingErrors,
+		ce.HardwareOverruns,
+		ce.BufferOverruns,
+		ce.TimeoutErrors,
+		ce.AlignmentErrors,
+	} {
+		binary.BigEndian.PutUint32(b[2+4*i:], v)
+	}
+	return b
+}
+
+// findCallErrorsAvp looks up and decodes the Call Errors AVP of a WEN message
+func findCallErrorsAvp(avps []avp) (*CallErrors, error) {
+	b, err := findBytesAvp(avps, vendorIDIetf, avpTypeCallErrors)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != callErrorsLen {
+		return nil, fmt.Errorf("bad %v length %d", avpTypeCallErrors, len(b))
+	}
+	return &CallErrors{
+		CRCErrors:        binary.BigEndian.Uint32(b[2:]),
+		FramingErrors:    binary.BigEndian.Uint32(b[6:]),
+		HardwareOverruns: binary.BigEndian.Uint32(b[10:]),
+		BufferOverruns:   binary.BigEndian.Uint32(b[14:]),
+		TimeoutErrors:    binary.BigEndian.Uint32(b[18:]),
+		AlignmentErrors:  binary.BigEndian.Uint32(b[22:]),
+	}, nil
+}
+
+func encodeACCM(accm *ACCM) []byte {
+	b := make([]byte, accmLen)
+	binary.BigEndian.PutUint32(b[2:], accm.SendACCM)
+	binary.BigEndian.PutUint32(b[6:], accm.ReceiveACCM)
+	return b
+}
+
+// findACCMAvp looks up and decodes the ACCM AVP of an SLI message
+func findACCMAvp(avps []avp) (*ACCM, error) {
+	b, err := findBytesAvp(avps, vendorIDIetf, avpTypeAccm)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != accmLen {
+		return nil, fmt.Errorf("bad %v length %d", avpTypeAccm, len(b))
+	}
+	return &ACCM{
+		SendACCM:    binary.BigEndian.Uint32(b[2:]),
+		ReceiveACCM: binary.BigEndian.Uint32(b[6:]),
+	}, nil
+}
+
 // newV3ControlMessage builds a new control message
 func newV3ControlMessage(ccid ControlConnID, avps []avp) (msg *v3ControlMessage, err error) {
 	return &v3ControlMessage{
@@ -864,3 +1354,488 @@ func newV3ControlMessage(ccid ControlConnID, avps []avp) (msg *v3ControlMessage,
 		avps:   avps,
 	}, nil
 }
+
+func buildV3Msg(ccid ControlConnID, in []avpIn) (msg *v3ControlMessage, err error) {
+	msg, err = newV3ControlMessage(ccid, []avp{})
+	if err != nil {
+		return
+	}
+	for _, i := range in {
+		avp, err := newAvp(vendorIDIetf, i.typ, i.data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AVP %v: %v", i.typ, err)
+		}
+		msg.appendAvp(avp)
+	}
+	return
+}
+
+// Circuit Status AVP bits.  Ref: RFC3931 section 5.4.5
+const (
+	v3CircuitStatusActive uint16 = 0x0001
+	v3CircuitStatusNew    uint16 = 0x0002
+)
+
+// Data Sequencing AVP values.  Ref: RFC3931 section 5.4.4
+const (
+	v3DataSequencingNone uint16 = 0
+	v3DataSequencingAll  uint16 = 2
+)
+
+// v3PseudowireCaps lists the pseudowire types supported by dynamic L2TPv3
+// tunnels.
+var v3PseudowireCaps = []uint16{uint16(PseudowireTypeEth)}
+
+// newV3Sccrq builds a new SCCRQ message
+func newV3Sccrq(cfg *TunnelConfig, routerID uint32, nonce, tiebreaker []byte) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Host Name
+	- Router ID
+	- Assigned Control Connection ID
+	- Pseudowire Capabilities List
+
+	and we MAY include:
+
+	- Random Vector
+	- Control Message Authentication Nonce
+	- Message Digest
+	- Control Connection Tie Breaker
+	- Vendor Name
+	- Receive Window Size
+	- Preferred Language
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeSccrq},
+		{avpTypeHostName, cfg.HostName},
+		{avpTypeRouterID, routerID},
+		{avpTypeAssignedConnID, uint32(cfg.TunnelID)},
+		{avpTypePseudowireCaps, v3PseudowireCaps},
+	}
+	if nonce != nil {
+		in = append(in, avpIn{avpTypeControlAuthNonce, nonce})
+	}
+	if tiebreaker != nil {
+		in = append(in, avpIn{avpTypeTiebreaker, tiebreaker})
+	}
+	return buildV3Msg(0, in)
+}
+
+// newV3Sccrp builds a new SCCRP message
+func newV3Sccrp(cfg *TunnelConfig, routerID uint32, nonce []byte) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Host Name
+	- Router ID
+	- Assigned Control Connection ID
+	- Pseudowire Capabilities List
+
+	and we MAY include:
+
+	- Random Vector
+	- Control Message Authentication Nonce
+	- Message Digest
+	- Vendor Name
+	- Receive Window Size
+	- Preferred Language
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeSccrp},
+		{avpTypeHostName, cfg.HostName},
+		{avpTypeRouterID, routerID},
+		{avpTypeAssignedConnID, uint32(cfg.TunnelID)},
+		{avpTypePseudowireCaps, v3PseudowireCaps},
+	}
+	if nonce != nil {
+		in = append(in, avpIn{avpTypeControlAuthNonce, nonce})
+	}
+	return buildV3Msg(cfg.PeerTunnelID, in)
+}
+
+// newV3Scccn builds a new SCCCN message
+func newV3Scccn(cfg *TunnelConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeScccn},
+	}
+	return buildV3Msg(cfg.PeerTunnelID, in)
+}
+
+// newV3Stopccn builds a new StopCCN message
+func newV3Stopccn(rc *resultCode, cfg *TunnelConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Result Code
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- Assigned Control Connection ID
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeStopccn},
+		{avpTypeResultCode, rc},
+		{avpTypeAssignedConnID, uint32(cfg.TunnelID)},
+	}
+	return buildV3Msg(cfg.PeerTunnelID, in)
+}
+
+// v3SessionAvps returns the optional AVPs describing the data plane of a
+// session, which are sent in the ICRQ and ICRP messages.
+func v3SessionAvps(scfg *SessionConfig) []avpIn {
+	sequencing := v3DataSequencingNone
+	if scfg.SeqNum {
+		sequencing = v3DataSequencingAll
+	}
+	in := []avpIn{
+		{avpTypeL2specificSublayer, uint16(scfg.L2SpecType)},
+		{avpTypeDataSequencing, sequencing},
+	}
+	if len(scfg.Cookie) > 0 {
+		in = append(in, avpIn{avpTypeAssignedCookie, scfg.Cookie})
+	}
+	return in
+}
+
+// newV3Icrq builds a new ICRQ message
+func newV3Icrq(callSerial uint32, pccid ControlConnID, scfg *SessionConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Local Session ID
+	- Remote Session ID
+	- Serial Number
+	- Pseudowire Type
+	- Remote End ID
+	- Circuit Status
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- Assigned Cookie
+	- Session Tie Breaker
+	- L2-Specific Sublayer
+	- Data Sequencing
+	- Tx Connect Speed
+	- Rx Connect Speed
+	- Physical Channel ID
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeIcrq},
+		{avpTypeLocalSessionID, uint32(scfg.SessionID)},
+		{avpTypeRemoteSessionID, uint32(0)},
+		{avpTypeCallSerialNumber, callSerial},
+		{avpTypePseudowireType, uint16(scfg.Pseudowire)},
+		{avpTypeRemoteEndID, []byte(scfg.RemoteEndID)},
+		{avpTypeCircuitStatus, v3CircuitStatusActive | v3CircuitStatusNew},
+	}
+	return buildV3Msg(pccid, append(in, v3SessionAvps(scfg)...))
+}
+
+// newV3Icrp builds a new ICRP message
+func newV3Icrp(pccid ControlConnID, scfg *SessionConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Local Session ID
+	- Remote Session ID
+	- Circuit Status
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- Assigned Cookie
+	- L2-Specific Sublayer
+	- Data Sequencing
+	- Tx Connect Speed
+	- Rx Connect Speed
+	- Physical Channel ID
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeIcrp},
+		{avpTypeLocalSessionID, uint32(scfg.SessionID)},
+		{avpTypeRemoteSessionID, uint32(scfg.PeerSessionID)},
+		{avpTypeCircuitStatus, v3CircuitStatusActive | v3CircuitStatusNew},
+	}
+	return buildV3Msg(pccid, append(in, v3SessionAvps(scfg)...))
+}
+
+// newV3Iccn builds a new ICCN message
+func newV3Iccn(pccid ControlConnID, scfg *SessionConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Local Session ID
+	- Remote Session ID
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- L2-Specific Sublayer
+	- Data Sequencing
+	- Tx Connect Speed
+	- Rx Connect Speed
+	- Circuit Status
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeIccn},
+		{avpTypeLocalSessionID, uint32(scfg.SessionID)},
+		{avpTypeRemoteSessionID, uint32(scfg.PeerSessionID)},
+	}
+	return buildV3Msg(pccid, in)
+}
+
+// newV3Cdn builds a new CDN message
+func newV3Cdn(pccid ControlConnID, rc *resultCode, scfg *SessionConfig) (msg *v3ControlMessage, err error) {
+	/* RFC3931 says we MUST include:
+
+	- Message Type
+	- Result Code
+	- Local Session ID
+	- Remote Session ID
+
+	and we MAY include:
+
+	- Random Vector
+	- Message Digest
+	- Q.931 Cause Code
+	*/
+	in := []avpIn{
+		{avpTypeMessage, avpMsgTypeCdn},
+		{avpTypeResultCode, rc},
+		{avpTypeLocalSessionID, uint32(scfg.SessionID)},
+		{avpTypeRemoteSessionID, uint32(scfg.PeerSessionID)},
+	}
+	return buildV3Msg(pccid, in)
+}
+
+// msgControlConnID returns the control connection ID a message is
+// addressed to: the tunnel ID of an L2TPv2 message, or the control
+// connection ID of an L2TPv3 message.
+func msgControlConnID(msg controlMessage) ControlConnID {
+	switch m := msg.(type) {
+	case *v2ControlMessage:
+		return ControlConnID(m.Tid())
+	case *v3ControlMessage:
+		return ControlConnID(m.ControlConnectionID())
+	}
+	return 0
+}
+
+// isPeerSccrq returns true if a message is an SCCRQ addressed to control
+// connection ID 0: a peer opening a control connection to us.
+func isPeerSccrq(msg controlMessage) bool {
+	return msg.getType() == avpMsgTypeSccrq && msgControlConnID(msg) == 0
+}
+
+// msgSessionID returns the session ID a session message is addressed to:
+// the session ID in the L2TPv2 header, or the Remote Session ID AVP of an
+// L2TPv3 message.
+func msgSessionID(msg controlMessage) ControlConnID {
+	switch m := msg.(type) {
+	case *v2ControlMessage:
+		return ControlConnID(m.Sid())
+	case *v3ControlMessage:
+		sid, _ := findUint32Avp(m.getAvps(), vendorIDIetf, avpTypeRemoteSessionID)
+		return ControlConnID(sid)
+	}
+	return 0
+}
+
+// findPeerControlConnID returns the control connection ID the peer assigned
+// in an SCCRQ or SCCRP message.
+func findPeerControlConnID(msg controlMessage) (ControlConnID, error) {
+	if msg.protocolVersion() == ProtocolVersion3 {
+		id, err := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeAssignedConnID)
+		return ControlConnID(id), err
+	}
+	id, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeTunnelID)
+	return ControlConnID(id), err
+}
+
+// findPeerSessionID returns the session ID the peer assigned in a session
+// message.
+func findPeerSessionID(msg controlMessage) (ControlConnID, error) {
+	if msg.protocolVersion() == ProtocolVersion3 {
+		id, err := findUint32Avp(msg.getAvps(), vendorIDIetf, avpTypeLocalSessionID)
+		return ControlConnID(id), err
+	}
+	id, err := findUint16Avp(msg.getAvps(), vendorIDIetf, avpTypeSessionID)
+	return ControlConnID(id), err
+}
+
+// v3NonceLen is the length of the Control Message Authentication Nonce we
+// send.  Ref: RFC3931 section 5.4.3
+const v3NonceLen = 16
+
+// Digest Type values carried in the Message Digest AVP.
+// Ref: RFC3931 section 5.4.1
+const (
+	v3DigestTypeHMACMD5  uint16 = 0
+	v3DigestTypeHMACSHA1 uint16 = 1
+)
+
+// v3Digest implements L2TPv3 control message authentication using the
+// Message Digest AVP.  It holds the key derived from the shared secret,
+// and the nonces exchanged in the SCCRQ and SCCRP.
+// Ref: RFC3931 section 4.3
+type v3Digest struct {
+	wireType uint16
+	newHash  func() hash.Hash
+	key      []byte
+	nonce    []byte
+
+	lock      sync.Mutex
+	peerNonce []byte
+}
+
+// newV3Digest creates a v3Digest using a random nonce
+func newV3Digest(typ DigestType, secret string) (*v3Digest, error) {
+	d := &v3Digest{}
+	switch typ {
+	case DigestTypeHMACMD5:
+		d.wireType, d.newHash = v3DigestTypeHMACMD5, md5.New
+	case DigestTypeHMACSHA1:
+		d.wireType, d.newHash = v3DigestTypeHMACSHA1, sha1.New
+	default:
+		return nil, fmt.Errorf("unsupported digest type %v", typ)
+	}
+	if secret == "" {
+		return nil, errors.New("control message authentication requires a secret")
+	}
+
+	// Shared-Key = HMAC_Hash(secret, 2)
+	h := hmac.New(d.newHash, []byte(secret))
+	h.Write([]byte{2})
+	d.key = h.Sum(nil)
+
+	d.nonce = make([]byte, v3NonceLen)
+	_, err := rand.Read(d.nonce)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *v3Digest) setPeerNonce(nonce []byte) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.peerNonce = nonce
+}
+
+// compute returns the digest of a message encoded as b, whose Message
+// Digest value is held at offset.  The nonces are those of the sender
+// followed by those of the receiver; none are used for the SCCRQ, which
+// is sent before they are exchanged.
+func (d *v3Digest) compute(msgType avpMsgType, b []byte, offset int, senderNonce, receiverNonce []byte) []byte {
+	zeroed := append([]byte{}, b...)
+	for i := offset; i < offset+d.newHash().Size(); i++ {
+		zeroed[i] = 0
+	}
+	h := hmac.New(d.newHash, d.key)
+	if msgType != avpMsgTypeSccrq {
+		h.Write(senderNonce)
+		h.Write(receiverNonce)
+	}
+	h.Write(zeroed)
+	return h.Sum(nil)
+}
+
+// findDigest returns the index of the message's Message Digest AVP of our
+// digest type, and the offset of its digest value within the encoded
+// message.  It returns an error if there is no such AVP.
+func (d *v3Digest) findDigest(msg *v3ControlMessage) (index, offset int, err error) {
+	offset = v3HeaderLen
+	for i, a := range msg.avps {
+		if a.getType() == avpTypeMessageDigest && a.vendorID() == vendorIDIetf {
+			v := a.payload.data
+			if len(v) == 2+d.newHash().Size() && binary.BigEndian.Uint16(v) == d.wireType {
+				return i, offset + avpHeaderLen + 2, nil
+			}
+		}
+		offset += a.totalLen()
+	}
+	return 0, 0, errors.New("no Message Digest AVP")
+}
+
+// sign adds a Message Digest AVP to a message following its Message Type
+// AVP, or updates the AVP if the message already carries one.  Since the
+// digest covers the header sequence numbers a message must be signed each
+// time it is transmitted.
+func (d *v3Digest) sign(msg *v3ControlMessage) error {
+	if _, _, err := d.findDigest(msg); err != nil {
+		value := make([]byte, 2+d.newHash().Size())
+		binary.BigEndian.PutUint16(value, d.wireType)
+		a, err := newAvp(vendorIDIetf, avpTypeMessageDigest, value)
+		if err != nil {
+			return err
+		}
+		// A ZLB has no Message Type AVP, so can't be signed
+		if len(msg.avps) == 0 {
+			return errors.New("cannot sign a ZLB message")
+		}
+		msg.avps = append(msg.avps[:1], append([]avp{*a}, msg.avps[1:]...)...)
+		msg.header.Common.Len += uint16(a.totalLen())
+	}
+
+	index, offset, err := d.findDigest(msg)
+	if err != nil {
+		return err
+	}
+	b, err := msg.toBytes()
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	peerNonce := d.peerNonce
+	d.lock.Unlock()
+
+	digest := d.compute(msg.getType(), b, offset, d.nonce, peerNonce)
+	copy(msg.avps[index].payload.data[2:], digest)
+	return nil
+}
+
+// verify checks the Message Digest AVP of a received message.  The peer's
+// nonce is learnt from its SCCRP, which is signed using it.
+func (d *v3Digest) verify(msg *v3ControlMessage) error {
+	_, offset, err := d.findDigest(msg)
+	if err != nil {
+		return err
+	}
+	b, err := msg.toBytes()
+	if err != nil {
+		return err
+	}
+
+	if msg.getType() == avpMsgTypeSccrp {
+		if nonce, err := findBytesAvp(msg.getAvps(), vendorIDIetf, avpTypeControlAuthNonce); err == nil {
+			d.setPeerNonce(nonce)
+		}
+	}
+
+	d.lock.Lock()
+	peerNonce := d.peerNonce
+	d.lock.Unlock()
+
+	want := d.compute(msg.getType(), b, offset, peerNonce, d.nonce)
+	if !hmac.Equal(b[offset:offset+len(want)], want) {
+		return errors.New("bad message digest")
+	}
+	return nil
+}
@@ -231,13 +231,13 @@ func TestV2TunnelBuildValidate(t *testing.T) {
 			rc:   resultCode{},
 			buildersGood: []func(*TunnelConfig, *resultCode) (*v2ControlMessage, error){
 				func(tcfg *TunnelConfig, rc *resultCode) (*v2ControlMessage, error) {
-					return newV2Sccrq(tcfg)
+					return newV2Sccrq(tcfg, []byte{1, 2, 3, 4}, make([]byte, tiebreakerLen))
 				},
 				func(tcfg *TunnelConfig, rc *resultCode) (*v2ControlMessage, error) {
-					return newV2Sccrp(tcfg)
+					return newV2Sccrp(tcfg, []byte{1, 2, 3, 4}, make([]byte, 16))
 				},
 				func(tcfg *TunnelConfig, rc *resultCode) (*v2ControlMessage, error) {
-					return newV2Scccn(tcfg)
+					return newV2Scccn(tcfg, make([]byte, 16))
 				},
 				func(tcfg *TunnelConfig, rc *resultCode) (*v2ControlMessage, error) {
 					return newV2Stopccn(rc, tcfg)
@@ -261,3 +261,283 @@ func TestV2TunnelBuildValidate(t *testing.T) {
 		}
 	}
 }
+
+func TestV2SessionBuildValidate(t *testing.T) {
+	scfg := &SessionConfig{
+		SessionID:     42,
+		PeerSessionID: 24,
+		CalledNumber:  "555-0100",
+	}
+	rc := &resultCode{}
+	builders := []func() (*v2ControlMessage, error){
+		func() (*v2ControlMessage, error) { return newV2Icrq(1, 12, scfg) },
+		func() (*v2ControlMessage, error) { return newV2Icrp(12, scfg) },
+		func() (*v2ControlMessage, error) { return newV2Iccn(12, scfg) },
+		func() (*v2ControlMessage, error) { return newV2Ocrq(1, 12, scfg) },
+		func() (*v2ControlMessage, error) { return newV2Ocrp(12, scfg) },
+		func() (*v2ControlMessage, error) { return newV2Occn(12, scfg) },
+		func() (*v2ControlMessage, error) { return newV2Cdn(12, rc, scfg) },
+		func() (*v2ControlMessage, error) { return newV2Wen(12, scfg, &CallErrors{}) },
+		func() (*v2ControlMessage, error) { return newV2Sli(12, scfg, &ACCM{}) },
+	}
+	for i, builder := range builders {
+		msg, err := builder()
+		if err != nil {
+			t.Fatalf("builder %v: %v", i, err)
+		}
+		err = msg.validate()
+		if err != nil {
+			t.Fatalf("builder %v validation (%v): %v", i, msg.getType(), err)
+		}
+	}
+}
+
+func TestV2LinkInfo(t *testing.T) {
+	scfg := &SessionConfig{SessionID: 42, PeerSessionID: 24}
+
+	ce := CallErrors{
+		CRCErrors:        1,
+		FramingErrors:    2,
+		HardwareOverruns: 3,
+		BufferOverruns:   4,
+		TimeoutErrors:    5,
+		AlignmentErrors:  0xfffffff6,
+	}
+	wen, err := newV2Wen(12, scfg, &ce)
+	if err != nil {
+		t.Fatalf("newV2Wen(): %v", err)
+	}
+	gotCe, err := findCallErrorsAvp(wen.getAvps())
+	if err != nil {
+		t.Fatalf("findCallErrorsAvp(): %v", err)
+	}
+	if *gotCe != ce {
+		t.Errorf("call errors: expected %+v, got %+v", ce, *gotCe)
+	}
+
+	accm := ACCM{SendACCM: 0xffffffff, ReceiveACCM: 0x000a0000}
+	sli, err := newV2Sli(12, scfg, &accm)
+	if err != nil {
+		t.Fatalf("newV2Sli(): %v", err)
+	}
+	gotAccm, err := findACCMAvp(sli.getAvps())
+	if err != nil {
+		t.Fatalf("findACCMAvp(): %v", err)
+	}
+	if *gotAccm != accm {
+		t.Errorf("ACCM: expected %+v, got %+v", accm, *gotAccm)
+	}
+
+	if sli.Tid() != 12 || sli.Sid() != 24 {
+		t.Errorf("SLI addressed to %v/%v, expected 12/24", sli.Tid(), sli.Sid())
+	}
+}
+
+func TestV3BuildValidate(t *testing.T) {
+	tcfg := &TunnelConfig{
+		HostName:     "blackhole.local",
+		TunnelID:     4419,
+		PeerTunnelID: 9841,
+		Version:      ProtocolVersion3,
+	}
+	scfg := &SessionConfig{
+		SessionID:     123456,
+		PeerSessionID: 654321,
+		Pseudowire:    PseudowireTypeEth,
+		Cookie:        []byte{0x01, 0x02, 0x03, 0x04},
+		SeqNum:        true,
+		RemoteEndID:   "vlan100",
+	}
+	rc := &resultCode{result: avpStopCCNResultCodeClearConnection}
+	builders := []func() (*v3ControlMessage, error){
+		func() (*v3ControlMessage, error) { return newV3Sccrq(tcfg, 1, nil, make([]byte, tiebreakerLen)) },
+		func() (*v3ControlMessage, error) { return newV3Sccrp(tcfg, 1, make([]byte, v3NonceLen)) },
+		func() (*v3ControlMessage, error) { return newV3Scccn(tcfg) },
+		func() (*v3ControlMessage, error) { return newV3Stopccn(rc, tcfg) },
+		func() (*v3ControlMessage, error) { return newV3Icrq(1, 9841, scfg) },
+		func() (*v3ControlMessage, error) { return newV3Icrp(9841, scfg) },
+		func() (*v3ControlMessage, error) { return newV3Iccn(9841, scfg) },
+		func() (*v3ControlMessage, error) { return newV3Cdn(9841, rc, scfg) },
+	}
+	for i, builder := range builders {
+		msg, err := builder()
+		if err != nil {
+			t.Fatalf("builder %v: %v", i, err)
+		}
+		err = msg.validate()
+		if err != nil {
+			t.Fatalf("builder %v validation (%v): %v", i, msg.getType(), err)
+		}
+
+		// Check the message survives encoding, and carries the IDs
+		// the peer will use to address us
+		b, err := msg.toBytes()
+		if err != nil {
+			t.Fatalf("builder %v toBytes(): %v", i, err)
+		}
+		got, err := parseMessageBuffer(b)
+		if err != nil || len(got) != 1 {
+			t.Fatalf("builder %v parseMessageBuffer(): %v", i, err)
+		}
+		if got[0].getType() != msg.getType() {
+			t.Fatalf("builder %v: wanted %v, got %v", i, msg.getType(), got[0].getType())
+		}
+		switch msg.getType() {
+		case avpMsgTypeSccrq, avpMsgTypeSccrp:
+			if id, err := findPeerControlConnID(got[0]); err != nil || id != tcfg.TunnelID {
+				t.Errorf("builder %v: assigned control connection ID %v, %v", i, id, err)
+			}
+		case avpMsgTypeIcrq, avpMsgTypeIcrp:
+			if id, err := findPeerSessionID(got[0]); err != nil || id != scfg.SessionID {
+				t.Errorf("builder %v: local session ID %v, %v", i, id, err)
+			}
+		}
+	}
+
+	// A ZLB is parsed as an ACK
+	got, err := parseMessageBuffer([]byte{0xc8, 0x03, 0x00, 0x0c, 0x00, 0x00, 0x11, 0x43, 0x00, 0x00, 0x00, 0x00})
+	if err != nil || len(got) != 1 || got[0].getType() != avpMsgTypeAck {
+		t.Fatalf("failed to parse v3 ZLB: %v", err)
+	}
+}
+
+func TestV3MessageDigest(t *testing.T) {
+	for _, typ := range []DigestType{DigestTypeHMACMD5, DigestTypeHMACSHA1} {
+		lac, err := newV3Digest(typ, "opensesame")
+		if err != nil {
+			t.Fatalf("newV3Digest(%v): %v", typ, err)
+		}
+		lns, err := newV3Digest(typ, "opensesame")
+		if err != nil {
+			t.Fatalf("newV3Digest(%v): %v", typ, err)
+		}
+		other, err := newV3Digest(typ, "letmein")
+		if err != nil {
+			t.Fatalf("newV3Digest(%v): %v", typ, err)
+		}
+		tcfg := &TunnelConfig{HostName: "lac.local", TunnelID: 4419, PeerTunnelID: 9841}
+
+		// The SCCRQ is signed before the nonces are exchanged
+		sccrq, err := newV3Sccrq(tcfg, 1, lac.nonce, nil)
+		if err != nil {
+			t.Fatalf("newV3Sccrq(): %v", err)
+		}
+		if err = lac.sign(sccrq); err != nil {
+			t.Fatalf("sign(SCCRQ): %v", err)
+		}
+		if err = lns.verify(sccrq); err != nil {
+			t.Fatalf("verify(SCCRQ): %v", err)
+		}
+		if err = other.verify(sccrq); err == nil {
+			t.Errorf("verify(SCCRQ) succeeded using the wrong secret")
+		}
+		lns.setPeerNonce(lac.nonce)
+
+		// The LAC learns the LNS nonce from the SCCRP
+		sccrp, err := newV3Sccrp(tcfg, 2, lns.nonce)
+		if err != nil {
+			t.Fatalf("newV3Sccrp(): %v", err)
+		}
+		if err = lns.sign(sccrp); err != nil {
+			t.Fatalf("sign(SCCRP): %v", err)
+		}
+		if err = lac.verify(sccrp); err != nil {
+			t.Fatalf("verify(SCCRP): %v", err)
+		}
+
+		// Signing a retransmission updates the existing digest
+		scccn, err := newV3Scccn(tcfg)
+		if err != nil {
+			t.Fatalf("newV3Scccn(): %v", err)
+		}
+		for ns := uint16(1); ns < 3; ns++ {
+			scccn.setTransportSeqNum(ns, 1)
+			if err = lac.sign(scccn); err != nil {
+				t.Fatalf("sign(SCCCN): %v", err)
+			}
+			if err = scccn.validate(); err != nil {
+				t.Fatalf("validate(SCCCN): %v", err)
+			}
+			if err = lns.verify(scccn); err != nil {
+				t.Fatalf("verify(SCCCN): %v", err)
+			}
+		}
+		if len(scccn.getAvps()) != 2 || scccn.getAvps()[1].getType() != avpTypeMessageDigest {
+			t.Errorf("expected Message Type and Message Digest AVPs, got %v", scccn.getAvps())
+		}
+
+		// Any change to the message invalidates the digest
+		scccn.setTransportSeqNum(3, 1)
+		if err = lns.verify(scccn); err == nil {
+			t.Errorf("verify(SCCCN) succeeded for a modified message")
+		}
+	}
+}
+
+func TestV2ChallengeResponse(t *testing.T) {
+	challenge := make([]byte, 16)
+	for i := range challenge {
+		challenge[i] = byte(i)
+	}
+	cases := []struct {
+		msgType avpMsgType
+		want    string
+	}{
+		{avpMsgTypeSccrp, "79FBFB5871EC3C310CF7A214B633EFCF"},
+		{avpMsgTypeScccn, "B971DAA828B132782FD87104272A54A5"},
+	}
+	for _, c := range cases {
+		got := v2ChallengeResponse(c.msgType, "opensesame", challenge)
+		if want := mustDecodeHex(t, c.want); !bytes.Equal(got, want) {
+			t.Errorf("v2ChallengeResponse(%v) = %X, want %X", c.msgType, got, want)
+		}
+	}
+}
+
+func TestV2HiddenAvps(t *testing.T) {
+	scfg := &SessionConfig{SessionID: 42, CalledNumber: "555-0100"}
+	msg, err := newV2Ocrq(1, 12, scfg)
+	if err != nil {
+		t.Fatalf("newV2Ocrq(): %v", err)
+	}
+	err = msg.hideAvps("opensesame", avpSensitiveTypes)
+	if err != nil {
+		t.Fatalf("hideAvps(): %v", err)
+	}
+	b, err := msg.toBytes()
+	if err != nil {
+		t.Fatalf("toBytes(): %v", err)
+	}
+	if len(b) != msg.getLen() {
+		t.Fatalf("message length %d, header says %d", len(b), msg.getLen())
+	}
+
+	parse := func() *v2ControlMessage {
+		msgs, err := parseMessageBuffer(b)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("parseMessageBuffer(): %v, %d messages", err, len(msgs))
+		}
+		return msgs[0].(*v2ControlMessage)
+	}
+
+	got := parse()
+	if err = got.unhideAvps(""); err == nil {
+		t.Errorf("revealed hidden AVPs without a secret")
+	}
+
+	got = parse()
+	if err = got.unhideAvps("opensesame"); err != nil {
+		t.Fatalf("unhideAvps(): %v", err)
+	}
+	if err = got.validate(); err != nil {
+		t.Fatalf("validate(): %v", err)
+	}
+	sid, err := findUint16Avp(got.getAvps(), vendorIDIetf, avpTypeSessionID)
+	if err != nil || sid != 42 {
+		t.Errorf("session ID = %v, %v, want 42", sid, err)
+	}
+	called, err := findStringAvp(got.getAvps(), vendorIDIetf, avpTypeCalledNumber)
+	if err != nil || called != "555-0100" {
+		t.Errorf("called number = %q, %v, want 555-0100", called, err)
+	}
+}
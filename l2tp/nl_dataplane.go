@@ -174,7 +174,11 @@ func (sdp *nlSessionDataPlane) HandleDataPacket(data []byte) error {
 	return nil
 }
 
-func (sdp *nlSessionDataPlane) Start(data []byte) error {
+func (sdp *nlSessionDataPlane) Start(nc *SessionNetworkConfig) error {
+	return nil
+}
+
+func (sdp *nlSessionDataPlane) Stop() error {
 	return nil
 }
 
@@ -48,6 +48,10 @@ func (sdp *nullSessionDataPlane) HandleDataPacket(data []byte) error {
 	return nil
 }
 
-func (sdp *nullSessionDataPlane) Start(data []byte) error {
+func (sdp *nullSessionDataPlane) Start(nc *SessionNetworkConfig) error {
+	return nil
+}
+
+func (sdp *nullSessionDataPlane) Stop() error {
 	return nil
 }
@@ -2,16 +2,56 @@ package l2tp
 
 import (
 	"bytes"
+	"crypto/des"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
-)
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
 
-var pppLCPId = 0
+	"golang.org/x/crypto/md4"
+)
 
 type pppProtocolType uint16
 
-const pppLCPMagicNumber uint32 = 0x12345678
-const pppLCPMRU uint16 = 1500
+// Default and minimum MRU.  Ref: RFC1661 section 6.1
+const (
+	pppLCPMRU    uint16 = 1500
+	pppLCPMinMRU uint16 = 128
+)
+
+// Overheads used in computing the MTU of the network layer carried over
+// PPP in an L2TPv2 UDP tunnel.  The path MTU is assumed to be 1500.
+const (
+	pppPathMTU      = 1500
+	pppIPv4Overhead = 20
+	pppIPv6Overhead = 40
+	pppUDPOverhead  = 8
+)
+
+// pppMTU returns the largest network layer packet which may be sent over
+// the session without exceeding either negotiated MRU or, once the L2TP,
+// UDP and IP headers of the tunnel are added, the path MTU.
+func pppMTU(mru, peerMRU uint16, ipv6Tunnel bool) int {
+	ipOverhead := pppIPv4Overhead
+	if ipv6Tunnel {
+		ipOverhead = pppIPv6Overhead
+	}
+	mtu := pppPathMTU - ipOverhead - pppUDPOverhead - pppDataHeaderLen
+	if int(mru) < mtu {
+		mtu = int(mru)
+	}
+	if int(peerMRU) < mtu {
+		mtu = int(peerMRU)
+	}
+	return mtu
+}
 
 const (
 	pppDataHeaderLen     = 10
@@ -20,12 +60,22 @@ const (
 )
 
 const (
-	pppAddress      byte            = 0xFF
-	pppControl      byte            = 0x03
-	pppProtocolIPV4 pppProtocolType = 0x0021
-	pppProtocolLCP  pppProtocolType = 0xC021
-	pppProtocolPAP  pppProtocolType = 0xC023
-	pppProtocolIPCP pppProtocolType = 0x8021
+	pppAddress        byte            = 0xFF
+	pppControl        byte            = 0x03
+	pppProtocolIPV4   pppProtocolType = 0x0021
+	pppProtocolIPV6   pppProtocolType = 0x0057
+	pppProtocolLCP    pppProtocolType = 0xC021
+	pppProtocolPAP    pppProtocolType = 0xC023
+	pppProtocolCHAP   pppProtocolType = 0xC223
+	pppProtocolIPCP   pppProtocolType = 0x8021
+	pppProtocolIPV6CP pppProtocolType = 0x8057
+	pppProtocolCCP    pppProtocolType = 0x80FD
+	// pppProtocolCompressed carries a packet compressed or encrypted by
+	// the algorithm negotiated by CCP
+	pppProtocolCompressed pppProtocolType = 0x00FD
+	// Van Jacobson TCP/IP header compression, ref: RFC1144, RFC1332
+	pppProtocolVJCompressed   pppProtocolType = 0x002D
+	pppProtocolVJUncompressed pppProtocolType = 0x002F
 )
 
 const (
@@ -42,17 +92,61 @@ const (
 	pppCodeDiscardRequest   byte = 0x0B
 )
 
+// CHAP codes, ref: RFC1994 section 4
+const (
+	pppCHAPCodeChallenge byte = 0x01
+	pppCHAPCodeResponse  byte = 0x02
+	pppCHAPCodeSuccess   byte = 0x03
+	pppCHAPCodeFailure   byte = 0x04
+)
+
+// CHAP algorithms carried in the LCP Authentication-Protocol option
+const (
+	pppCHAPAlgorithmMD5      byte = 0x05
+	pppCHAPAlgorithmMSCHAPv2 byte = 0x81
+)
+
+// pppAuthTimeout limits the time the peer may take to authenticate us
+// once LCP is open
+const pppAuthTimeout = 30 * time.Second
+
+// pppMPPETimeout limits the time the peer may take to negotiate MPPE once
+// authenticated when MPPE is required, rather than waiting for CCP to run
+// out of retries
+const pppMPPETimeout = 10 * time.Second
+
 const (
-	pppIPCPOptionIPCompression byte = 0x002D
+	pppIPCPOptionIPCompression byte = 0x02
 	pppIPCPOptionIPAddress     byte = 0x03
 	pppIPCPOptionPrimaryDNS    byte = 0x81
+	pppIPCPOptionPrimaryNBNS   byte = 0x82
 	pppIPCPOptionSecondaryDNS  byte = 0x83
+	pppIPCPOptionSecondaryNBNS byte = 0x84
+)
+
+// CCP codes, ref: RFC1962 section 2
+const (
+	pppCCPCodeResetRequest byte = 0x0E
+	pppCCPCodeResetAck     byte = 0x0F
+)
+
+// CCP options, ref: RFC3078 section 2.1, RFC1979 section 4
+const (
+	pppCCPOptionMPPE    byte = 0x12
+	pppCCPOptionDeflate byte = 0x1A
+)
+
+// IPV6CP options, ref: RFC5072 section 4
+const (
+	pppIPV6CPOptionInterfaceID byte = 0x01
 )
 
 const (
 	pppLCPOptionMRU          byte = 0x01
 	pppLCPOptionAuthProtocol byte = 0x03
 	pppLCPOptionMagicNumber  byte = 0x05
+	pppLCPOptionPFC          byte = 0x07
+	pppLCPOptionACFC         byte = 0x08
 )
 
 type pppPayload struct {
@@ -65,12 +159,13 @@ type pppPayload struct {
 func (payload *pppPayload) getOptions() []pppOption {
 	opts := []pppOption{}
 	b := payload.data
-	for len(b) > 2 {
+	for len(b) >= 2 {
 		opt := pppOption{
 			type_:  b[0],
 			length: uint8(b[1]),
 		}
-		if opt.length <= 2 {
+		// Options such as ACFC and PFC carry no data
+		if opt.length < 2 || int(opt.length) > len(b) {
 			break
 		}
 		opt.value = b[2:opt.length]
@@ -85,6 +180,23 @@ func (payload *pppPayload) setData(data []byte) {
 	payload.length = uint16(len(data)) + 4
 }
 
+func (payload *pppPayload) toBytes() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := buf.WriteByte(payload.code); err != nil {
+		return nil, err
+	}
+	if err := buf.WriteByte(payload.identifier); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(payload.data))+pppPayloadHeaderLen); err != nil {
+		return nil, err
+	}
+	if _, err := buf.Write(payload.data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func newPPPPayload(code byte, identifier byte, data []byte) *pppPayload {
 	return &pppPayload{
 		code:       code,
@@ -94,13 +206,23 @@ func newPPPPayload(code byte, identifier byte, data []byte) *pppPayload {
 	}
 }
 
-func getLCPId() byte {
-	pppLCPId++
-	return byte(pppLCPId)
+// isControl returns true for protocols whose packets carry a code,
+// identifier and length, i.e. the link and network control protocols.
+// Ref: RFC1661 section 2
+func (p pppProtocolType) isControl() bool {
+	return p&0x8000 != 0
 }
 
-func resetLCPId() {
-	pppLCPId = 0
+// newPPPMagicNumber returns a random, non-zero LCP magic number.
+// Ref: RFC1661 section 6.4
+func newPPPMagicNumber() uint32 {
+	b := make([]byte, 4)
+	for {
+		_, _ = rand.Read(b)
+		if magic := binary.BigEndian.Uint32(b); magic != 0 {
+			return magic
+		}
+	}
 }
 
 type pppOption struct {
@@ -125,6 +247,18 @@ func encodePPPOptions(opts []pppOption) []byte {
 	return encBuf.Bytes()
 }
 
+func newPPPUint16Option(type_ byte, value uint16) pppOption {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, value)
+	return pppOption{type_: type_, length: 4, value: b}
+}
+
+func newPPPUint32Option(type_ byte, value uint32) pppOption {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, value)
+	return pppOption{type_: type_, length: 6, value: b}
+}
+
 func (opt *pppOption) toUint16() uint16 {
 	return binary.BigEndian.Uint16(opt.value)
 }
@@ -134,38 +268,41 @@ func (opt *pppOption) toUint32() uint32 {
 }
 
 func (opt *pppOption) supportPap() bool {
-	return opt.type_ == pppLCPOptionAuthProtocol && pppProtocolType(opt.toUint16()) == pppProtocolPAP
+	return opt.type_ == pppLCPOptionAuthProtocol &&
+		len(opt.value) == 2 &&
+		pppProtocolType(opt.toUint16()) == pppProtocolPAP
+}
+
+func (opt *pppOption) supportChap() bool {
+	return opt.type_ == pppLCPOptionAuthProtocol &&
+		len(opt.value) == 3 &&
+		pppProtocolType(opt.toUint16()) == pppProtocolCHAP &&
+		(opt.value[2] == pppCHAPAlgorithmMD5 || opt.value[2] == pppCHAPAlgorithmMSCHAPv2)
 }
 
 func (opt *pppOption) supportMagicNumber() bool {
-	return opt.type_ == pppLCPOptionMagicNumber
+	return opt.type_ == pppLCPOptionMagicNumber && len(opt.value) == 4
 }
 
 func (opt *pppOption) supportMRU() bool {
-	return opt.type_ == pppLCPOptionMRU
+	return opt.type_ == pppLCPOptionMRU && len(opt.value) == 2
 }
 
-func newPPPResponse(tid, sid ControlConnID, request *pppDataMessage) *pppDataMessage {
-	return &pppDataMessage{
-		header: PPPDataHeader{
-			FlagsVer: 0x0002,
-			Tid:      uint16(tid),
-			Sid:      uint16(sid),
-			Address:  pppAddress,
-			Control:  pppControl,
-			Protocol: request.header.Protocol,
-		},
-		payload: pppPayload{
-			code:       request.payload.code + 1,
-			identifier: request.payload.identifier,
-			length:     0,
-			data:       request.payload.data,
-		},
-	}
+func (opt *pppOption) supportPFC() bool {
+	return opt.type_ == pppLCPOptionPFC && len(opt.value) == 0
+}
+
+func (opt *pppOption) supportACFC() bool {
+	return opt.type_ == pppLCPOptionACFC && len(opt.value) == 0
+}
+
+func (opt *pppOption) supportVJ() bool {
+	return opt.type_ == pppIPCPOptionIPCompression &&
+		len(opt.value) == vjOptionLen &&
+		pppProtocolType(opt.toUint16()) == pppProtocolVJCompressed
 }
 
-func newPPPMessage(tid, sid ControlConnID, protocol pppProtocolType, code, reqId byte, opts []pppOption) *pppDataMessage {
-	optsBytes := encodePPPOptions(opts)
+func newPPPPacket(tid, sid ControlConnID, protocol pppProtocolType, code, identifier byte, data []byte) *pppDataMessage {
 	return &pppDataMessage{
 		header: PPPDataHeader{
 			FlagsVer: 0x0002,
@@ -177,39 +314,14 @@ func newPPPMessage(tid, sid ControlConnID, protocol pppProtocolType, code, reqId
 		},
 		payload: pppPayload{
 			code:       code,
-			identifier: reqId,
-			length:     uint16(len(optsBytes)) + 4,
-			data:       optsBytes,
+			identifier: identifier,
+			length:     uint16(len(data)) + pppPayloadHeaderLen,
+			data:       data,
 		},
 	}
 }
 
-func newLcpRequest(tid, sid ControlConnID, supportMRU, supportMagicNum bool) *pppDataMessage {
-	resetLCPId()
-	opts := []pppOption{}
-	if supportMRU {
-		mru := make([]byte, 2)
-		binary.BigEndian.PutUint16(mru, pppLCPMRU)
-		opts = append(opts, pppOption{
-			type_:  pppLCPOptionMRU,
-			length: 4,
-			value:  mru,
-		})
-	}
-	if supportMagicNum {
-		magicNum := make([]byte, 4)
-		binary.BigEndian.PutUint32(magicNum, pppLCPMagicNumber)
-		opts = append(opts, pppOption{
-			type_:  pppLCPOptionMagicNumber,
-			length: 6,
-			value:  magicNum,
-		})
-	}
-	return newPPPMessage(tid, sid, pppProtocolLCP, pppCodeConfigureRequest, getLCPId(), opts)
-}
-
-func newPapRequest(tid, sid ControlConnID, peerId, password string) *pppDataMessage {
-	resetLCPId()
+func newPapRequest(tid, sid ControlConnID, identifier byte, peerId, password string) *pppDataMessage {
 	papRequest := &papRequest{
 		peerIdLength:   uint8(len(peerId)),
 		peerId:         peerId,
@@ -228,35 +340,16 @@ func newPapRequest(tid, sid ControlConnID, peerId, password string) *pppDataMess
 		},
 		payload: pppPayload{
 			code:       pppCodeConfigureRequest,
-			identifier: getLCPId(),
+			identifier: identifier,
 			length:     uint16(len(papBytes)) + 4,
 			data:       papBytes,
 		},
 	}
 }
 
-func newIpcpRequest(tid, sid ControlConnID, ipAddr []byte) *pppDataMessage {
-	opts := []pppOption{}
-	if ipAddr == nil {
-		resetLCPId()
-		opts = append(opts, pppOption{
-			type_:  pppIPCPOptionIPAddress,
-			length: 6,
-			value:  []byte{0, 0, 0, 0},
-		})
-	} else {
-		opts = append(opts, pppOption{
-			type_:  pppIPCPOptionIPAddress,
-			length: 6,
-			value:  ipAddr,
-		})
-	}
-	return newPPPMessage(tid, sid, pppProtocolIPCP, pppCodeConfigureRequest, getLCPId(), opts)
-}
-
-func newEchoRequest(tid, sid ControlConnID) *pppDataMessage {
+func newEchoRequest(tid, sid ControlConnID, identifier byte, magic uint32) *pppDataMessage {
 	magicNum := make([]byte, 4)
-	binary.BigEndian.PutUint32(magicNum, pppLCPMagicNumber)
+	binary.BigEndian.PutUint32(magicNum, magic)
 	return &pppDataMessage{
 		header: PPPDataHeader{
 			FlagsVer: 0x0002,
@@ -268,16 +361,16 @@ func newEchoRequest(tid, sid ControlConnID) *pppDataMessage {
 		},
 		payload: pppPayload{
 			code:       pppCodeEchoRequest,
-			identifier: getLCPId(),
+			identifier: identifier,
 			length:     8,
 			data:       magicNum,
 		},
 	}
 }
 
-func newEchoReply(tid, sid ControlConnID, request *pppDataMessage) *pppDataMessage {
+func newEchoReply(tid, sid ControlConnID, request *pppDataMessage, magic uint32) *pppDataMessage {
 	magicNum := make([]byte, 4)
-	binary.BigEndian.PutUint32(magicNum, pppLCPMagicNumber)
+	binary.BigEndian.PutUint32(magicNum, magic)
 	return &pppDataMessage{
 		header: PPPDataHeader{
 			FlagsVer: 0x0002,
@@ -296,7 +389,11 @@ func newEchoReply(tid, sid ControlConnID, request *pppDataMessage) *pppDataMessa
 	}
 }
 
-func newTerminateReply(tid, sid ControlConnID, request *pppDataMessage) *pppDataMessage {
+func newChapResponse(tid, sid ControlConnID, identifier byte, value []byte, name string) *pppDataMessage {
+	data := make([]byte, 0, 1+len(value)+len(name))
+	data = append(data, byte(len(value)))
+	data = append(data, value...)
+	data = append(data, name...)
 	return &pppDataMessage{
 		header: PPPDataHeader{
 			FlagsVer: 0x0002,
@@ -304,35 +401,234 @@ func newTerminateReply(tid, sid ControlConnID, request *pppDataMessage) *pppData
 			Sid:      uint16(sid),
 			Address:  pppAddress,
 			Control:  pppControl,
-			Protocol: request.header.Protocol,
+			Protocol: uint16(pppProtocolCHAP),
 		},
 		payload: pppPayload{
-			code:       request.payload.code + 1,
-			identifier: request.payload.identifier,
-			length:     request.payload.length,
-			data:       request.payload.data,
+			code:       pppCHAPCodeResponse,
+			identifier: identifier,
+			length:     uint16(len(data)) + 4,
+			data:       data,
 		},
 	}
 }
 
-func newTerminateRequest(tid, sid ControlConnID) *pppDataMessage {
-	resetLCPId()
-	return &pppDataMessage{
-		header: PPPDataHeader{
-			FlagsVer: 0x0002,
-			Tid:      uint16(tid),
-			Sid:      uint16(sid),
-			Address:  pppAddress,
-			Control:  pppControl,
-			Protocol: uint16(pppProtocolLCP),
-		},
-		payload: pppPayload{
-			code:       pppCodeTerminateRequest,
-			identifier: getLCPId(),
-			length:     4,
-			data:       nil,
-		},
+// parseChapChallenge extracts the challenge value and authenticator
+// name from the data of a CHAP Challenge packet.
+func parseChapChallenge(data []byte) (value []byte, name string, err error) {
+	if len(data) < 1 {
+		return nil, "", errors.New("no value size in CHAP challenge")
+	}
+	valueSize := int(data[0])
+	if valueSize == 0 || len(data) < 1+valueSize {
+		return nil, "", errors.New("bad value size in CHAP challenge")
+	}
+	return data[1 : 1+valueSize], string(data[1+valueSize:]), nil
+}
+
+// chapMD5Response computes the CHAP-MD5 response value for a challenge.
+// Ref: RFC1994 section 4.1.
+func chapMD5Response(identifier byte, secret string, challenge []byte) []byte {
+	h := md5.New()
+	h.Write([]byte{identifier})
+	h.Write([]byte(secret))
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+// MS-CHAPv2 response value lengths, ref: RFC2759 section 4
+const (
+	mschapv2ChallengeLen  = 16
+	mschapv2NtResponseLen = 24
+	mschapv2ResponseLen   = 49
+)
+
+// mschapv2Response holds an MS-CHAPv2 response computed for an
+// authenticator challenge, along with the values derived from it which
+// are needed once the authenticator has replied.
+type mschapv2Response struct {
+	// value is the Response packet value: peer challenge, reserved
+	// octets, NT-Response and flags.
+	value []byte
+	// authenticatorResponse is the "S=" string the authenticator must
+	// return in its Success packet.
+	authenticatorResponse string
+	// masterKey is the RFC3079 MPPE master key.
+	masterKey []byte
+}
+
+// newMschapv2Response computes the MS-CHAPv2 response to an authenticator
+// challenge.  Ref: RFC2759 section 8.
+func newMschapv2Response(authChallenge, peerChallenge []byte, username, password string) (*mschapv2Response, error) {
+	if len(authChallenge) != mschapv2ChallengeLen {
+		return nil, fmt.Errorf("bad MS-CHAPv2 challenge length %d", len(authChallenge))
+	}
+	if len(peerChallenge) != mschapv2ChallengeLen {
+		return nil, fmt.Errorf("bad MS-CHAPv2 peer challenge length %d", len(peerChallenge))
+	}
+
+	// The challenge hash uses the user name without any domain prefix
+	if i := strings.LastIndex(username, "\\"); i >= 0 {
+		username = username[i+1:]
+	}
+
+	passwordHash := ntPasswordHash(password)
+	challenge := mschapv2ChallengeHash(peerChallenge, authChallenge, username)
+	ntResponse := mschapv2ChallengeResponse(challenge, passwordHash)
+
+	value := make([]byte, 0, mschapv2ResponseLen)
+	value = append(value, peerChallenge...)
+	value = append(value, make([]byte, 8)...)
+	value = append(value, ntResponse...)
+	value = append(value, 0)
+
+	passwordHashHash := md4Sum(passwordHash)
+
+	return &mschapv2Response{
+		value:                 value,
+		authenticatorResponse: mschapv2AuthenticatorResponse(passwordHashHash, ntResponse, challenge),
+		masterKey:             mppeMasterKey(passwordHashHash, ntResponse),
+	}, nil
+}
+
+// verifySuccess checks the authenticator response carried in the message
+// of an MS-CHAPv2 Success packet, e.g. "S=<40 hex digits> M=<message>".
+func (r *mschapv2Response) verifySuccess(message string) error {
+	i := strings.Index(message, "S=")
+	if i < 0 || len(message) < i+42 {
+		return errors.New("no authenticator response in MS-CHAPv2 success message")
+	}
+	if !strings.EqualFold(message[i:i+42], r.authenticatorResponse) {
+		return errors.New("MS-CHAPv2 authenticator response mismatch")
+	}
+	return nil
+}
+
+func md4Sum(b []byte) []byte {
+	h := md4.New()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func ntPasswordHash(password string) []byte {
+	u := utf16.Encode([]rune(password))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return md4Sum(b)
+}
+
+func mschapv2ChallengeHash(peerChallenge, authChallenge []byte, username string) []byte {
+	h := sha1.New()
+	h.Write(peerChallenge)
+	h.Write(authChallenge)
+	h.Write([]byte(username))
+	return h.Sum(nil)[:8]
+}
+
+// desKey expands a 7 octet key into an 8 octet DES key, inserting
+// (unused) parity bits.
+func desKey(k []byte) []byte {
+	return []byte{
+		k[0] & 0xfe,
+		(k[0]<<7 | k[1]>>1) & 0xfe,
+		(k[1]<<6 | k[2]>>2) & 0xfe,
+		(k[2]<<5 | k[3]>>3) & 0xfe,
+		(k[3]<<4 | k[4]>>4) & 0xfe,
+		(k[4]<<3 | k[5]>>5) & 0xfe,
+		(k[5]<<2 | k[6]>>6) & 0xfe,
+		k[6] << 1,
+	}
+}
+
+func mschapv2ChallengeResponse(challenge, passwordHash []byte) []byte {
+	zPasswordHash := make([]byte, 21)
+	copy(zPasswordHash, passwordHash)
+
+	response := make([]byte, mschapv2NtResponseLen)
+	for i := 0; i < 3; i++ {
+		// A DES cipher can't fail to initialise with an 8 octet key
+		block, _ := des.NewCipher(desKey(zPasswordHash[7*i : 7*i+7]))
+		block.Encrypt(response[8*i:], challenge)
 	}
+	return response
+}
+
+var (
+	mschapv2Magic1 = []byte("Magic server to client signing constant")
+	mschapv2Magic2 = []byte("Pad to make it do more than one iteration")
+	mppeMagic1     = []byte("This is the MPPE Master Key")
+)
+
+func mschapv2AuthenticatorResponse(passwordHashHash, ntResponse, challenge []byte) string {
+	h := sha1.New()
+	h.Write(passwordHashHash)
+	h.Write(ntResponse)
+	h.Write(mschapv2Magic1)
+	digest := h.Sum(nil)
+
+	h = sha1.New()
+	h.Write(digest)
+	h.Write(challenge)
+	h.Write(mschapv2Magic2)
+	return "S=" + strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
+}
+
+// mppeMasterKey derives the MPPE master key from an MS-CHAPv2 exchange.
+// Ref: RFC3079 section 3.4.
+func mppeMasterKey(passwordHashHash, ntResponse []byte) []byte {
+	h := sha1.New()
+	h.Write(passwordHashHash)
+	h.Write(ntResponse)
+	h.Write(mppeMagic1)
+	return h.Sum(nil)[:16]
+}
+
+// parseMschapv2Failure renders the message of an MS-CHAPv2 Failure packet,
+// e.g. "E=691 R=0 C=<hex> V=3 M=<text>", as a human-readable reason.
+// Ref: RFC2759 section 6.
+func parseMschapv2Failure(message string) string {
+	var errCode int
+	var text string
+
+	if i := strings.Index(message, "M="); i >= 0 {
+		text = message[i+2:]
+		message = message[:i]
+	}
+	for _, field := range strings.Fields(message) {
+		if strings.HasPrefix(field, "E=") {
+			errCode, _ = strconv.Atoi(field[2:])
+		}
+	}
+
+	var reason string
+	switch errCode {
+	case 646:
+		reason = "restricted logon hours"
+	case 647:
+		reason = "account disabled"
+	case 648:
+		reason = "password expired"
+	case 649:
+		reason = "no dial-in permission"
+	case 691:
+		reason = "authentication failure"
+	case 709:
+		reason = "error changing password"
+	default:
+		if errCode == 0 {
+			reason = "unknown error"
+		} else {
+			reason = fmt.Sprintf("error %d", errCode)
+		}
+	}
+	if errCode != 0 {
+		reason = fmt.Sprintf("%s (E=%d)", reason, errCode)
+	}
+	if text = strings.TrimSpace(text); text != "" {
+		reason = fmt.Sprintf("%s: %s", reason, text)
+	}
+	return reason
 }
 
 type papRequest struct {
@@ -368,6 +664,11 @@ type PPPDataHeader struct {
 	Address  byte
 	Control  byte
 	Protocol uint16
+	// ACFC, if set, omits the address and control fields, and PFC, if
+	// set, sends protocols below 0x100 in a single byte.  Either may be
+	// used only once negotiated by LCP.  Ref: RFC1661 section 6.5, 6.6
+	ACFC bool
+	PFC  bool
 }
 
 func NewPPPDataHeader(tid, sid ControlConnID, protocol uint16) *PPPDataHeader {
@@ -382,9 +683,54 @@ func NewPPPDataHeader(tid, sid ControlConnID, protocol uint16) *PPPDataHeader {
 }
 
 func (h *PPPDataHeader) ToBytes() []byte {
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.BigEndian, h)
-	return buf.Bytes()
+	b := make([]byte, 6, pppDataHeaderLen)
+	binary.BigEndian.PutUint16(b[0:], h.FlagsVer)
+	binary.BigEndian.PutUint16(b[2:], h.Tid)
+	binary.BigEndian.PutUint16(b[4:], h.Sid)
+	if !h.ACFC {
+		b = append(b, h.Address, h.Control)
+	}
+	if h.PFC && h.Protocol <= 0xff {
+		b = append(b, byte(h.Protocol))
+	} else {
+		b = append(b, byte(h.Protocol>>8), byte(h.Protocol))
+	}
+	return b
+}
+
+// parsePPPDataHeader parses the L2TP and PPP headers of a data message,
+// returning the length of the headers.  Compressed address, control and
+// protocol fields are accepted whether or not they have been negotiated.
+// Ref: RFC1661 section 6.5, 6.6
+func parsePPPDataHeader(b []byte, h *PPPDataHeader) (n int, err error) {
+	if len(b) < 6 {
+		return 0, errors.New("no L2TP data header present in the input buffer")
+	}
+	h.FlagsVer = binary.BigEndian.Uint16(b[0:])
+	h.Tid = binary.BigEndian.Uint16(b[2:])
+	h.Sid = binary.BigEndian.Uint16(b[4:])
+	n = 6
+
+	h.Address = pppAddress
+	h.Control = pppControl
+	h.ACFC = true
+	if len(b) >= n+2 && b[n] == pppAddress && b[n+1] == pppControl {
+		h.ACFC = false
+		n += 2
+	}
+
+	// The least significant bit of the last byte of the protocol is 1
+	if len(b) > n && b[n]&0x01 != 0 {
+		h.Protocol = uint16(b[n])
+		h.PFC = true
+		return n + 1, nil
+	}
+	if len(b) < n+2 {
+		return 0, errors.New("no PPP protocol present in the input buffer")
+	}
+	h.Protocol = binary.BigEndian.Uint16(b[n:])
+	h.PFC = false
+	return n + 2, nil
 }
 
 // pppDataMessage represents an data message
@@ -408,7 +754,7 @@ func (m *pppDataMessage) protocolVersion() ProtocolVersion {
 }
 
 func (m *pppDataMessage) getLen() int {
-	return int(pppDataHeaderLen + pppPayloadHeaderLen + len(m.payload.data))
+	return len(m.header.ToBytes()) + pppPayloadHeaderLen + len(m.payload.data)
 }
 
 func (m *pppDataMessage) ns() uint16 {
@@ -442,7 +788,7 @@ func (m *pppDataMessage) setTransportSeqNum(ns, nr uint16) {
 func (m *pppDataMessage) toBytes() ([]byte, error) {
 	buf := new(bytes.Buffer)
 
-	if err := binary.Write(buf, binary.BigEndian, m.header); err != nil {
+	if _, err := buf.Write(m.header.ToBytes()); err != nil {
 		return nil, err
 	}
 
@@ -484,17 +830,29 @@ func (m *pppDataMessage) Protocol() pppProtocolType {
 	return pppProtocolType(m.header.Protocol)
 }
 
+// information returns the information field of the PPP frame
+func (m *pppDataMessage) information() []byte {
+	if !m.Protocol().isControl() {
+		return m.payload.data
+	}
+	b, err := m.payload.toBytes()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
 func bytesToDataMsg(b []byte) (msg *pppDataMessage, err error) {
-	buf := bytes.NewBuffer(b)
 	msg = new(pppDataMessage)
-	if err = binary.Read(buf, binary.BigEndian, &msg.header); err != nil {
+	n, err := parsePPPDataHeader(b, &msg.header)
+	if err != nil {
 		return nil, err
 	}
-	if msg.header.Protocol == uint16(pppProtocolIPV4) {
-		msg.payload.data = b[pppDataHeaderLen:]
+	if !pppProtocolType(msg.header.Protocol).isControl() {
+		msg.payload.data = b[n:]
 		return msg, nil
 	} else {
-		err = parsePPPBuffer(b[pppDataHeaderLen:], &msg.payload)
+		err = parsePPPBuffer(b[n:], &msg.payload)
 	}
 	return msg, err
 }
@@ -506,6 +864,9 @@ func parsePPPBuffer(b []byte, p *pppPayload) (err error) {
 	p.code = b[0]
 	p.identifier = b[1]
 	p.length = binary.BigEndian.Uint16(b[2:4])
+	if p.length < pppPayloadHeaderLen || int(p.length) > len(b) {
+		return fmt.Errorf("bad PPP packet length %d", p.length)
+	}
 	if p.length > 4 {
 		p.data = b[4:p.length]
 	}
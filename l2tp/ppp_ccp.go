@@ -0,0 +1,253 @@
+package l2tp
+
+import "errors"
+
+// pppCompressor implements the transmit side of a compression or
+// encryption algorithm negotiated by CCP.
+type pppCompressor interface {
+	// compress returns the protocol and data to send for a packet:
+	// either a CCP datagram, or the packet itself if it is sent
+	// uncompressed.
+	compress(protocol pppProtocolType, data []byte) (pppProtocolType, []byte)
+	// reset resets the algorithm on receipt of a Reset-Request.
+	reset()
+	// overhead returns the number of bytes the algorithm may add to a
+	// packet.
+	overhead() int
+}
+
+// pppDecompressor implements the receive side of a compression or
+// encryption algorithm negotiated by CCP.
+type pppDecompressor interface {
+	// decompress returns the packet carried in a CCP datagram.  It
+	// returns errCCPResync if the peer must be sent a Reset-Request.
+	decompress(packet []byte) (pppProtocolType, []byte, error)
+	// incompressible is called for packets the peer sent uncompressed.
+	incompressible(protocol pppProtocolType, data []byte)
+	// reset resets the algorithm on receipt of a Reset-Ack.
+	reset()
+}
+
+// errCCPResync is returned by a pppDecompressor which has lost
+// synchronisation with the peer's compressor.
+var errCCPResync = errors.New("ccp decompressor out of sync")
+
+// ccpAlgorithmName returns the name of a negotiated algorithm for logging
+func ccpAlgorithmName(alg interface{}) string {
+	switch alg.(type) {
+	case *mppeState:
+		return "mppe"
+	case *deflateCompressor, *deflateDecompressor:
+		return "deflate"
+	}
+	return "none"
+}
+
+// pppCCP implements the Compression Control Protocol option negotiation
+// for a dynamic session.  The algorithms supported are 128-bit MPPE and
+// Deflate.  Ref: RFC1962, RFC3078, RFC1979.
+//
+// CCP options are negotiated independently in each direction: the option
+// in our Configure-Request governs the packets the peer sends us, while
+// the option in the peer's Configure-Request governs the packets we send.
+// Deflate is not used if MPPE is available.
+type pppCCP struct {
+	ds *dynamicSession
+	// mppe is set if MPPE keys are available, and deflate if Deflate
+	// compression is enabled
+	mppe    bool
+	deflate bool
+	// requestMPPE is cleared if the peer rejects MPPE for the packets it
+	// sends us.
+	requestMPPE bool
+	// bits holds the MPPE option bits we request
+	bits uint32
+	// peerMPPE is set once we have acknowledged the peer's request for
+	// MPPE, with the option bits it requested held in peerBits.
+	peerMPPE bool
+	peerBits uint32
+	// Deflate options, handled in the same way as those for MPPE
+	requestDeflate bool
+	window         int
+	peerDeflate    bool
+	peerWindow     int
+}
+
+func newPPPCCP(ds *dynamicSession) *pppCCP {
+	return &pppCCP{
+		ds:          ds,
+		mppe:        true,
+		requestMPPE: true,
+		// Stateless mode is preferred since it copes with packet loss
+		// without the need for a CCP Reset-Request round trip.
+		bits:   mppeOption128Bit | mppeOptionStateless,
+		window: deflateMaxWindow,
+	}
+}
+
+// configure selects the algorithms to negotiate before CCP is opened
+func (ccp *pppCCP) configure(mppe, deflate bool) {
+	ccp.mppe = mppe
+	ccp.deflate = deflate && !mppe
+	ccp.requestMPPE = ccp.mppe
+	ccp.requestDeflate = ccp.deflate
+}
+
+// mppeBitsWanted returns the MPPE option bits we accept given a set of bits
+// offered by the peer: 128-bit encryption, in either stateless or stateful
+// mode.  Ref: RFC3078 section 2.1
+func mppeBitsWanted(bits uint32) uint32 {
+	return mppeOption128Bit | bits&mppeOptionStateless
+}
+
+func (ccp *pppCCP) configureRequest() []pppOption {
+	opts := []pppOption{}
+	if ccp.requestMPPE {
+		opts = append(opts, newPPPUint32Option(pppCCPOptionMPPE, ccp.bits))
+	}
+	if ccp.requestDeflate {
+		opts = append(opts, pppOption{
+			type_:  pppCCPOptionDeflate,
+			length: 4,
+			value:  deflateOptionValue(ccp.window),
+		})
+	}
+	return opts
+}
+
+func (ccp *pppCCP) configureRequestReceived(opts []pppOption) (code byte, resp []pppOption) {
+	ackOpts := []pppOption{}
+	nakOpts := []pppOption{}
+	rejectOpts := []pppOption{}
+
+	ccp.peerMPPE = false
+	ccp.peerDeflate = false
+	for _, opt := range opts {
+		switch {
+		case ccp.mppe && !ccp.peerMPPE && opt.type_ == pppCCPOptionMPPE && len(opt.value) == 4:
+			bits := opt.toUint32()
+			if want := mppeBitsWanted(bits); bits != want {
+				nakOpts = append(nakOpts, newPPPUint32Option(pppCCPOptionMPPE, want))
+				continue
+			}
+			ccp.peerMPPE = true
+			ccp.peerBits = bits
+			ackOpts = append(ackOpts, opt)
+		case ccp.deflate && !ccp.peerDeflate && opt.type_ == pppCCPOptionDeflate:
+			window, ok := parseDeflateOption(opt.value)
+			if !ok || window < deflateMinWindow || window > deflateMaxWindow {
+				nakOpts = append(nakOpts, pppOption{
+					type_:  pppCCPOptionDeflate,
+					length: 4,
+					value:  deflateOptionValue(deflateMaxWindow),
+				})
+				continue
+			}
+			ccp.peerDeflate = true
+			ccp.peerWindow = window
+			ackOpts = append(ackOpts, opt)
+		default:
+			rejectOpts = append(rejectOpts, opt)
+		}
+	}
+
+	if len(rejectOpts) > 0 {
+		return pppCodeConfigureReject, rejectOpts
+	} else if len(nakOpts) > 0 {
+		return pppCodeConfigureNak, nakOpts
+	}
+	return pppCodeConfigureAck, ackOpts
+}
+
+func (ccp *pppCCP) configureAckReceived(opts []pppOption) error {
+	return nil
+}
+
+func (ccp *pppCCP) configureNakReceived(opts []pppOption) {
+	for _, opt := range opts {
+		switch opt.type_ {
+		case pppCCPOptionMPPE:
+			if len(opt.value) != 4 {
+				continue
+			}
+			// The peer suggests the bits it will accept: stop
+			// requesting MPPE if 128-bit encryption isn't among them.
+			bits := opt.toUint32()
+			if bits&mppeOption128Bit == 0 {
+				ccp.requestMPPE = false
+			} else {
+				ccp.bits = mppeBitsWanted(bits)
+			}
+		case pppCCPOptionDeflate:
+			// We can decompress any window size, so adopt the peer's
+			window, ok := parseDeflateOption(opt.value)
+			if !ok || window < deflateMinWindow || window > deflateMaxWindow {
+				ccp.requestDeflate = false
+			} else {
+				ccp.window = window
+			}
+		}
+	}
+}
+
+func (ccp *pppCCP) configureRejectReceived(opts []pppOption) {
+	for _, opt := range opts {
+		switch opt.type_ {
+		case pppCCPOptionMPPE:
+			ccp.requestMPPE = false
+		case pppCCPOptionDeflate:
+			ccp.requestDeflate = false
+		}
+	}
+}
+
+func (ccp *pppCCP) handleCode(msg *pppDataMessage) bool {
+	switch msg.payload.code {
+	case pppCCPCodeResetRequest:
+		// The peer has lost synchronisation with our compressor: reset
+		// it and acknowledge.  Ref: RFC1962 section 2.1
+		if ccp.ds.ccp.isOpened() {
+			ccp.ds.resetCompressor()
+			ccp.ds.sendPPP(pppProtocolCCP, pppCCPCodeResetAck, msg.payload.identifier, nil)
+		}
+		return true
+	case pppCCPCodeResetAck:
+		if ccp.ds.ccp.isOpened() {
+			ccp.ds.resetDecompressor()
+		}
+		return true
+	}
+	return false
+}
+
+func (ccp *pppCCP) thisLayerUp() {
+	var tx pppCompressor
+	var rx pppDecompressor
+	if ccp.peerMPPE || ccp.requestMPPE {
+		send, recv := mppeStartKeys(ccp.ds.mppeMasterKey)
+		if ccp.peerMPPE {
+			tx = newMppeState(send, ccp.peerBits&mppeOptionStateless == 0)
+		}
+		if ccp.requestMPPE {
+			rx = newMppeState(recv, ccp.bits&mppeOptionStateless == 0)
+		}
+	}
+	if ccp.peerDeflate {
+		tx = newDeflateCompressor(ccp.peerWindow)
+	}
+	if ccp.requestDeflate {
+		rx = newDeflateDecompressor()
+	}
+	ccp.ds.onCCPUp(tx, rx)
+}
+
+func (ccp *pppCCP) thisLayerDown() {
+	ccp.ds.onCCPDown()
+}
+
+func (ccp *pppCCP) thisLayerStarted() {
+}
+
+func (ccp *pppCCP) thisLayerFinished(reason string) {
+	ccp.ds.onCCPFinished(reason)
+}
@@ -0,0 +1,87 @@
+package l2tp
+
+import "testing"
+
+func TestCCPMPPENegotiation(t *testing.T) {
+	ccp := newPPPCCP(&dynamicSession{})
+
+	opts := ccp.configureRequest()
+	if len(opts) != 1 || opts[0].type_ != pppCCPOptionMPPE ||
+		opts[0].toUint32() != mppeOption128Bit|mppeOptionStateless {
+		t.Fatalf("expected request for stateless 128-bit MPPE, got %v", opts)
+	}
+
+	// offers including weaker or compressed modes are naked down to 128-bit
+	offer := mppeOption128Bit | mppeOption40Bit | mppeOptionMPPC
+	code, resp := ccp.configureRequestReceived([]pppOption{newPPPUint32Option(pppCCPOptionMPPE, offer)})
+	if code != pppCodeConfigureNak || len(resp) != 1 || resp[0].toUint32() != mppeOption128Bit {
+		t.Fatalf("expected Configure-Nak suggesting 128-bit MPPE, got %v %v", codeToString(code), resp)
+	}
+	if ccp.peerMPPE {
+		t.Fatalf("peer MPPE enabled by a naked request")
+	}
+
+	code, _ = ccp.configureRequestReceived([]pppOption{newPPPUint32Option(pppCCPOptionMPPE, mppeOption128Bit)})
+	if code != pppCodeConfigureAck || !ccp.peerMPPE || ccp.peerBits != mppeOption128Bit {
+		t.Fatalf("expected stateful 128-bit MPPE to be acked, got %v", codeToString(code))
+	}
+
+	// other compression algorithms are rejected
+	code, _ = ccp.configureRequestReceived([]pppOption{{type_: 26, length: 4, value: []byte{0x78, 0x00}}})
+	if code != pppCodeConfigureReject {
+		t.Fatalf("expected Configure-Reject for unsupported algorithm, got %v", codeToString(code))
+	}
+
+	// the peer may ask us to use stateful mode
+	ccp.configureNakReceived([]pppOption{newPPPUint32Option(pppCCPOptionMPPE, mppeOption128Bit)})
+	if !ccp.requestMPPE || ccp.bits != mppeOption128Bit {
+		t.Fatalf("expected stateful MPPE request after nak, got %v %x", ccp.requestMPPE, ccp.bits)
+	}
+	ccp.configureNakReceived([]pppOption{newPPPUint32Option(pppCCPOptionMPPE, mppeOption40Bit)})
+	if ccp.requestMPPE {
+		t.Fatalf("still requesting MPPE after peer refused 128-bit encryption")
+	}
+}
+
+func TestCCPDeflateNegotiation(t *testing.T) {
+	ccp := newPPPCCP(&dynamicSession{})
+
+	// MPPE takes precedence over deflate
+	ccp.configure(true, true)
+	opts := ccp.configureRequest()
+	if len(opts) != 1 || opts[0].type_ != pppCCPOptionMPPE {
+		t.Fatalf("expected request for MPPE only, got %v", opts)
+	}
+
+	ccp.configure(false, true)
+	opts = ccp.configureRequest()
+	if len(opts) != 1 || opts[0].type_ != pppCCPOptionDeflate || opts[0].value[0] != 0x78 || opts[0].value[1] != 0x00 {
+		t.Fatalf("expected request for deflate with a 32k window, got %v", opts)
+	}
+
+	// MPPE is rejected when no keys are available
+	code, _ := ccp.configureRequestReceived([]pppOption{newPPPUint32Option(pppCCPOptionMPPE, mppeOption128Bit)})
+	if code != pppCodeConfigureReject || ccp.peerMPPE {
+		t.Fatalf("expected Configure-Reject for MPPE, got %v", codeToString(code))
+	}
+
+	// an invalid check method is naked
+	code, resp := ccp.configureRequestReceived([]pppOption{{type_: pppCCPOptionDeflate, length: 4, value: []byte{0x78, 0x01}}})
+	if code != pppCodeConfigureNak || len(resp) != 1 || resp[0].value[0] != 0x78 || resp[0].value[1] != 0x00 {
+		t.Fatalf("expected Configure-Nak suggesting deflate with sequence checks, got %v %v", codeToString(code), resp)
+	}
+
+	code, _ = ccp.configureRequestReceived([]pppOption{{type_: pppCCPOptionDeflate, length: 4, value: []byte{0x48, 0x00}}})
+	if code != pppCodeConfigureAck || !ccp.peerDeflate || ccp.peerWindow != 12 {
+		t.Fatalf("expected deflate with a 4k window to be acked, got %v", codeToString(code))
+	}
+
+	ccp.configureNakReceived([]pppOption{{type_: pppCCPOptionDeflate, length: 4, value: []byte{0x28, 0x00}}})
+	if !ccp.requestDeflate || ccp.window != 10 {
+		t.Fatalf("expected deflate request with a 1k window after nak, got %v %d", ccp.requestDeflate, ccp.window)
+	}
+	ccp.configureRejectReceived([]pppOption{{type_: pppCCPOptionDeflate, length: 4, value: []byte{0x28, 0x00}}})
+	if ccp.requestDeflate {
+		t.Fatalf("still requesting deflate after reject")
+	}
+}
@@ -0,0 +1,198 @@
+package l2tp
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// deflateMethod is the compression method carried in the CCP Deflate
+	// option.  Ref: RFC1979 section 4
+	deflateMethod byte = 0x08
+	// deflateCheckSequence is the only check method defined by RFC1979
+	deflateCheckSequence byte = 0x00
+	// Window sizes, as a base-2 logarithm, allowed in the Deflate option
+	deflateMinWindow = 8
+	deflateMaxWindow = 15
+	deflateHistory   = 1 << deflateMaxWindow
+	deflateSeqLen    = 2
+)
+
+var (
+	// deflateSyncMarker is appended to each packet by a sync flush,
+	// and omitted on the wire.  Ref: RFC1979 section 2.1
+	deflateSyncMarker = []byte{0x00, 0x00, 0xff, 0xff}
+	// deflateTail restores the sync marker, then terminates the stream
+	// with an empty final block so that a packet reads to a clean EOF.
+	deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+)
+
+// deflateOptionValue returns the value of a Deflate option for a window size
+func deflateOptionValue(window int) []byte {
+	return []byte{byte(window-deflateMinWindow)<<4 | deflateMethod, deflateCheckSequence}
+}
+
+// parseDeflateOption returns the window size of a Deflate option, or false
+// if the option requests something other than deflate with sequence number
+// checks.
+func parseDeflateOption(value []byte) (window int, ok bool) {
+	if len(value) != 2 || value[0]&0x0f != deflateMethod || value[1] != deflateCheckSequence {
+		return 0, false
+	}
+	return int(value[0]>>4) + deflateMinWindow, true
+}
+
+// deflateProtocolBytes returns a protocol number as compressed: a single
+// byte where possible.  Ref: RFC1979 section 2.1
+func deflateProtocolBytes(protocol pppProtocolType) []byte {
+	if protocol <= 0xff {
+		return []byte{byte(protocol)}
+	}
+	return []byte{byte(protocol >> 8), byte(protocol)}
+}
+
+// deflateCompressible returns true for the protocols which may be compressed
+func deflateCompressible(protocol pppProtocolType) bool {
+	return protocol <= 0x3fff && protocol != pppProtocolCompressed
+}
+
+// deflateCompressor implements the transmit side of PPP Deflate
+// compression.  Ref: RFC1979
+//
+// It is not safe for concurrent use.
+type deflateCompressor struct {
+	buf bytes.Buffer
+	w   *flate.Writer
+	seq uint16
+}
+
+func newDeflateCompressor(window int) *deflateCompressor {
+	// The flate package always uses a 32k window.  A peer with a smaller
+	// window is sent Huffman-coded data only, which never refers back
+	// into the history.  The lower compression levels leave packets of
+	// a few hundred bytes uncompressed, so the best level is used.
+	level := flate.BestCompression
+	if window < deflateMaxWindow {
+		level = flate.HuffmanOnly
+	}
+	c := &deflateCompressor{}
+	c.w, _ = flate.NewWriter(&c.buf, level)
+	return c
+}
+
+func (c *deflateCompressor) compress(protocol pppProtocolType, data []byte) (pppProtocolType, []byte) {
+	if !deflateCompressible(protocol) {
+		return protocol, data
+	}
+	c.buf.Reset()
+	_ = binary.Write(&c.buf, binary.BigEndian, c.seq)
+	c.seq++
+	_, _ = c.w.Write(deflateProtocolBytes(protocol))
+	_, _ = c.w.Write(data)
+	_ = c.w.Flush()
+
+	out := bytes.TrimSuffix(c.buf.Bytes(), deflateSyncMarker)
+	// Packets which don't compress are sent as they are: the peer adds
+	// them to its history just as our compressor has.
+	if len(out) > len(data) {
+		return protocol, data
+	}
+	return pppProtocolCompressed, append([]byte{}, out...)
+}
+
+func (c *deflateCompressor) reset() {
+	c.seq = 0
+	c.w.Reset(&c.buf)
+}
+
+func (c *deflateCompressor) overhead() int {
+	return 0
+}
+
+// deflateDecompressor implements the receive side of PPP Deflate
+// compression.
+//
+// It is not safe for concurrent use.
+type deflateDecompressor struct {
+	r       io.ReadCloser
+	history []byte
+	seq     uint16
+	// discard is set once a reset has been requested, until the peer
+	// acknowledges it.
+	discard bool
+}
+
+func newDeflateDecompressor() *deflateDecompressor {
+	return &deflateDecompressor{
+		r: flate.NewReader(bytes.NewReader(nil)),
+	}
+}
+
+func (d *deflateDecompressor) addHistory(b ...[]byte) {
+	for _, x := range b {
+		d.history = append(d.history, x...)
+	}
+	if len(d.history) > deflateHistory {
+		d.history = append(d.history[:0], d.history[len(d.history)-deflateHistory:]...)
+	}
+}
+
+// resync discards packets until the peer resets its compressor
+func (d *deflateDecompressor) resync() error {
+	if d.discard {
+		return errors.New("discarding deflate packet pending reset")
+	}
+	d.discard = true
+	return errCCPResync
+}
+
+func (d *deflateDecompressor) decompress(packet []byte) (pppProtocolType, []byte, error) {
+	if d.discard {
+		return 0, nil, d.resync()
+	}
+	if len(packet) < deflateSeqLen+1 {
+		return 0, nil, errors.New("short deflate packet")
+	}
+	if binary.BigEndian.Uint16(packet) != d.seq {
+		return 0, nil, d.resync()
+	}
+	d.seq++
+
+	in := append(append([]byte{}, packet[deflateSeqLen:]...), deflateTail...)
+	if err := d.r.(flate.Resetter).Reset(bytes.NewReader(in), d.history); err != nil {
+		return 0, nil, d.resync()
+	}
+	out, err := io.ReadAll(d.r)
+	if err != nil || len(out) == 0 {
+		return 0, nil, d.resync()
+	}
+	d.addHistory(out)
+
+	// The protocol field may be compressed.  Ref: RFC1979 section 2.1
+	if out[0]&0x01 != 0 {
+		return pppProtocolType(out[0]), out[1:], nil
+	}
+	if len(out) < 2 {
+		return 0, nil, errors.New("short deflate payload")
+	}
+	return pppProtocolType(binary.BigEndian.Uint16(out)), out[2:], nil
+}
+
+// incompressible adds a packet the peer sent uncompressed to the history,
+// as the peer's compressor has done.
+func (d *deflateDecompressor) incompressible(protocol pppProtocolType, data []byte) {
+	if !deflateCompressible(protocol) {
+		return
+	}
+	d.seq++
+	d.addHistory(deflateProtocolBytes(protocol), data)
+}
+
+func (d *deflateDecompressor) reset() {
+	d.seq = 0
+	d.history = d.history[:0]
+	d.discard = false
+}
@@ -0,0 +1,75 @@
+package l2tp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeflateRoundTrip(t *testing.T) {
+	for _, window := range []int{deflateMaxWindow, deflateMinWindow} {
+		c := newDeflateCompressor(window)
+		d := newDeflateDecompressor()
+		compressed := 0
+		for i := 0; i < 200; i++ {
+			data := bytes.Repeat([]byte{0x45, 0x00, byte(i), 0xaa, 0x55, 0x01, 0x02, 0x03}, 20)
+			if i%10 == 3 {
+				// random-looking data doesn't compress
+				data = make([]byte, 16)
+				for j := range data {
+					data[j] = byte(i*131 + j*97)
+				}
+			}
+			protocol, packet := c.compress(pppProtocolIPV4, data)
+			if protocol != pppProtocolCompressed {
+				if protocol != pppProtocolIPV4 || !bytes.Equal(packet, data) {
+					t.Fatalf("window %d packet %d: unexpected uncompressed packet 0x%04x", window, i, uint16(protocol))
+				}
+				d.incompressible(protocol, packet)
+				continue
+			}
+			compressed++
+			gotProtocol, got, err := d.decompress(packet)
+			if err != nil {
+				t.Fatalf("window %d packet %d: decompress failed: %v", window, i, err)
+			}
+			if gotProtocol != pppProtocolIPV4 || !bytes.Equal(got, data) {
+				t.Fatalf("window %d packet %d: got protocol 0x%04x data %x, want %x",
+					window, i, uint16(gotProtocol), got, data)
+			}
+		}
+		if compressed == 0 {
+			t.Fatalf("window %d: no packets compressed", window)
+		}
+	}
+}
+
+func TestDeflateResync(t *testing.T) {
+	c := newDeflateCompressor(deflateMaxWindow)
+	d := newDeflateDecompressor()
+	data := bytes.Repeat([]byte("deflate"), 10)
+
+	_, packet := c.compress(pppProtocolIPV4, data)
+	if _, _, err := d.decompress(packet); err != nil {
+		t.Fatalf("decompress failed: %v", err)
+	}
+
+	// lose a packet: the decompressor must request a reset
+	c.compress(pppProtocolIPV4, data)
+	_, packet = c.compress(pppProtocolIPV4, data)
+	if _, _, err := d.decompress(packet); err != errCCPResync {
+		t.Fatalf("expected resync error after packet loss, got %v", err)
+	}
+	_, packet = c.compress(pppProtocolIPV4, data)
+	if _, _, err := d.decompress(packet); err == nil || err == errCCPResync {
+		t.Fatalf("expected packet to be discarded while awaiting reset, got %v", err)
+	}
+
+	// Reset-Request resets the compressor, and Reset-Ack the decompressor
+	c.reset()
+	d.reset()
+	_, packet = c.compress(pppProtocolIPV6, data)
+	protocol, got, err := d.decompress(packet)
+	if err != nil || protocol != pppProtocolIPV6 || !bytes.Equal(got, data) {
+		t.Fatalf("expected resync after reset, got 0x%04x %x, %v", uint16(protocol), got, err)
+	}
+}
@@ -0,0 +1,510 @@
+package l2tp
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Option negotiation automaton parameters.
+// Ref: RFC1661 section 4.6
+const (
+	pppRestartTimeout = 3 * time.Second
+	pppMaxTerminate   = 2
+	pppMaxConfigure   = 10
+	pppMaxFailure     = 5
+)
+
+// pppNegotiator is implemented by each PPP control protocol (LCP and the
+// NCPs) to provide the protocol-specific parts of option negotiation, and
+// to act on the layer events signalled by the negotiation automaton.
+type pppNegotiator interface {
+	// configureRequest returns the options for our next Configure-Request.
+	configureRequest() []pppOption
+
+	// configureRequestReceived checks the options of a Configure-Request
+	// from the peer, returning the response code (Configure-Ack,
+	// Configure-Nak or Configure-Reject) and the options to send with it.
+	configureRequestReceived(opts []pppOption) (code byte, resp []pppOption)
+
+	// configureAckReceived is called when the peer acknowledges our
+	// Configure-Request.  It returns an error if the acknowledged options
+	// can't be used, in which case the Configure-Ack is discarded and the
+	// request retransmitted.  If the restart count is exhausted, the layer
+	// finishes with the error as the reason.
+	configureAckReceived(opts []pppOption) error
+
+	// configureNakReceived is called when the peer naks options in our
+	// Configure-Request, suggesting alternative values.
+	configureNakReceived(opts []pppOption)
+
+	// configureRejectReceived is called when the peer rejects options in
+	// our Configure-Request.
+	configureRejectReceived(opts []pppOption)
+
+	// handleCode is called for packets with codes outside the range
+	// handled by the automaton.  It returns false if the code is
+	// unknown, in which case a Code-Reject is sent to the peer.
+	handleCode(msg *pppDataMessage) bool
+
+	// thisLayerUp is called when the automaton enters the Opened state.
+	thisLayerUp()
+
+	// thisLayerDown is called when the automaton leaves the Opened state.
+	thisLayerDown()
+
+	// thisLayerStarted is called when the automaton requires the lower
+	// layer to come up.
+	thisLayerStarted()
+
+	// thisLayerFinished is called when the automaton no longer requires
+	// the lower layer.  The reason indicates why negotiation finished.
+	thisLayerFinished(reason string)
+}
+
+// pppLink is implemented by the owner of pppFSM instances: it transmits
+// control packets on behalf of the automaton, and delivers restart timer
+// expiry back to the goroutine running the automaton.
+type pppLink interface {
+	sendPPP(protocol pppProtocolType, code, identifier byte, data []byte)
+	pppTimeout(f *pppFSM, seq uint)
+	// pppPeerMRU returns the peer's maximum receive unit, which limits
+	// the size of the packets the automaton sends.
+	pppPeerMRU() uint16
+}
+
+// pppFSM implements the RFC1661 option negotiation automaton for a
+// single PPP control protocol.
+//
+// It is not safe for concurrent use: all methods, including timeout,
+// must be called from the same goroutine.
+type pppFSM struct {
+	logger       log.Logger
+	name         string
+	protocol     pppProtocolType
+	link         pppLink
+	neg          pppNegotiator
+	fsm          fsm
+	restartCount int
+	failureCount int
+	identifier   byte
+	reqID        byte
+	timer        *time.Timer
+	timerSeq     uint
+	finishReason string
+	// ackErr records why the peer's last Configure-Ack was discarded
+	ackErr error
+	// rx and response are the packet being processed and the
+	// response to it, for use by the transition actions.
+	rx           *pppDataMessage
+	responseCode byte
+	responseOpts []pppOption
+}
+
+// Ref: RFC1661 section 4.1
+func newPPPFSM(logger log.Logger, name string, protocol pppProtocolType, link pppLink, neg pppNegotiator) *pppFSM {
+	f := &pppFSM{
+		logger:   log.With(logger, "ppp_protocol", name),
+		name:     name,
+		protocol: protocol,
+		link:     link,
+		neg:      neg,
+	}
+
+	negotiating := []string{"reqsent", "ackrcvd", "acksent"}
+	eachOf := func(states []string, events []string, cb fsmCallback, to string) []eventDesc {
+		out := []eventDesc{}
+		for _, s := range states {
+			dst := to
+			if dst == "" {
+				dst = s
+			}
+			out = append(out, eventDesc{from: s, events: events, cb: cb, to: dst})
+		}
+		return out
+	}
+
+	table := []eventDesc{
+		{from: "initial", events: []string{"up"}, to: "closed"},
+		{from: "initial", events: []string{"open"}, cb: f.act(f.tls), to: "starting"},
+		{from: "initial", events: []string{"close"}, to: "initial"},
+
+		{from: "starting", events: []string{"up"}, cb: f.act(f.ircConfigure, f.scr), to: "reqsent"},
+		{from: "starting", events: []string{"open"}, to: "starting"},
+		{from: "starting", events: []string{"close"}, cb: f.act(f.tlf), to: "initial"},
+
+		{from: "closed", events: []string{"down"}, to: "initial"},
+		{from: "closed", events: []string{"open"}, cb: f.act(f.ircConfigure, f.scr), to: "reqsent"},
+		{from: "closed", events: []string{"close"}, to: "closed"},
+		{from: "closed", events: []string{"rcr+", "rcr-", "rca", "rcn"}, cb: f.act(f.sta), to: "closed"},
+		{from: "closed", events: []string{"rtr"}, cb: f.act(f.sta), to: "closed"},
+		{from: "closed", events: []string{"rta", "rxj+", "rxr"}, to: "closed"},
+		{from: "closed", events: []string{"ruc"}, cb: f.act(f.scj), to: "closed"},
+		{from: "closed", events: []string{"rxj-"}, cb: f.act(f.tlf), to: "closed"},
+
+		{from: "stopped", events: []string{"down"}, cb: f.act(f.tls), to: "starting"},
+		{from: "stopped", events: []string{"open"}, to: "stopped"},
+		{from: "stopped", events: []string{"close"}, to: "closed"},
+		{from: "stopped", events: []string{"rcr+"}, cb: f.act(f.ircConfigure, f.scr, f.sca), to: "acksent"},
+		{from: "stopped", events: []string{"rcr-"}, cb: f.act(f.ircConfigure, f.scr, f.scn), to: "reqsent"},
+		{from: "stopped", events: []string{"rca", "rcn", "rtr"}, cb: f.act(f.sta), to: "stopped"},
+		{from: "stopped", events: []string{"rta", "rxj+", "rxr"}, to: "stopped"},
+		{from: "stopped", events: []string{"ruc"}, cb: f.act(f.scj), to: "stopped"},
+		{from: "stopped", events: []string{"rxj-"}, cb: f.act(f.tlf), to: "stopped"},
+
+		{from: "closing", events: []string{"down"}, to: "initial"},
+		{from: "closing", events: []string{"open"}, to: "stopping"},
+		{from: "closing", events: []string{"close"}, to: "closing"},
+		{from: "closing", events: []string{"to+"}, cb: f.act(f.str), to: "closing"},
+		{from: "closing", events: []string{"to-"}, cb: f.act(f.tlf), to: "closed"},
+		{from: "closing", events: []string{"rcr+", "rcr-", "rca", "rcn", "rxj+", "rxr"}, to: "closing"},
+		{from: "closing", events: []string{"rtr"}, cb: f.act(f.sta), to: "closing"},
+		{from: "closing", events: []string{"rta", "rxj-"}, cb: f.act(f.tlf), to: "closed"},
+		{from: "closing", events: []string{"ruc"}, cb: f.act(f.scj), to: "closing"},
+
+		{from: "stopping", events: []string{"down"}, to: "starting"},
+		{from: "stopping", events: []string{"open"}, to: "stopping"},
+		{from: "stopping", events: []string{"close"}, to: "closing"},
+		{from: "stopping", events: []string{"to+"}, cb: f.act(f.str), to: "stopping"},
+		{from: "stopping", events: []string{"to-"}, cb: f.act(f.tlf), to: "stopped"},
+		{from: "stopping", events: []string{"rcr+", "rcr-", "rca", "rcn", "rxj+", "rxr"}, to: "stopping"},
+		{from: "stopping", events: []string{"rtr"}, cb: f.act(f.sta), to: "stopping"},
+		{from: "stopping", events: []string{"rta", "rxj-"}, cb: f.act(f.tlf), to: "stopped"},
+		{from: "stopping", events: []string{"ruc"}, cb: f.act(f.scj), to: "stopping"},
+
+		{from: "reqsent", events: []string{"to+"}, cb: f.act(f.scr), to: "reqsent"},
+		{from: "reqsent", events: []string{"rcr+"}, cb: f.act(f.sca), to: "acksent"},
+		{from: "reqsent", events: []string{"rcr-"}, cb: f.act(f.scn), to: "reqsent"},
+		{from: "reqsent", events: []string{"rca"}, cb: f.act(f.ircConfigure), to: "ackrcvd"},
+		{from: "reqsent", events: []string{"rcn"}, cb: f.act(f.ircConfigure, f.scr), to: "reqsent"},
+		{from: "reqsent", events: []string{"rta", "rxj+", "rxr"}, to: "reqsent"},
+
+		{from: "ackrcvd", events: []string{"to+"}, cb: f.act(f.scr), to: "reqsent"},
+		{from: "ackrcvd", events: []string{"rcr+"}, cb: f.act(f.sca, f.tlu), to: "opened"},
+		{from: "ackrcvd", events: []string{"rcr-"}, cb: f.act(f.scn), to: "ackrcvd"},
+		{from: "ackrcvd", events: []string{"rca", "rcn"}, cb: f.act(f.scr), to: "reqsent"},
+		{from: "ackrcvd", events: []string{"rta", "rxj+"}, to: "reqsent"},
+		{from: "ackrcvd", events: []string{"rxr"}, to: "ackrcvd"},
+
+		{from: "acksent", events: []string{"to+"}, cb: f.act(f.scr), to: "acksent"},
+		{from: "acksent", events: []string{"rcr+"}, cb: f.act(f.sca), to: "acksent"},
+		{from: "acksent", events: []string{"rcr-"}, cb: f.act(f.scn), to: "reqsent"},
+		{from: "acksent", events: []string{"rca"}, cb: f.act(f.ircConfigure, f.tlu), to: "opened"},
+		{from: "acksent", events: []string{"rcn"}, cb: f.act(f.ircConfigure, f.scr), to: "acksent"},
+		{from: "acksent", events: []string{"rta", "rxj+", "rxr"}, to: "acksent"},
+
+		{from: "opened", events: []string{"down"}, cb: f.act(f.tld), to: "starting"},
+		{from: "opened", events: []string{"open"}, to: "opened"},
+		{from: "opened", events: []string{"close"}, cb: f.act(f.tld, f.ircTerminate, f.str), to: "closing"},
+		{from: "opened", events: []string{"rcr+"}, cb: f.act(f.tld, f.scr, f.sca), to: "acksent"},
+		{from: "opened", events: []string{"rcr-"}, cb: f.act(f.tld, f.scr, f.scn), to: "reqsent"},
+		{from: "opened", events: []string{"rca", "rcn", "rta"}, cb: f.act(f.tld, f.scr), to: "reqsent"},
+		{from: "opened", events: []string{"rtr"}, cb: f.act(f.tld, f.zrc, f.sta), to: "stopping"},
+		{from: "opened", events: []string{"ruc"}, cb: f.act(f.scj), to: "opened"},
+		{from: "opened", events: []string{"rxj+", "rxr"}, to: "opened"},
+		{from: "opened", events: []string{"rxj-"}, cb: f.act(f.tld, f.ircTerminate, f.str), to: "stopping"},
+	}
+	table = append(table, eachOf(negotiating, []string{"down"}, nil, "starting")...)
+	table = append(table, eachOf(negotiating, []string{"open"}, nil, "")...)
+	table = append(table, eachOf(negotiating, []string{"close"}, f.act(f.ircTerminate, f.str), "closing")...)
+	table = append(table, eachOf(negotiating, []string{"to-"}, f.act(f.tlf), "stopped")...)
+	table = append(table, eachOf(negotiating, []string{"rtr"}, f.act(f.sta), "reqsent")...)
+	table = append(table, eachOf(negotiating, []string{"ruc"}, f.act(f.scj), "")...)
+	table = append(table, eachOf(negotiating, []string{"rxj-"}, f.act(f.tlf), "stopped")...)
+
+	f.fsm = fsm{
+		current: "initial",
+		table:   table,
+	}
+	return f
+}
+
+// act combines transition actions into a single fsm callback
+func (f *pppFSM) act(actions ...func()) fsmCallback {
+	return func(args []interface{}) {
+		for _, a := range actions {
+			a()
+		}
+	}
+}
+
+func (f *pppFSM) handleEvent(ev string) {
+	from := f.fsm.current
+	err := f.fsm.handleEvent(ev)
+	if err != nil {
+		// Events with no transition are not expected to occur per
+		// RFC1661, and are ignored.
+		level.Debug(f.logger).Log(
+			"message", "ignoring ppp fsm event",
+			"event", ev,
+			"error", err)
+		return
+	}
+
+	level.Debug(f.logger).Log(
+		"message", "ppp fsm event",
+		"event", ev,
+		"from", from,
+		"to", f.fsm.current)
+
+	// The restart timer only runs while we're awaiting a response
+	switch f.fsm.current {
+	case "reqsent", "ackrcvd", "acksent", "closing", "stopping":
+	default:
+		f.stopTimer()
+	}
+}
+
+// up signals that the lower layer is ready to carry packets.
+func (f *pppFSM) up() {
+	f.handleEvent("up")
+}
+
+// down signals that the lower layer is no longer available.
+func (f *pppFSM) down() {
+	f.handleEvent("down")
+}
+
+// open signals that the link is administratively available.
+func (f *pppFSM) open() {
+	f.handleEvent("open")
+}
+
+// close signals that the link is not administratively available.
+func (f *pppFSM) close() {
+	f.handleEvent("close")
+}
+
+func (f *pppFSM) isOpened() bool {
+	return f.fsm.current == "opened"
+}
+
+// input processes a packet received for the automaton's protocol.
+func (f *pppFSM) input(msg *pppDataMessage) {
+	f.rx = msg
+	defer func() { f.rx = nil }()
+
+	switch msg.payload.code {
+	case pppCodeConfigureRequest:
+		f.responseCode, f.responseOpts = f.neg.configureRequestReceived(msg.payload.getOptions())
+		if f.responseCode == pppCodeConfigureAck {
+			f.handleEvent("rcr+")
+			return
+		}
+		if f.responseCode == pppCodeConfigureNak {
+			// Ref: RFC1661 section 4.6, Max-Failure
+			f.failureCount++
+			if f.failureCount > pppMaxFailure {
+				f.responseCode = pppCodeConfigureReject
+			}
+		}
+		f.handleEvent("rcr-")
+	case pppCodeConfigureAck, pppCodeConfigureNak, pppCodeConfigureReject:
+		if msg.payload.identifier != f.reqID {
+			level.Debug(f.logger).Log(
+				"message", "discarding response with mismatched identifier",
+				"code", msg.payload.code,
+				"identifier", msg.payload.identifier,
+				"expected", f.reqID)
+			return
+		}
+		switch msg.payload.code {
+		case pppCodeConfigureAck:
+			f.ackErr = f.neg.configureAckReceived(msg.payload.getOptions())
+			if f.ackErr != nil {
+				level.Error(f.logger).Log(
+					"message", "discarding unusable Configure-Ack",
+					"error", f.ackErr)
+				return
+			}
+			f.handleEvent("rca")
+		case pppCodeConfigureNak:
+			f.neg.configureNakReceived(msg.payload.getOptions())
+			f.handleEvent("rcn")
+		case pppCodeConfigureReject:
+			f.neg.configureRejectReceived(msg.payload.getOptions())
+			f.handleEvent("rcn")
+		}
+	case pppCodeTerminateRequest:
+		f.finishReason = "terminated by peer"
+		f.handleEvent("rtr")
+	case pppCodeTerminateAck:
+		f.handleEvent("rta")
+	case pppCodeCodeReject:
+		// Rejection of a code the automaton relies on is catastrophic
+		if len(msg.payload.data) > 0 && msg.payload.data[0] <= pppCodeCodeReject {
+			f.finishReason = "peer rejected code " + codeToString(msg.payload.data[0])
+			f.handleEvent("rxj-")
+		} else {
+			f.handleEvent("rxj+")
+		}
+	default:
+		if !f.neg.handleCode(msg) {
+			f.handleEvent("ruc")
+		}
+	}
+}
+
+// protocolRejected processes a Protocol-Reject of the automaton's protocol
+// received by LCP.  Ref: RFC1661 section 5.7
+func (f *pppFSM) protocolRejected() {
+	f.finishReason = "protocol rejected by peer"
+	f.handleEvent("rxj-")
+}
+
+// timeout processes expiry of the restart timer.
+func (f *pppFSM) timeout(seq uint) {
+	if seq != f.timerSeq || f.timer == nil {
+		// stale timer
+		return
+	}
+	f.timer = nil
+	if f.restartCount > 0 {
+		f.handleEvent("to+")
+	} else {
+		// Termination timeouts keep the reason termination started
+		switch f.fsm.current {
+		case "closing", "stopping":
+		default:
+			f.finishReason = "no response from peer"
+			if f.ackErr != nil {
+				f.finishReason = f.ackErr.Error()
+			}
+		}
+		f.handleEvent("to-")
+	}
+}
+
+func (f *pppFSM) startTimer() {
+	f.stopTimer()
+	f.timerSeq++
+	seq := f.timerSeq
+	f.timer = time.AfterFunc(pppRestartTimeout, func() {
+		f.link.pppTimeout(f, seq)
+	})
+}
+
+func (f *pppFSM) stopTimer() {
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+}
+
+// nextIdentifier returns the identifier for a new request packet of the
+// automaton's protocol.  Identifiers are per-session state.
+func (f *pppFSM) nextIdentifier() byte {
+	f.identifier++
+	return f.identifier
+}
+
+func (f *pppFSM) send(code, identifier byte, data []byte) {
+	f.link.sendPPP(f.protocol, code, identifier, data)
+}
+
+// Transition actions, ref: RFC1661 section 4.4
+
+func (f *pppFSM) tlu() {
+	f.neg.thisLayerUp()
+}
+
+func (f *pppFSM) tld() {
+	f.neg.thisLayerDown()
+}
+
+func (f *pppFSM) tls() {
+	f.finishReason = ""
+	f.ackErr = nil
+	f.failureCount = 0
+	f.neg.thisLayerStarted()
+}
+
+func (f *pppFSM) tlf() {
+	reason := f.finishReason
+	if reason == "" {
+		reason = "negotiation finished"
+	}
+	f.neg.thisLayerFinished(reason)
+}
+
+func (f *pppFSM) ircConfigure() {
+	f.restartCount = pppMaxConfigure
+}
+
+func (f *pppFSM) ircTerminate() {
+	f.restartCount = pppMaxTerminate
+}
+
+func (f *pppFSM) zrc() {
+	f.restartCount = 0
+	f.startTimer()
+}
+
+func (f *pppFSM) scr() {
+	f.restartCount--
+	f.reqID = f.nextIdentifier()
+	f.send(pppCodeConfigureRequest, f.reqID, encodePPPOptions(f.neg.configureRequest()))
+	f.startTimer()
+}
+
+func (f *pppFSM) sca() {
+	f.failureCount = 0
+	f.send(pppCodeConfigureAck, f.rx.payload.identifier, encodePPPOptions(f.responseOpts))
+}
+
+func (f *pppFSM) scn() {
+	f.send(f.responseCode, f.rx.payload.identifier, encodePPPOptions(f.responseOpts))
+}
+
+func (f *pppFSM) str() {
+	f.restartCount--
+	f.reqID = f.nextIdentifier()
+	f.send(pppCodeTerminateRequest, f.reqID, nil)
+	f.startTimer()
+}
+
+func (f *pppFSM) sta() {
+	f.send(pppCodeTerminateAck, f.rx.payload.identifier, nil)
+}
+
+func (f *pppFSM) scj() {
+	rejected, err := f.rx.payload.toBytes()
+	if err != nil {
+		return
+	}
+	// The rejected packet is truncated to fit the peer's MRU.
+	// Ref: RFC1661 section 5.6
+	if limit := int(f.link.pppPeerMRU()) - pppPayloadHeaderLen; len(rejected) > limit {
+		rejected = rejected[:limit]
+	}
+	f.send(pppCodeCodeReject, f.nextIdentifier(), rejected)
+}
+
+func codeToString(code byte) string {
+	switch code {
+	case pppCodeConfigureRequest:
+		return "Configure-Request"
+	case pppCodeConfigureAck:
+		return "Configure-Ack"
+	case pppCodeConfigureNak:
+		return "Configure-Nak"
+	case pppCodeConfigureReject:
+		return "Configure-Reject"
+	case pppCodeTerminateRequest:
+		return "Terminate-Request"
+	case pppCodeTerminateAck:
+		return "Terminate-Ack"
+	case pppCodeCodeReject:
+		return "Code-Reject"
+	case pppCodeProtocolReject:
+		return "Protocol-Reject"
+	case pppCodeEchoRequest:
+		return "Echo-Request"
+	case pppCodeEchoReply:
+		return "Echo-Reply"
+	case pppCodeDiscardRequest:
+		return "Discard-Request"
+	}
+	return "unknown"
+}
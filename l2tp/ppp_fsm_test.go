@@ -0,0 +1,239 @@
+package l2tp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+type testPPPPacket struct {
+	code, identifier byte
+	data             []byte
+}
+
+type testPPPLink struct {
+	sent []testPPPPacket
+	mru  uint16
+}
+
+func (l *testPPPLink) sendPPP(protocol pppProtocolType, code, identifier byte, data []byte) {
+	l.sent = append(l.sent, testPPPPacket{code: code, identifier: identifier, data: data})
+}
+
+func (l *testPPPLink) pppTimeout(f *pppFSM, seq uint) {
+}
+
+func (l *testPPPLink) pppPeerMRU() uint16 {
+	if l.mru == 0 {
+		return pppLCPMRU
+	}
+	return l.mru
+}
+
+func (l *testPPPLink) last() testPPPPacket {
+	return l.sent[len(l.sent)-1]
+}
+
+type testPPPNegotiator struct {
+	up, finished bool
+	reason       string
+	rcrCode      byte
+	ackErr       error
+}
+
+func (n *testPPPNegotiator) configureRequest() []pppOption {
+	return []pppOption{newPPPUint16Option(pppLCPOptionMRU, 1500)}
+}
+
+func (n *testPPPNegotiator) configureRequestReceived(opts []pppOption) (byte, []pppOption) {
+	return n.rcrCode, opts
+}
+
+func (n *testPPPNegotiator) configureAckReceived(opts []pppOption) error { return n.ackErr }
+func (n *testPPPNegotiator) configureNakReceived(opts []pppOption)       {}
+func (n *testPPPNegotiator) configureRejectReceived(opts []pppOption)    {}
+func (n *testPPPNegotiator) handleCode(msg *pppDataMessage) bool         { return false }
+func (n *testPPPNegotiator) thisLayerUp()                                { n.up = true }
+func (n *testPPPNegotiator) thisLayerDown()                              { n.up = false }
+func (n *testPPPNegotiator) thisLayerStarted()                           {}
+func (n *testPPPNegotiator) thisLayerFinished(reason string) {
+	n.finished = true
+	n.reason = reason
+}
+
+func newTestPPPFSM() (*pppFSM, *testPPPLink, *testPPPNegotiator) {
+	link := &testPPPLink{}
+	neg := &testPPPNegotiator{rcrCode: pppCodeConfigureAck}
+	f := newPPPFSM(log.NewNopLogger(), "test", pppProtocolLCP, link, neg)
+	return f, link, neg
+}
+
+func testPPPInput(f *pppFSM, code, identifier byte, data []byte) {
+	f.input(newPPPPacket(0, 0, pppProtocolLCP, code, identifier, data))
+}
+
+func TestPPPFSMOpen(t *testing.T) {
+	f, link, neg := newTestPPPFSM()
+	defer f.stopTimer()
+
+	f.open()
+	f.up()
+	if len(link.sent) != 1 || link.last().code != pppCodeConfigureRequest {
+		t.Fatalf("expected Configure-Request on open, got %v", link.sent)
+	}
+	reqID := link.last().identifier
+
+	testPPPInput(f, pppCodeConfigureRequest, 77, encodePPPOptions([]pppOption{newPPPUint16Option(pppLCPOptionMRU, 1400)}))
+	if link.last().code != pppCodeConfigureAck || link.last().identifier != 77 {
+		t.Fatalf("expected Configure-Ack with identifier 77, got %+v", link.last())
+	}
+
+	// a response with the wrong identifier must be discarded
+	testPPPInput(f, pppCodeConfigureAck, reqID+1, nil)
+	if f.isOpened() {
+		t.Fatalf("opened on Configure-Ack with mismatched identifier")
+	}
+
+	testPPPInput(f, pppCodeConfigureAck, reqID, nil)
+	if !f.isOpened() || !neg.up {
+		t.Fatalf("expected opened state, got %v", f.fsm.current)
+	}
+
+	// unknown codes are rejected
+	testPPPInput(f, 42, 9, nil)
+	if link.last().code != pppCodeCodeReject {
+		t.Fatalf("expected Code-Reject for unknown code, got %+v", link.last())
+	}
+
+	// peer termination
+	testPPPInput(f, pppCodeTerminateRequest, 12, nil)
+	if link.last().code != pppCodeTerminateAck || link.last().identifier != 12 {
+		t.Fatalf("expected Terminate-Ack with identifier 12, got %+v", link.last())
+	}
+	if neg.up {
+		t.Fatalf("layer still up after Terminate-Request")
+	}
+	f.timeout(f.timerSeq)
+	if !neg.finished || neg.reason != "terminated by peer" {
+		t.Fatalf("expected layer finished by peer, got %v %q", neg.finished, neg.reason)
+	}
+}
+
+func TestPPPFSMRestart(t *testing.T) {
+	f, link, neg := newTestPPPFSM()
+	defer f.stopTimer()
+
+	f.open()
+	f.up()
+	for i := 1; i < pppMaxConfigure; i++ {
+		f.timeout(f.timerSeq)
+	}
+	if len(link.sent) != pppMaxConfigure {
+		t.Fatalf("expected %d Configure-Requests, got %d", pppMaxConfigure, len(link.sent))
+	}
+	if neg.finished {
+		t.Fatalf("layer finished before restart count exhausted")
+	}
+	f.timeout(f.timerSeq)
+	if !neg.finished || neg.reason != "no response from peer" {
+		t.Fatalf("expected layer finished on timeout, got %v %q", neg.finished, neg.reason)
+	}
+	if f.fsm.current != "stopped" {
+		t.Fatalf("expected stopped state, got %v", f.fsm.current)
+	}
+}
+
+func TestPPPFSMUnusableAck(t *testing.T) {
+	f, link, neg := newTestPPPFSM()
+	defer f.stopTimer()
+
+	neg.ackErr = errors.New("unusable options")
+	f.open()
+	f.up()
+	testPPPInput(f, pppCodeConfigureRequest, 1, nil)
+	for i := 1; i < pppMaxConfigure; i++ {
+		testPPPInput(f, pppCodeConfigureAck, f.reqID, nil)
+		if f.isOpened() {
+			t.Fatalf("opened on unusable Configure-Ack")
+		}
+		f.timeout(f.timerSeq)
+	}
+	if link.last().code != pppCodeConfigureRequest {
+		t.Fatalf("expected Configure-Request to be retransmitted, got %+v", link.last())
+	}
+	testPPPInput(f, pppCodeConfigureAck, f.reqID, nil)
+	f.timeout(f.timerSeq)
+	if !neg.finished || neg.reason != "unusable options" {
+		t.Fatalf("expected layer finished with ack error, got %v %q", neg.finished, neg.reason)
+	}
+}
+
+func TestPPPFSMMaxFailure(t *testing.T) {
+	f, link, neg := newTestPPPFSM()
+	defer f.stopTimer()
+
+	neg.rcrCode = pppCodeConfigureNak
+	f.open()
+	f.up()
+	for i := 0; i < pppMaxFailure; i++ {
+		testPPPInput(f, pppCodeConfigureRequest, byte(i), nil)
+		if link.last().code != pppCodeConfigureNak {
+			t.Fatalf("request %d: expected Configure-Nak, got %+v", i, link.last())
+		}
+	}
+	testPPPInput(f, pppCodeConfigureRequest, 99, nil)
+	if link.last().code != pppCodeConfigureReject {
+		t.Fatalf("expected Configure-Reject after max failures, got %+v", link.last())
+	}
+}
+
+func TestPPPFSMProtocolReject(t *testing.T) {
+	f, link, neg := newTestPPPFSM()
+	defer f.stopTimer()
+
+	// rejection during negotiation finishes the layer immediately
+	f.open()
+	f.up()
+	f.protocolRejected()
+	if f.fsm.current != "stopped" || !neg.finished || neg.reason != "protocol rejected by peer" {
+		t.Fatalf("expected stopped state on protocol reject, got %v, finished %v %q",
+			f.fsm.current, neg.finished, neg.reason)
+	}
+
+	// rejection once opened terminates the link
+	f, link, neg = newTestPPPFSM()
+	defer f.stopTimer()
+	f.open()
+	f.up()
+	testPPPInput(f, pppCodeConfigureRequest, 1, nil)
+	testPPPInput(f, pppCodeConfigureAck, link.sent[0].identifier, nil)
+	if !f.isOpened() {
+		t.Fatalf("expected opened state, got %v", f.fsm.current)
+	}
+	f.protocolRejected()
+	if neg.up || link.last().code != pppCodeTerminateRequest {
+		t.Fatalf("expected layer down and Terminate-Request, got up %v, last sent %+v", neg.up, link.last())
+	}
+}
+
+func TestPPPFSMCodeReject(t *testing.T) {
+	f, link, _ := newTestPPPFSM()
+	defer f.stopTimer()
+	link.mru = 64
+
+	f.open()
+	f.up()
+	testPPPInput(f, 0x7f, 5, []byte{1, 2, 3, 4})
+	rej := link.last()
+	if rej.code != pppCodeCodeReject || len(rej.data) != 8 || rej.data[0] != 0x7f || rej.data[1] != 5 {
+		t.Fatalf("expected Code-Reject of unknown code, got %+v", rej)
+	}
+
+	// the rejected packet is truncated to fit the peer's MRU
+	testPPPInput(f, 0x7f, 6, make([]byte, 200))
+	rej = link.last()
+	if rej.code != pppCodeCodeReject || len(rej.data) != 64-pppPayloadHeaderLen {
+		t.Fatalf("expected Code-Reject truncated to %v bytes, got %v bytes", 64-pppPayloadHeaderLen, len(rej.data))
+	}
+}
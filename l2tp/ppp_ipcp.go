@@ -0,0 +1,203 @@
+package l2tp
+
+import (
+	"errors"
+	"net"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// pppIPCP implements the IP Control Protocol option negotiation for a
+// dynamic session.  Ref: RFC1332, RFC1877.
+type pppIPCP struct {
+	ds *dynamicSession
+	// requested lists the address options we request, in order.
+	// Options rejected by the peer are removed.
+	requested []byte
+	// addresses holds the current value of each requested option,
+	// starting as 0.0.0.0 and updated by Configure-Nak from the peer.
+	addresses map[byte]net.IP
+	// VJ header compression of the packets the peer sends us
+	requestVJ    bool
+	vjMaxSlotID  byte
+	vjCompSlotID bool
+	// VJ header compression of the packets we send, if the peer asked
+	// and hasn't rejected the compressed packets
+	peerVJ         bool
+	peerVJMaxSlot  byte
+	peerVJCompSlot bool
+	peerVJRejected bool
+}
+
+func newPPPIPCP(ds *dynamicSession) *pppIPCP {
+	ipcp := &pppIPCP{
+		ds: ds,
+		requested: []byte{
+			pppIPCPOptionIPAddress,
+			pppIPCPOptionPrimaryDNS,
+			pppIPCPOptionSecondaryDNS,
+		},
+		addresses:    make(map[byte]net.IP),
+		requestVJ:    ds.cfg.VJCompression,
+		vjMaxSlotID:  vjMaxSlotID,
+		vjCompSlotID: true,
+	}
+	if ds.cfg.RequestNBNS {
+		ipcp.requested = append(ipcp.requested,
+			pppIPCPOptionPrimaryNBNS,
+			pppIPCPOptionSecondaryNBNS)
+	}
+	for _, t := range ipcp.requested {
+		ipcp.addresses[t] = net.IPv4zero.To4()
+	}
+	return ipcp
+}
+
+func (ipcp *pppIPCP) configureRequest() []pppOption {
+	opts := []pppOption{}
+	for _, t := range ipcp.requested {
+		opts = append(opts, pppOption{
+			type_:  t,
+			length: 6,
+			value:  ipcp.addresses[t],
+		})
+	}
+	if ipcp.requestVJ {
+		opts = append(opts, newVJOption(ipcp.vjMaxSlotID, ipcp.vjCompSlotID))
+	}
+	return opts
+}
+
+// newVJOption returns an IP-Compression-Protocol option requesting VJ
+// compression.  Ref: RFC1332 section 4
+func newVJOption(maxSlotID byte, compSlotID bool) pppOption {
+	value := []byte{0x00, byte(pppProtocolVJCompressed), maxSlotID, 0}
+	if compSlotID {
+		value[3] = 1
+	}
+	return pppOption{
+		type_:  pppIPCPOptionIPCompression,
+		length: 2 + vjOptionLen,
+		value:  value,
+	}
+}
+
+func (ipcp *pppIPCP) configureRequestReceived(opts []pppOption) (code byte, resp []pppOption) {
+	ipcp.peerVJ = false
+	for _, opt := range opts {
+		if ipcp.ds.cfg.VJCompression && !ipcp.peerVJRejected && opt.supportVJ() {
+			ipcp.peerVJ = true
+			ipcp.peerVJMaxSlot = opt.value[2]
+			ipcp.peerVJCompSlot = opt.value[3] != 0
+		}
+	}
+	// accept all options
+	return pppCodeConfigureAck, opts
+}
+
+// configureAckReceived refuses an Ack which leaves us without an address,
+// since the session can't carry IPv4 traffic without one.  The peer may
+// assign an address on retransmission of our request.
+func (ipcp *pppIPCP) configureAckReceived(opts []pppOption) error {
+	if ipcp.networkConfig().Address == nil {
+		return errors.New("peer didn't assign an IPv4 address")
+	}
+	return nil
+}
+
+func (ipcp *pppIPCP) configureNakReceived(opts []pppOption) {
+	for _, opt := range opts {
+		if _, ok := ipcp.addresses[opt.type_]; ok && len(opt.value) == 4 {
+			ipcp.addresses[opt.type_] = net.IP(append([]byte{}, opt.value...))
+		}
+		if opt.type_ == pppIPCPOptionIPCompression {
+			// Adopt the peer's VJ parameters, or stop requesting
+			// compression if the peer suggests another protocol
+			if opt.supportVJ() {
+				ipcp.vjMaxSlotID = opt.value[2]
+				ipcp.vjCompSlotID = opt.value[3] != 0
+			} else {
+				ipcp.requestVJ = false
+			}
+		}
+	}
+}
+
+func (ipcp *pppIPCP) configureRejectReceived(opts []pppOption) {
+	for _, opt := range opts {
+		if opt.type_ == pppIPCPOptionIPAddress {
+			level.Error(ipcp.ds.logger).Log(
+				"message", "peer rejected ipcp address negotiation")
+		}
+		if opt.type_ == pppIPCPOptionIPCompression {
+			ipcp.requestVJ = false
+			continue
+		}
+		for i, t := range ipcp.requested {
+			if t == opt.type_ {
+				ipcp.requested = append(ipcp.requested[:i], ipcp.requested[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// vjProtocolRejected stops VJ compression of the packets we send when the
+// peer rejects them with a Protocol-Reject, despite having asked for them.
+// The peer's request for compression is ignored if IPCP is renegotiated.
+func (ipcp *pppIPCP) vjProtocolRejected() {
+	level.Info(ipcp.ds.logger).Log(
+		"message", "peer rejected vj compressed packets")
+	ipcp.peerVJ = false
+	ipcp.peerVJRejected = true
+	ipcp.ds.setVJCompression(nil, ipcp.ds.vjRx)
+}
+
+func (ipcp *pppIPCP) handleCode(msg *pppDataMessage) bool {
+	return false
+}
+
+// networkConfig returns the negotiated addresses.  Options which the
+// peer rejected or didn't provide a value for are left nil.
+func (ipcp *pppIPCP) networkConfig() *SessionNetworkConfig {
+	addr := func(t byte) net.IP {
+		for _, r := range ipcp.requested {
+			if r == t && !ipcp.addresses[t].Equal(net.IPv4zero) {
+				return ipcp.addresses[t]
+			}
+		}
+		return nil
+	}
+	return &SessionNetworkConfig{
+		Address:       addr(pppIPCPOptionIPAddress),
+		PrimaryDNS:    addr(pppIPCPOptionPrimaryDNS),
+		SecondaryDNS:  addr(pppIPCPOptionSecondaryDNS),
+		PrimaryNBNS:   addr(pppIPCPOptionPrimaryNBNS),
+		SecondaryNBNS: addr(pppIPCPOptionSecondaryNBNS),
+	}
+}
+
+func (ipcp *pppIPCP) thisLayerUp() {
+	var tx *vjCompressor
+	var rx *vjDecompressor
+	if ipcp.peerVJ {
+		tx = newVJCompressor(ipcp.peerVJMaxSlot, ipcp.peerVJCompSlot)
+	}
+	if ipcp.requestVJ {
+		rx = newVJDecompressor(ipcp.vjMaxSlotID)
+	}
+	ipcp.ds.setVJCompression(tx, rx)
+	ipcp.ds.onIPCPUp(ipcp.networkConfig())
+}
+
+func (ipcp *pppIPCP) thisLayerDown() {
+	ipcp.ds.setVJCompression(nil, nil)
+	ipcp.ds.onIPCPDown()
+}
+
+func (ipcp *pppIPCP) thisLayerStarted() {
+}
+
+func (ipcp *pppIPCP) thisLayerFinished(reason string) {
+	ipcp.ds.onPPPFinished("IPCP", reason)
+}
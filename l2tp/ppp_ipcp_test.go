@@ -0,0 +1,118 @@
+package l2tp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestIPCPNegotiation(t *testing.T) {
+	ds := &dynamicSession{
+		baseSession: newBaseSession(log.NewNopLogger(), "s1", nil, &SessionConfig{RequestNBNS: true}),
+	}
+	ipcp := newPPPIPCP(ds)
+
+	opts := ipcp.configureRequest()
+	if len(opts) != 5 {
+		t.Fatalf("expected 5 options in initial request, got %v", opts)
+	}
+	for _, opt := range opts {
+		if !net.IP(opt.value).Equal(net.IPv4zero) {
+			t.Fatalf("expected option %v to request 0.0.0.0, got %v", opt.type_, net.IP(opt.value))
+		}
+	}
+
+	// the peer must assign an address rather than ack 0.0.0.0
+	if err := ipcp.configureAckReceived(opts); err == nil {
+		t.Fatalf("configureAckReceived() of 0.0.0.0 succeeded")
+	}
+
+	ipcp.configureNakReceived([]pppOption{
+		{type_: pppIPCPOptionIPAddress, length: 6, value: []byte{10, 0, 0, 2}},
+		{type_: pppIPCPOptionPrimaryDNS, length: 6, value: []byte{8, 8, 8, 8}},
+		{type_: pppIPCPOptionSecondaryDNS, length: 6, value: []byte{8, 8, 4, 4}},
+	})
+	ipcp.configureRejectReceived([]pppOption{
+		{type_: pppIPCPOptionPrimaryNBNS, length: 6, value: []byte{0, 0, 0, 0}},
+		{type_: pppIPCPOptionSecondaryNBNS, length: 6, value: []byte{0, 0, 0, 0}},
+	})
+
+	if err := ipcp.configureAckReceived(nil); err != nil {
+		t.Fatalf("configureAckReceived() with assigned address: %v", err)
+	}
+
+	opts = ipcp.configureRequest()
+	if len(opts) != 3 {
+		t.Fatalf("expected rejected options to be dropped from request, got %v", opts)
+	}
+
+	nc := ipcp.networkConfig()
+	want := SessionNetworkConfig{
+		Address:      net.IPv4(10, 0, 0, 2),
+		PrimaryDNS:   net.IPv4(8, 8, 8, 8),
+		SecondaryDNS: net.IPv4(8, 8, 4, 4),
+	}
+	if !nc.Address.Equal(want.Address) ||
+		!nc.PrimaryDNS.Equal(want.PrimaryDNS) ||
+		!nc.SecondaryDNS.Equal(want.SecondaryDNS) ||
+		nc.PrimaryNBNS != nil || nc.SecondaryNBNS != nil {
+		t.Fatalf("networkConfig() = %+v, want %+v", nc, want)
+	}
+}
+
+func TestIPCPVJNegotiation(t *testing.T) {
+	ds := &dynamicSession{
+		baseSession: newBaseSession(log.NewNopLogger(), "s1", nil, &SessionConfig{VJCompression: true}),
+	}
+	ipcp := newPPPIPCP(ds)
+
+	opts := ipcp.configureRequest()
+	if last := opts[len(opts)-1]; !last.supportVJ() || last.value[2] != vjMaxSlotID || last.value[3] != 1 {
+		t.Fatalf("expected request for VJ compression, got %v", opts)
+	}
+
+	code, _ := ipcp.configureRequestReceived([]pppOption{newVJOption(7, false)})
+	if code != pppCodeConfigureAck || !ipcp.peerVJ || ipcp.peerVJMaxSlot != 7 || ipcp.peerVJCompSlot {
+		t.Fatalf("expected peer VJ parameters to be recorded, got %v %+v", codeToString(code), ipcp)
+	}
+
+	ipcp.configureNakReceived([]pppOption{newVJOption(3, false)})
+	if !ipcp.requestVJ || ipcp.vjMaxSlotID != 3 || ipcp.vjCompSlotID {
+		t.Fatalf("expected VJ parameters from nak to be adopted, got %+v", ipcp)
+	}
+
+	ipcp.configureRejectReceived([]pppOption{newVJOption(3, false)})
+	if ipcp.requestVJ || len(ipcp.configureRequest()) != 3 {
+		t.Fatalf("still requesting VJ compression after reject")
+	}
+}
+
+func TestIPCPVJProtocolReject(t *testing.T) {
+	ds := &dynamicSession{
+		baseSession: newBaseSession(log.NewNopLogger(), "s1", nil, &SessionConfig{VJCompression: true}),
+	}
+	ds.lcpNeg = newPPPLCP(ds)
+	ds.ipcpNeg = newPPPIPCP(ds)
+
+	ds.ipcpNeg.configureRequestReceived([]pppOption{newVJOption(vjMaxSlotID, true)})
+	ds.setVJCompression(newVJCompressor(vjMaxSlotID, true), newVJDecompressor(vjMaxSlotID))
+
+	rejected := make([]byte, 8)
+	binary.BigEndian.PutUint16(rejected, uint16(pppProtocolVJCompressed))
+	ds.lcpNeg.protocolRejectReceived(newPPPPacket(0, 0, pppProtocolLCP, pppCodeProtocolReject, 1, rejected))
+
+	if ds.vjTx != nil || ds.ipcpNeg.peerVJ {
+		t.Fatalf("still compressing packets sent to the peer after protocol reject")
+	}
+	if ds.vjRx == nil {
+		t.Fatalf("stopped decompressing packets from the peer after protocol reject")
+	}
+
+	// the peer's request for compression is ignored on renegotiation
+	ds.ipcpNeg.configureRequestReceived([]pppOption{newVJOption(vjMaxSlotID, true)})
+	if ds.ipcpNeg.peerVJ {
+		t.Fatalf("peer VJ compression accepted again after protocol reject")
+	}
+}
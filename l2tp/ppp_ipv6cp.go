@@ -0,0 +1,141 @@
+package l2tp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+)
+
+const pppIPV6CPInterfaceIDLen = 8
+
+// pppIPV6CP implements the IPv6 Control Protocol option negotiation for a
+// dynamic session.  Ref: RFC5072.
+type pppIPV6CP struct {
+	ds        *dynamicSession
+	localID   []byte
+	peerID    []byte
+	requestID bool
+}
+
+func newPPPIPV6CP(ds *dynamicSession) *pppIPV6CP {
+	return &pppIPV6CP{
+		ds:        ds,
+		localID:   newPPPInterfaceID(nil),
+		requestID: true,
+	}
+}
+
+// newPPPInterfaceID returns a random, non-zero IPv6 interface identifier
+// which differs from the identifier passed in.  Ref: RFC5072 section 4.1
+func newPPPInterfaceID(not []byte) []byte {
+	zero := make([]byte, pppIPV6CPInterfaceIDLen)
+	id := make([]byte, pppIPV6CPInterfaceIDLen)
+	for {
+		_, _ = rand.Read(id)
+		if !bytes.Equal(id, zero) && !bytes.Equal(id, not) {
+			return id
+		}
+	}
+}
+
+// interfaceIDToLinkLocal returns the IPv6 link-local address formed from
+// an interface identifier.  Ref: RFC5072 section 5
+func interfaceIDToLinkLocal(id []byte) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	ip[0] = 0xfe
+	ip[1] = 0x80
+	copy(ip[8:], id)
+	return ip
+}
+
+func (ipv6cp *pppIPV6CP) configureRequest() []pppOption {
+	opts := []pppOption{}
+	if ipv6cp.requestID {
+		opts = append(opts, pppOption{
+			type_:  pppIPV6CPOptionInterfaceID,
+			length: 2 + pppIPV6CPInterfaceIDLen,
+			value:  ipv6cp.localID,
+		})
+	}
+	return opts
+}
+
+func (ipv6cp *pppIPV6CP) configureRequestReceived(opts []pppOption) (code byte, resp []pppOption) {
+	ackOpts := []pppOption{}
+	nakOpts := []pppOption{}
+	rejectOpts := []pppOption{}
+
+	for _, opt := range opts {
+		if opt.type_ != pppIPV6CPOptionInterfaceID || len(opt.value) != pppIPV6CPInterfaceIDLen {
+			rejectOpts = append(rejectOpts, opt)
+			continue
+		}
+		// A zero identifier, or one matching ours, must be naked with
+		// a suggested alternative.  Ref: RFC5072 section 4.1
+		zero := bytes.Equal(opt.value, make([]byte, pppIPV6CPInterfaceIDLen))
+		if zero || bytes.Equal(opt.value, ipv6cp.localID) {
+			nakOpts = append(nakOpts, pppOption{
+				type_:  pppIPV6CPOptionInterfaceID,
+				length: 2 + pppIPV6CPInterfaceIDLen,
+				value:  newPPPInterfaceID(ipv6cp.localID),
+			})
+			continue
+		}
+		ipv6cp.peerID = append([]byte{}, opt.value...)
+		ackOpts = append(ackOpts, opt)
+	}
+
+	if len(rejectOpts) > 0 {
+		return pppCodeConfigureReject, rejectOpts
+	} else if len(nakOpts) > 0 {
+		return pppCodeConfigureNak, nakOpts
+	}
+	return pppCodeConfigureAck, ackOpts
+}
+
+func (ipv6cp *pppIPV6CP) configureAckReceived(opts []pppOption) error {
+	return nil
+}
+
+func (ipv6cp *pppIPV6CP) configureNakReceived(opts []pppOption) {
+	for _, opt := range opts {
+		if opt.type_ != pppIPV6CPOptionInterfaceID || len(opt.value) != pppIPV6CPInterfaceIDLen {
+			continue
+		}
+		// Use the peer's suggestion unless it conflicts with the peer's
+		// own identifier, in which case pick another.
+		if bytes.Equal(opt.value, ipv6cp.peerID) ||
+			bytes.Equal(opt.value, make([]byte, pppIPV6CPInterfaceIDLen)) {
+			ipv6cp.localID = newPPPInterfaceID(ipv6cp.peerID)
+		} else {
+			ipv6cp.localID = append([]byte{}, opt.value...)
+		}
+	}
+}
+
+func (ipv6cp *pppIPV6CP) configureRejectReceived(opts []pppOption) {
+	for _, opt := range opts {
+		if opt.type_ == pppIPV6CPOptionInterfaceID {
+			ipv6cp.requestID = false
+		}
+	}
+}
+
+func (ipv6cp *pppIPV6CP) handleCode(msg *pppDataMessage) bool {
+	return false
+}
+
+func (ipv6cp *pppIPV6CP) thisLayerUp() {
+	ipv6cp.ds.onIPV6CPUp(ipv6cp.localID)
+}
+
+func (ipv6cp *pppIPV6CP) thisLayerDown() {
+	ipv6cp.ds.onIPV6CPDown()
+}
+
+func (ipv6cp *pppIPV6CP) thisLayerStarted() {
+}
+
+func (ipv6cp *pppIPV6CP) thisLayerFinished(reason string) {
+	ipv6cp.ds.onIPV6CPFinished(reason)
+}
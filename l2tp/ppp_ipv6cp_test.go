@@ -0,0 +1,63 @@
+package l2tp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestIPV6CPInterfaceIDNegotiation(t *testing.T) {
+	ipv6cp := &pppIPV6CP{
+		localID:   []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		requestID: true,
+	}
+
+	cases := []struct {
+		name string
+		id   []byte
+		want byte
+	}{
+		{"zero identifier", make([]byte, 8), pppCodeConfigureNak},
+		{"identifier matches ours", []byte{1, 2, 3, 4, 5, 6, 7, 8}, pppCodeConfigureNak},
+		{"unique identifier", []byte{8, 7, 6, 5, 4, 3, 2, 1}, pppCodeConfigureAck},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			code, resp := ipv6cp.configureRequestReceived([]pppOption{
+				{type_: pppIPV6CPOptionInterfaceID, length: 10, value: c.id},
+			})
+			if code != c.want {
+				t.Fatalf("got %v, want %v", codeToString(code), codeToString(c.want))
+			}
+			if code == pppCodeConfigureNak {
+				if len(resp) != 1 || bytes.Equal(resp[0].value, ipv6cp.localID) ||
+					bytes.Equal(resp[0].value, make([]byte, 8)) {
+					t.Fatalf("bad suggested identifier %v", resp)
+				}
+			}
+		})
+	}
+	if !bytes.Equal(ipv6cp.peerID, []byte{8, 7, 6, 5, 4, 3, 2, 1}) {
+		t.Fatalf("peer identifier not recorded: %v", ipv6cp.peerID)
+	}
+
+	// a nak suggesting the peer's identifier must not be adopted
+	ipv6cp.configureNakReceived([]pppOption{
+		{type_: pppIPV6CPOptionInterfaceID, length: 10, value: []byte{8, 7, 6, 5, 4, 3, 2, 1}},
+	})
+	if bytes.Equal(ipv6cp.localID, ipv6cp.peerID) {
+		t.Fatalf("adopted peer's interface identifier")
+	}
+
+	ipv6cp.configureNakReceived([]pppOption{
+		{type_: pppIPV6CPOptionInterfaceID, length: 10, value: []byte{0xa, 0xb, 0xc, 0xd, 0, 0, 0, 1}},
+	})
+	if !bytes.Equal(ipv6cp.localID, []byte{0xa, 0xb, 0xc, 0xd, 0, 0, 0, 1}) {
+		t.Fatalf("suggested interface identifier not adopted: %v", ipv6cp.localID)
+	}
+
+	want := net.ParseIP("fe80::a0b:c0d:0:1")
+	if got := interfaceIDToLinkLocal(ipv6cp.localID); !got.Equal(want) {
+		t.Fatalf("interfaceIDToLinkLocal() = %v, want %v", got, want)
+	}
+}
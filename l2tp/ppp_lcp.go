@@ -0,0 +1,373 @@
+package l2tp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// pppLCPMaxLoopback is the number of consecutive magic number collisions
+// after which the link is considered to be looped back.
+const pppLCPMaxLoopback = pppMaxFailure
+
+// pppLCP implements the Link Control Protocol option negotiation for a
+// dynamic session.  Ref: RFC1661 section 6.
+type pppLCP struct {
+	ds                 *dynamicSession
+	mru                uint16
+	peerMRU            uint16
+	requestMRU         bool
+	requestMagicNumber bool
+	magic              uint32
+	peerMagic          uint32
+	collisions         int
+	// header compression: we request that the peer compresses the
+	// frames it sends, and compress the frames we send if it asks us to
+	requestACFC bool
+	requestPFC  bool
+	peerACFC    bool
+	peerPFC     bool
+	// keepalive state: echoSent records when each outstanding echo
+	// request was sent, by identifier
+	echoSent    map[byte]time.Time
+	echoPending uint
+}
+
+func newPPPLCP(ds *dynamicSession) *pppLCP {
+	mru := pppLCPMRU
+	if ds.cfg.MRU != 0 {
+		mru = ds.cfg.MRU
+	}
+	return &pppLCP{
+		ds:                 ds,
+		mru:                mru,
+		peerMRU:            pppLCPMRU,
+		requestMRU:         true,
+		requestMagicNumber: true,
+		magic:              newPPPMagicNumber(),
+		requestACFC:        true,
+		requestPFC:         true,
+	}
+}
+
+// magicNumber returns the local magic number for use in LCP packets,
+// which is zero if the Magic-Number option has not been negotiated.
+func (lcp *pppLCP) magicNumber() uint32 {
+	if !lcp.requestMagicNumber {
+		return 0
+	}
+	return lcp.magic
+}
+
+// onLoopback tears the link down on detection of a looped-back link
+func (lcp *pppLCP) onLoopback() {
+	level.Error(lcp.ds.logger).Log(
+		"message", "lcp loopback detected",
+		"magic", lcp.magic)
+	lcp.ds.onPPPFinished("LCP", "loopback detected")
+}
+
+func (lcp *pppLCP) configureRequest() []pppOption {
+	opts := []pppOption{}
+	if lcp.requestMRU {
+		opts = append(opts, newPPPUint16Option(pppLCPOptionMRU, lcp.mru))
+	}
+	if lcp.requestMagicNumber {
+		opts = append(opts, newPPPUint32Option(pppLCPOptionMagicNumber, lcp.magic))
+	}
+	if lcp.requestPFC {
+		opts = append(opts, pppOption{type_: pppLCPOptionPFC, length: 2})
+	}
+	if lcp.requestACFC {
+		opts = append(opts, pppOption{type_: pppLCPOptionACFC, length: 2})
+	}
+	return opts
+}
+
+func (lcp *pppLCP) configureRequestReceived(opts []pppOption) (code byte, resp []pppOption) {
+	ackOpts := []pppOption{}
+	nakOpts := []pppOption{}
+	rejectOpts := []pppOption{}
+
+	lcp.ds.authProtocol = 0
+	lcp.peerMRU = pppLCPMRU
+	lcp.peerACFC = false
+	lcp.peerPFC = false
+	for _, opt := range opts {
+		if opt.supportPap() || opt.supportChap() {
+			lcp.ds.authProtocol = pppProtocolType(opt.toUint16())
+			if lcp.ds.authProtocol == pppProtocolCHAP {
+				lcp.ds.chapAlgorithm = opt.value[2]
+			}
+			ackOpts = append(ackOpts, opt)
+			continue
+		}
+		if opt.type_ == pppLCPOptionAuthProtocol {
+			// Suggest an authentication protocol we can use instead
+			nakOpts = append(nakOpts, pppOption{
+				type_:  pppLCPOptionAuthProtocol,
+				length: 5,
+				value:  []byte{0xC2, 0x23, pppCHAPAlgorithmMSCHAPv2},
+			})
+			continue
+		}
+		if opt.supportMagicNumber() {
+			// A peer magic number matching our own may indicate a
+			// looped-back link.  Ref: RFC1661 section 6.4
+			if lcp.requestMagicNumber && opt.toUint32() == lcp.magic {
+				lcp.collisions++
+				if lcp.collisions > pppLCPMaxLoopback {
+					lcp.onLoopback()
+				}
+				lcp.magic = newPPPMagicNumber()
+				nakOpts = append(nakOpts, newPPPUint32Option(pppLCPOptionMagicNumber, newPPPMagicNumber()))
+				continue
+			}
+			lcp.peerMagic = opt.toUint32()
+			ackOpts = append(ackOpts, opt)
+			continue
+		}
+		if opt.supportMRU() {
+			if opt.toUint16() < pppLCPMinMRU {
+				nakOpts = append(nakOpts, newPPPUint16Option(pppLCPOptionMRU, pppLCPMinMRU))
+				continue
+			}
+			lcp.peerMRU = opt.toUint16()
+			ackOpts = append(ackOpts, opt)
+			continue
+		}
+		if opt.supportPFC() {
+			lcp.peerPFC = true
+			ackOpts = append(ackOpts, opt)
+			continue
+		}
+		if opt.supportACFC() {
+			lcp.peerACFC = true
+			ackOpts = append(ackOpts, opt)
+			continue
+		}
+		rejectOpts = append(rejectOpts, opt)
+	}
+
+	if len(rejectOpts) > 0 {
+		return pppCodeConfigureReject, rejectOpts
+	} else if len(nakOpts) > 0 {
+		return pppCodeConfigureNak, nakOpts
+	}
+	return pppCodeConfigureAck, ackOpts
+}
+
+func (lcp *pppLCP) configureAckReceived(opts []pppOption) error {
+	return nil
+}
+
+func (lcp *pppLCP) configureNakReceived(opts []pppOption) {
+	for _, opt := range opts {
+		if opt.supportMRU() && opt.toUint16() >= pppLCPMinMRU {
+			lcp.mru = opt.toUint16()
+		}
+		if opt.supportMagicNumber() {
+			// Always pick a fresh random magic number rather than the
+			// suggested one: if the link is looped back, the suggestion
+			// is the value our own Configure-Nak carried.
+			lcp.magic = newPPPMagicNumber()
+		}
+	}
+}
+
+func (lcp *pppLCP) configureRejectReceived(opts []pppOption) {
+	for _, opt := range opts {
+		switch opt.type_ {
+		case pppLCPOptionMRU:
+			lcp.requestMRU = false
+			lcp.mru = pppLCPMRU
+		case pppLCPOptionMagicNumber:
+			lcp.requestMagicNumber = false
+		case pppLCPOptionPFC:
+			lcp.requestPFC = false
+		case pppLCPOptionACFC:
+			lcp.requestACFC = false
+		}
+	}
+}
+
+func (lcp *pppLCP) handleCode(msg *pppDataMessage) bool {
+	ds := lcp.ds
+	switch msg.payload.code {
+	case pppCodeEchoRequest:
+		if !ds.lcp.isOpened() {
+			return true
+		}
+		if lcp.isLoopedBack(msg) {
+			lcp.onLoopback()
+			return true
+		}
+		res := newEchoReply(ds.parent.getCfg().PeerTunnelID, ds.cfg.PeerSessionID, msg, lcp.magicNumber())
+		ds.dt.xport.sendMessage1(res, false)
+		ds.parent.handleUserEvent(&SessionEchoEvent{
+			TunnelName:    ds.parent.getName(),
+			Tunnel:        ds.parent,
+			TunnelConfig:  ds.parent.getCfg(),
+			SessionName:   ds.getName(),
+			Session:       ds,
+			SessionConfig: ds.cfg,
+		})
+		return true
+	case pppCodeEchoReply:
+		if ds.lcp.isOpened() {
+			lcp.echoReplyReceived(msg)
+		}
+		return true
+	case pppCodeDiscardRequest:
+		return true
+	case pppCodeProtocolReject:
+		if ds.lcp.isOpened() {
+			lcp.protocolRejectReceived(msg)
+		}
+		return true
+	}
+	return false
+}
+
+// isLoopedBack returns true if an LCP packet carrying a magic number
+// contains our own magic number.  Ref: RFC1661 section 5.8
+func (lcp *pppLCP) isLoopedBack(msg *pppDataMessage) bool {
+	magic := lcp.magicNumber()
+	if magic == 0 || len(msg.payload.data) < 4 {
+		return false
+	}
+	return binary.BigEndian.Uint32(msg.payload.data[:4]) == magic
+}
+
+// protocolRejectReceived shuts down the control protocol responsible for
+// the protocol the peer rejected.  Ref: RFC1661 section 5.7
+func (lcp *pppLCP) protocolRejectReceived(msg *pppDataMessage) {
+	ds := lcp.ds
+	if len(msg.payload.data) < 2 {
+		return
+	}
+	protocol := pppProtocolType(binary.BigEndian.Uint16(msg.payload.data[:2]))
+
+	level.Info(ds.logger).Log(
+		"message", "peer rejected protocol",
+		"protocol", fmt.Sprintf("0x%04x", uint16(protocol)))
+
+	switch protocol {
+	case pppProtocolLCP:
+		ds.lcp.protocolRejected()
+	case pppProtocolIPCP, pppProtocolIPV4:
+		ds.ipcp.protocolRejected()
+	case pppProtocolVJCompressed, pppProtocolVJUncompressed:
+		ds.ipcpNeg.vjProtocolRejected()
+	case pppProtocolIPV6CP, pppProtocolIPV6:
+		ds.ipv6cp.protocolRejected()
+	case pppProtocolCCP, pppProtocolCompressed:
+		ds.ccp.protocolRejected()
+	}
+}
+
+// keepalive is called periodically while LCP is open if the session is
+// configured to send echo requests.  It sends the next echo request, or
+// closes the session if too many requests have gone unanswered.
+func (lcp *pppLCP) keepalive() {
+	ds := lcp.ds
+	if ds.cfg.LcpEchoFailure > 0 && lcp.echoPending >= ds.cfg.LcpEchoFailure {
+		level.Error(ds.logger).Log(
+			"message", "lcp echo timeout",
+			"unanswered", lcp.echoPending)
+		ds.parent.handleUserEvent(&SessionEchoTimeoutEvent{
+			TunnelName:    ds.parent.getName(),
+			Tunnel:        ds.parent,
+			TunnelConfig:  ds.parent.getCfg(),
+			SessionName:   ds.getName(),
+			Session:       ds,
+			SessionConfig: ds.cfg,
+			Failures:      lcp.echoPending,
+		})
+		ds.handleEvent("close",
+			avpCDNResultCodeLostCarrier,
+			avpErrorCodeNoError,
+			fmt.Sprintf("no reply to %d LCP echo requests", lcp.echoPending))
+		return
+	}
+
+	id := ds.lcp.nextIdentifier()
+	if lcp.echoSent == nil {
+		lcp.echoSent = make(map[byte]time.Time)
+	}
+	lcp.echoSent[id] = time.Now()
+	lcp.echoPending++
+	req := newEchoRequest(ds.parent.getCfg().PeerTunnelID, ds.cfg.PeerSessionID, id, lcp.magicNumber())
+	ds.dt.xport.sendMessage1(req, false)
+}
+
+// echoReplyReceived matches an Echo-Reply against the outstanding echo
+// requests sent by keepalive.  A reply to any of them shows the link is
+// alive: on a slow link the reply may arrive after the next request has
+// been sent.
+func (lcp *pppLCP) echoReplyReceived(msg *pppDataMessage) {
+	ds := lcp.ds
+	if lcp.isLoopedBack(msg) {
+		lcp.onLoopback()
+		return
+	}
+	sent, ok := lcp.echoSent[msg.payload.identifier]
+	if !ok {
+		level.Debug(ds.logger).Log(
+			"message", "discarding unexpected lcp echo reply",
+			"identifier", msg.payload.identifier)
+		return
+	}
+	if lcp.peerMagic != 0 && len(msg.payload.data) >= 4 &&
+		binary.BigEndian.Uint32(msg.payload.data[:4]) != lcp.peerMagic {
+		level.Debug(ds.logger).Log(
+			"message", "discarding lcp echo reply with mismatched magic number")
+		return
+	}
+
+	rtt := time.Since(sent)
+	delete(lcp.echoSent, msg.payload.identifier)
+	lcp.echoPending = 0
+
+	level.Debug(ds.logger).Log(
+		"message", "lcp echo reply",
+		"rtt", rtt)
+	ds.parent.handleUserEvent(&SessionEchoReplyEvent{
+		TunnelName:    ds.parent.getName(),
+		Tunnel:        ds.parent,
+		TunnelConfig:  ds.parent.getCfg(),
+		SessionName:   ds.getName(),
+		Session:       ds,
+		SessionConfig: ds.cfg,
+		RTT:           rtt,
+	})
+}
+
+func (lcp *pppLCP) thisLayerUp() {
+	lcp.collisions = 0
+	lcp.echoSent = nil
+	lcp.echoPending = 0
+	lcp.ds.setHeaderCompression(lcp.peerACFC, lcp.peerPFC)
+	lcp.ds.startEcho()
+	lcp.ds.startAuth()
+}
+
+func (lcp *pppLCP) thisLayerDown() {
+	lcp.ds.setHeaderCompression(false, false)
+	lcp.ds.stopEcho()
+	lcp.ds.authenticated = false
+	lcp.ds.stopAuthTimer()
+	lcp.ds.ipcp.down()
+	lcp.ds.ipv6cp.down()
+	lcp.ds.ccp.down()
+	lcp.ds.onLCPDown()
+}
+
+func (lcp *pppLCP) thisLayerStarted() {
+}
+
+func (lcp *pppLCP) thisLayerFinished(reason string) {
+	lcp.ds.onPPPFinished("LCP", reason)
+}
@@ -0,0 +1,355 @@
+package l2tp
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestLCPMagicNumberCollision(t *testing.T) {
+	lcp := &pppLCP{
+		ds:                 &dynamicSession{},
+		requestMagicNumber: true,
+		magic:              0x11223344,
+	}
+
+	code, resp := lcp.configureRequestReceived([]pppOption{
+		newPPPUint32Option(pppLCPOptionMagicNumber, 0x11223344),
+	})
+	if code != pppCodeConfigureNak {
+		t.Fatalf("expected Configure-Nak on magic number collision, got %v", codeToString(code))
+	}
+	if len(resp) != 1 || !resp[0].supportMagicNumber() || resp[0].toUint32() == 0x11223344 {
+		t.Fatalf("expected Configure-Nak suggesting a new magic number, got %v", resp)
+	}
+	if lcp.magic == 0x11223344 {
+		t.Fatalf("local magic number unchanged after collision")
+	}
+
+	code, _ = lcp.configureRequestReceived([]pppOption{
+		newPPPUint32Option(pppLCPOptionMagicNumber, 0xcafef00d),
+	})
+	if code != pppCodeConfigureAck {
+		t.Fatalf("expected Configure-Ack, got %v", codeToString(code))
+	}
+	if lcp.peerMagic != 0xcafef00d {
+		t.Fatalf("peer magic number = %x, want %x", lcp.peerMagic, 0xcafef00d)
+	}
+}
+
+func TestLCPIsLoopedBack(t *testing.T) {
+	lcp := &pppLCP{requestMagicNumber: true, magic: 0x11223344}
+
+	magic := make([]byte, 4)
+	binary.BigEndian.PutUint32(magic, 0x11223344)
+	echo := newPPPPacket(0, 0, pppProtocolLCP, pppCodeEchoRequest, 1, magic)
+	if !lcp.isLoopedBack(echo) {
+		t.Fatalf("failed to detect our own magic number in echo request")
+	}
+
+	binary.BigEndian.PutUint32(magic, 0x55667788)
+	if lcp.isLoopedBack(echo) {
+		t.Fatalf("peer magic number reported as loopback")
+	}
+
+	// without a negotiated magic number loopback can't be detected
+	lcp.requestMagicNumber = false
+	binary.BigEndian.PutUint32(magic, 0)
+	if lcp.isLoopedBack(echo) {
+		t.Fatalf("zero magic number reported as loopback")
+	}
+}
+
+func TestLCPMRUNegotiation(t *testing.T) {
+	lcp := newPPPLCP(&dynamicSession{
+		baseSession: newBaseSession(nil, "s1", nil, &SessionConfig{MRU: 1400}),
+	})
+	if lcp.mru != 1400 {
+		t.Fatalf("local MRU = %v, want configured value 1400", lcp.mru)
+	}
+
+	code, resp := lcp.configureRequestReceived([]pppOption{newPPPUint16Option(pppLCPOptionMRU, 64)})
+	if code != pppCodeConfigureNak || len(resp) != 1 || resp[0].toUint16() != pppLCPMinMRU {
+		t.Fatalf("expected Configure-Nak suggesting the minimum MRU, got %v %v", codeToString(code), resp)
+	}
+
+	code, _ = lcp.configureRequestReceived([]pppOption{newPPPUint16Option(pppLCPOptionMRU, 1300)})
+	if code != pppCodeConfigureAck || lcp.peerMRU != 1300 {
+		t.Fatalf("expected peer MRU 1300 to be acked, got %v, peer MRU %v", codeToString(code), lcp.peerMRU)
+	}
+
+	lcp.configureNakReceived([]pppOption{newPPPUint16Option(pppLCPOptionMRU, 1200)})
+	if lcp.mru != 1200 {
+		t.Fatalf("local MRU = %v after nak, want 1200", lcp.mru)
+	}
+	lcp.configureNakReceived([]pppOption{newPPPUint16Option(pppLCPOptionMRU, 16)})
+	if lcp.mru != 1200 {
+		t.Fatalf("local MRU = %v after nak below minimum, want 1200", lcp.mru)
+	}
+}
+
+func TestLCPHeaderCompression(t *testing.T) {
+	lcp := newPPPLCP(&dynamicSession{
+		baseSession: newBaseSession(nil, "s1", nil, &SessionConfig{}),
+	})
+
+	// zero-length options must survive parsing
+	payload := pppPayload{data: encodePPPOptions(lcp.configureRequest())}
+	opts := payload.getOptions()
+	compression := []pppOption{}
+	for _, opt := range opts {
+		if opt.supportPFC() || opt.supportACFC() {
+			compression = append(compression, opt)
+		}
+	}
+	if len(compression) != 2 {
+		t.Fatalf("expected request for PFC and ACFC, got %v", opts)
+	}
+
+	code, _ := lcp.configureRequestReceived(compression)
+	if code != pppCodeConfigureAck || !lcp.peerPFC || !lcp.peerACFC {
+		t.Fatalf("expected PFC and ACFC to be acked, got %v, PFC %v, ACFC %v",
+			codeToString(code), lcp.peerPFC, lcp.peerACFC)
+	}
+
+	lcp.configureRejectReceived([]pppOption{{type_: pppLCPOptionACFC, length: 2}})
+	for _, opt := range lcp.configureRequest() {
+		if opt.supportACFC() {
+			t.Fatalf("ACFC still requested after reject")
+		}
+	}
+}
+
+func TestPPPMTU(t *testing.T) {
+	cases := []struct {
+		mru, peerMRU uint16
+		ipv6Tunnel   bool
+		want         int
+	}{
+		{1500, 1500, false, 1462},
+		{1500, 1500, true, 1442},
+		{1500, 1400, false, 1400},
+		{1280, 1500, true, 1280},
+	}
+	for _, c := range cases {
+		if got := pppMTU(c.mru, c.peerMRU, c.ipv6Tunnel); got != c.want {
+			t.Errorf("pppMTU(%v, %v, %v) = %v, want %v", c.mru, c.peerMRU, c.ipv6Tunnel, got, c.want)
+		}
+	}
+}
+
+type lcpEchoTest struct {
+	lcp    *pppLCP
+	events []interface{}
+	closed []interface{}
+}
+
+func (e *lcpEchoTest) HandleEvent(event interface{}) {
+	e.events = append(e.events, event)
+}
+
+// newLCPEchoTest creates an LCP instance for an established session whose
+// echo requests are sent from the local address to an unused peer address.
+func newLCPEchoTest(t *testing.T, local, peer string, cfg *SessionConfig) *lcpEchoTest {
+	logger := log.NewNopLogger()
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	t.Cleanup(ctx.Close)
+
+	addrs, err := ctx.resolveTunnelAddresses(&TunnelConfig{
+		Local: local,
+		Encap: EncapTypeUDP,
+	}, peer)
+	if err != nil {
+		t.Fatalf("resolveTunnelAddresses(%v): %v", peer, err)
+	}
+	sal, sap := addrs[0].sal, addrs[0].sap
+	cp, err := newL2tpControlPlane(sal, sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(%v, %v): %v", sal, sap, err)
+	}
+	err = cp.bind()
+	if err != nil {
+		cp.close()
+		t.Fatalf("cp.bind(): %v", err)
+	}
+	xcfg := defaulttransportConfig()
+	xcfg.Version = ProtocolVersion2
+	xport, err := newTransport(logger, cp, xcfg)
+	if err != nil {
+		cp.close()
+		t.Fatalf("newTransport(): %v", err)
+	}
+	t.Cleanup(xport.close)
+
+	e := &lcpEchoTest{}
+	ctx.RegisterEventHandler(e)
+
+	dt := &dynamicTunnel{
+		baseTunnel: newBaseTunnel(logger, "t1", ctx, &TunnelConfig{
+			Version:      ProtocolVersion2,
+			PeerTunnelID: 42,
+		}),
+		xport: xport,
+	}
+	ds := &dynamicSession{
+		baseSession: newBaseSession(logger, "s1", dt, cfg),
+		dt:          dt,
+		established: true,
+		lcp:         &pppFSM{},
+	}
+	ds.fsm = fsm{
+		current: "established",
+		table: []eventDesc{
+			{
+				from:   "established",
+				events: []string{"close"},
+				cb:     func(args []interface{}) { e.closed = args },
+				to:     "dead",
+			},
+		},
+	}
+
+	e.lcp = newPPPLCP(ds)
+	e.lcp.peerMagic = 0xcafef00d
+	return e
+}
+
+// sendEcho calls keepalive and returns the echo request it sent
+func (e *lcpEchoTest) sendEcho(t *testing.T) *pppDataMessage {
+	e.lcp.keepalive()
+	if _, ok := e.lcp.echoSent[e.lcp.ds.lcp.identifier]; !ok {
+		t.Fatalf("keepalive didn't record echo request %d", e.lcp.ds.lcp.identifier)
+	}
+	return newEchoRequest(42, 0, e.lcp.ds.lcp.identifier, e.lcp.magicNumber())
+}
+
+func (e *lcpEchoTest) replyEvents() (replies []*SessionEchoReplyEvent) {
+	for _, ev := range e.events {
+		if r, ok := ev.(*SessionEchoReplyEvent); ok {
+			replies = append(replies, r)
+		}
+	}
+	return
+}
+
+func TestLCPEchoReply(t *testing.T) {
+	e := newLCPEchoTest(t, "127.0.0.1:6240", "127.0.0.1:6241", &SessionConfig{})
+
+	req := e.sendEcho(t)
+	if e.lcp.echoPending != 1 {
+		t.Fatalf("echoPending = %v, want 1", e.lcp.echoPending)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	e.lcp.echoReplyReceived(newEchoReply(0, 0, req, e.lcp.peerMagic))
+
+	if e.lcp.echoPending != 0 {
+		t.Errorf("echoPending = %v after reply, want 0", e.lcp.echoPending)
+	}
+	replies := e.replyEvents()
+	if len(replies) != 1 {
+		t.Fatalf("expected one SessionEchoReplyEvent, got %v", e.events)
+	}
+	if replies[0].RTT < 10*time.Millisecond {
+		t.Errorf("RTT = %v, want at least 10ms", replies[0].RTT)
+	}
+	if e.closed != nil {
+		t.Errorf("session closed on echo reply: %v", e.closed)
+	}
+}
+
+func TestLCPEchoReplyLate(t *testing.T) {
+	e := newLCPEchoTest(t, "127.0.0.1:6242", "127.0.0.1:6243", &SessionConfig{})
+
+	// The reply to the first request arrives after the second request
+	// has been sent, as it does when the round trip time exceeds the
+	// echo interval.
+	first := e.sendEcho(t)
+	e.sendEcho(t)
+	e.lcp.echoReplyReceived(newEchoReply(0, 0, first, e.lcp.peerMagic))
+
+	if e.lcp.echoPending != 0 {
+		t.Errorf("echoPending = %v after late reply, want 0", e.lcp.echoPending)
+	}
+	if len(e.replyEvents()) != 1 {
+		t.Fatalf("expected one SessionEchoReplyEvent, got %v", e.events)
+	}
+
+	// A duplicate of the reply is ignored
+	e.lcp.echoReplyReceived(newEchoReply(0, 0, first, e.lcp.peerMagic))
+	if len(e.replyEvents()) != 1 {
+		t.Errorf("duplicate reply generated an event: %v", e.events)
+	}
+}
+
+func TestLCPEchoReplyIgnored(t *testing.T) {
+	e := newLCPEchoTest(t, "127.0.0.1:6244", "127.0.0.1:6245", &SessionConfig{})
+
+	req := e.sendEcho(t)
+
+	// wrong magic number
+	e.lcp.echoReplyReceived(newEchoReply(0, 0, req, 0x01020304))
+
+	// unknown identifier
+	unknown := newEchoRequest(42, 0, req.payload.identifier+1, e.lcp.magicNumber())
+	e.lcp.echoReplyReceived(newEchoReply(0, 0, unknown, e.lcp.peerMagic))
+
+	if e.lcp.echoPending != 1 {
+		t.Errorf("echoPending = %v, want 1", e.lcp.echoPending)
+	}
+	if len(e.events) != 0 {
+		t.Errorf("unexpected events: %v", e.events)
+	}
+	if e.closed != nil {
+		t.Errorf("session closed on ignored reply: %v", e.closed)
+	}
+}
+
+func TestLCPEchoTimeout(t *testing.T) {
+	e := newLCPEchoTest(t, "127.0.0.1:6246", "127.0.0.1:6247", &SessionConfig{
+		LcpEchoFailure: 3,
+	})
+
+	for i := 0; i < 3; i++ {
+		e.sendEcho(t)
+	}
+	if len(e.events) != 0 || e.closed != nil {
+		t.Fatalf("session timed out before LcpEchoFailure reached: %v, %v", e.events, e.closed)
+	}
+
+	e.lcp.keepalive()
+
+	if len(e.events) != 1 {
+		t.Fatalf("expected one event, got %v", e.events)
+	}
+	ev, ok := e.events[0].(*SessionEchoTimeoutEvent)
+	if !ok {
+		t.Fatalf("expected SessionEchoTimeoutEvent, got %T", e.events[0])
+	}
+	if ev.Failures != 3 {
+		t.Errorf("Failures = %v, want 3", ev.Failures)
+	}
+	if len(e.closed) < 1 || e.closed[0] != avpCDNResultCodeLostCarrier {
+		t.Errorf("expected close with result code %v, got %v", avpCDNResultCodeLostCarrier, e.closed)
+	}
+}
+
+func TestLCPEchoReplyLoopback(t *testing.T) {
+	e := newLCPEchoTest(t, "127.0.0.1:6248", "127.0.0.1:6249", &SessionConfig{})
+
+	req := e.sendEcho(t)
+	e.lcp.echoReplyReceived(newEchoReply(0, 0, req, e.lcp.magicNumber()))
+
+	if len(e.replyEvents()) != 0 {
+		t.Errorf("looped back reply generated an event: %v", e.events)
+	}
+	if len(e.closed) < 1 || e.closed[0] != avpCDNResultCodeGeneralError {
+		t.Errorf("expected close with result code %v, got %v", avpCDNResultCodeGeneralError, e.closed)
+	}
+}
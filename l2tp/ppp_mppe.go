@@ -0,0 +1,222 @@
+package l2tp
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+)
+
+// MPPE option bits carried in the CCP MPPE option.
+// Ref: RFC3078 section 2.1
+const (
+	mppeOptionStateless uint32 = 0x01000000 // H
+	mppeOption56Bit     uint32 = 0x00000080 // M
+	mppeOption128Bit    uint32 = 0x00000040 // S
+	mppeOption40Bit     uint32 = 0x00000020 // L
+	mppeOptionMPPC      uint32 = 0x00000001 // C
+)
+
+// MPPE packet header bits.  Ref: RFC3078 section 3
+const (
+	mppeBitFlushed   byte = 0x80 // A
+	mppeBitEncrypted byte = 0x10 // D
+)
+
+const (
+	mppeKeyLen      = 16
+	mppeCCountSpace = 4096
+	mppeHeaderLen   = 2
+	// mppeOverhead is the number of bytes MPPE adds to each packet: the
+	// MPPE header, and the protocol field moved inside the encryption.
+	mppeOverhead = 4
+)
+
+var (
+	mppeSHApad1 = bytes.Repeat([]byte{0x00}, 40)
+	mppeSHApad2 = bytes.Repeat([]byte{0xf2}, 40)
+	mppeMagic2  = []byte("On the client side, this is the send key; " +
+		"on the server side, it is the receive key.")
+	mppeMagic3 = []byte("On the client side, this is the receive key; " +
+		"on the server side, it is the send key.")
+)
+
+// mppeStartKeys derives the client's send and receive start keys from the
+// MS-CHAPv2 master key.  Ref: RFC3079 section 3.3
+func mppeStartKeys(masterKey []byte) (send, recv []byte) {
+	startKey := func(magic []byte) []byte {
+		h := sha1.New()
+		h.Write(masterKey)
+		h.Write(mppeSHApad1)
+		h.Write(magic)
+		h.Write(mppeSHApad2)
+		return h.Sum(nil)[:mppeKeyLen]
+	}
+	return startKey(mppeMagic2), startKey(mppeMagic3)
+}
+
+// mppeState holds the keys and coherency count for one direction of an
+// MPPE-encrypted link, modelled on the Linux ppp_mppe implementation.
+//
+// It is not safe for concurrent use.
+type mppeState struct {
+	startKey   []byte
+	sessionKey []byte
+	cipher     *rc4.Cipher
+	stateful   bool
+	ccount     uint16
+	// flush is set on the encryptor to force a rekey on the next packet
+	flush bool
+	// discard is set on a stateful decryptor which has lost packets
+	discard bool
+}
+
+func newMppeState(startKey []byte, stateful bool) *mppeState {
+	s := &mppeState{
+		startKey:   startKey,
+		sessionKey: append([]byte{}, startKey...),
+		stateful:   stateful,
+		ccount:     mppeCCountSpace - 1,
+	}
+	s.rekey(true)
+	return s
+}
+
+// rekey derives the next session key.  Ref: RFC3079 section 3.6, 3.7
+func (s *mppeState) rekey(initial bool) {
+	h := sha1.New()
+	h.Write(s.startKey)
+	h.Write(mppeSHApad1)
+	h.Write(s.sessionKey)
+	h.Write(mppeSHApad2)
+	interim := h.Sum(nil)[:mppeKeyLen]
+
+	if initial {
+		s.sessionKey = interim
+	} else {
+		c, _ := rc4.NewCipher(interim)
+		s.sessionKey = make([]byte, mppeKeyLen)
+		c.XORKeyStream(s.sessionKey, interim)
+	}
+	s.cipher, _ = rc4.NewCipher(s.sessionKey)
+}
+
+// encrypt returns the MPPE packet carrying a packet of the given protocol.
+// Ref: RFC3078 section 3
+func (s *mppeState) encrypt(protocol pppProtocolType, data []byte) []byte {
+	s.ccount = (s.ccount + 1) % mppeCCountSpace
+
+	bits := mppeBitEncrypted
+	// Stateless mode rekeys on every packet, stateful mode on every
+	// "flag" packet or when requested by the peer.
+	if !s.stateful || s.ccount&0xff == 0xff || s.flush {
+		s.rekey(false)
+		bits |= mppeBitFlushed
+		s.flush = false
+	}
+
+	out := make([]byte, mppeHeaderLen+2+len(data))
+	binary.BigEndian.PutUint16(out, s.ccount)
+	out[0] |= bits
+	binary.BigEndian.PutUint16(out[mppeHeaderLen:], uint16(protocol))
+	copy(out[mppeHeaderLen+2:], data)
+	s.cipher.XORKeyStream(out[mppeHeaderLen:], out[mppeHeaderLen:])
+	return out
+}
+
+// compress implements pppCompressor
+func (s *mppeState) compress(protocol pppProtocolType, data []byte) (pppProtocolType, []byte) {
+	return pppProtocolCompressed, s.encrypt(protocol, data)
+}
+
+// reset implements pppCompressor and pppDecompressor.  The encryptor
+// flushes on the next packet; the decryptor resynchronises on the
+// flushed bit rather than on receipt of Reset-Ack.  Ref: RFC3078 section 8
+func (s *mppeState) reset() {
+	s.flush = true
+}
+
+// overhead implements pppCompressor
+func (s *mppeState) overhead() int {
+	return mppeOverhead
+}
+
+// decompress implements pppDecompressor
+func (s *mppeState) decompress(packet []byte) (pppProtocolType, []byte, error) {
+	return s.decrypt(packet)
+}
+
+// incompressible implements pppDecompressor.  Unencrypted packets are
+// discarded, so never reach the decryptor.
+func (s *mppeState) incompressible(protocol pppProtocolType, data []byte) {
+}
+
+// decrypt returns the protocol and data of the packet carried in an MPPE
+// packet.  Ref: RFC3078 section 3, 8
+func (s *mppeState) decrypt(packet []byte) (protocol pppProtocolType, data []byte, err error) {
+	if len(packet) < mppeHeaderLen+1 {
+		return 0, nil, errors.New("short mppe packet")
+	}
+	bits := packet[0] & 0xf0
+	ccount := binary.BigEndian.Uint16(packet) & 0x0fff
+	flushed := bits&mppeBitFlushed != 0
+
+	if bits&mppeBitEncrypted == 0 {
+		return 0, nil, errors.New("mppe packet not encrypted")
+	}
+	if !s.stateful && !flushed {
+		return 0, nil, errors.New("mppe flushed bit not set in stateless mode")
+	}
+	if s.stateful && ccount&0xff == 0xff && !flushed {
+		return 0, nil, errors.New("mppe flushed bit not set on flag packet")
+	}
+
+	if !s.stateful {
+		// Discard late packets, and rekey once for each packet
+		// missed since the last one received.
+		if (ccount-s.ccount)%mppeCCountSpace > mppeCCountSpace/2 {
+			return 0, nil, errors.New("late mppe packet")
+		}
+		for s.ccount != ccount {
+			s.rekey(false)
+			s.ccount = (s.ccount + 1) % mppeCCountSpace
+		}
+	} else {
+		if !s.discard {
+			s.ccount = (s.ccount + 1) % mppeCCountSpace
+			if ccount != s.ccount {
+				s.discard = true
+				return 0, nil, errCCPResync
+			}
+		} else {
+			// Packets are discarded until the peer flushes in
+			// response to our Reset-Request.
+			if !flushed {
+				return 0, nil, errors.New("discarding mppe packet pending resync")
+			}
+			// Rekey once for each missed flag packet
+			for ccount&^0xff != s.ccount&^0xff {
+				s.rekey(false)
+				s.ccount = (s.ccount + 256) % mppeCCountSpace
+			}
+			s.discard = false
+			s.ccount = ccount
+		}
+		if flushed {
+			s.rekey(false)
+		}
+	}
+
+	plain := make([]byte, len(packet)-mppeHeaderLen)
+	s.cipher.XORKeyStream(plain, packet[mppeHeaderLen:])
+
+	// The protocol field may be compressed.  Ref: RFC1661 section 6.5
+	if plain[0]&0x01 != 0 {
+		return pppProtocolType(plain[0]), plain[1:], nil
+	}
+	if len(plain) < 2 {
+		return 0, nil, errors.New("short mppe payload")
+	}
+	return pppProtocolType(binary.BigEndian.Uint16(plain)), plain[2:], nil
+}
@@ -0,0 +1,103 @@
+package l2tp
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Ref: RFC3079 section 3.5.3
+func TestMPPEKeyDerivation(t *testing.T) {
+	masterKey := mustDecodeHex(t, "FDECE3717A8C838CB388E527AE3CDD31")
+
+	// The RFC's example derives the server's send key, which is the
+	// client's receive key.
+	send, recv := mppeStartKeys(masterKey)
+	if want := mustDecodeHex(t, "8B7CDC149B993A1BA118CB153F56DCCB"); !bytes.Equal(recv, want) {
+		t.Fatalf("receive start key = %X, want %X", recv, want)
+	}
+	if bytes.Equal(send, recv) {
+		t.Fatalf("send and receive start keys are identical")
+	}
+
+	s := newMppeState(recv, true)
+	if want := mustDecodeHex(t, "405CB2247A7956E6E211007AE27B22D4"); !bytes.Equal(s.sessionKey, want) {
+		t.Fatalf("initial session key = %X, want %X", s.sessionKey, want)
+	}
+
+	out := make([]byte, len("test message"))
+	s.cipher.XORKeyStream(out, []byte("test message"))
+	if want := mustDecodeHex(t, "81848317DF68846272FB5ABE"); !bytes.Equal(out, want) {
+		t.Fatalf("encrypted data = %X, want %X", out, want)
+	}
+}
+
+func TestMPPERoundTrip(t *testing.T) {
+	key := mustDecodeHex(t, "8B7CDC149B993A1BA118CB153F56DCCB")
+
+	cases := []struct {
+		name     string
+		stateful bool
+		// lost returns true for packets dropped in transit
+		lost func(i int) bool
+	}{
+		{"stateless", false, func(i int) bool { return false }},
+		{"stateless with loss", false, func(i int) bool { return i%7 == 3 }},
+		{"stateful", true, func(i int) bool { return false }},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			enc := newMppeState(key, c.stateful)
+			dec := newMppeState(key, c.stateful)
+			// run past a coherency count wrap to cover flag packets
+			for i := 0; i < mppeCCountSpace+300; i++ {
+				data := []byte{0x45, byte(i), byte(i >> 8), 0xaa, 0x55}
+				packet := enc.encrypt(pppProtocolIPV4, data)
+				if c.lost(i) {
+					continue
+				}
+				protocol, got, err := dec.decrypt(packet)
+				if err != nil {
+					t.Fatalf("packet %d: decrypt failed: %v", i, err)
+				}
+				if protocol != pppProtocolIPV4 || !bytes.Equal(got, data) {
+					t.Fatalf("packet %d: got protocol 0x%04x data %x, want 0x%04x %x",
+						i, uint16(protocol), got, uint16(pppProtocolIPV4), data)
+				}
+			}
+		})
+	}
+}
+
+func TestMPPEStatefulResync(t *testing.T) {
+	key := mustDecodeHex(t, "8B7CDC149B993A1BA118CB153F56DCCB")
+	enc := newMppeState(key, true)
+	dec := newMppeState(key, true)
+	data := []byte{0x45, 0x00, 0x01, 0x02}
+
+	if _, _, err := dec.decrypt(enc.encrypt(pppProtocolIPV4, data)); err != nil {
+		t.Fatalf("decrypt failed: %v", err)
+	}
+
+	// lose a packet: the decryptor must request a reset
+	enc.encrypt(pppProtocolIPV4, data)
+	if _, _, err := dec.decrypt(enc.encrypt(pppProtocolIPV4, data)); err != errCCPResync {
+		t.Fatalf("expected resync error after packet loss, got %v", err)
+	}
+	if _, _, err := dec.decrypt(enc.encrypt(pppProtocolIPV4, data)); err == nil {
+		t.Fatalf("decrypted packet while awaiting resync")
+	}
+
+	// the encryptor flushes on receipt of the peer's Reset-Request
+	enc.flush = true
+	packet := enc.encrypt(pppProtocolIPV4, data)
+	if packet[0]&mppeBitFlushed == 0 {
+		t.Fatalf("flushed bit not set after reset")
+	}
+	_, got, err := dec.decrypt(packet)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("expected resync on flushed packet, got %x, %v", got, err)
+	}
+	if _, _, err := dec.decrypt(enc.encrypt(pppProtocolIPV4, data)); err != nil {
+		t.Fatalf("decrypt after resync failed: %v", err)
+	}
+}
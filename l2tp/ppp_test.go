@@ -0,0 +1,614 @@
+package l2tp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestChapMD5Response(t *testing.T) {
+	challenge := []byte{
+		0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+		0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+	}
+	want, _ := hex.DecodeString("03dc98c5a832692b49df73cf48fcb4e9")
+	got := chapMD5Response(0x2a, "secret", challenge)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("chapMD5Response() = %x, want %x", got, want)
+	}
+}
+
+func TestParseChapChallenge(t *testing.T) {
+	cases := []struct {
+		in        []byte
+		wantValue []byte
+		wantName  string
+		wantErr   bool
+	}{
+		{
+			in:        []byte{0x04, 0xde, 0xad, 0xbe, 0xef, 'l', 'n', 's'},
+			wantValue: []byte{0xde, 0xad, 0xbe, 0xef},
+			wantName:  "lns",
+		},
+		{
+			in:        []byte{0x02, 0x01, 0x02},
+			wantValue: []byte{0x01, 0x02},
+		},
+		{in: []byte{}, wantErr: true},
+		{in: []byte{0x00}, wantErr: true},
+		{in: []byte{0x08, 0x01, 0x02}, wantErr: true},
+	}
+	for _, c := range cases {
+		value, name, err := parseChapChallenge(c.in)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseChapChallenge(%x) succeeded, expected error", c.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseChapChallenge(%x): %v", c.in, err)
+			continue
+		}
+		if !bytes.Equal(value, c.wantValue) || name != c.wantName {
+			t.Errorf("parseChapChallenge(%x) = %x, %q, want %x, %q",
+				c.in, value, name, c.wantValue, c.wantName)
+		}
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("hex.DecodeString(%q): %v", s, err)
+	}
+	return b
+}
+
+// Ref: RFC2759 section 9.2, RFC3079 section 3.5.3
+func TestMschapv2Response(t *testing.T) {
+	authChallenge := mustDecodeHex(t, "5B5D7C7D7B3F2F3E3C2C602132262628")
+	peerChallenge := mustDecodeHex(t, "21402324255E262A28295F2B3A337C7E")
+	wantNtResponse := mustDecodeHex(t, "82309ECD8D708B5EA08FAA3981CD83544233114A3D85D6DF")
+	wantMasterKey := mustDecodeHex(t, "FDECE3717A8C838CB388E527AE3CDD31")
+	wantAuthResponse := "S=407A5589115FD0D6209F510FE9C04566932CDA56"
+
+	if got, want := ntPasswordHash("clientPass"), mustDecodeHex(t, "44EBBA8D5312B8D611474411F56989AE"); !bytes.Equal(got, want) {
+		t.Errorf("ntPasswordHash() = %X, want %X", got, want)
+	}
+
+	for _, username := range []string{"User", "DOMAIN\\User"} {
+		r, err := newMschapv2Response(authChallenge, peerChallenge, username, "clientPass")
+		if err != nil {
+			t.Fatalf("newMschapv2Response(): %v", err)
+		}
+		if len(r.value) != mschapv2ResponseLen {
+			t.Errorf("response value length %d, want %d", len(r.value), mschapv2ResponseLen)
+		}
+		if got := r.value[24:48]; !bytes.Equal(got, wantNtResponse) {
+			t.Errorf("NT-Response = %X, want %X", got, wantNtResponse)
+		}
+		if r.authenticatorResponse != wantAuthResponse {
+			t.Errorf("authenticator response = %v, want %v", r.authenticatorResponse, wantAuthResponse)
+		}
+		if !bytes.Equal(r.masterKey, wantMasterKey) {
+			t.Errorf("master key = %X, want %X", r.masterKey, wantMasterKey)
+		}
+		if err := r.verifySuccess(wantAuthResponse + " M=Welcome"); err != nil {
+			t.Errorf("verifySuccess(): %v", err)
+		}
+		if err := r.verifySuccess("S=0000000000000000000000000000000000000000 M=Welcome"); err == nil {
+			t.Errorf("verifySuccess() accepted a bad authenticator response")
+		}
+	}
+}
+
+func TestParseMschapv2Failure(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{
+			in:   "E=691 R=0 C=00000000000000000000000000000000 V=3 M=Authentication failure",
+			want: "authentication failure (E=691): Authentication failure",
+		},
+		{
+			in:   "E=648 R=0 V=3",
+			want: "password expired (E=648)",
+		},
+		{
+			in:   "E=1234 R=1",
+			want: "error 1234 (E=1234)",
+		},
+		{
+			in:   "",
+			want: "unknown error",
+		},
+	}
+	for _, c := range cases {
+		if got := parseMschapv2Failure(c.in); got != c.want {
+			t.Errorf("parseMschapv2Failure(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestBytesToDataMsg(t *testing.T) {
+	header := []byte{0x00, 0x02, 0x00, 0x01, 0x00, 0x02, 0xff, 0x03}
+
+	// network layer protocols carry the raw packet
+	ipv6 := append(append([]byte{}, header...), 0x00, 0x57, 0x60, 0x00, 0x00, 0x00, 0x00, 0x00)
+	msg, err := bytesToDataMsg(ipv6)
+	if err != nil {
+		t.Fatalf("bytesToDataMsg(%x): %v", ipv6, err)
+	}
+	if !bytes.Equal(msg.payload.data, ipv6[pppDataHeaderLen:]) {
+		t.Fatalf("ipv6 payload = %x, want %x", msg.payload.data, ipv6[pppDataHeaderLen:])
+	}
+	if !bytes.Equal(msg.information(), ipv6[pppDataHeaderLen:]) {
+		t.Fatalf("information() = %x, want %x", msg.information(), ipv6[pppDataHeaderLen:])
+	}
+
+	// control protocols are parsed
+	ccp := append(append([]byte{}, header...), 0x80, 0xfd, 0x01, 0x07, 0x00, 0x06, 0x12, 0x34)
+	msg, err = bytesToDataMsg(ccp)
+	if err != nil {
+		t.Fatalf("bytesToDataMsg(%x): %v", ccp, err)
+	}
+	if msg.payload.code != pppCodeConfigureRequest || msg.payload.identifier != 7 ||
+		!bytes.Equal(msg.payload.data, []byte{0x12, 0x34}) {
+		t.Fatalf("bad ccp payload %+v", msg.payload)
+	}
+	if !bytes.Equal(msg.information(), ccp[pppDataHeaderLen:]) {
+		t.Fatalf("information() = %x, want %x", msg.information(), ccp[pppDataHeaderLen:])
+	}
+
+	// control packets with a length exceeding the frame are rejected
+	bad := append(append([]byte{}, header...), 0xc0, 0x21, 0x01, 0x07, 0x00, 0x40)
+	if _, err = bytesToDataMsg(bad); err == nil {
+		t.Fatalf("bytesToDataMsg(%x) succeeded with bad length", bad)
+	}
+
+	// compressed address/control and protocol fields are accepted
+	ipv4 := []byte{0x45, 0x00, 0x00, 0x14}
+	for _, c := range []struct {
+		name      string
+		ppp       []byte
+		acfc, pfc bool
+	}{
+		{"acfc", []byte{0x00, 0x21}, true, false},
+		{"pfc", []byte{0xff, 0x03, 0x21}, false, true},
+		{"acfc and pfc", []byte{0x21}, true, true},
+	} {
+		frame := append(append(append([]byte{}, header[:6]...), c.ppp...), ipv4...)
+		msg, err = bytesToDataMsg(frame)
+		if err != nil {
+			t.Fatalf("%s: bytesToDataMsg(%x): %v", c.name, frame, err)
+		}
+		if msg.Protocol() != pppProtocolIPV4 || !bytes.Equal(msg.payload.data, ipv4) {
+			t.Fatalf("%s: got protocol 0x%04x payload %x", c.name, uint16(msg.Protocol()), msg.payload.data)
+		}
+		if msg.header.ACFC != c.acfc || msg.header.PFC != c.pfc || msg.validate() != nil {
+			t.Fatalf("%s: bad header %+v", c.name, msg.header)
+		}
+	}
+}
+
+func TestPPPDataHeaderToBytes(t *testing.T) {
+	cases := []struct {
+		protocol  pppProtocolType
+		acfc, pfc bool
+		want      []byte
+	}{
+		{pppProtocolIPV4, false, false, []byte{0x00, 0x02, 0x00, 0x01, 0x00, 0x02, 0xff, 0x03, 0x00, 0x21}},
+		{pppProtocolIPV4, true, false, []byte{0x00, 0x02, 0x00, 0x01, 0x00, 0x02, 0x00, 0x21}},
+		{pppProtocolIPV4, true, true, []byte{0x00, 0x02, 0x00, 0x01, 0x00, 0x02, 0x21}},
+		// protocols above 0xff can't be compressed
+		{pppProtocolIPCP, false, true, []byte{0x00, 0x02, 0x00, 0x01, 0x00, 0x02, 0xff, 0x03, 0x80, 0x21}},
+	}
+	for _, c := range cases {
+		h := NewPPPDataHeader(1, 2, uint16(c.protocol))
+		h.ACFC = c.acfc
+		h.PFC = c.pfc
+		if got := h.ToBytes(); !bytes.Equal(got, c.want) {
+			t.Errorf("ToBytes() with ACFC %v PFC %v = %x, want %x", c.acfc, c.pfc, got, c.want)
+		}
+	}
+}
+
+// testSessionDataPlane records the network configuration the session data
+// plane is started with, and how often it is stopped
+type testSessionDataPlane struct {
+	nullSessionDataPlane
+	started []SessionNetworkConfig
+	stopped int
+}
+
+func (sdp *testSessionDataPlane) Start(nc *SessionNetworkConfig) error {
+	sdp.started = append(sdp.started, *nc)
+	return nil
+}
+
+func (sdp *testSessionDataPlane) Stop() error {
+	sdp.stopped++
+	return nil
+}
+
+// pppSessionTest runs the PPP negotiation of an established session
+// against a peer played by the test.  The test reads the PPP packets the
+// session sends from a socket bound to the peer address, and passes the
+// peer's packets to the session directly.
+type pppSessionTest struct {
+	t       *testing.T
+	ds      *dynamicSession
+	dp      *testSessionDataPlane
+	peer    *net.UDPConn
+	pending []*pppDataMessage
+	events  []interface{}
+	closed  []interface{}
+}
+
+func (e *pppSessionTest) HandleEvent(event interface{}) {
+	e.events = append(e.events, event)
+}
+
+func newPPPSessionTest(t *testing.T, local, peer string, cfg *SessionConfig) *pppSessionTest {
+	logger := log.NewNopLogger()
+
+	ctx, err := NewContext(nil, logger)
+	if err != nil {
+		t.Fatalf("NewContext(): %v", err)
+	}
+	t.Cleanup(ctx.Close)
+
+	tcfg := &TunnelConfig{
+		Local:        local,
+		Encap:        EncapTypeUDP,
+		Version:      ProtocolVersion2,
+		PeerTunnelID: 42,
+	}
+	addrs, err := ctx.resolveTunnelAddresses(tcfg, peer)
+	if err != nil {
+		t.Fatalf("resolveTunnelAddresses(%v): %v", peer, err)
+	}
+
+	peerAddr, err := net.ResolveUDPAddr("udp", peer)
+	if err != nil {
+		t.Fatalf("ResolveUDPAddr(%v): %v", peer, err)
+	}
+	conn, err := net.ListenUDP("udp", peerAddr)
+	if err != nil {
+		t.Fatalf("ListenUDP(%v): %v", peer, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	cp, err := newL2tpControlPlane(addrs[0].sal, addrs[0].sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(%v, %v): %v", addrs[0].sal, addrs[0].sap, err)
+	}
+	err = cp.bind()
+	if err != nil {
+		cp.close()
+		t.Fatalf("cp.bind(): %v", err)
+	}
+	xcfg := defaulttransportConfig()
+	xcfg.Version = ProtocolVersion2
+	xport, err := newTransport(logger, cp, xcfg)
+	if err != nil {
+		cp.close()
+		t.Fatalf("newTransport(): %v", err)
+	}
+	t.Cleanup(xport.close)
+
+	e := &pppSessionTest{
+		t:    t,
+		dp:   &testSessionDataPlane{},
+		peer: conn,
+	}
+	ctx.RegisterEventHandler(e)
+
+	dt := newDynamicTunnelInstance("t1", ctx, addrs[0].sal, addrs[0].sap, tcfg)
+	dt.xport = xport
+
+	if cfg.SessionID == 0 {
+		cfg.SessionID = 1
+	}
+	ds := newDynamicSessionInstance(1, "s1", dt, cfg)
+	ds.established = true
+	ds.dp = e.dp
+	ds.fsm = fsm{
+		current: "established",
+		table: []eventDesc{
+			{
+				from:   "established",
+				events: []string{"close"},
+				cb:     func(args []interface{}) { e.closed = args },
+				to:     "dead",
+			},
+		},
+	}
+	t.Cleanup(func() {
+		ds.stopEcho()
+		ds.stopAuthTimer()
+		ds.stopMPPETimer()
+		for _, f := range []*pppFSM{ds.lcp, ds.ipcp, ds.ipv6cp, ds.ccp} {
+			f.stopTimer()
+		}
+		close(ds.doneChan)
+	})
+
+	e.ds = ds
+	return e
+}
+
+// recv returns the next packet of the protocol sent by the session,
+// queueing packets of other protocols for later calls.
+func (e *pppSessionTest) recv(protocol pppProtocolType) *pppDataMessage {
+	e.t.Helper()
+	for i, msg := range e.pending {
+		if msg.Protocol() == protocol {
+			e.pending = append(e.pending[:i], e.pending[i+1:]...)
+			return msg
+		}
+	}
+	b := make([]byte, 4096)
+	for {
+		e.peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := e.peer.ReadFromUDP(b)
+		if err != nil {
+			e.t.Fatalf("no 0x%04x packet received: %v", uint16(protocol), err)
+		}
+		msg, err := bytesToDataMsg(append([]byte{}, b[:n]...))
+		if err != nil {
+			e.t.Fatalf("bytesToDataMsg(): %v", err)
+		}
+		if msg.Protocol() == protocol {
+			return msg
+		}
+		e.pending = append(e.pending, msg)
+	}
+}
+
+// expectNone fails the test if the session sends a packet of the protocol
+func (e *pppSessionTest) expectNone(protocol pppProtocolType) {
+	e.t.Helper()
+	for _, msg := range e.pending {
+		if msg.Protocol() == protocol {
+			e.t.Fatalf("unexpected 0x%04x packet: %+v", uint16(protocol), msg.payload)
+		}
+	}
+	b := make([]byte, 4096)
+	for {
+		e.peer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		n, _, err := e.peer.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		msg, err := bytesToDataMsg(append([]byte{}, b[:n]...))
+		if err != nil {
+			e.t.Fatalf("bytesToDataMsg(): %v", err)
+		}
+		if msg.Protocol() == protocol {
+			e.t.Fatalf("unexpected 0x%04x packet: %+v", uint16(protocol), msg.payload)
+		}
+		e.pending = append(e.pending, msg)
+	}
+}
+
+// input passes a packet from the peer to the session
+func (e *pppSessionTest) input(protocol pppProtocolType, code, identifier byte, data []byte) {
+	e.ds.handlePPPMsg(newPPPPacket(0, e.ds.cfg.SessionID, protocol, code, identifier, data))
+}
+
+// negotiate acknowledges the session's Configure-Request for the protocol,
+// first naking it with the options in nak if any are given, and has the
+// session acknowledge the peer's Configure-Request carrying opts.
+func (e *pppSessionTest) negotiate(protocol pppProtocolType, opts []pppOption, nak ...pppOption) {
+	e.t.Helper()
+	req := e.recv(protocol)
+	if req.payload.code != pppCodeConfigureRequest {
+		e.t.Fatalf("expected 0x%04x Configure-Request, got %+v", uint16(protocol), req.payload)
+	}
+	if len(nak) > 0 {
+		e.input(protocol, pppCodeConfigureNak, req.payload.identifier, encodePPPOptions(nak))
+		req = e.recv(protocol)
+	}
+	e.input(protocol, pppCodeConfigureAck, req.payload.identifier, req.payload.data)
+
+	e.input(protocol, pppCodeConfigureRequest, 100, encodePPPOptions(opts))
+	ack := e.recv(protocol)
+	if ack.payload.code != pppCodeConfigureAck || ack.payload.identifier != 100 {
+		e.t.Fatalf("expected 0x%04x Configure-Ack, got %+v", uint16(protocol), ack.payload)
+	}
+}
+
+// openLCP starts PPP on the session and negotiates LCP, with the peer
+// requesting the options in opts
+func (e *pppSessionTest) openLCP(opts ...pppOption) {
+	e.t.Helper()
+	e.ds.startPPP()
+	e.negotiate(pppProtocolLCP, opts)
+	if !e.ds.lcp.isOpened() {
+		e.t.Fatalf("LCP not opened")
+	}
+}
+
+// openIPCP negotiates IPCP, with the peer assigning the address
+func (e *pppSessionTest) openIPCP(address net.IP) {
+	e.t.Helper()
+	e.negotiate(pppProtocolIPCP, nil, pppOption{
+		type_:  pppIPCPOptionIPAddress,
+		length: 6,
+		value:  address.To4(),
+	})
+	if !e.ds.ipcp.isOpened() {
+		e.t.Fatalf("IPCP not opened")
+	}
+}
+
+// newCHAPAuthOption returns the LCP option requesting CHAP authentication
+func newCHAPAuthOption(algorithm byte) pppOption {
+	return pppOption{
+		type_:  pppLCPOptionAuthProtocol,
+		length: 5,
+		value:  []byte{0xc2, 0x23, algorithm},
+	}
+}
+
+func TestChapResult(t *testing.T) {
+	e := newPPPSessionTest(t, "127.0.0.1:6250", "127.0.0.1:6251", &SessionConfig{
+		PeerId:   "user",
+		Password: "secret",
+	})
+	e.openLCP(newCHAPAuthOption(pppCHAPAlgorithmMD5))
+
+	// a result with no outstanding response is discarded
+	e.input(pppProtocolCHAP, pppCHAPCodeSuccess, 1, nil)
+	if e.ds.authenticated {
+		t.Fatalf("authenticated by success without a challenge")
+	}
+
+	challenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	e.input(pppProtocolCHAP, pppCHAPCodeChallenge, 7,
+		append(append([]byte{byte(len(challenge))}, challenge...), "lns"...))
+	res := e.recv(pppProtocolCHAP)
+	if res.payload.code != pppCHAPCodeResponse || res.payload.identifier != 7 {
+		t.Fatalf("expected CHAP response with identifier 7, got %+v", res.payload)
+	}
+
+	// as is one which doesn't match the outstanding response
+	e.input(pppProtocolCHAP, pppCHAPCodeSuccess, 8, nil)
+	e.input(pppProtocolCHAP, pppCHAPCodeFailure, 8, nil)
+	if e.ds.authenticated || e.closed != nil {
+		t.Fatalf("result with mismatched identifier accepted: authenticated %v, closed %v",
+			e.ds.authenticated, e.closed)
+	}
+
+	e.input(pppProtocolCHAP, pppCHAPCodeSuccess, 7, nil)
+	if !e.ds.authenticated || e.ds.authTimer != nil {
+		t.Fatalf("not authenticated by success: authenticated %v, timer %v",
+			e.ds.authenticated, e.ds.authTimer)
+	}
+	e.recv(pppProtocolIPCP)
+}
+
+func TestChapTimeout(t *testing.T) {
+	e := newPPPSessionTest(t, "127.0.0.1:6252", "127.0.0.1:6253", &SessionConfig{
+		PeerId:   "user",
+		Password: "secret",
+	})
+	e.openLCP(newCHAPAuthOption(pppCHAPAlgorithmMD5))
+
+	if e.ds.authTimer == nil {
+		t.Fatalf("authentication timer not started")
+	}
+	e.ds.onAuthTimeout()
+	if len(e.closed) < 3 || e.closed[2] != "CHAP authentication failed: timed out waiting for the peer" {
+		t.Fatalf("expected close on authentication timeout, got %v", e.closed)
+	}
+}
+
+func TestPPPLCPRenegotiation(t *testing.T) {
+	e := newPPPSessionTest(t, "127.0.0.1:6254", "127.0.0.1:6255", &SessionConfig{})
+	e.openLCP()
+	e.openIPCP(net.IPv4(10, 0, 0, 1))
+	if len(e.dp.started) != 1 || !e.dp.started[0].Address.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("data plane not started with the assigned address: %+v", e.dp.started)
+	}
+
+	// the peer renegotiates LCP, taking down the network layer
+	e.input(pppProtocolLCP, pppCodeConfigureRequest, 101, nil)
+	req := e.recv(pppProtocolLCP)
+	if req.payload.code != pppCodeConfigureRequest {
+		t.Fatalf("expected LCP Configure-Request, got %+v", req.payload)
+	}
+	ack := e.recv(pppProtocolLCP)
+	if ack.payload.code != pppCodeConfigureAck || ack.payload.identifier != 101 {
+		t.Fatalf("expected LCP Configure-Ack, got %+v", ack.payload)
+	}
+	if e.dp.stopped != 1 {
+		t.Fatalf("data plane not stopped by LCP renegotiation")
+	}
+	e.input(pppProtocolLCP, pppCodeConfigureAck, req.payload.identifier, req.payload.data)
+	if !e.ds.lcp.isOpened() {
+		t.Fatalf("LCP not reopened")
+	}
+
+	e.openIPCP(net.IPv4(10, 0, 0, 2))
+	if len(e.dp.started) != 2 || !e.dp.started[1].Address.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Fatalf("data plane not restarted with the reassigned address: %+v", e.dp.started)
+	}
+}
+
+func TestPPPIPV6CPIgnored(t *testing.T) {
+	e := newPPPSessionTest(t, "127.0.0.1:6256", "127.0.0.1:6257", &SessionConfig{
+		EnableIPv6: true,
+	})
+	e.openLCP()
+
+	// the peer ignores IPV6CP: IPv4 starts without waiting for it
+	e.openIPCP(net.IPv4(10, 0, 0, 1))
+	req := e.recv(pppProtocolIPV6CP)
+	if req.payload.code != pppCodeConfigureRequest {
+		t.Fatalf("expected IPV6CP Configure-Request, got %+v", req.payload)
+	}
+	if len(e.dp.started) != 1 || e.dp.started[0].IPv6InterfaceID != nil {
+		t.Fatalf("data plane not started with IPv4 only: %+v", e.dp.started)
+	}
+
+	// IPv6 is added once the peer negotiates IPV6CP
+	e.input(pppProtocolIPV6CP, pppCodeConfigureAck, req.payload.identifier, req.payload.data)
+	e.input(pppProtocolIPV6CP, pppCodeConfigureRequest, 100, nil)
+	if len(e.dp.started) != 2 || e.dp.stopped != 1 ||
+		!e.dp.started[1].Address.Equal(net.IPv4(10, 0, 0, 1)) ||
+		e.dp.started[1].IPv6InterfaceID == nil {
+		t.Fatalf("data plane not restarted with IPv6: %+v, stopped %v", e.dp.started, e.dp.stopped)
+	}
+}
+
+func TestPPPCCPIgnored(t *testing.T) {
+	e := newPPPSessionTest(t, "127.0.0.1:6258", "127.0.0.1:6259", &SessionConfig{
+		Deflate: true,
+	})
+	e.openLCP()
+
+	// the peer ignores CCP: optional compression doesn't hold up IPv4
+	e.openIPCP(net.IPv4(10, 0, 0, 1))
+	req := e.recv(pppProtocolCCP)
+	if req.payload.code != pppCodeConfigureRequest {
+		t.Fatalf("expected CCP Configure-Request, got %+v", req.payload)
+	}
+	if len(e.dp.started) != 1 {
+		t.Fatalf("data plane not started without CCP: %+v", e.dp.started)
+	}
+	if e.ds.mppeTimer != nil {
+		t.Fatalf("MPPE timer started when MPPE isn't required")
+	}
+}
+
+func TestPPPCCPIgnoredMPPERequired(t *testing.T) {
+	e := newPPPSessionTest(t, "127.0.0.1:6260", "127.0.0.1:6261", &SessionConfig{
+		MPPE: MPPEPolicyRequire,
+	})
+	// as if keyed by MS-CHAPv2 authentication
+	e.ds.mppeMasterKey = make([]byte, 16)
+	e.openLCP()
+
+	// the peer ignores CCP: the data plane doesn't start unencrypted
+	e.openIPCP(net.IPv4(10, 0, 0, 1))
+	e.recv(pppProtocolCCP)
+	if len(e.dp.started) != 0 {
+		t.Fatalf("data plane started without MPPE: %+v", e.dp.started)
+	}
+	if e.ds.mppeTimer == nil {
+		t.Fatalf("MPPE timer not started")
+	}
+
+	e.ds.onMPPETimeout()
+	if len(e.closed) < 3 ||
+		e.closed[2] != "CCP negotiation failed: peer did not negotiate required MPPE encryption" {
+		t.Fatalf("expected close on MPPE timeout, got %v", e.closed)
+	}
+}
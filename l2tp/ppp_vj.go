@@ -0,0 +1,455 @@
+package l2tp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Van Jacobson compressed packet change mask bits.  Ref: RFC1144 section 3.2.2
+const (
+	vjNewC     byte = 0x40
+	vjNewI     byte = 0x20
+	vjPushBit  byte = 0x10
+	vjNewS     byte = 0x08
+	vjNewA     byte = 0x04
+	vjNewW     byte = 0x02
+	vjNewU     byte = 0x01
+	vjSpecialI      = vjNewS | vjNewW | vjNewU
+	vjSpecialD      = vjNewS | vjNewA | vjNewW | vjNewU
+	vjSpecials      = vjSpecialD
+)
+
+// TCP flags which affect compression
+const (
+	vjTCPFlagFIN byte = 0x01
+	vjTCPFlagSYN byte = 0x02
+	vjTCPFlagRST byte = 0x04
+	vjTCPFlagPSH byte = 0x08
+	vjTCPFlagACK byte = 0x10
+	vjTCPFlagURG byte = 0x20
+)
+
+const (
+	// vjMaxSlotID is the highest slot identifier we request: 16 slots is
+	// the RFC1144 recommendation.
+	vjMaxSlotID byte = 15
+	// vjOptionLen is the length of the IPCP IP-Compression-Protocol
+	// option value for VJ compression.  Ref: RFC1332 section 4
+	vjOptionLen = 4
+)
+
+// vjHeaderLen returns the combined length of the IPv4 and TCP headers of
+// a packet, or 0 if the packet isn't a complete, unfragmented TCP/IPv4
+// packet.
+func vjHeaderLen(p []byte) int {
+	if len(p) < 20 || p[0]>>4 != 4 || p[9] != 6 {
+		return 0
+	}
+	ihl := int(p[0]&0x0f) * 4
+	if ihl < 20 || int(binary.BigEndian.Uint16(p[2:])) != len(p) {
+		return 0
+	}
+	// fragment offset or more fragments bit
+	if binary.BigEndian.Uint16(p[6:])&0x3fff != 0 {
+		return 0
+	}
+	if len(p) < ihl+20 {
+		return 0
+	}
+	doff := int(p[ihl+12]>>4) * 4
+	if doff < 20 || len(p) < ihl+doff {
+		return 0
+	}
+	return ihl + doff
+}
+
+// vjIPChecksum sets the header checksum of an IPv4 header
+func vjIPChecksum(hdr []byte) {
+	ihl := int(hdr[0]&0x0f) * 4
+	hdr[10], hdr[11] = 0, 0
+	var sum uint32
+	for i := 0; i < ihl; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	binary.BigEndian.PutUint16(hdr[10:], ^uint16(sum))
+}
+
+// vjEncode appends a delta to a compressed header.  Values from 1 to 255
+// take one byte, others three.  Ref: RFC1144 section 3.2.2
+func vjEncode(b []byte, n uint16) []byte {
+	if n == 0 || n > 255 {
+		return append(b, 0, byte(n>>8), byte(n))
+	}
+	return append(b, byte(n))
+}
+
+// vjDecode reads a delta encoded by vjEncode from b at offset i,
+// returning the delta and the offset following it.
+func vjDecode(b []byte, i int) (n uint16, next int, err error) {
+	if i >= len(b) {
+		return 0, i, errors.New("short vj compressed header")
+	}
+	if b[i] != 0 {
+		return uint16(b[i]), i + 1, nil
+	}
+	if i+3 > len(b) {
+		return 0, i, errors.New("short vj compressed header")
+	}
+	return binary.BigEndian.Uint16(b[i+1:]), i + 3, nil
+}
+
+// vjSlot holds the headers of the last packet of a TCP connection
+type vjSlot struct {
+	hdr      []byte
+	lastUsed uint64
+}
+
+// vjCompressor implements the transmit side of VJ TCP/IP header
+// compression, modelled on the RFC1144 reference implementation.
+//
+// It is not safe for concurrent use.
+type vjCompressor struct {
+	slots    []vjSlot
+	lastXmit int
+	clock    uint64
+	// compressSlotID is set if the peer allows the slot identifier to be
+	// omitted when unchanged
+	compressSlotID bool
+}
+
+func newVJCompressor(maxSlotID byte, compressSlotID bool) *vjCompressor {
+	return &vjCompressor{
+		slots:          make([]vjSlot, int(maxSlotID)+1),
+		lastXmit:       -1,
+		compressSlotID: compressSlotID,
+	}
+}
+
+// findSlot returns the slot holding the connection of a packet, or the
+// least recently used slot if there is none.
+func (c *vjCompressor) findSlot(p []byte, ihl int) (slot int, found bool) {
+	lru := 0
+	for i := range c.slots {
+		hdr := c.slots[i].hdr
+		if hdr != nil {
+			oihl := int(hdr[0]&0x0f) * 4
+			if bytes.Equal(hdr[12:20], p[12:20]) && bytes.Equal(hdr[oihl:oihl+4], p[ihl:ihl+4]) {
+				return i, true
+			}
+		}
+		if c.slots[i].lastUsed < c.slots[lru].lastUsed {
+			lru = i
+		}
+	}
+	return lru, false
+}
+
+// compress returns the protocol and packet to send for an IPv4 packet.
+// Packets which can't be compressed are returned unchanged.
+// Ref: RFC1144 section 3.2.3
+func (c *vjCompressor) compress(p []byte) (pppProtocolType, []byte) {
+	hlen := vjHeaderLen(p)
+	if hlen == 0 {
+		return pppProtocolIPV4, p
+	}
+	ihl := int(p[0]&0x0f) * 4
+	tcp := p[ihl:hlen]
+	flags := tcp[13]
+	if flags&(vjTCPFlagSYN|vjTCPFlagFIN|vjTCPFlagRST) != 0 || flags&vjTCPFlagACK == 0 {
+		return pppProtocolIPV4, p
+	}
+
+	slot, found := c.findSlot(p, ihl)
+	c.clock++
+	c.slots[slot].lastUsed = c.clock
+	if !found {
+		return c.uncompressed(slot, p, hlen)
+	}
+
+	// Fields which are expected to be constant must match the previous
+	// packet, otherwise the packet is sent uncompressed.
+	old := c.slots[slot].hdr
+	if len(old) != hlen || old[0] != p[0] {
+		return c.uncompressed(slot, p, hlen)
+	}
+	otcp := old[ihl:]
+	if old[1] != p[1] || old[8] != p[8] ||
+		!bytes.Equal(old[6:8], p[6:8]) ||
+		!bytes.Equal(old[20:ihl], p[20:ihl]) ||
+		otcp[12] != tcp[12] ||
+		otcp[13]&^(vjTCPFlagPSH|vjTCPFlagURG) != flags&^(vjTCPFlagPSH|vjTCPFlagURG) ||
+		!bytes.Equal(otcp[20:], tcp[20:]) {
+		return c.uncompressed(slot, p, hlen)
+	}
+
+	var changes byte
+	deltas := make([]byte, 0, 16)
+
+	if flags&vjTCPFlagURG != 0 {
+		deltas = vjEncode(deltas, binary.BigEndian.Uint16(tcp[18:]))
+		changes |= vjNewU
+	} else if !bytes.Equal(tcp[18:20], otcp[18:20]) || otcp[13]&vjTCPFlagURG != 0 {
+		// The special case encodings don't clear the URG flag
+		return c.uncompressed(slot, p, hlen)
+	}
+	if d := binary.BigEndian.Uint16(tcp[14:]) - binary.BigEndian.Uint16(otcp[14:]); d != 0 {
+		deltas = vjEncode(deltas, d)
+		changes |= vjNewW
+	}
+	deltaA := binary.BigEndian.Uint32(tcp[8:]) - binary.BigEndian.Uint32(otcp[8:])
+	if deltaA != 0 {
+		if deltaA > 0xffff {
+			return c.uncompressed(slot, p, hlen)
+		}
+		deltas = vjEncode(deltas, uint16(deltaA))
+		changes |= vjNewA
+	}
+	deltaS := binary.BigEndian.Uint32(tcp[4:]) - binary.BigEndian.Uint32(otcp[4:])
+	if deltaS != 0 {
+		if deltaS > 0xffff {
+			return c.uncompressed(slot, p, hlen)
+		}
+		deltas = vjEncode(deltas, uint16(deltaS))
+		changes |= vjNewS
+	}
+
+	oldData := uint32(binary.BigEndian.Uint16(old[2:])) - uint32(hlen)
+	switch changes {
+	case 0:
+		// Nothing changed: a packet carrying data following a pure ack
+		// is normal for interactive traffic.  Anything else is likely
+		// a retransmission, sent uncompressed in case the peer missed
+		// the compressed version.
+		if len(p) != int(binary.BigEndian.Uint16(old[2:])) && oldData == 0 {
+			break
+		}
+		return c.uncompressed(slot, p, hlen)
+	case vjSpecialI, vjSpecialD:
+		// the changes collide with a special case encoding
+		return c.uncompressed(slot, p, hlen)
+	case vjNewS | vjNewA:
+		if deltaS == deltaA && deltaS == oldData {
+			// echoed interactive traffic
+			changes = vjSpecialI
+			deltas = deltas[:0]
+		}
+	case vjNewS:
+		if deltaS == oldData {
+			// unidirectional data transfer
+			changes = vjSpecialD
+			deltas = deltas[:0]
+		}
+	}
+
+	if d := binary.BigEndian.Uint16(p[4:]) - binary.BigEndian.Uint16(old[4:]); d != 1 {
+		deltas = vjEncode(deltas, d)
+		changes |= vjNewI
+	}
+	if flags&vjTCPFlagPSH != 0 {
+		changes |= vjPushBit
+	}
+
+	c.slots[slot].hdr = append(c.slots[slot].hdr[:0], p[:hlen]...)
+
+	out := make([]byte, 0, 4+len(deltas)+len(p)-hlen)
+	if slot != c.lastXmit || !c.compressSlotID {
+		out = append(out, changes|vjNewC, byte(slot))
+		c.lastXmit = slot
+	} else {
+		out = append(out, changes)
+	}
+	out = append(out, tcp[16], tcp[17])
+	out = append(out, deltas...)
+	out = append(out, p[hlen:]...)
+	return pppProtocolVJCompressed, out
+}
+
+// uncompressed records a packet's headers in a slot, and returns the
+// packet with the IP protocol field replaced by the slot identifier.
+func (c *vjCompressor) uncompressed(slot int, p []byte, hlen int) (pppProtocolType, []byte) {
+	c.slots[slot].hdr = append(c.slots[slot].hdr[:0], p[:hlen]...)
+	c.lastXmit = slot
+	out := append([]byte{}, p...)
+	out[9] = byte(slot)
+	return pppProtocolVJUncompressed, out
+}
+
+// vjDecompressor implements the receive side of VJ TCP/IP header
+// compression.
+//
+// It is not safe for concurrent use.
+type vjDecompressor struct {
+	slots    [][]byte
+	lastRecv int
+	// toss is set when the decompressor has lost synchronisation with
+	// the compressor, and compressed packets are discarded until one
+	// carries an explicit slot identifier.  Ref: RFC1144 section 4.1
+	toss bool
+}
+
+func newVJDecompressor(maxSlotID byte) *vjDecompressor {
+	return &vjDecompressor{
+		slots:    make([][]byte, int(maxSlotID)+1),
+		lastRecv: -1,
+		toss:     true,
+	}
+}
+
+// tossPacket is called when a packet may have been lost, since the
+// next compressed packet may then be decompressed incorrectly.
+func (d *vjDecompressor) tossPacket() {
+	d.toss = true
+}
+
+// decompress returns the IPv4 packet carried by a VJ compressed or
+// uncompressed packet.  Ref: RFC1144 section 4
+func (d *vjDecompressor) decompress(protocol pppProtocolType, data []byte) ([]byte, error) {
+	var p []byte
+	var err error
+	switch protocol {
+	case pppProtocolVJUncompressed:
+		p, err = d.uncompressed(data)
+	case pppProtocolVJCompressed:
+		p, err = d.compressed(data)
+	default:
+		return nil, errors.New("not a vj compressed packet")
+	}
+	if err != nil && err != errVJToss {
+		d.toss = true
+	}
+	return p, err
+}
+
+// errVJToss is returned for compressed packets discarded while the
+// decompressor resynchronises.
+var errVJToss = errors.New("discarding vj packet pending resync")
+
+func (d *vjDecompressor) uncompressed(data []byte) ([]byte, error) {
+	if len(data) < 20 {
+		return nil, errors.New("short vj uncompressed packet")
+	}
+	slot := int(data[9])
+	if slot >= len(d.slots) {
+		return nil, errors.New("vj slot identifier out of range")
+	}
+	p := append([]byte{}, data...)
+	p[9] = 6
+	hlen := vjHeaderLen(p)
+	if hlen == 0 {
+		return nil, errors.New("bad vj uncompressed packet")
+	}
+	vjIPChecksum(p)
+	d.slots[slot] = append(d.slots[slot][:0], p[:hlen]...)
+	d.lastRecv = slot
+	d.toss = false
+	return p, nil
+}
+
+func (d *vjDecompressor) compressed(data []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, errors.New("short vj compressed packet")
+	}
+	changes := data[0]
+	i := 1
+	if changes&vjNewC != 0 {
+		if len(data) < 2 {
+			return nil, errors.New("short vj compressed packet")
+		}
+		slot := int(data[1])
+		if slot >= len(d.slots) {
+			return nil, errors.New("vj slot identifier out of range")
+		}
+		d.toss = false
+		d.lastRecv = slot
+		i++
+	} else if d.toss {
+		return nil, errVJToss
+	}
+	if d.lastRecv < 0 || d.slots[d.lastRecv] == nil {
+		return nil, errors.New("vj slot not initialised")
+	}
+	if len(data) < i+2 {
+		return nil, errors.New("short vj compressed packet")
+	}
+
+	hdr := d.slots[d.lastRecv]
+	hlen := len(hdr)
+	ihl := int(hdr[0]&0x0f) * 4
+	tcp := hdr[ihl:]
+	oldData := uint32(binary.BigEndian.Uint16(hdr[2:])) - uint32(hlen)
+
+	// Work on a copy so the slot is unchanged on error
+	next := append([]byte{}, hdr...)
+	ntcp := next[ihl:]
+	copy(ntcp[16:18], data[i:i+2])
+	i += 2
+	if changes&vjPushBit != 0 {
+		ntcp[13] |= vjTCPFlagPSH
+	} else {
+		ntcp[13] &^= vjTCPFlagPSH
+	}
+
+	addSeq := func(off int, n uint32) {
+		binary.BigEndian.PutUint32(ntcp[off:], binary.BigEndian.Uint32(tcp[off:])+n)
+	}
+	var n uint16
+	var err error
+	switch changes & vjSpecials {
+	case vjSpecialI:
+		addSeq(8, oldData)
+		addSeq(4, oldData)
+	case vjSpecialD:
+		addSeq(4, oldData)
+	default:
+		if changes&vjNewU != 0 {
+			ntcp[13] |= vjTCPFlagURG
+			if n, i, err = vjDecode(data, i); err != nil {
+				return nil, err
+			}
+			binary.BigEndian.PutUint16(ntcp[18:], n)
+		} else {
+			ntcp[13] &^= vjTCPFlagURG
+		}
+		if changes&vjNewW != 0 {
+			if n, i, err = vjDecode(data, i); err != nil {
+				return nil, err
+			}
+			binary.BigEndian.PutUint16(ntcp[14:], binary.BigEndian.Uint16(tcp[14:])+n)
+		}
+		if changes&vjNewA != 0 {
+			if n, i, err = vjDecode(data, i); err != nil {
+				return nil, err
+			}
+			addSeq(8, uint32(n))
+		}
+		if changes&vjNewS != 0 {
+			if n, i, err = vjDecode(data, i); err != nil {
+				return nil, err
+			}
+			addSeq(4, uint32(n))
+		}
+	}
+	n = 1
+	if changes&vjNewI != 0 {
+		if n, i, err = vjDecode(data, i); err != nil {
+			return nil, err
+		}
+	}
+	binary.BigEndian.PutUint16(next[4:], binary.BigEndian.Uint16(hdr[4:])+n)
+
+	payload := data[i:]
+	if hlen+len(payload) > 0xffff {
+		return nil, errors.New("vj decompressed packet too long")
+	}
+	binary.BigEndian.PutUint16(next[2:], uint16(hlen+len(payload)))
+	vjIPChecksum(next)
+	d.slots[d.lastRecv] = next
+
+	p := make([]byte, 0, hlen+len(payload))
+	p = append(p, next...)
+	return append(p, payload...), nil
+}
@@ -0,0 +1,152 @@
+package l2tp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+type testTCPPacket struct {
+	id        uint16
+	sport     uint16
+	seq, ack  uint32
+	flags     byte
+	window    uint16
+	urg       uint16
+	dataLen   int
+	protocolN byte
+}
+
+func (tp testTCPPacket) bytes() []byte {
+	p := make([]byte, 40+tp.dataLen)
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+	binary.BigEndian.PutUint16(p[4:], tp.id)
+	p[6] = 0x40 // don't fragment
+	p[8] = 64
+	p[9] = 6
+	if tp.protocolN != 0 {
+		p[9] = tp.protocolN
+	}
+	copy(p[12:], []byte{10, 0, 0, 2, 192, 0, 2, 1})
+	tcp := p[20:]
+	binary.BigEndian.PutUint16(tcp[0:], tp.sport)
+	binary.BigEndian.PutUint16(tcp[2:], 22)
+	binary.BigEndian.PutUint32(tcp[4:], tp.seq)
+	binary.BigEndian.PutUint32(tcp[8:], tp.ack)
+	tcp[12] = 5 << 4
+	tcp[13] = tp.flags
+	binary.BigEndian.PutUint16(tcp[14:], tp.window)
+	binary.BigEndian.PutUint16(tcp[16:], uint16(tp.seq)^tp.id) // arbitrary checksum
+	binary.BigEndian.PutUint16(tcp[18:], tp.urg)
+	for i := 40; i < len(p); i++ {
+		p[i] = byte(i)
+	}
+	vjIPChecksum(p)
+	return p
+}
+
+func TestVJRoundTrip(t *testing.T) {
+	const ack, psh, urg, syn = vjTCPFlagACK, vjTCPFlagPSH, vjTCPFlagURG, vjTCPFlagSYN
+	packets := []struct {
+		testTCPPacket
+		want pppProtocolType
+	}{
+		{testTCPPacket{id: 1, sport: 1000, seq: 100, flags: syn, window: 1000}, pppProtocolIPV4},
+		{testTCPPacket{id: 2, sport: 1000, seq: 101, ack: 500, flags: ack, window: 1000}, pppProtocolVJUncompressed},
+		// data following an ack
+		{testTCPPacket{id: 3, sport: 1000, seq: 101, ack: 500, flags: ack | psh, window: 1000, dataLen: 10}, pppProtocolVJCompressed},
+		// unidirectional data transfer
+		{testTCPPacket{id: 4, sport: 1000, seq: 111, ack: 500, flags: ack, window: 1000, dataLen: 10}, pppProtocolVJCompressed},
+		// echoed interactive traffic
+		{testTCPPacket{id: 5, sport: 1000, seq: 121, ack: 510, flags: ack, window: 1000, dataLen: 1}, pppProtocolVJCompressed},
+		// window, ack and id changes
+		{testTCPPacket{id: 9, sport: 1000, seq: 122, ack: 900, flags: ack, window: 800}, pppProtocolVJCompressed},
+		{testTCPPacket{id: 10, sport: 1000, seq: 122, ack: 1200, flags: ack, window: 800}, pppProtocolVJCompressed},
+		// urgent data, and the end of it
+		{testTCPPacket{id: 11, sport: 1000, seq: 122, ack: 1200, flags: ack | urg, window: 800, urg: 3, dataLen: 3}, pppProtocolVJCompressed},
+		{testTCPPacket{id: 12, sport: 1000, seq: 125, ack: 1200, flags: ack, window: 800, urg: 3}, pppProtocolVJUncompressed},
+		{testTCPPacket{id: 13, sport: 1000, seq: 125, ack: 1200, flags: ack, window: 800, urg: 3, dataLen: 3}, pppProtocolVJCompressed},
+		// a retransmission is sent uncompressed
+		{testTCPPacket{id: 14, sport: 1000, seq: 125, ack: 1200, flags: ack, window: 800, urg: 3, dataLen: 3}, pppProtocolVJUncompressed},
+		// a second connection
+		{testTCPPacket{id: 14, sport: 2000, seq: 5, ack: 6, flags: ack, window: 100}, pppProtocolVJUncompressed},
+		{testTCPPacket{id: 15, sport: 2000, seq: 5, ack: 6, flags: ack, window: 100, dataLen: 20}, pppProtocolVJCompressed},
+		{testTCPPacket{id: 16, sport: 1000, seq: 128, ack: 1200, flags: ack, window: 800, urg: 3, dataLen: 3}, pppProtocolVJCompressed},
+		// sequence number jumps are sent uncompressed
+		{testTCPPacket{id: 17, sport: 1000, seq: 131 + 0x10000, ack: 1200, flags: ack, window: 800, urg: 3}, pppProtocolVJUncompressed},
+		// non-TCP packets pass through
+		{testTCPPacket{id: 18, protocolN: 17}, pppProtocolIPV4},
+	}
+
+	for _, compSlotID := range []bool{true, false} {
+		c := newVJCompressor(vjMaxSlotID, compSlotID)
+		d := newVJDecompressor(vjMaxSlotID)
+		for i, tp := range packets {
+			in := tp.bytes()
+			protocol, out := c.compress(append([]byte{}, in...))
+			if protocol != tp.want {
+				t.Fatalf("packet %d: compressed to protocol 0x%04x, want 0x%04x", i, uint16(protocol), uint16(tp.want))
+			}
+			if protocol == pppProtocolVJCompressed {
+				if len(out) >= len(in) {
+					t.Fatalf("packet %d: compressed length %d not less than %d", i, len(out), len(in))
+				}
+				if out[0]&vjNewC == 0 && !compSlotID {
+					t.Fatalf("packet %d: slot identifier omitted", i)
+				}
+			}
+			if protocol == pppProtocolIPV4 {
+				continue
+			}
+			got, err := d.decompress(protocol, out)
+			if err != nil {
+				t.Fatalf("packet %d: decompress failed: %v", i, err)
+			}
+			if !bytes.Equal(got, in) {
+				t.Fatalf("packet %d: decompressed\n%x\nwant\n%x", i, got, in)
+			}
+		}
+	}
+}
+
+func TestVJToss(t *testing.T) {
+	c := newVJCompressor(vjMaxSlotID, true)
+	d := newVJDecompressor(vjMaxSlotID)
+
+	first := testTCPPacket{id: 1, sport: 1000, seq: 1, ack: 1, flags: vjTCPFlagACK, window: 100}
+	protocol, out := c.compress(first.bytes())
+	if _, err := d.decompress(protocol, out); err != nil {
+		t.Fatalf("decompress failed: %v", err)
+	}
+
+	// after a lost packet, compressed packets without a slot identifier
+	// are discarded
+	d.tossPacket()
+	next := testTCPPacket{id: 2, sport: 1000, seq: 1, ack: 1, flags: vjTCPFlagACK, window: 100, dataLen: 5}
+	protocol, out = c.compress(next.bytes())
+	if protocol != pppProtocolVJCompressed || out[0]&vjNewC != 0 {
+		t.Fatalf("expected compressed packet without slot identifier, got 0x%04x %x", uint16(protocol), out)
+	}
+	if _, err := d.decompress(protocol, out); err != errVJToss {
+		t.Fatalf("expected packet to be tossed, got %v", err)
+	}
+
+	// the retransmission is sent uncompressed, resynchronising the peer
+	retransmit := next
+	retransmit.id = 3
+	in := retransmit.bytes()
+	protocol, out = c.compress(append([]byte{}, in...))
+	got, err := d.decompress(protocol, out)
+	if protocol != pppProtocolVJUncompressed || err != nil || !bytes.Equal(got, in) {
+		t.Fatalf("expected resync on uncompressed packet, got 0x%04x, %v", uint16(protocol), err)
+	}
+
+	// corrupt packets also set toss
+	if _, err := d.decompress(pppProtocolVJCompressed, []byte{vjNewC, 200, 0, 0}); err == nil {
+		t.Fatalf("decompressed packet with bad slot identifier")
+	}
+	if !d.toss {
+		t.Fatalf("toss not set after bad packet")
+	}
+}
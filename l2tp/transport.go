@@ -84,6 +84,10 @@ type transportConfig struct {
 	Version ProtocolVersion
 	// Peer control connection ID to use for transport-generated messages
 	PeerControlConnID ControlConnID
+	// Digest, if set, authenticates L2TPv3 control messages: messages
+	// are signed on transmission, and received messages which fail
+	// verification are discarded.
+	Digest *v3Digest
 }
 
 // transport represents the RFC2661/RFC3931
@@ -103,6 +107,24 @@ type transport struct {
 	txQueue, ackQueue    []*xmitMsg
 	senderWg             sync.WaitGroup
 	receiverWg           sync.WaitGroup
+	closeOnce            sync.Once
+	// downErr records the error which first caused the transport to fail
+	downLock sync.Mutex
+	downErr  error
+}
+
+// errTransportClosed is the cause of a transport shut down by its user
+var errTransportClosed = errors.New("transport shut down by user")
+
+// retriesExhaustedError is the cause of a transport which failed because
+// the peer didn't acknowledge a message.
+type retriesExhaustedError struct {
+	msgType avpMsgType
+	retries uint
+}
+
+func (e *retriesExhaustedError) Error() string {
+	return fmt.Sprintf("transmit of %s failed after %d retry attempts", e.msgType, e.retries)
 }
 
 // Increment transport sequence number by one avoiding overflow
@@ -255,6 +277,7 @@ func (xport *transport) receiver() {
 	for {
 		buffer, from, err := xport.rawRecv()
 		if err != nil {
+			xport.setDownErr(fmt.Errorf("socket read failed: %v", err))
 			close(xport.nrChan)
 			level.Error(xport.logger).Log(
 				"message", "socket read failed",
@@ -282,6 +305,7 @@ func (xport *transport) receiver() {
 				"message", "frame receive failed",
 				"error", err)
 			if strings.Contains("failed to parse mandatory AVP", err.Error()) {
+				xport.setDownErr(err)
 				close(xport.nrChan)
 				return
 			}
@@ -308,7 +332,7 @@ func (xport *transport) sender() {
 		// Transmission request from user code
 		case xmitMsg, ok := <-xport.sendChan:
 			if !ok {
-				xport.down(errors.New("transport shut down by user"))
+				xport.down(errTransportClosed)
 				return
 			}
 
@@ -415,9 +439,36 @@ func (xport *transport) recvFrame(rawMsg *rawMsg) (messages []controlMessage, er
 		}
 	}
 
+	if xport.config.Digest != nil {
+		messages = xport.authenticate(messages)
+	}
+
 	return messages, nil
 }
 
+// authenticate returns the messages which carry a valid Message Digest.
+// Messages which fail authentication are silently discarded: they are
+// neither acknowledged nor passed up to the tunnel.
+// Ref: RFC3931 section 4.3
+func (xport *transport) authenticate(messages []controlMessage) (out []controlMessage) {
+	for _, msg := range messages {
+		m, ok := msg.(*v3ControlMessage)
+		if !ok {
+			continue
+		}
+		err := xport.config.Digest.verify(m)
+		if err != nil {
+			level.Debug(xport.logger).Log(
+				"message", "discarding unauthenticated control message",
+				"message_type", m.getType(),
+				"error", err)
+			continue
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
 // Find the next message which can be handled (either stale or in-sequence)
 func (xport *transport) dequeueRxMessage() *recvMsg {
 	for i := 0; i < len(xport.rxQueue); i++ {
@@ -467,6 +518,15 @@ func (xport *transport) sendMessage1(msg controlMessage, isRetransmit bool) erro
 		msg.setTransportSeqNum(ns, nr)
 	}
 
+	// The digest covers the sequence numbers, so is computed afresh
+	// for each transmission.
+	if m, ok := msg.(*v3ControlMessage); ok && xport.config.Digest != nil {
+		err := xport.config.Digest.sign(m)
+		if err != nil {
+			return fmt.Errorf("failed to sign %v message: %v", m.getType(), err)
+		}
+	}
+
 	level.Debug(xport.logger).Log(
 		"message", "send",
 		"message_type", msg.getType(),
@@ -506,8 +566,10 @@ func (xport *transport) sendMessage(msg *xmitMsg) error {
 func (xport *transport) retransmitMessage(msg *xmitMsg) error {
 	msg.nretries++
 	if msg.nretries >= xport.config.MaxRetries {
-		return fmt.Errorf("transmit of %s failed after %d retry attempts",
-			msg.msg.getType(), xport.config.MaxRetries)
+		return &retriesExhaustedError{
+			msgType: msg.msg.getType(),
+			retries: xport.config.MaxRetries,
+		}
 	}
 	err := xport.sendMessage(msg)
 	if err == nil {
@@ -582,6 +644,8 @@ func (xport *transport) closeReceiver() {
 
 func (xport *transport) down(err error) {
 
+	xport.setDownErr(err)
+
 	// Shut down the receiver
 	xport.closeReceiver()
 
@@ -614,6 +678,25 @@ func (xport *transport) down(err error) {
 
 }
 
+// setDownErr records the cause of the transport failing, unless a cause
+// has already been recorded: the receiver and sender goroutines may both
+// report the same failure.
+func (xport *transport) setDownErr(err error) {
+	xport.downLock.Lock()
+	defer xport.downLock.Unlock()
+	if xport.downErr == nil {
+		xport.downErr = err
+	}
+}
+
+// getDownErr returns the cause of the transport failing, or nil if the
+// transport is up.
+func (xport *transport) getDownErr() error {
+	xport.downLock.Lock()
+	defer xport.downLock.Unlock()
+	return xport.downErr
+}
+
 func (xport *transport) toggleAckTimer(enable bool) {
 	if enable {
 		xport.ackTimer.Reset(xport.config.AckTimeout)
@@ -789,8 +872,10 @@ func (xport *transport) recv() (msg controlMessage, from unix.Sockaddr, err erro
 	return m.msg, m.from, nil
 }
 
-// close closes the transport.
+// close closes the transport.  It is safe to call more than once.
 func (xport *transport) close() {
-	close(xport.sendChan)
+	xport.closeOnce.Do(func() {
+		close(xport.sendChan)
+	})
 	xport.senderWg.Wait()
 }
@@ -9,7 +9,6 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-	"golang.org/x/sys/unix"
 )
 
 func TestNilControlPlane(t *testing.T) {
@@ -178,20 +177,18 @@ func flipTestInfo(info *transportSendRecvTestInfo) *transportSendRecvTestInfo {
 
 func transportTestnewTransport(testCfg *transportSendRecvTestInfo) (xport *transport, err error) {
 
-	var sal, sap unix.Sockaddr
 	var cp *controlPlane
 
-	switch testCfg.encap {
-	case EncapTypeUDP:
-		sal, sap, err = newUDPAddressPair(testCfg.local, testCfg.peer)
-	case EncapTypeIP:
-		sal, sap, err = newIPAddressPair(testCfg.local, testCfg.tid, testCfg.peer, testCfg.xcfg.PeerControlConnID)
-	default:
-		err = fmt.Errorf("unhandled encap type %v", testCfg.encap)
-	}
+	addrs, err := (&Context{}).resolveTunnelAddresses(&TunnelConfig{
+		Local:        testCfg.local,
+		Encap:        testCfg.encap,
+		TunnelID:     testCfg.tid,
+		PeerTunnelID: testCfg.xcfg.PeerControlConnID,
+	}, testCfg.peer)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init tunnel address structures: %v", err)
 	}
+	sal, sap := addrs[0].sal, addrs[0].sap
 
 	cp, err = newL2tpControlPlane(sal, sap)
 	if err != nil {
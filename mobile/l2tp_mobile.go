@@ -27,11 +27,30 @@ type VpnService interface {
 	// See also: https://developer.android.com/reference/android/net/VpnService.html#protect(int)
 	Protect(fd int) bool
 
-	GetVpnFd(ip []byte) int
+	// GetVpnFd establishes the VPN interface using the network
+	// configuration negotiated with the peer, returning its file descriptor.
+	GetVpnFd(cfg *VpnConfig) int
 
 	HandleEvent(name string, event string)
 }
 
+// VpnConfig holds the network configuration negotiated with the peer,
+// for use with VpnService.Builder.  Addresses the peer did not provide
+// are nil.
+type VpnConfig struct {
+	// Address is the IPv4 address assigned to the VPN interface.
+	Address []byte
+	// PrimaryDns and SecondaryDns are the DNS servers provided by the peer.
+	PrimaryDns   []byte
+	SecondaryDns []byte
+	// Ipv6InterfaceId is the 8 byte IPv6 interface identifier negotiated
+	// with the peer, from which the link-local address fe80::/64 is formed.
+	// It is nil if IPv6 was not negotiated.
+	Ipv6InterfaceId []byte
+	// Mtu is the MTU to set on the VPN interface.
+	Mtu int
+}
+
 var l2tpApp *application
 
 func newApplication(cfg *config.Config, logWriter LogWriter, vpnService VpnService) (app *application, err error) {
@@ -109,6 +128,14 @@ func (app *application) HandleEvent(event interface{}) {
 		e := event.(*l2tp.SessionEchoEvent)
 		app.vpnService.HandleEvent("SessionEchoEvent", e.SessionName)
 		break
+	case *l2tp.SessionEchoReplyEvent:
+		e := event.(*l2tp.SessionEchoReplyEvent)
+		app.vpnService.HandleEvent("SessionEchoReplyEvent", e.SessionName)
+		break
+	case *l2tp.SessionEchoTimeoutEvent:
+		e := event.(*l2tp.SessionEchoTimeoutEvent)
+		app.vpnService.HandleEvent("SessionEchoTimeoutEvent", e.SessionName)
+		break
 	case *l2tp.SessionDownEvent:
 		e := event.(*l2tp.SessionDownEvent)
 		app.vpnService.HandleEvent("SessionDownEvent", e.SessionName)
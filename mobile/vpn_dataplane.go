@@ -2,6 +2,7 @@ package l2tpMobile
 
 import (
 	"errors"
+
 	"go-l2tp-mobile/l2tp"
 
 	"github.com/go-kit/log"
@@ -30,11 +31,17 @@ type vpnSessionDataPlane struct {
 	psid       l2tp.ControlConnID
 	ptid       l2tp.ControlConnID
 	isDown     bool
+	stop       chan struct{}
 	logger     log.Logger
 }
 
 func (dpf *vpnDataPlane) NewTunnel(tcfg *l2tp.TunnelConfig, sal, sap unix.Sockaddr, fd int) (l2tp.TunnelDataPlane, error) {
-	// control plane started
+	// Protect the control plane socket again here, since the tunnel may
+	// have replaced the socket protected when it was created while it
+	// failed over between peers.
+	if !dpf.vpnService.Protect(fd) {
+		return nil, errors.New("failed to protect tunnel file descriptor")
+	}
 	dpf.tunnelFd = fd
 	return &vpnTunnelDataPlane{}, nil
 }
@@ -63,13 +70,22 @@ func (tdp *vpnTunnelDataPlane) Down() error {
 	return nil
 }
 
-func (sdp *vpnSessionDataPlane) Start(ip []byte) error {
+func (sdp *vpnSessionDataPlane) Start(nc *l2tp.SessionNetworkConfig) error {
 	if sdp.logger != nil {
-		sdp.logger.Log("message", "starting vpn session", "ip", ip)
+		sdp.logger.Log("message", "starting vpn session",
+			"ip", nc.Address,
+			"primary_dns", nc.PrimaryDNS,
+			"secondary_dns", nc.SecondaryDNS,
+			"mtu", nc.MTU)
 	}
 
-	// TODO add session config, e.g. MTU, MRU, etc.
-	sdp.vpnFd = sdp.vpnService.GetVpnFd(ip)
+	sdp.vpnFd = sdp.vpnService.GetVpnFd(&VpnConfig{
+		Address:         nc.Address,
+		PrimaryDns:      nc.PrimaryDNS,
+		SecondaryDns:    nc.SecondaryDNS,
+		Ipv6InterfaceId: nc.IPv6InterfaceID,
+		Mtu:             nc.MTU,
+	})
 	if err := unix.SetNonblock(sdp.vpnFd, true); err != nil {
 		if sdp.logger != nil {
 			sdp.logger.Log("message", "setNonblock failed", "err", err)
@@ -80,12 +96,20 @@ func (sdp *vpnSessionDataPlane) Start(ip []byte) error {
 	// session started
 	// start reading from vpn fd, and writing to tunnel fd
 	buffer := make([]byte, 4096)
-	pppHeader := l2tp.NewPPPDataHeader(sdp.ptid, sdp.psid, uint16(0x0021)) // ipv4
-	headerBytes := pppHeader.ToBytes()
-	limitSize := 1500 - len(headerBytes)
+	encapsulate := nc.Encapsulate
+	limitSize := nc.MTU
+	vpnFd := sdp.vpnFd
+	stop := make(chan struct{})
+	sdp.stop = stop
 	go func() {
+	loop:
 		for !sdp.isDown {
-			n, err := unix.Read(sdp.vpnFd, buffer)
+			select {
+			case <-stop:
+				break loop
+			default:
+			}
+			n, err := unix.Read(vpnFd, buffer)
 			if err == unix.EAGAIN || err == unix.EWOULDBLOCK || n > limitSize {
 				// skip over size limit packets
 				continue
@@ -94,7 +118,12 @@ func (sdp *vpnSessionDataPlane) Start(ip []byte) error {
 				break
 			}
 			if err == nil && n > 0 {
-				unix.Write(sdp.tunnelFd, append(headerBytes, buffer[:n]...))
+				// frame, and encrypt if negotiated, for the session
+				packet, err := encapsulate(buffer[:n])
+				if err != nil {
+					continue
+				}
+				unix.Write(sdp.tunnelFd, packet)
 			}
 		}
 		if sdp.logger != nil {
@@ -104,6 +133,20 @@ func (sdp *vpnSessionDataPlane) Start(ip []byte) error {
 	return nil
 }
 
+func (sdp *vpnSessionDataPlane) Stop() error {
+	if sdp.logger != nil {
+		sdp.logger.Log("message", "stopping vpn session")
+	}
+	// stop the reader of the current vpn fd, Start obtains a new one
+	// with the renegotiated configuration
+	if sdp.stop != nil {
+		close(sdp.stop)
+		sdp.stop = nil
+	}
+	sdp.vpnFd = -1
+	return nil
+}
+
 func (sdp *vpnSessionDataPlane) GetStatistics() (*l2tp.SessionDataPlaneStatistics, error) {
 	return nil, nil
 }
@@ -128,13 +171,6 @@ func (sdp *vpnSessionDataPlane) HandleDataPacket(data []byte) error {
 	return err
 }
 
-func (sdp *vpnSessionDataPlane) PingByLcpEcho() error {
-	if sdp.vpnFd == -1 {
-		return errors.New("vpn fd is not ready")
-	}
-	return nil
-}
-
 func newVpnDataPlane(vpnService VpnService, logger log.Logger) (l2tp.DataPlane, error) {
 	return &vpnDataPlane{
 		vpnService: vpnService,